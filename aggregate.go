@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// aggregateFile is the file that differentially private aggregate statistics are written to when the proxy is
+// stopped, or an empty string if the proxy does not run in aggregate-only mode. In aggregate-only mode, payloads of
+// packets are never logged or stored, so that the statistics may be shared without revealing private data.
+var aggregateFile string
+
+// aggregateEpsilon is the privacy budget of the aggregate statistics. Lower values add more noise.
+var aggregateEpsilon = 1.0
+
+// aggregateHistograms is the amount of histograms released in the aggregate statistics, over which the privacy
+// budget is split.
+const aggregateHistograms = 4
+
+// aggregateBuckets is the amount of power of two buckets of the size, interval and duration histograms.
+const aggregateBuckets = 24
+
+// aggregateSession holds the packets of a single session, which are only added to the aggregate when the session
+// closes, normalised so that every session contributes the same weight regardless of the amount of packets it
+// sent.
+type aggregateSession struct {
+	start     time.Time
+	last      map[string]time.Time
+	packets   map[string]int
+	sizes     map[string]int
+	intervals map[string]int
+}
+
+// aggregates holds the histograms summed over closed sessions and the sessions that are still active.
+var aggregates = struct {
+	sync.Mutex
+	active    map[int64]*aggregateSession
+	packets   map[string]float64
+	sizes     map[string]float64
+	intervals map[string]float64
+	durations map[string]float64
+}{
+	active:  map[int64]*aggregateSession{},
+	packets: map[string]float64{}, sizes: map[string]float64{}, intervals: map[string]float64{}, durations: map[string]float64{},
+}
+
+// aggregateReport is the aggregate statistics written in aggregate-only mode. Every value is a sum of the
+// contributions of sessions with Laplace noise added.
+type aggregateReport struct {
+	Epsilon float64 `json:"epsilon"`
+	// Sessions is the noisy amount of sessions the statistics were collected over.
+	Sessions float64 `json:"sessions"`
+	// Packets holds the distribution of packets by direction and name.
+	Packets map[string]float64 `json:"packets"`
+	// Sizes holds the distribution of packet sizes by direction, bucketed by powers of two bytes.
+	Sizes map[string]float64 `json:"sizes"`
+	// Intervals holds the distribution of the time between two packets of the same direction, bucketed by powers
+	// of two milliseconds.
+	Intervals map[string]float64 `json:"intervals"`
+	// Durations holds the distribution of session durations, bucketed by powers of two seconds.
+	Durations map[string]float64 `json:"durations"`
+}
+
+// powerBucket returns the name of the power of two bucket that the value passed falls in, such as <=64.
+func powerBucket(v float64) string {
+	for i := 0; i < aggregateBuckets-1; i++ {
+		if v <= float64(int(1)<<i) {
+			return "<=" + strconv.Itoa(1<<i)
+		}
+	}
+	return ">" + strconv.Itoa(1<<(aggregateBuckets-2))
+}
+
+// powerBuckets returns the names of all power of two buckets.
+func powerBuckets() []string {
+	buckets := make([]string, 0, aggregateBuckets)
+	for i := 0; i < aggregateBuckets-1; i++ {
+		buckets = append(buckets, "<="+strconv.Itoa(1<<i))
+	}
+	return append(buckets, ">"+strconv.Itoa(1<<(aggregateBuckets-2)))
+}
+
+// enableAggregateMode makes the proxy collect aggregate statistics written to the file passed when it is stopped.
+// Packets are no longer logged individually, and options that would store or publish payloads are refused.
+func enableAggregateMode(file string, options map[string]bool) error {
+	for name, set := range options {
+		if set {
+			return fmt.Errorf("-%s stores or publishes packet payloads and can't be used in aggregate-only mode", name)
+		}
+	}
+	if aggregateEpsilon <= 0 {
+		return fmt.Errorf("invalid privacy budget %v: must be positive", aggregateEpsilon)
+	}
+	aggregateFile, forensicsDir = file, ""
+	// Only connections are logged, even if the configuration is reloaded.
+	if err := flag.Set("v", "quiet"); err != nil {
+		return err
+	}
+	reloadState.Lock()
+	reloadState.fixed["v"] = true
+	reloadState.Unlock()
+
+	addPacketListener(aggregatePacket)
+	addSessionCloseListener(closeAggregateSession)
+	onShutdown(writeAggregateReport)
+	return nil
+}
+
+// aggregatePacket counts the packet event passed in the histograms of its session.
+func aggregatePacket(e packetEvent) {
+	aggregates.Lock()
+	defer aggregates.Unlock()
+	s, ok := aggregates.active[e.Session]
+	if !ok {
+		s = &aggregateSession{start: e.Time, last: map[string]time.Time{}, packets: map[string]int{}, sizes: map[string]int{}, intervals: map[string]int{}}
+		aggregates.active[e.Session] = s
+	}
+	s.packets[e.Direction+"/"+e.Name]++
+	s.sizes[e.Direction+"/"+powerBucket(float64(e.Size))]++
+	if last, ok := s.last[e.Direction]; ok {
+		s.intervals[e.Direction+"/"+powerBucket(float64(e.Time.Sub(last).Milliseconds()))]++
+	}
+	s.last[e.Direction] = e.Time
+}
+
+// closeAggregateSession adds the histograms of the session with the ID passed to the aggregate. Each histogram of
+// a session is normalised to a sum of 1, so that adding or removing a session changes every histogram of the
+// aggregate by at most 1.
+func closeAggregateSession(id int64) {
+	aggregates.Lock()
+	defer aggregates.Unlock()
+	s, ok := aggregates.active[id]
+	if !ok {
+		return
+	}
+	delete(aggregates.active, id)
+	add := func(dst map[string]float64, src map[string]int) {
+		var total int
+		for _, n := range src {
+			total += n
+		}
+		for key, n := range src {
+			dst[key] += float64(n) / float64(total)
+		}
+	}
+	add(aggregates.packets, s.packets)
+	add(aggregates.sizes, s.sizes)
+	add(aggregates.intervals, s.intervals)
+	aggregates.durations[powerBucket(time.Since(s.start).Seconds())]++
+}
+
+// laplace returns a sample of the Laplace distribution centred on 0 with the scale passed.
+func laplace(scale float64) float64 {
+	u := rand.Float64() - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+// noisyHistogram returns the histogram passed with Laplace noise of the scale passed added to every key of the
+// domain passed. Noise is added to keys that are not in the histogram too, so that the keys released don't reveal
+// which packets were seen. Negative values are clamped to 0 and values are rounded to two decimals.
+func noisyHistogram(histogram map[string]float64, domain []string, scale float64) map[string]float64 {
+	noisy := make(map[string]float64, len(domain))
+	for _, key := range domain {
+		v := math.Max(histogram[key]+laplace(scale), 0)
+		noisy[key] = math.Round(v*100) / 100
+	}
+	return noisy
+}
+
+// writeAggregateReport closes the sessions still active and writes the aggregate statistics with noise added to the
+// aggregate file.
+func writeAggregateReport() {
+	for _, s := range activeSessions() {
+		closeAggregateSession(s.id)
+	}
+	aggregates.Lock()
+	defer aggregates.Unlock()
+
+	directions := []string{"serverbound", "clientbound"}
+	var packets, sizes, intervals []string
+	for _, f := range packetPool {
+		name := getType(f(), false)
+		for _, direction := range directions {
+			packets = append(packets, direction+"/"+name)
+		}
+	}
+	sort.Strings(packets)
+	for _, direction := range directions {
+		for _, bucket := range powerBuckets() {
+			sizes = append(sizes, direction+"/"+bucket)
+			intervals = append(intervals, direction+"/"+bucket)
+		}
+	}
+	// Every histogram changes by at most 1 when a session is added or removed, so the budget is split evenly.
+	scale := aggregateHistograms / aggregateEpsilon
+	report := aggregateReport{
+		Epsilon:   aggregateEpsilon,
+		Packets:   noisyHistogram(aggregates.packets, packets, scale),
+		Sizes:     noisyHistogram(aggregates.sizes, sizes, scale),
+		Intervals: noisyHistogram(aggregates.intervals, intervals, scale),
+		Durations: noisyHistogram(aggregates.durations, powerBuckets(), scale),
+	}
+	for _, n := range report.Durations {
+		report.Sessions += n
+	}
+	report.Sessions = math.Round(report.Sessions)
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("An error occurred whilst encoding the aggregate statistics: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(aggregateFile, b, 0644); err != nil {
+		log.Printf("An error occurred whilst writing the aggregate statistics: %v\n", err)
+		return
+	}
+	log.Printf("Wrote aggregate statistics of about %.0f sessions with a privacy budget of %v to %s\n", report.Sessions, aggregateEpsilon, aggregateFile)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/login"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// deviceOSNames holds the names of the operating systems of clients, indexed by their device OS.
+var deviceOSNames = map[protocol.DeviceOS]string{
+	protocol.DeviceAndroid:   "Android",
+	protocol.DeviceIOS:       "iOS",
+	protocol.DeviceOSX:       "macOS",
+	protocol.DeviceFireOS:    "FireOS",
+	protocol.DeviceGearVR:    "GearVR",
+	protocol.DeviceHololens:  "Hololens",
+	protocol.DeviceWin10:     "Windows 10",
+	protocol.DeviceWin32:     "Windows",
+	protocol.DeviceDedicated: "Dedicated",
+	protocol.DeviceTVOS:      "tvOS",
+	protocol.DeviceOrbis:     "PlayStation",
+	protocol.DeviceNX:        "Switch",
+	protocol.DeviceXBOX:      "Xbox",
+	protocol.DeviceWP:        "Windows Phone",
+	protocol.DeviceLinux:     "Linux",
+}
+
+// inputModeNames and uiProfileNames hold the names of the input modes and UI profiles of clients.
+var (
+	inputModeNames = []string{"unknown", "mouse", "touch", "gamepad", "motion controller"}
+	uiProfileNames = []string{"classic", "pocket"}
+)
+
+// clientDimensions holds the dimensions that connecting clients are aggregated by, in the order they are shown.
+var clientDimensions = []string{"os", "input", "ui", "version", "model", "country"}
+
+// clientReport is the aggregate of the clients that connected to the proxy, counted per value of each dimension.
+type clientReport struct {
+	Clients    int                       `json:"clients"`
+	Dimensions map[string]map[string]int `json:"dimensions"`
+}
+
+// clientStats holds the aggregate of all clients that connected during this run.
+var clientStats = struct {
+	sync.Mutex
+	clientReport
+}{clientReport: clientReport{Dimensions: map[string]map[string]int{}}}
+
+// clientReportFile is the file that the aggregate of connected clients is written to when the proxy is stopped,
+// or an empty string to not write it.
+var clientReportFile string
+
+// clientProfile returns the value of each dimension for the client data and address passed.
+func clientProfile(data login.ClientData, addr net.Addr) map[string]string {
+	deviceOS, ok := deviceOSNames[data.DeviceOS]
+	if !ok {
+		deviceOS = strconv.Itoa(int(data.DeviceOS))
+	}
+	profile := map[string]string{
+		"os":      deviceOS,
+		"input":   levelName(inputModeNames, data.CurrentInputMode),
+		"ui":      levelName(uiProfileNames, data.UIProfile),
+		"version": data.GameVersion,
+		"model":   data.DeviceModel,
+	}
+	if country, ok := lookupCountry(addr); ok {
+		profile["country"] = country
+	}
+	return profile
+}
+
+// recordClient adds the client of the session to the client statistics and logs its profile.
+func (s *session) recordClient() {
+	profile := clientProfile(s.client.ClientData(), s.client.RemoteAddr())
+	clientStats.Lock()
+	clientStats.Clients++
+	for dimension, value := range profile {
+		if value == "" {
+			continue
+		}
+		values, ok := clientStats.Dimensions[dimension]
+		if !ok {
+			values = map[string]int{}
+			clientStats.Dimensions[dimension] = values
+		}
+		values[value]++
+	}
+	clientStats.Unlock()
+
+	fields := logFields{"session": strconv.FormatInt(s.id, 10)}
+	parts := make([]string, 0, len(clientDimensions))
+	for _, dimension := range clientDimensions {
+		if value := profile[dimension]; value != "" {
+			fields[dimension] = value
+			parts = append(parts, dimension+"="+value)
+		}
+	}
+	logf(fields, "Session %d (%s) connected with %s\n", s.id, s.client.IdentityData().DisplayName, strings.Join(parts, " "))
+}
+
+// writeClientReport writes the aggregate of all clients that connected to the client report file.
+func writeClientReport() {
+	clientStats.Lock()
+	b, err := json.MarshalIndent(clientStats.clientReport, "", "  ")
+	clientStats.Unlock()
+	if err != nil {
+		log.Printf("Unable to encode client report: %v\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(clientReportFile, b, 0644); err != nil {
+		log.Printf("Unable to write client report: %v\n", err)
+	}
+}
+
+// geoRange is a range of IP addresses located in a single country.
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// geoRanges holds the ranges of the GeoIP database loaded, sorted by their start address.
+var geoRanges []geoRange
+
+// loadGeoIP loads a GeoIP database in CSV format with one range per line, holding the first address, the last
+// address and the country code of the range, such as the free databases of DB-IP and IP2Location. Addresses may
+// either be written as text or, for IPv4, as integers.
+func loadGeoIP(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.Trim(strings.TrimSpace(fields[i]), `"`)
+		}
+		start, err := parseGeoAddr(fields[0])
+		if err != nil {
+			if line == 1 {
+				// The first line may be a header.
+				continue
+			}
+			return fmt.Errorf("geoip %s:%d: %w", path, line, err)
+		}
+		end, err := parseGeoAddr(fields[1])
+		if err != nil {
+			return fmt.Errorf("geoip %s:%d: %w", path, line, err)
+		}
+		geoRanges = append(geoRanges, geoRange{start: start, end: end, country: fields[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	sort.Slice(geoRanges, func(i, j int) bool {
+		return geoRanges[i].start.Less(geoRanges[j].start)
+	})
+	return nil
+}
+
+// parseGeoAddr parses an address in a GeoIP database.
+func parseGeoAddr(s string) (netip.Addr, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	return addr.Unmap(), err
+}
+
+// lookupCountry returns the country code of the address passed. False is returned if no GeoIP database is loaded
+// or if the address is not in it.
+func lookupCountry(addr net.Addr) (string, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || len(geoRanges) == 0 {
+		return "", false
+	}
+	ip, ok := netip.AddrFromSlice(udpAddr.IP)
+	if !ok {
+		return "", false
+	}
+	ip = ip.Unmap()
+	i := sort.Search(len(geoRanges), func(i int) bool {
+		return ip.Less(geoRanges[i].start)
+	}) - 1
+	if i < 0 || geoRanges[i].end.Less(ip) || geoRanges[i].start.BitLen() != ip.BitLen() {
+		return "", false
+	}
+	return geoRanges[i].country, true
+}
+
+func init() {
+	registerCommand("clients", consoleCommand{
+		usage:       "[dimension]",
+		description: "Shows the device OS, input mode, UI profile, version, model and country of clients that connected.",
+		run: func(args []string) {
+			clientStats.Lock()
+			defer clientStats.Unlock()
+			log.Printf("%d clients connected.\n", clientStats.Clients)
+			for _, dimension := range clientDimensions {
+				if len(args) > 0 && args[0] != dimension {
+					continue
+				}
+				values := clientStats.Dimensions[dimension]
+				names := make([]string, 0, len(values))
+				for name := range values {
+					names = append(names, name)
+				}
+				sort.Slice(names, func(i, j int) bool {
+					if values[names[i]] != values[names[j]] {
+						return values[names[i]] > values[names[j]]
+					}
+					return names[i] < names[j]
+				})
+				log.Printf("%s:\n", dimension)
+				for _, name := range names {
+					log.Printf("    %-30s %5d %5.1f%%\n", name, values[name], float64(values[name])/float64(clientStats.Clients)*100)
+				}
+			}
+		},
+	})
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/auth"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// identityProvider provides the Live token source used to authenticate with the upstream server.
+type identityProvider interface {
+	// TokenSource returns a token source that produces valid Live tokens.
+	TokenSource() (oauth2.TokenSource, error)
+}
+
+// newIdentityProvider returns the identity provider with the name passed. The value is interpreted depending
+// on the provider: it is the token file for "device", the environment variable for "env" and the URL of the
+// token service for "url".
+func newIdentityProvider(name, value string) (identityProvider, error) {
+	switch name {
+	case "device":
+		return deviceCodeProvider{path: value}, nil
+	case "env":
+		return envTokenProvider{variable: value}, nil
+	case "url":
+		return urlTokenProvider{url: value}, nil
+	case "offline":
+		return offlineProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown identity provider %q", name)
+}
+
+// deviceCodeProvider is an identityProvider that reads the token from a file if cached or requests logging in
+// with a device code. The token is written back to the file every time it is refreshed and when the proxy is
+// stopped.
+type deviceCodeProvider struct {
+	path string
+}
+
+// TokenSource ...
+func (p deviceCodeProvider) TokenSource() (oauth2.TokenSource, error) {
+	token := new(oauth2.Token)
+	tokenData, err := ioutil.ReadFile(p.path)
+	if err == nil {
+		_ = json.Unmarshal(tokenData, token)
+	} else {
+		token, err = auth.RequestLiveToken()
+		if err != nil {
+			return nil, err
+		}
+	}
+	persist := func(tok *oauth2.Token) error {
+		b, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(p.path, b, 0644)
+	}
+	src, err := newTokenMonitor(&liveRefreshSource{t: token}, persist)
+	if err != nil {
+		// The cached refresh token expired and can no longer be used to obtain a new token. We require the
+		// user to log in again and use that token instead.
+		token, err = auth.RequestLiveToken()
+		if err != nil {
+			return nil, err
+		}
+		if src, err = newTokenMonitor(&liveRefreshSource{t: token}, persist); err != nil {
+			return nil, err
+		}
+	}
+	return src, nil
+}
+
+// envTokenProvider is an identityProvider that uses a Live refresh token held by an environment variable, so
+// that credentials may be supplied without interaction.
+type envTokenProvider struct {
+	variable string
+}
+
+// TokenSource ...
+func (p envTokenProvider) TokenSource() (oauth2.TokenSource, error) {
+	refreshToken := os.Getenv(p.variable)
+	if refreshToken == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", p.variable)
+	}
+	src, err := newTokenMonitor(&liveRefreshSource{t: &oauth2.Token{RefreshToken: refreshToken}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("refresh token from %s: %w", p.variable, err)
+	}
+	return src, nil
+}
+
+// offlineProvider is an identityProvider that provides no token, so that the proxy logs in to the upstream server
+// without Xbox Live authentication. It only works with servers that have online mode disabled, such as the mock
+// server.
+type offlineProvider struct{}
+
+// TokenSource ...
+func (offlineProvider) TokenSource() (oauth2.TokenSource, error) {
+	return nil, nil
+}
+
+// urlTokenProvider is an identityProvider that fetches Live tokens from an external token service. The service
+// is expected to respond to GET requests with a JSON encoded oauth2 token.
+type urlTokenProvider struct {
+	url string
+}
+
+// TokenSource ...
+func (p urlTokenProvider) TokenSource() (oauth2.TokenSource, error) {
+	return newTokenMonitor(urlTokenSource{url: p.url, client: &http.Client{Timeout: time.Second * 30}}, nil)
+}
+
+// urlTokenSource is an oauth2.TokenSource requesting a new token from a URL every time Token is called.
+type urlTokenSource struct {
+	url    string
+	client *http.Client
+}
+
+// Token ...
+func (src urlTokenSource) Token() (*oauth2.Token, error) {
+	resp, err := src.client.Get(src.url)
+	if err != nil {
+		return nil, fmt.Errorf("request token from %s: %w", src.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request token from %s: unexpected status %s", src.url, resp.Status)
+	}
+	token := new(oauth2.Token)
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("decode token from %s: %w", src.url, err)
+	}
+	return token, nil
+}
+
+// liveRefreshSource is an oauth2.TokenSource that obtains a new Live token using the refresh token of the last
+// token obtained every time Token is called.
+type liveRefreshSource struct {
+	t *oauth2.Token
+}
+
+// Token ...
+func (src *liveRefreshSource) Token() (*oauth2.Token, error) {
+	tok, err := auth.RefreshTokenSource(&oauth2.Token{RefreshToken: src.t.RefreshToken}).Token()
+	if err != nil {
+		return nil, err
+	}
+	src.t = tok
+	return tok, nil
+}
+
+// tokenRefreshMargin is the time before the expiry of a token at which the token is proactively refreshed.
+var tokenRefreshMargin = time.Minute * 5
+
+// activeTokenMonitor is the token monitor of the identity used to connect to the upstream server. It is replaced by
+// the login command while sessions may be connecting, so it is accessed atomically.
+var activeTokenMonitor atomic.Pointer[tokenMonitor]
+
+// tokenMonitor is an oauth2.TokenSource that caches the token returned by an underlying token source and
+// refreshes it in the background before it expires, so that it never expires whilst a client is connecting.
+type tokenMonitor struct {
+	src     oauth2.TokenSource
+	persist func(tok *oauth2.Token) error
+
+	mu          sync.Mutex
+	tok         *oauth2.Token
+	lastRefresh time.Time
+	lastErr     error
+
+	stopped chan struct{}
+}
+
+// newTokenMonitor creates a tokenMonitor that obtains tokens from the source passed and immediately requests
+// the first token. persist, if non-nil, is called with every token obtained so that it may be stored.
+func newTokenMonitor(src oauth2.TokenSource, persist func(tok *oauth2.Token) error) (*tokenMonitor, error) {
+	m := &tokenMonitor{src: src, persist: persist, stopped: make(chan struct{})}
+	if err := m.refresh(); err != nil {
+		return nil, err
+	}
+	if previous := activeTokenMonitor.Swap(m); previous != nil {
+		previous.stop()
+	}
+	go m.run()
+	return m, nil
+}
+
+// Token returns the current token, refreshing it first if it is about to expire.
+func (m *tokenMonitor) Token() (*oauth2.Token, error) {
+	m.mu.Lock()
+	tok := m.tok
+	m.mu.Unlock()
+	if !tok.Expiry.IsZero() && time.Until(tok.Expiry) < tokenRefreshMargin {
+		if err := m.refresh(); err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		tok = m.tok
+		m.mu.Unlock()
+	}
+	return tok, nil
+}
+
+// refresh obtains a new token from the underlying token source and persists it.
+func (m *tokenMonitor) refresh() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tok, err := m.src.Token()
+	m.lastErr = err
+	if err != nil {
+		return err
+	}
+	m.tok, m.lastRefresh = tok, time.Now()
+	if m.persist != nil {
+		if err := m.persist(tok); err != nil {
+			log.Printf("Unable to persist token: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// run refreshes the token in the background each time it is about to expire. Failed refreshes are retried
+// every 30 seconds.
+func (m *tokenMonitor) run() {
+	for {
+		m.mu.Lock()
+		expiry := m.tok.Expiry
+		m.mu.Unlock()
+		if expiry.IsZero() {
+			// The token never expires, so there is nothing to monitor.
+			return
+		}
+		wait := time.Until(expiry.Add(-tokenRefreshMargin))
+		if wait < time.Second*30 {
+			// Don't spin if the token source keeps returning tokens that are about to expire.
+			wait = time.Second * 30
+		}
+		select {
+		case <-time.After(wait):
+		case <-m.stopped:
+			return
+		}
+		for {
+			err := m.refresh()
+			if err == nil {
+				break
+			}
+			log.Printf("Unable to refresh token, retrying in 30 seconds: %v\n", err)
+			select {
+			case <-time.After(time.Second * 30):
+			case <-m.stopped:
+				return
+			}
+		}
+	}
+}
+
+// persistActiveToken persists the token of the active token monitor, if its tokens are persisted. It is called when
+// the proxy is stopped. Monitors replaced by the login command persisted their last token when it was refreshed.
+func persistActiveToken() {
+	m := activeTokenMonitor.Load()
+	if m == nil || m.persist == nil {
+		return
+	}
+	tok, err := m.Token()
+	if err != nil {
+		log.Printf("Unable to persist token: %v\n", err)
+		return
+	}
+	if err := m.persist(tok); err != nil {
+		log.Printf("Unable to persist token: %v\n", err)
+	}
+}
+
+// stop stops refreshing the token in the background.
+func (m *tokenMonitor) stop() {
+	close(m.stopped)
+}
+
+// status returns the expiry of the current token, the time it was last refreshed and the error of the last
+// refresh attempt.
+func (m *tokenMonitor) status() (expiry, lastRefresh time.Time, lastErr error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tok.Expiry, m.lastRefresh, m.lastErr
+}
+
+func init() {
+	onShutdown(persistActiveToken)
+	registerCommand("token", consoleCommand{
+		description: "Shows the expiry of the token used to authenticate with the upstream server.",
+		run: func([]string) {
+			m := activeTokenMonitor.Load()
+			if m == nil {
+				log.Println("No token is in use.")
+				return
+			}
+			expiry, lastRefresh, lastErr := m.status()
+			log.Printf("Token expires at %s (in %s), last refreshed at %s\n", expiry.Format(time.RFC3339), time.Until(expiry).Round(time.Second), lastRefresh.Format(time.RFC3339))
+			if lastErr != nil {
+				log.Printf("Last refresh failed: %v\n", lastErr)
+			}
+		},
+	})
+}
+
+// profileDir is the directory that the tokens of profiles used with the login command are stored in.
+var profileDir = "profiles"
+
+// identity is an oauth2.TokenSource delegating to the token source of the identity currently in use, so that the
+// identity used for new connections to the upstream server may be switched at runtime.
+type identity struct {
+	mu      sync.Mutex
+	src     oauth2.TokenSource
+	profile string
+}
+
+// activeIdentity is the identity used to connect to the upstream server.
+var activeIdentity = &identity{}
+
+// Token ...
+func (id *identity) Token() (*oauth2.Token, error) {
+	id.mu.Lock()
+	src := id.src
+	id.mu.Unlock()
+	if src == nil {
+		return nil, errors.New("the proxy logs in without authentication")
+	}
+	return src.Token()
+}
+
+// tokenSource returns the identity as token source, or nil if the identity currently in use logs in without
+// authentication.
+func (id *identity) tokenSource() oauth2.TokenSource {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if id.src == nil {
+		return nil
+	}
+	return id
+}
+
+// set switches to the token source passed, which belongs to the profile with the name passed.
+func (id *identity) set(profile string, src oauth2.TokenSource) {
+	id.mu.Lock()
+	id.src, id.profile = src, profile
+	id.mu.Unlock()
+}
+
+func init() {
+	registerCommand("login", consoleCommand{
+		usage:       "[profile [device|env|url|offline [value]]]",
+		description: "Shows the current profile or switches the identity used for new connections to a profile, logged in with the identity provider passed.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				activeIdentity.mu.Lock()
+				log.Printf("Using profile %q for new connections.\n", activeIdentity.profile)
+				activeIdentity.mu.Unlock()
+				return
+			}
+			profile := args[0]
+			if strings.ContainsAny(profile, `/\.`) {
+				log.Printf("Invalid profile name %q.\n", profile)
+				return
+			}
+			// Profiles log in with the device code flow by default, caching their token in the profile directory.
+			// The other providers take the environment variable or URL holding the token as value, as with -auth.
+			name, value := "device", filepath.Join(profileDir, profile+".tok")
+			if len(args) > 1 {
+				name, value = args[1], ""
+				if len(args) > 2 {
+					value = args[2]
+				}
+				if name == "device" && value == "" {
+					value = filepath.Join(profileDir, profile+".tok")
+				}
+			}
+			if (name == "env" || name == "url") && value == "" {
+				log.Printf("The %s provider needs a value: login %s %s <value>\n", name, profile, name)
+				return
+			}
+			provider, err := newIdentityProvider(name, value)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			// Logging in may require the device code flow, so it is done in the background to keep the console
+			// responsive.
+			go func() {
+				if name == "device" {
+					if err := os.MkdirAll(filepath.Dir(value), 0700); err != nil {
+						log.Printf("Unable to create profile directory: %v\n", err)
+						return
+					}
+				}
+				src, err := provider.TokenSource()
+				if err != nil {
+					log.Printf("Unable to log in as %q: %v\n", profile, err)
+					return
+				}
+				activeIdentity.set(profile, src)
+				log.Printf("Switched to profile %q using the %s provider. New connections will use this identity.\n", profile, name)
+			}()
+		},
+	})
+}
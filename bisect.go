@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("bisect", "Narrows down the packets of a capture that crash a client by replaying subsets to it", runBisect)
+}
+
+// bisectLoginPackets are the packets sent by the listener itself when a client joins, which are therefore never
+// replayed.
+var bisectLoginPackets = map[uint32]bool{
+	packet.IDNetworkSettings:         true,
+	packet.IDServerToClientHandshake: true,
+	packet.IDPlayStatus:              true,
+	packet.IDResourcePacksInfo:       true,
+	packet.IDResourcePackStack:       true,
+	packet.IDStartGame:               true,
+}
+
+// crashReplayer replays subsets of the clientbound packets of a capture to clients connecting to a listener and
+// reports if the client crashed.
+type crashReplayer struct {
+	listener *minecraft.Listener
+	data     minecraft.GameData
+	records  []capture.Record
+	// wait is the time the client is given to crash after the last packet was sent, and delay the time waited
+	// between packets.
+	wait, delay time.Duration
+	trials      int
+}
+
+// crashes replays the records with the indices passed to the next client that connects and reports if the
+// client disconnected before the wait after the last packet ended.
+func (r *crashReplayer) crashes(indices []int) (bool, error) {
+	r.trials++
+	log.Printf("Trial %d: connect the client to %s to replay %d packets\n", r.trials, r.listener.Addr(), len(indices))
+	c, err := r.listener.Accept()
+	if err != nil {
+		return false, err
+	}
+	conn := c.(*minecraft.Conn)
+	if err := conn.StartGame(r.data); err != nil {
+		// The client disconnected whilst spawning, which is not caused by the packets replayed.
+		return false, fmt.Errorf("start game: %w", err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := conn.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+	for _, i := range indices {
+		rec := r.records[i]
+		if _, err := conn.Write(append(binary.AppendUvarint(nil, uint64(rec.PacketID)), rec.Payload...)); err != nil {
+			break
+		}
+		if r.delay > 0 {
+			_ = conn.Flush()
+			time.Sleep(r.delay)
+		}
+	}
+	_ = conn.Flush()
+	select {
+	case <-closed:
+		log.Printf("Trial %d: the client disconnected, the crash was reproduced\n", r.trials)
+		return true, nil
+	case <-time.After(r.wait):
+		log.Printf("Trial %d: the client is still connected, the crash was not reproduced\n", r.trials)
+		_ = r.listener.Disconnect(conn, "Bisect trial passed, reconnect for the next trial.")
+		return false, nil
+	}
+}
+
+// minimizeCrash reduces the indices passed to a minimal subsequence for which test still reports a crash, using
+// the ddmin delta debugging algorithm: the sequence is split into chunks, and a chunk or its complement replaces
+// the sequence if it still crashes, doubling the amount of chunks if neither does.
+func minimizeCrash(indices []int, test func([]int) (bool, error)) ([]int, error) {
+	n := 2
+	for len(indices) >= 2 {
+		chunks := splitChunks(indices, n)
+		reduced := false
+		for i, chunk := range chunks {
+			if ok, err := test(chunk); err != nil {
+				return indices, err
+			} else if ok {
+				indices, n, reduced = chunk, 2, true
+				break
+			}
+			if n == 2 {
+				// The complement of one of two chunks is the other chunk, which is tested next.
+				continue
+			}
+			var complement []int
+			for j, other := range chunks {
+				if j != i {
+					complement = append(complement, other...)
+				}
+			}
+			if ok, err := test(complement); err != nil {
+				return indices, err
+			} else if ok {
+				indices, n, reduced = complement, max(n-1, 2), true
+				break
+			}
+		}
+		if reduced {
+			continue
+		}
+		if n >= len(indices) {
+			break
+		}
+		n = min(n*2, len(indices))
+	}
+	return indices, nil
+}
+
+// splitChunks splits the indices passed into n chunks of roughly equal size.
+func splitChunks(indices []int, n int) [][]int {
+	chunks := make([][]int, 0, n)
+	for i := 0; i < n; i++ {
+		chunks = append(chunks, indices[i*len(indices)/n:(i+1)*len(indices)/n])
+	}
+	return chunks
+}
+
+// gameDataFromStartGame returns the game data that results in the StartGame packet passed being sent.
+func gameDataFromStartGame(pk *packet.StartGame) minecraft.GameData {
+	return minecraft.GameData{
+		WorldName:                    pk.WorldName,
+		WorldSeed:                    pk.WorldSeed,
+		Difficulty:                   pk.Difficulty,
+		EntityUniqueID:               pk.EntityUniqueID,
+		EntityRuntimeID:              pk.EntityRuntimeID,
+		PlayerGameMode:               pk.PlayerGameMode,
+		PersonaDisabled:              pk.PersonaDisabled,
+		CustomSkinsDisabled:          pk.CustomSkinsDisabled,
+		BaseGameVersion:              pk.BaseGameVersion,
+		PlayerPosition:               pk.PlayerPosition,
+		Pitch:                        pk.Pitch,
+		Yaw:                          pk.Yaw,
+		Dimension:                    pk.Dimension,
+		WorldSpawn:                   pk.WorldSpawn,
+		EditorWorld:                  pk.EditorWorld,
+		WorldGameMode:                pk.WorldGameMode,
+		GameRules:                    pk.GameRules,
+		Time:                         pk.Time,
+		ServerBlockStateChecksum:     pk.ServerBlockStateChecksum,
+		CustomBlocks:                 pk.Blocks,
+		Items:                        pk.Items,
+		PlayerMovementSettings:       pk.PlayerMovementSettings,
+		ServerAuthoritativeInventory: pk.ServerAuthoritativeInventory,
+		Experiments:                  pk.Experiments,
+		PlayerPermissions:            pk.PlayerPermissions,
+		ClientSideGeneration:         pk.ClientSideGeneration,
+		ChatRestrictionLevel:         pk.ChatRestrictionLevel,
+		DisablePlayerInteractions:    pk.DisablePlayerInteractions,
+	}
+}
+
+// startGameFromGameData returns the StartGame packet that is sent to a client when the game is started with the
+// game data passed. It is the inverse of gameDataFromStartGame.
+func startGameFromGameData(data minecraft.GameData) *packet.StartGame {
+	return &packet.StartGame{
+		WorldName:                    data.WorldName,
+		WorldSeed:                    data.WorldSeed,
+		Difficulty:                   data.Difficulty,
+		EntityUniqueID:               data.EntityUniqueID,
+		EntityRuntimeID:              data.EntityRuntimeID,
+		PlayerGameMode:               data.PlayerGameMode,
+		PersonaDisabled:              data.PersonaDisabled,
+		CustomSkinsDisabled:          data.CustomSkinsDisabled,
+		BaseGameVersion:              data.BaseGameVersion,
+		PlayerPosition:               data.PlayerPosition,
+		Pitch:                        data.Pitch,
+		Yaw:                          data.Yaw,
+		Dimension:                    data.Dimension,
+		WorldSpawn:                   data.WorldSpawn,
+		EditorWorld:                  data.EditorWorld,
+		WorldGameMode:                data.WorldGameMode,
+		GameRules:                    data.GameRules,
+		Time:                         data.Time,
+		ServerBlockStateChecksum:     data.ServerBlockStateChecksum,
+		Blocks:                       data.CustomBlocks,
+		Items:                        data.Items,
+		PlayerMovementSettings:       data.PlayerMovementSettings,
+		ServerAuthoritativeInventory: data.ServerAuthoritativeInventory,
+		Experiments:                  data.Experiments,
+		PlayerPermissions:            data.PlayerPermissions,
+		ClientSideGeneration:         data.ClientSideGeneration,
+		ChatRestrictionLevel:         data.ChatRestrictionLevel,
+		DisablePlayerInteractions:    data.DisablePlayerInteractions,
+		GameVersion:                  protocol.CurrentVersion,
+	}
+}
+
+// newCrashReplayer reads the clientbound packets of the session passed from the capture at the path passed, or
+// of the first session if it is 0, and starts listening for the client that they are replayed to.
+func newCrashReplayer(path string, sessionID uint64, addr string, wait, delay time.Duration) (*crashReplayer, capture.Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, capture.Header{}, err
+	}
+	defer f.Close()
+	dec, err := capture.NewDecoder(f)
+	if err != nil {
+		return nil, capture.Header{}, err
+	}
+	h := dec.Header()
+	replayer := &crashReplayer{wait: wait, delay: delay, data: minecraft.GameData{
+		WorldName:      "bisect",
+		PlayerGameMode: 1,
+		WorldGameMode:  1,
+	}}
+	for {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, h, fmt.Errorf("read record %d: %w", len(replayer.records), err)
+		}
+		capture.Migrate(h, &r)
+		if sessionID == 0 {
+			sessionID = r.Session
+		}
+		if r.Session != sessionID || r.Direction != capture.DirectionClientbound {
+			continue
+		}
+		if r.PacketID == packet.IDStartGame {
+			if pk, err := decodePacket(r.PacketID, r.Payload, 0); err == nil {
+				replayer.data = gameDataFromStartGame(pk.(*packet.StartGame))
+			}
+		}
+		if !bisectLoginPackets[r.PacketID] {
+			replayer.records = append(replayer.records, r)
+		}
+	}
+	if len(replayer.records) == 0 {
+		return nil, h, fmt.Errorf("no clientbound packets of session %d in %s", sessionID, path)
+	}
+	if replayer.data.WorldName == "bisect" {
+		log.Println("The capture holds no StartGame packet: the client is spawned in an empty world.")
+	}
+	replayer.listener, err = minecraft.ListenConfig{
+		AuthenticationDisabled: true,
+		StatusProvider:         minecraft.NewStatusProvider("bds-mitm bisect"),
+	}.Listen("raknet", addr)
+	if err != nil {
+		return nil, h, err
+	}
+	return replayer, h, nil
+}
+
+// writeReplayCapture writes the records passed to a new capture at the path passed, with the header of the
+// capture they were read from.
+func writeReplayCapture(path string, h capture.Header, records []capture.Record) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc, err := capture.NewEncoder(f, capture.Header{
+		CreatedUnixNano:  time.Now().UnixNano(),
+		Upstream:         h.Upstream,
+		Protocol:         h.Protocol,
+		MinecraftVersion: h.MinecraftVersion,
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// runBisect runs the bisect subcommand, which narrows down the clientbound packets of a capture that crash a
+// client to a minimal subsequence. Subsets of the packets are replayed to a client connecting to a local
+// listener, which has to be reconnected for every trial, and a subset is considered to reproduce the crash if
+// the client disconnects while or shortly after it is replayed.
+func runBisect(args []string) error {
+	fs := flag.NewFlagSet("bisect", flag.ExitOnError)
+	out := fs.String("o", "", "Output file of the minimal capture (defaults to <capture>-minimal.bdscap)")
+	addr := fs.String("listen", "127.0.0.1:19133", "Address to listen on for the client")
+	sessionID := fs.Uint64("session", 0, "Session of the capture to replay, or 0 for the first session")
+	keep := fs.String("keep", "", "Comma separated packets or @groups that are replayed in every trial and never removed")
+	wait := fs.Duration("wait", 5*time.Second, "Time the client is given to crash after the last packet was replayed")
+	delay := fs.Duration("delay", 0, "Time waited between replayed packets")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: bisect [-o output] [-listen address] [-session id] [-keep packets] [-wait duration] [-delay duration] <capture>")
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(in, ".bdscap") + "-minimal.bdscap"
+	}
+	kept := map[string]bool{}
+	if *keep != "" {
+		names, err := expandPacketNames(strings.Split(*keep, ","))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			kept[name] = true
+		}
+	}
+	replayer, h, err := newCrashReplayer(in, *sessionID, *addr, *wait, *delay)
+	if err != nil {
+		return err
+	}
+	defer replayer.listener.Close()
+	var candidates, always []int
+	for i, r := range replayer.records {
+		if kept[r.PacketName] {
+			always = append(always, i)
+		} else {
+			candidates = append(candidates, i)
+		}
+	}
+
+	// The packets kept are merged into every subset tested, keeping the order of the capture. Subsets already
+	// tested are not replayed again, as every trial requires the client to reconnect.
+	results := map[string]bool{}
+	test := func(subset []int) (bool, error) {
+		key := fmt.Sprint(subset)
+		if crashed, ok := results[key]; ok {
+			return crashed, nil
+		}
+		crashed, err := replayer.crashes(mergeIndices(subset, always))
+		if err == nil {
+			results[key] = crashed
+		}
+		return crashed, err
+	}
+	if len(candidates) > 0 {
+		if ok, err := test(candidates); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("replaying the full capture does not crash the client")
+		}
+	}
+	minimal, err := minimizeCrash(candidates, test)
+	if err != nil {
+		return err
+	}
+	minimal = mergeIndices(minimal, always)
+
+	log.Printf("Reduced %d packets to %d after %d trials:\n", len(replayer.records), len(minimal), replayer.trials)
+	records := make([]capture.Record, 0, len(minimal))
+	for _, i := range minimal {
+		r := replayer.records[i]
+		log.Printf("  %s (%d bytes)\n", r.PacketName, len(r.Payload))
+		records = append(records, r)
+	}
+	if err := writeReplayCapture(*out, h, records); err != nil {
+		return err
+	}
+	log.Printf("Wrote the minimal capture to %s\n", *out)
+	return nil
+}
+
+// mergeIndices merges two sorted slices of indices into a new sorted slice.
+func mergeIndices(a, b []int) []int {
+	merged := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		if len(b) == 0 || len(a) > 0 && a[0] < b[0] {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	return merged
+}
@@ -0,0 +1,422 @@
+// Package capture implements the capture file format of bds-mitm, which holds packets recorded by the proxy.
+// The format is defined in capture.proto and encoded using the protobuf wire format, so that captures may be
+// read by external tools.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+)
+
+// Version is the version of the capture format written by this package.
+const Version = 3
+
+// magic is the sequence of bytes every capture file starts with.
+var magic = []byte("BDSMCAP\x00")
+
+// MaxMessageSize is the maximum size of a single header or record in a capture. It is far larger than any packet
+// a server sends, and stops a corrupt length prefix from making a Decoder allocate gigabytes.
+const MaxMessageSize = 64 << 20
+
+// Direction is the direction a packet travelled in.
+type Direction int32
+
+const (
+	// DirectionUnspecified is the zero value of Direction.
+	DirectionUnspecified Direction = iota
+	// DirectionServerbound is the direction of packets sent by the client to the server.
+	DirectionServerbound
+	// DirectionClientbound is the direction of packets sent by the server to the client.
+	DirectionClientbound
+)
+
+// String ...
+func (d Direction) String() string {
+	switch d {
+	case DirectionServerbound:
+		return "serverbound"
+	case DirectionClientbound:
+		return "clientbound"
+	}
+	return "unspecified"
+}
+
+// Header is the first message of a capture file.
+type Header struct {
+	// Version is the version of the capture format the file was written with.
+	Version uint32
+	// CreatedUnixNano is the time the capture was started at.
+	CreatedUnixNano int64
+	// Upstream is the address of the server the proxy was connected to.
+	Upstream string
+	// Protocol is the protocol version of the packets held in the capture.
+	Protocol int32
+	// MinecraftVersion is the Minecraft version matching the protocol version.
+	MinecraftVersion string
+	// DedupMinSize is the minimum size of payloads that are deduplicated, or 0 if payloads are not deduplicated.
+	// Deduplicated payloads are stored only the first time they occur and referred to by their hash afterwards.
+	DedupMinSize uint32
+}
+
+// Record is a single packet captured.
+type Record struct {
+	// TimeUnixNano is the time the packet was received by the proxy.
+	TimeUnixNano int64
+	// Session is the ID of the session the packet was sent in.
+	Session uint64
+	// Direction is the direction the packet travelled in.
+	Direction Direction
+	// PacketID is the ID of the packet.
+	PacketID uint32
+	// PacketName is the name of the packet. It is informational only.
+	PacketName string
+	// Payload is the encoded packet, excluding its header.
+	Payload []byte
+	// PayloadRef is the SHA-256 hash of the payload if it was deduplicated. Decoders fill out the payload of
+	// records that only hold a reference to a payload stored earlier in the capture.
+	PayloadRef []byte
+	// Annotation is the text of a marker inserted into the capture by the user, such as "about to open chest".
+	// Records with an annotation hold no packet: their direction is unspecified and their payload is empty.
+	// Annotations were added in version 3, so that readers of older versions reject captures holding them
+	// instead of reading them as packets.
+	Annotation string
+}
+
+// IsAnnotation checks if the record is a marker inserted by the user rather than a packet.
+func (r Record) IsAnnotation() bool {
+	return r.Annotation != ""
+}
+
+// Marshal encodes the header using the protobuf wire format.
+func (h Header) Marshal() []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(h.Version))
+	b = appendVarint(b, 2, uint64(h.CreatedUnixNano))
+	b = appendString(b, 3, h.Upstream)
+	b = appendVarint(b, 4, uint64(h.Protocol))
+	b = appendString(b, 5, h.MinecraftVersion)
+	b = appendVarint(b, 6, uint64(h.DedupMinSize))
+	return b
+}
+
+// Unmarshal decodes a header encoded using the protobuf wire format. Unknown fields are skipped.
+func (h *Header) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, v uint64, s []byte) {
+		switch num {
+		case 1:
+			h.Version = uint32(v)
+		case 2:
+			h.CreatedUnixNano = int64(v)
+		case 3:
+			h.Upstream = string(s)
+		case 4:
+			h.Protocol = int32(v)
+		case 5:
+			h.MinecraftVersion = string(s)
+		case 6:
+			h.DedupMinSize = uint32(v)
+		}
+	})
+}
+
+// Marshal encodes the record using the protobuf wire format.
+func (r Record) Marshal() []byte {
+	b := make([]byte, 0, len(r.Payload)+len(r.PacketName)+len(r.PayloadRef)+len(r.Annotation)+32)
+	b = appendVarint(b, 1, uint64(r.TimeUnixNano))
+	b = appendVarint(b, 2, r.Session)
+	b = appendVarint(b, 3, uint64(r.Direction))
+	b = appendVarint(b, 4, uint64(r.PacketID))
+	b = appendString(b, 5, r.PacketName)
+	if len(r.Payload) > 0 {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Payload)
+	}
+	if len(r.PayloadRef) > 0 {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.PayloadRef)
+	}
+	return appendString(b, 8, r.Annotation)
+}
+
+// Unmarshal decodes a record encoded using the protobuf wire format. Unknown fields are skipped.
+func (r *Record) Unmarshal(b []byte) error {
+	return unmarshal(b, func(num protowire.Number, v uint64, s []byte) {
+		switch num {
+		case 1:
+			r.TimeUnixNano = int64(v)
+		case 2:
+			r.Session = v
+		case 3:
+			r.Direction = Direction(v)
+		case 4:
+			r.PacketID = uint32(v)
+		case 5:
+			r.PacketName = string(s)
+		case 6:
+			r.Payload = append([]byte(nil), s...)
+		case 7:
+			r.PayloadRef = append([]byte(nil), s...)
+		case 8:
+			r.Annotation = string(s)
+		}
+	})
+}
+
+// appendVarint appends a varint field to b if v is not the zero value.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendString appends a string field to b if s is not empty.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// unmarshal decodes the fields of a message, calling f with the value of each varint field or the contents
+// of each length-delimited field.
+func unmarshal(b []byte, f func(num protowire.Number, v uint64, s []byte)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, v, nil)
+			b = b[n:]
+		case protowire.BytesType:
+			s, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			f(num, 0, s)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
+
+// Encoder writes a capture file to an io.Writer.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+
+	dedupMinSize int
+	// stored holds the hashes of the deduplicated payloads written so far.
+	stored  map[[sha256.Size]byte]struct{}
+	saved   int64
+	written int64
+}
+
+// MemoryUsage returns an estimate of the memory held by the encoder in bytes: its record buffer and the hashes of
+// the deduplicated payloads written so far.
+func (enc *Encoder) MemoryUsage() int {
+	return cap(enc.buf) + len(enc.stored)*sha256.Size
+}
+
+// NewEncoder writes the magic bytes and the header passed to w and returns an Encoder writing records to it.
+// The version of the header is set to Version. If the DedupMinSize of the header is not 0, payloads of at least
+// that size are only written the first time they occur.
+func NewEncoder(w io.Writer, h Header) (*Encoder, error) {
+	h.Version = Version
+	enc := &Encoder{w: w, dedupMinSize: int(h.DedupMinSize), stored: map[[sha256.Size]byte]struct{}{}}
+	if _, err := w.Write(magic); err != nil {
+		return nil, err
+	}
+	enc.written = int64(len(magic))
+	if err := enc.writeMessage(h.Marshal()); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// Encode writes a record to the capture.
+func (enc *Encoder) Encode(r Record) error {
+	r.PayloadRef = nil
+	if enc.dedupMinSize > 0 && len(r.Payload) >= enc.dedupMinSize {
+		hash := sha256.Sum256(r.Payload)
+		r.PayloadRef = hash[:]
+		if _, ok := enc.stored[hash]; ok {
+			enc.saved += int64(len(r.Payload))
+			r.Payload = nil
+		} else {
+			enc.stored[hash] = struct{}{}
+		}
+	}
+	return enc.writeMessage(r.Marshal())
+}
+
+// Saved returns the amount of payload bytes that were not written because they were deduplicated.
+func (enc *Encoder) Saved() int64 {
+	return enc.saved
+}
+
+// Written returns the amount of bytes written to the capture so far, including the magic bytes and the header.
+func (enc *Encoder) Written() int64 {
+	return enc.written
+}
+
+// writeMessage writes an encoded message prefixed with its length. An error is returned if the message is larger
+// than MaxMessageSize, as decoders would not be able to read it.
+func (enc *Encoder) writeMessage(b []byte) error {
+	if len(b) > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum of %d bytes", len(b), MaxMessageSize)
+	}
+	enc.buf = protowire.AppendVarint(enc.buf[:0], uint64(len(b)))
+	enc.buf = append(enc.buf, b...)
+	n, err := enc.w.Write(enc.buf)
+	enc.written += int64(n)
+	return err
+}
+
+// Decoder reads a capture file from an io.Reader.
+type Decoder struct {
+	r      *bufio.Reader
+	header Header
+	// payloads holds the deduplicated payloads read so far, indexed by their hash.
+	payloads map[[sha256.Size]byte][]byte
+}
+
+// ErrUnsupportedVersion is returned by NewDecoder if the capture was written with a newer version of the format
+// than supported.
+var ErrUnsupportedVersion = errors.New("unsupported capture version")
+
+// NewDecoder reads the magic bytes and header of a capture file from r and returns a Decoder reading the
+// records that follow.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	dec := &Decoder{r: bufio.NewReader(r), payloads: map[[sha256.Size]byte][]byte{}}
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(dec.r, m); err != nil {
+		return nil, fmt.Errorf("read magic: %w", err)
+	}
+	if !bytes.Equal(m, magic) {
+		return nil, fmt.Errorf("not a capture file")
+	}
+	b, err := dec.readMessage()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if err := dec.header.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("decode header: %w", err)
+	}
+	if dec.header.Version > Version {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, dec.header.Version)
+	}
+	return dec, nil
+}
+
+// Header returns the header of the capture.
+func (dec *Decoder) Header() Header {
+	return dec.header
+}
+
+// Decode reads the next record of the capture. io.EOF is returned if no records are left. Payloads of records
+// referring to a deduplicated payload are filled out, which requires keeping all deduplicated payloads in memory.
+func (dec *Decoder) Decode() (Record, error) {
+	var r Record
+	b, err := dec.readMessage()
+	if err != nil {
+		return r, err
+	}
+	if err := r.Unmarshal(b); err != nil {
+		return r, err
+	}
+	if len(r.PayloadRef) == sha256.Size {
+		hash, ok := [sha256.Size]byte(r.PayloadRef), true
+		if r.Payload != nil {
+			dec.payloads[hash] = r.Payload
+		} else if r.Payload, ok = dec.payloads[hash]; !ok {
+			return r, fmt.Errorf("payload %x referred to before it was stored", r.PayloadRef)
+		}
+	}
+	return r, nil
+}
+
+// readMessage reads a message prefixed with its length. An error is returned if the length exceeds
+// MaxMessageSize.
+func (dec *Decoder) readMessage() ([]byte, error) {
+	l, err := readUvarint(dec.r)
+	if err != nil {
+		return nil, err
+	}
+	if l > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d bytes", l, MaxMessageSize)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(dec.r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// readUvarint reads a protobuf varint from r. io.EOF is returned only if no bytes could be read.
+func readUvarint(r io.ByteReader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v |= uint64(c&0x7f) << (7 * i)
+		if c < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("varint overflows 64 bits")
+}
+
+// migrations holds functions upgrading a record from the version at their index to the next version. A
+// function may be nil if the records of a version need no changes.
+var migrations = []func(h *Header, r *Record){
+	0: nil,
+	// Version 2 added deduplicated payloads, which are resolved by the Decoder.
+	1: nil,
+	// Version 3 added annotation records. Captures written before the version was raised may hold annotation
+	// records that also set packet fields, which are cleared as annotations hold no packet.
+	2: func(h *Header, r *Record) {
+		if r.IsAnnotation() {
+			r.Direction, r.PacketID, r.PacketName, r.Payload, r.PayloadRef = DirectionUnspecified, 0, "", nil, nil
+		}
+	},
+}
+
+// Migrate upgrades a record read from a capture with the header passed to the current version of the format.
+// It returns false if the capture has a version newer than supported.
+func Migrate(h Header, r *Record) bool {
+	if h.Version > Version {
+		return false
+	}
+	for v := h.Version; v < Version; v++ {
+		if int(v) < len(migrations) && migrations[v] != nil {
+			migrations[v](&h, r)
+		}
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// encodeRecords encodes the records passed into a capture with the header passed and returns it with the encoder.
+func encodeRecords(t *testing.T, h Header, records []Record) (*bytes.Buffer, *Encoder) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	enc, err := NewEncoder(buf, h)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	return buf, enc
+}
+
+// decodeRecords decodes all records of the capture passed.
+func decodeRecords(t *testing.T, r io.Reader) (Header, []Record) {
+	t.Helper()
+	dec, err := NewDecoder(r)
+	if err != nil {
+		t.Fatalf("new decoder: %v", err)
+	}
+	var records []Record
+	for {
+		rec, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return dec.Header(), records
+		}
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	h := Header{CreatedUnixNano: 1700000000000000000, Upstream: "127.0.0.1:19132", Protocol: 567, MinecraftVersion: "1.19.60"}
+	records := []Record{
+		{TimeUnixNano: 1, Session: 1, Direction: DirectionServerbound, PacketID: 9, PacketName: "Text", Payload: []byte{1, 2, 3}},
+		{TimeUnixNano: 2, Session: 1, Direction: DirectionClientbound, PacketID: 58, PacketName: "LevelChunk", Payload: bytes.Repeat([]byte{7}, 300)},
+		{TimeUnixNano: 3, Session: 1, Annotation: "about to open chest"},
+	}
+	buf, enc := encodeRecords(t, h, records)
+	if enc.Written() != int64(buf.Len()) {
+		t.Errorf("encoder reports %d bytes written, buffer holds %d", enc.Written(), buf.Len())
+	}
+
+	got, decoded := decodeRecords(t, buf)
+	h.Version = Version
+	if got != h {
+		t.Errorf("header = %+v, want %+v", got, h)
+	}
+	if !reflect.DeepEqual(decoded, records) {
+		t.Errorf("records = %+v, want %+v", decoded, records)
+	}
+	if !decoded[2].IsAnnotation() || decoded[0].IsAnnotation() {
+		t.Errorf("annotation records were not recognised")
+	}
+}
+
+func TestEncodeDeduplicatesPayloads(t *testing.T) {
+	large, small := bytes.Repeat([]byte{0xab}, 64), []byte{1, 2}
+	records := []Record{
+		{TimeUnixNano: 1, PacketName: "SubChunk", Payload: large},
+		{TimeUnixNano: 2, PacketName: "Text", Payload: small},
+		{TimeUnixNano: 3, PacketName: "SubChunk", Payload: large},
+		{TimeUnixNano: 4, PacketName: "SubChunk", Payload: large},
+	}
+	buf, enc := encodeRecords(t, Header{DedupMinSize: 32}, records)
+	if want := int64(2 * len(large)); enc.Saved() != want {
+		t.Errorf("saved %d bytes, want %d", enc.Saved(), want)
+	}
+	plain, _ := encodeRecords(t, Header{}, records)
+	if buf.Len() >= plain.Len() {
+		t.Errorf("deduplicated capture is %d bytes, not smaller than %d bytes without deduplication", buf.Len(), plain.Len())
+	}
+
+	_, decoded := decodeRecords(t, buf)
+	if len(decoded) != len(records) {
+		t.Fatalf("decoded %d records, want %d", len(decoded), len(records))
+	}
+	for i, r := range decoded {
+		if !bytes.Equal(r.Payload, records[i].Payload) {
+			t.Errorf("record %d: payload = %x, want %x", i, r.Payload, records[i].Payload)
+		}
+	}
+	if decoded[1].PayloadRef != nil {
+		t.Errorf("payload smaller than the minimum size was deduplicated")
+	}
+	if len(decoded[3].PayloadRef) == 0 {
+		t.Errorf("repeated payload holds no reference")
+	}
+}
+
+func TestDecodeUnknownPayloadRef(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc, err := NewEncoder(buf, Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record referring to a payload that was never stored, as written by a truncated or corrupt capture.
+	r := Record{PacketName: "SubChunk", PayloadRef: bytes.Repeat([]byte{1}, 32)}
+	if err := enc.writeMessage(r.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewDecoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Decode(); err == nil {
+		t.Errorf("decoding a record referring to an unknown payload succeeded")
+	}
+}
+
+// rawCapture returns a capture consisting of the magic bytes followed by the length prefixed messages passed.
+func rawCapture(messages ...[]byte) *bytes.Buffer {
+	buf := bytes.NewBuffer(append([]byte(nil), magic...))
+	for _, m := range messages {
+		buf.Write(protowire.AppendVarint(nil, uint64(len(m))))
+		buf.Write(m)
+	}
+	return buf
+}
+
+func TestDecoderRejectsNewerVersion(t *testing.T) {
+	_, err := NewDecoder(rawCapture(Header{Version: Version + 1}.Marshal()))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("err = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestDecoderRejectsOversizedMessage(t *testing.T) {
+	buf := rawCapture(Header{Version: Version}.Marshal())
+	buf.Write(protowire.AppendVarint(nil, MaxMessageSize+1))
+	dec, err := NewDecoder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dec.Decode(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("err = %v, want an error for the message size", err)
+	}
+}
+
+func TestDecoderRejectsOtherFiles(t *testing.T) {
+	if _, err := NewDecoder(bytes.NewReader([]byte("PK\x03\x04 not a capture"))); err == nil {
+		t.Errorf("decoding a file without the magic bytes succeeded")
+	}
+}
+
+func TestMigrateAnnotations(t *testing.T) {
+	r := Record{Direction: DirectionClientbound, PacketID: 9, PacketName: "Text", Payload: []byte{1}, Annotation: "mark"}
+	if !Migrate(Header{Version: 2}, &r) {
+		t.Fatal("migrating a version 2 record failed")
+	}
+	want := Record{Annotation: "mark"}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("migrated record = %+v, want %+v", r, want)
+	}
+
+	pk := Record{Direction: DirectionClientbound, PacketID: 9, PacketName: "Text", Payload: []byte{1}}
+	before := pk
+	if !Migrate(Header{Version: 1}, &pk) || !reflect.DeepEqual(pk, before) {
+		t.Errorf("migrating a packet record changed it to %+v", pk)
+	}
+	if Migrate(Header{Version: Version + 1}, &pk) {
+		t.Errorf("migrating a record of a newer version succeeded")
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1"+ManifestSuffix)
+	m := Manifest{Session: 1, Upstream: "127.0.0.1:19132", Segments: []Segment{
+		{File: "1-0.bdscap", FirstUnixNano: 1, LastUnixNano: 2, Records: 2, Bytes: 100},
+		{File: "1-1.bdscap", FirstUnixNano: 3, LastUnixNano: 4, Records: 1, Bytes: 50},
+	}}
+	if err := WriteManifest(path, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("manifest = %+v, want %+v", got, m)
+	}
+
+	files, err := Files(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "1-0.bdscap"), filepath.Join(dir, "1-1.bdscap")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+	if files, _ := Files("single.bdscap"); !reflect.DeepEqual(files, []string{"single.bdscap"}) {
+		t.Errorf("files of a single capture = %v", files)
+	}
+}
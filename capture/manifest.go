@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestSuffix is the suffix of manifest files.
+const ManifestSuffix = ".manifest.json"
+
+// Manifest links the segments of a capture that was split into multiple files into one logical capture. Each
+// segment is a complete capture file with its own header.
+type Manifest struct {
+	Session  uint64    `json:"session"`
+	Upstream string    `json:"upstream"`
+	Segments []Segment `json:"segments"`
+}
+
+// Segment is a single file of a capture split into multiple files.
+type Segment struct {
+	// File is the path of the segment, relative to the directory of the manifest.
+	File string `json:"file"`
+	// FirstUnixNano and LastUnixNano are the times of the first and last record in the segment.
+	FirstUnixNano int64 `json:"first_unix_nano"`
+	LastUnixNano  int64 `json:"last_unix_nano"`
+	Records       int   `json:"records"`
+	Bytes         int64 `json:"bytes"`
+}
+
+// WriteManifest writes the manifest passed to the path passed, replacing it atomically so that readers never see
+// a partially written manifest.
+func WriteManifest(path string, m Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadManifest reads the manifest at the path passed.
+func ReadManifest(path string) (Manifest, error) {
+	var m Manifest
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// Files returns the paths of the capture files that make up the capture at the path passed in order. If the path
+// is that of a manifest, the paths of its segments are returned. Otherwise, the path itself is returned.
+func Files(path string) ([]string, error) {
+	if !strings.HasSuffix(path, ManifestSuffix) {
+		return []string{path}, nil
+	}
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, len(m.Segments))
+	for i, s := range m.Segments {
+		files[i] = filepath.Join(filepath.Dir(path), s.File)
+	}
+	return files, nil
+}
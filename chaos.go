@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosRule applies network faults to packets of a specific type travelling in a specific direction, to
+// reproduce bugs that only occur on unreliable networks.
+type chaosRule struct {
+	// packet is the name of the packet the rule applies to, or * for all packets.
+	packet string
+	// direction is the direction the rule applies to: serverbound, clientbound or both.
+	direction string
+	// drop is the percentage of matching packets that are dropped.
+	drop float64
+	// duplicate is the percentage of matching packets that are sent twice, as happens when a packet is
+	// retransmitted over UDP.
+	duplicate float64
+	// reorder is the percentage of matching packets that are overtaken by up to chaosReorderWindow packets sent
+	// after them.
+	reorder float64
+}
+
+// matches checks if the rule applies to a packet with the name passed travelling in the direction passed.
+func (r *chaosRule) matches(name, direction string) bool {
+	return (r.packet == "*" || r.packet == name) && (r.direction == "both" || r.direction == direction)
+}
+
+// String ...
+func (r *chaosRule) String() string {
+	return fmt.Sprintf("%s %s: drop %.1f%%, duplicate %.1f%%, reorder %.1f%%", r.packet, r.direction, r.drop, r.duplicate, r.reorder)
+}
+
+// chaosRules holds the chaos rules currently active.
+var chaosRules = struct {
+	sync.RWMutex
+	rules []*chaosRule
+}{}
+
+// updateChaosRule calls f with the chaos rule for the packet and direction passed, creating the rule if it did
+// not yet exist.
+func updateChaosRule(packet, direction string, f func(r *chaosRule)) {
+	chaosRules.Lock()
+	defer chaosRules.Unlock()
+	for _, r := range chaosRules.rules {
+		if r.packet == packet && r.direction == direction {
+			f(r)
+			return
+		}
+	}
+	r := &chaosRule{packet: packet, direction: direction}
+	f(r)
+	chaosRules.rules = append(chaosRules.rules, r)
+}
+
+// chaosModes holds the functions setting the percentage of a chaos mode on a rule, indexed by the mode name.
+var chaosModes = map[string]func(r *chaosRule, percentage float64){
+	"drop":      func(r *chaosRule, percentage float64) { r.drop = percentage },
+	"duplicate": func(r *chaosRule, percentage float64) { r.duplicate = percentage },
+	"reorder":   func(r *chaosRule, percentage float64) { r.reorder = percentage },
+}
+
+// chaosReorderWindow is the maximum amount of packets that may overtake a packet delayed by a reorder rule.
+var chaosReorderWindow = 4
+
+// chaosReorderTimeout is the maximum time a packet delayed by a reorder rule is held back waiting for packets to
+// overtake it.
+const chaosReorderTimeout = 50 * time.Millisecond
+
+// reorderUnsafePackets holds the packets that are never reordered, because the connection or the state of the
+// game depends on their order relative to other packets.
+var reorderUnsafePackets = map[string]bool{
+	getType(&packet.StartGame{}, false):                   true,
+	getType(&packet.PlayStatus{}, false):                  true,
+	getType(&packet.ChangeDimension{}, false):             true,
+	getType(&packet.Disconnect{}, false):                  true,
+	getType(&packet.Transfer{}, false):                    true,
+	getType(&packet.AddPlayer{}, false):                   true,
+	getType(&packet.AddActor{}, false):                    true,
+	getType(&packet.RemoveActor{}, false):                 true,
+	getType(&packet.LevelChunk{}, false):                  true,
+	getType(&packet.NetworkChunkPublisherUpdate{}, false): true,
+	getType(&packet.ContainerOpen{}, false):               true,
+	getType(&packet.ContainerClose{}, false):              true,
+	getType(&packet.SetLocalPlayerAsInitialised{}, false): true,
+}
+
+// chaosOutcome decides what happens to a packet with the name passed travelling in the direction passed
+// according to the chaos rules. It returns the amount of times the packet should be sent, which is 0 if the
+// packet should be dropped, and the amount of packets sent later that may overtake it.
+func chaosOutcome(name, direction string) (copies, delay int) {
+	chaosRules.RLock()
+	defer chaosRules.RUnlock()
+	copies = 1
+	for _, r := range chaosRules.rules {
+		if !r.matches(name, direction) {
+			continue
+		}
+		if r.drop > 0 && rand.Float64()*100 < r.drop {
+			return 0, 0
+		}
+		if r.duplicate > 0 && rand.Float64()*100 < r.duplicate {
+			copies = 2
+		}
+		if r.reorder > 0 && chaosReorderWindow > 0 && !reorderUnsafePackets[name] && rand.Float64()*100 < r.reorder {
+			delay = 1 + rand.Intn(chaosReorderWindow)
+		}
+	}
+	return copies, delay
+}
+
+// skewFields holds functions offsetting the tick or timestamp fields of packets by an amount, indexed by the
+// name of the packet. Ticks are offset in ticks, timestamps in the unit used by the packet.
+var skewFields = map[string]func(pk packet.Packet, offset int64){
+	getType(&packet.PlayerAuthInput{}, false): func(pk packet.Packet, offset int64) {
+		skewTick(&pk.(*packet.PlayerAuthInput).Tick, offset)
+	},
+	getType(&packet.MovePlayer{}, false): func(pk packet.Packet, offset int64) {
+		skewTick(&pk.(*packet.MovePlayer).Tick, offset)
+	},
+	getType(&packet.CorrectPlayerMovePrediction{}, false): func(pk packet.Packet, offset int64) {
+		skewTick(&pk.(*packet.CorrectPlayerMovePrediction).Tick, offset)
+	},
+	getType(&packet.SetActorData{}, false): func(pk packet.Packet, offset int64) {
+		skewTick(&pk.(*packet.SetActorData).Tick, offset)
+	},
+	getType(&packet.UpdateAttributes{}, false): func(pk packet.Packet, offset int64) {
+		skewTick(&pk.(*packet.UpdateAttributes).Tick, offset)
+	},
+	getType(&packet.TickSync{}, false): func(pk packet.Packet, offset int64) {
+		tickSync := pk.(*packet.TickSync)
+		if tickSync.ClientRequestTimestamp != 0 {
+			tickSync.ClientRequestTimestamp += offset
+		}
+		if tickSync.ServerReceptionTimestamp != 0 {
+			tickSync.ServerReceptionTimestamp += offset
+		}
+	},
+}
+
+// skewTick offsets the tick passed, clamping it to 0 so that a negative offset never wraps around.
+func skewTick(tick *uint64, offset int64) {
+	if offset < 0 && uint64(-offset) > *tick {
+		*tick = 0
+		return
+	}
+	*tick = uint64(int64(*tick) + offset)
+}
+
+// chaosSkew holds the offsets applied to the tick and timestamp fields of packets, indexed by the name of the
+// packet.
+var chaosSkew = struct {
+	sync.RWMutex
+	offsets map[string]int64
+}{offsets: map[string]int64{}}
+
+// setChaosSkew sets the offset applied to the tick and timestamp fields of packets with the name passed. An
+// offset of 0 disables skewing the packet.
+func setChaosSkew(name string, offset int64) error {
+	if _, ok := skewFields[name]; !ok {
+		return fmt.Errorf("packet %q has no tick or timestamp fields that may be skewed", name)
+	}
+	chaosSkew.Lock()
+	defer chaosSkew.Unlock()
+	if offset == 0 {
+		delete(chaosSkew.offsets, name)
+		return nil
+	}
+	chaosSkew.offsets[name] = offset
+	return nil
+}
+
+// skewPacket returns a copy of the packet passed with its tick and timestamp fields offset if a skew was set for it,
+// or the packet itself if not. The packet passed is never modified, as packet listeners may still be reading it.
+// True is returned if the packet was skewed.
+func skewPacket(name string, pk packet.Packet) (packet.Packet, bool) {
+	chaosSkew.RLock()
+	offset, ok := chaosSkew.offsets[name]
+	chaosSkew.RUnlock()
+	if !ok {
+		return pk, false
+	}
+	// The skewed fields are all fields of the packet struct itself, so a shallow copy is enough.
+	v := reflect.ValueOf(pk)
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	skewed := cp.Interface().(packet.Packet)
+	skewFields[name](skewed, offset)
+	return skewed, true
+}
+
+// addChaosSkews parses a comma separated list of skews in the format packet:offset, such as
+// PlayerAuthInput:20, and applies them.
+func addChaosSkews(list string) error {
+	for _, s := range strings.Split(list, ",") {
+		if s == "" {
+			continue
+		}
+		name, offset, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("invalid skew %q: expected packet:offset", s)
+		}
+		n, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid skew offset %q", offset)
+		}
+		if err := setChaosSkew(name, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addChaosRules parses a comma separated list of chaos rules in the format packet:direction:percentage, such
+// as SubChunk:clientbound:10, and applies the chaos mode passed to them.
+func addChaosRules(mode, list string) error {
+	for _, s := range strings.Split(list, ",") {
+		if s == "" {
+			continue
+		}
+		frag := strings.Split(s, ":")
+		if len(frag) != 3 {
+			return fmt.Errorf("invalid chaos rule %q: expected packet:direction:percentage", s)
+		}
+		if err := setChaosRule(mode, frag[0], frag[1], frag[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setChaosRule sets the percentage of packets with the name passed in a direction that the chaos mode passed
+// is applied to.
+func setChaosRule(mode, packet, direction, percentage string) error {
+	set, ok := chaosModes[mode]
+	if !ok {
+		return fmt.Errorf("unknown chaos mode %q", mode)
+	}
+	packets := []string{packet}
+	if packet != "*" {
+		var err error
+		if packets, err = expandPacketNames(packets); err != nil {
+			return err
+		}
+	}
+	if direction != "serverbound" && direction != "clientbound" && direction != "both" {
+		return fmt.Errorf("invalid direction %q: expected serverbound, clientbound or both", direction)
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(percentage, "%"), 64)
+	if err != nil || p < 0 || p > 100 {
+		return fmt.Errorf("invalid percentage %q", percentage)
+	}
+	for _, name := range packets {
+		updateChaosRule(name, direction, func(r *chaosRule) {
+			set(r, p)
+		})
+	}
+	return nil
+}
+
+func init() {
+	const usage = "Usage: chaos <drop|duplicate|reorder|window|skew|list|clear> [packet direction percentage]"
+	registerCommand("chaos", consoleCommand{
+		usage:       "<drop|duplicate|reorder|window|skew|list|clear> [packet direction percentage]",
+		description: "Manages rules that deliberately drop, duplicate, reorder or skew packets of specific types.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println(usage)
+				return
+			}
+			switch args[0] {
+			case "window":
+				if len(args) != 2 {
+					log.Printf("Reorder window is %d packets.\n", chaosReorderWindow)
+					return
+				}
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n <= 0 {
+					log.Printf("Invalid window %q.\n", args[1])
+					return
+				}
+				chaosRules.Lock()
+				chaosReorderWindow = n
+				chaosRules.Unlock()
+				log.Printf("Set reorder window to %d packets.\n", n)
+			case "skew":
+				if injectionDisabled() {
+					return
+				}
+				if len(args) != 3 {
+					log.Println("Usage: chaos skew <packet> <offset>")
+					return
+				}
+				offset, err := strconv.ParseInt(args[2], 10, 64)
+				if err != nil {
+					log.Printf("Invalid offset %q.\n", args[2])
+					return
+				}
+				if err := setChaosSkew(args[1], offset); err != nil {
+					log.Println(err)
+					return
+				}
+				log.Printf("Set skew of %s to %d.\n", args[1], offset)
+			case "list":
+				chaosRules.RLock()
+				for _, r := range chaosRules.rules {
+					log.Println(r)
+				}
+				chaosRules.RUnlock()
+				chaosSkew.RLock()
+				for name, offset := range chaosSkew.offsets {
+					log.Printf("%s: skew %d\n", name, offset)
+				}
+				chaosSkew.RUnlock()
+			case "clear":
+				chaosRules.Lock()
+				chaosRules.rules = nil
+				chaosRules.Unlock()
+				chaosSkew.Lock()
+				chaosSkew.offsets = map[string]int64{}
+				chaosSkew.Unlock()
+				log.Println("Cleared all chaos rules.")
+			default:
+				if injectionDisabled() {
+					return
+				}
+				if len(args) != 4 {
+					log.Println(usage)
+					return
+				}
+				if err := setChaosRule(args[0], args[1], args[2], args[3]); err != nil {
+					log.Println(err)
+					return
+				}
+				log.Printf("Set chaos rule: %s %s %s %s\n", args[0], args[1], args[2], args[3])
+			}
+		},
+	})
+}
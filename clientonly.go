@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bytes"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientOnly specifies if clients are answered by the proxy itself instead of being proxied to the upstream
+// server. The login phase is completed with the game data cached from an earlier session with the upstream
+// server, and everything the client sends is recorded, so that client behaviour can be studied in isolation.
+var clientOnly bool
+
+// loginCacheDir is the directory that the game data sent by upstream servers during the login phase is cached in,
+// so that clients can be logged in without the server in client-only mode. If empty, game data is not cached.
+var loginCacheDir = "login_cache"
+
+// clientOnlyRadius is the radius in chunks of the empty world sent to clients in client-only mode.
+const clientOnlyRadius = 4
+
+// clientOnlyClients is the amount of clients accepted in client-only mode, used to number their recordings.
+var clientOnlyClients atomic.Int64
+
+// loginCachePath returns the path of the file that the game data of the upstream server passed is cached in.
+func loginCachePath(upstream string) string {
+	name := strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(upstream)
+	return filepath.Join(loginCacheDir, name+".startgame")
+}
+
+// cacheGameData stores the game data of the upstream server passed in the login cache. The data is stored as the
+// payload of the StartGame packet it results in, as game rules and block properties can't be stored as JSON
+// without losing their types.
+func cacheGameData(upstream string, data minecraft.GameData) {
+	if loginCacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(loginCacheDir, 0755); err != nil {
+		log.Printf("Unable to cache the game data of %s: %v\n", upstream, err)
+		return
+	}
+	path := loginCachePath(upstream)
+	if err := os.WriteFile(path+".tmp", encodePacket(startGameFromGameData(data), 0), 0644); err != nil {
+		log.Printf("Unable to cache the game data of %s: %v\n", upstream, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("Unable to cache the game data of %s: %v\n", upstream, err)
+	}
+}
+
+// cachedGameData returns the game data of the upstream server passed from the login cache.
+func cachedGameData(upstream string) (minecraft.GameData, error) {
+	if loginCacheDir == "" {
+		return minecraft.GameData{}, fmt.Errorf("no login cache directory set")
+	}
+	b, err := os.ReadFile(loginCachePath(upstream))
+	if err != nil {
+		return minecraft.GameData{}, err
+	}
+	pk, err := decodePacket(packet.IDStartGame, b, 0)
+	if err != nil {
+		return minecraft.GameData{}, err
+	}
+	return gameDataFromStartGame(pk.(*packet.StartGame)), nil
+}
+
+// defaultGameData returns the game data that clients are logged in with in client-only mode if no game data of
+// the upstream server is cached.
+func defaultGameData() minecraft.GameData {
+	data := minecraft.GameData{
+		WorldName:       "bds-mitm client-only",
+		EntityUniqueID:  1,
+		EntityRuntimeID: 1,
+		PlayerGameMode:  1,
+		WorldGameMode:   1,
+		BaseGameVersion: "*",
+		Time:            6000,
+	}
+	data.PlayerPosition[1] = 1.62
+	return data
+}
+
+// emptyChunkPayload returns the payload of a LevelChunk without sub-chunks, holding only plains biomes.
+func emptyChunkPayload() []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; i < 24; i++ {
+		// A biome storage with a single value: plains.
+		buf.WriteByte(0<<1 | 1)
+		_ = protocol.WriteVarint32(buf, 1)
+	}
+	// No border blocks.
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// sendEmptyWorld sends empty chunks around the position of the player in the game data passed, so that the client
+// finishes spawning without a world.
+func sendEmptyWorld(conn *minecraft.Conn, data minecraft.GameData) {
+	pos := protocol.BlockPos{int32(data.PlayerPosition[0]), int32(data.PlayerPosition[1]), int32(data.PlayerPosition[2])}
+	_ = conn.WritePacket(&packet.NetworkChunkPublisherUpdate{Position: pos, Radius: clientOnlyRadius << 4})
+	chunk := emptyChunkPayload()
+	for x := pos.X()>>4 - clientOnlyRadius; x <= pos.X()>>4+clientOnlyRadius; x++ {
+		for z := pos.Z()>>4 - clientOnlyRadius; z <= pos.Z()>>4+clientOnlyRadius; z++ {
+			_ = conn.WritePacket(&packet.LevelChunk{Position: protocol.ChunkPos{x, z}, RawPayload: chunk})
+		}
+	}
+}
+
+// clientCadence holds the amount of packets of one type sent by a client in client-only mode and the time between
+// them.
+type clientCadence struct {
+	name     string
+	count    int
+	last     time.Time
+	interval time.Duration
+}
+
+// handleClientOnly logs in the client of the connection passed with cached game data and records every packet it
+// sends until it disconnects, without connecting to the upstream server.
+func handleClientOnly(conn *minecraft.Conn, upstream string) error {
+	defer conn.Close()
+	id := clientOnlyClients.Add(1)
+	name := conn.IdentityData().DisplayName
+
+	data, err := cachedGameData(upstream)
+	if err != nil {
+		log.Printf("No cached game data of %s, logging in %s with defaults: %v\n", upstream, name, err)
+		data = defaultGameData()
+	}
+	if err := conn.StartGame(data); err != nil {
+		return fmt.Errorf("start game: %w", err)
+	}
+	start := time.Now()
+	r := &sessionRecording{
+		base: filepath.Join(recordDir, fmt.Sprintf("client-%d-%s", id, start.Format("20060102-150405"))),
+		header: capture.Header{
+			Upstream:         upstream,
+			Protocol:         protocol.CurrentProtocol,
+			MinecraftVersion: protocol.CurrentVersion,
+			DedupMinSize:     uint32(captureDedupMinSize),
+		},
+		shieldID: shieldID(data),
+		manifest: capture.Manifest{Session: uint64(id), Upstream: upstream},
+	}
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		return err
+	}
+	if err := r.openSegment(start); err != nil {
+		return err
+	}
+	log.Printf("Client %d (%s) logged in without upstream, recording to %s\n", id, name, r.path)
+
+	sendEmptyWorld(conn, data)
+
+	cadence := map[uint32]*clientCadence{}
+	for {
+		pk, err := conn.ReadPacket()
+		if err != nil {
+			break
+		}
+		now := time.Now()
+		c, ok := cadence[pk.ID()]
+		if !ok {
+			c = &clientCadence{name: packetName(pk.ID())}
+			cadence[pk.ID()] = c
+		} else {
+			c.interval += now.Sub(c.last)
+		}
+		c.count++
+		c.last = now
+		if !packetRecorded(c.name, false) {
+			continue
+		}
+
+		if recordMaxSize > 0 && r.enc.Written() >= recordMaxSize || recordMaxAge > 0 && now.Sub(r.opened) >= recordMaxAge {
+			if err := r.rotate(now); err != nil {
+				log.Printf("An error occurred whilst splitting the recording of client %d: %v\n", id, err)
+				break
+			}
+		}
+		err = r.enc.Encode(capture.Record{
+			TimeUnixNano: now.UnixNano(),
+			Session:      uint64(id),
+			Direction:    capture.DirectionServerbound,
+			PacketID:     pk.ID(),
+			PacketName:   c.name,
+			Payload:      encodePacket(pk, r.shieldID),
+		})
+		if err != nil {
+			log.Printf("An error occurred whilst writing the recording of client %d: %v\n", id, err)
+			break
+		}
+		r.records++
+		r.track(now)
+	}
+	if err := r.closeSegment(); err != nil {
+		return err
+	}
+	if splitRecordings() {
+		if err := capture.WriteManifest(r.base+capture.ManifestSuffix, r.manifest); err != nil {
+			return err
+		}
+	}
+	log.Printf("Client %d (%s) disconnected after %v: wrote %d packets to %s\n", id, name, time.Since(start).Round(time.Millisecond), r.records, r.path)
+	logClientCadence(id, cadence)
+	return nil
+}
+
+// logClientCadence logs the amount of packets of every type sent by a client and the average time between them.
+func logClientCadence(id int64, cadence map[uint32]*clientCadence) {
+	list := make([]*clientCadence, 0, len(cadence))
+	for _, c := range cadence {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].count > list[j].count
+	})
+	for _, c := range list {
+		if c.count == 1 {
+			log.Printf("Client %d: %s x1\n", id, c.name)
+			continue
+		}
+		avg := c.interval / time.Duration(c.count-1)
+		log.Printf("Client %d: %s x%d, every %v on average\n", id, c.name, c.count, avg.Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"sync"
+	"time"
+)
+
+// clientProbeInterval is the interval at which NetworkStackLatency packets are sent to clients to measure how
+// long they take to process packets, or 0 to disable client probes.
+var clientProbeInterval time.Duration
+
+// clientProbeBase is the first timestamp of probes sent to clients. Probe timestamps are far from those sent by
+// servers so that the responses to probes can be told apart from responses to the server.
+const clientProbeBase = 0x4d49544d0000
+
+// clientProbeTimeout is the time after which a probe that was not answered is counted as lost.
+const clientProbeTimeout = time.Second * 10
+
+// clientHealth holds the results of the probes sent to the client of a session.
+type clientHealth struct {
+	next    int64
+	pending map[int64]time.Time
+	// last, avg and max are the last, exponentially weighted average and highest round trip times of probes.
+	last, avg, max time.Duration
+	answered, lost int
+}
+
+// clientHealths holds the probe results of every session, indexed by session ID.
+var clientHealths = struct {
+	sync.Mutex
+	m map[int64]*clientHealth
+}{m: map[int64]*clientHealth{}}
+
+// enableClientProbes registers the responder handling answers to probes so that they are not forwarded to the
+// server.
+func enableClientProbes() {
+	registerLocalResponder(getType(&packet.NetworkStackLatency{}, false), answerClientProbe)
+	addSessionCloseListener(func(id int64) {
+		clientHealths.Lock()
+		delete(clientHealths.m, id)
+		clientHealths.Unlock()
+	})
+}
+
+// startClientProbe starts sending probes to the client of the session every client probe interval.
+func (s *session) startClientProbe() {
+	clientHealths.Lock()
+	clientHealths.m[s.id] = &clientHealth{next: clientProbeBase, pending: map[int64]time.Time{}}
+	clientHealths.Unlock()
+	s.every("client probe", clientProbeInterval, func(s *session) {
+		clientHealths.Lock()
+		h, ok := clientHealths.m[s.id]
+		if !ok {
+			clientHealths.Unlock()
+			return
+		}
+		now := time.Now()
+		for ts, sent := range h.pending {
+			if now.Sub(sent) > clientProbeTimeout {
+				delete(h.pending, ts)
+				h.lost++
+			}
+		}
+		h.next++
+		h.pending[h.next] = now
+		ts := h.next
+		clientHealths.Unlock()
+		_ = s.sendToClient(&packet.NetworkStackLatency{Timestamp: ts, NeedsResponse: true})
+	})
+}
+
+// answerClientProbe records the round trip time of a probe answered by the client. Answers to packets sent by
+// the server are forwarded to it.
+func answerClientProbe(s *session, pk packet.Packet) ([]packet.Packet, bool) {
+	latency, ok := pk.(*packet.NetworkStackLatency)
+	if !ok {
+		return nil, false
+	}
+	clientHealths.Lock()
+	defer clientHealths.Unlock()
+	h, ok := clientHealths.m[s.id]
+	if !ok {
+		return nil, false
+	}
+	ts := latency.Timestamp
+	if _, pending := h.pending[ts]; !pending && ts%1000 == 0 {
+		// Some clients answer with the timestamp multiplied by 1000.
+		ts /= 1000
+	}
+	sent, pending := h.pending[ts]
+	if !pending {
+		return nil, false
+	}
+	delete(h.pending, ts)
+	h.last = time.Since(sent)
+	if h.answered == 0 {
+		h.avg = h.last
+	} else {
+		h.avg = (h.avg*7 + h.last) / 8
+	}
+	if h.last > h.max {
+		h.max = h.last
+	}
+	h.answered++
+	return nil, true
+}
+
+func init() {
+	registerCommand("health", consoleCommand{
+		description: "Compares the time clients take to answer probes with network and server latency.",
+		run: func([]string) {
+			if clientProbeInterval == 0 {
+				log.Println("Client probes are disabled, enable them using -client-probe.")
+				return
+			}
+			for _, s := range activeSessions() {
+				clientHealths.Lock()
+				h, ok := clientHealths.m[s.id]
+				var last, avg, max time.Duration
+				var answered, lost int
+				if ok {
+					last, avg, max, answered, lost = h.last, h.avg, h.max, h.answered, h.lost
+				}
+				clientHealths.Unlock()
+				if !ok || answered == 0 {
+					log.Printf("#%d: no probes answered yet\n", s.id)
+					continue
+				}
+				// The round trip of a probe includes the network and the time the client takes to process it, so
+				// the difference with the RakNet latency is spent by the client.
+				network := s.client.Latency() * 2
+				client := avg - network
+				if client < 0 {
+					client = 0
+				}
+				log.Printf("#%d: probe %v (last %v, max %v, %d lost), network %v, client processing %v, server latency %v\n",
+					s.id, avg.Round(time.Millisecond), last.Round(time.Millisecond), max.Round(time.Millisecond), lost,
+					network.Round(time.Millisecond), client.Round(time.Millisecond), s.server.Latency().Round(time.Millisecond))
+			}
+		},
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// consoleColor specifies if lines written to the console are coloured using ANSI escape codes. It is disabled
+// using -no-color or by setting the NO_COLOR environment variable.
+var consoleColor = os.Getenv("NO_COLOR") == ""
+
+// ansiColors holds the ANSI escape codes of the colours that may be used for packet categories, indexed by name.
+var ansiColors = map[string]string{
+	"red": "31", "green": "32", "yellow": "33", "blue": "34", "magenta": "35", "cyan": "36", "white": "37",
+	"gray": "90", "bright-red": "91", "bright-green": "92", "bright-yellow": "93", "bright-blue": "94",
+	"bright-magenta": "95", "bright-cyan": "96", "bright-white": "97",
+}
+
+const (
+	// serverboundColor is the colour of the time of lines describing packets sent by the client.
+	serverboundColor = "34"
+	// clientboundColor is the colour of the time of lines describing packets sent by the server.
+	clientboundColor = "35"
+	// errorColor is the colour of lines reporting errors.
+	errorColor = "31"
+)
+
+// categoryColors holds the colours of the packet categories, which are the packet groups, used for lines
+// describing packets in them. It may be extended or overridden using -colors.
+var categoryColors = map[string]string{
+	"movement":  "cyan",
+	"inventory": "yellow",
+	"world":     "green",
+	"chunks":    "green",
+	"chat":      "bright-cyan",
+	"entities":  "bright-blue",
+	"sounds":    "gray",
+}
+
+// packetColors holds the ANSI escape codes of the colours of packets, indexed by their name. It is built from
+// the category colours the first time it is used.
+var packetColors struct {
+	sync.Once
+	m map[string]string
+}
+
+// errorLines matches lines logged without fields that report errors.
+var errorLines = regexp.MustCompile(`(?i)\b(error|unable|failed|panic)`)
+
+// parseColors parses a comma separated list of category colours, such as movement=cyan,Text=red, which may refer
+// to packet groups, with or without @, packets and wildcard patterns.
+func parseColors(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, color, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid colour %q: expected category=colour", entry)
+		}
+		if _, ok := ansiColors[color]; !ok {
+			return fmt.Errorf("unknown colour %q", color)
+		}
+		name = strings.TrimPrefix(name, "@")
+		if _, ok := packetGroups[name]; !ok {
+			if _, err := expandPacketNames([]string{name}); err != nil {
+				return err
+			}
+		}
+		categoryColors[name] = color
+	}
+	return nil
+}
+
+// packetColor returns the ANSI escape code of the colour of the packet with the name passed, or an empty string
+// if it has no colour.
+func packetColor(name string) string {
+	packetColors.Do(func() {
+		packetColors.m = map[string]string{}
+		categories := make([]string, 0, len(categoryColors))
+		for category := range categoryColors {
+			categories = append(categories, category)
+		}
+		// Packet groups are applied before packets and patterns, so that colours of single packets take precedence.
+		sort.Slice(categories, func(i, j int) bool {
+			_, groupI := packetGroups[categories[i]]
+			_, groupJ := packetGroups[categories[j]]
+			if groupI != groupJ {
+				return groupI
+			}
+			return categories[i] < categories[j]
+		})
+		for _, category := range categories {
+			ref := category
+			if _, ok := packetGroups[category]; ok {
+				ref = "@" + category
+			}
+			names, _ := expandPacketNames([]string{ref})
+			for _, name := range names {
+				packetColors.m[name] = ansiColors[categoryColors[category]]
+			}
+		}
+	})
+	return packetColors.m[name]
+}
+
+// colorize wraps the text passed in the ANSI escape codes of the colour passed.
+func colorize(text, color string) string {
+	if color == "" {
+		return text
+	}
+	return "\x1b[" + color + "m" + text + "\x1b[0m"
+}
+
+// consoleLine formats a log entry as a line written to the console, colouring it if console colours are enabled.
+// The time of lines describing packets is coloured by their direction and the message by their category.
+func consoleLine(e logEntry) string {
+	t := e.time.Format("2006/01/02 15:04:05")
+	if !consoleColor {
+		return t + " " + e.message + "\n"
+	}
+	name, ok := e.fields["packet"]
+	if !ok {
+		if errorLines.MatchString(e.message) {
+			return colorize(t+" "+e.message, errorColor) + "\n"
+		}
+		return t + " " + e.message + "\n"
+	}
+	switch e.fields["direction"] {
+	case "client", "serverbound":
+		t = colorize(t, serverboundColor)
+	case "server", "clientbound":
+		t = colorize(t, clientboundColor)
+	}
+	return t + " " + colorize(e.message, packetColor(name)) + "\n"
+}
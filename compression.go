@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// clientCompression is the compression used for packets sent to and received from clients connecting to the proxy:
+// flate, snappy or none. With none, batches are still framed as flate so that clients accept them, but they are
+// stored without being compressed, which saves CPU on the proxy when clients are on localhost or the LAN.
+var clientCompression = "flate"
+
+// parseClientCompression returns the compression with the name passed, measuring the time spent on it.
+func parseClientCompression(name string) (*measuredCompression, error) {
+	c := &measuredCompression{name: name}
+	switch name {
+	case "flate":
+		c.Compression = packet.FlateCompression{}
+	case "snappy":
+		c.Compression = packet.SnappyCompression{}
+	case "none":
+		c.Compression = storedCompression{}
+	default:
+		return nil, fmt.Errorf("invalid compression %q: expected flate, snappy or none", name)
+	}
+	return c, nil
+}
+
+// storedCompression writes batches as flate streams of stored blocks, which clients decode as flate but which
+// take almost no time to produce.
+type storedCompression struct {
+	packet.FlateCompression
+}
+
+// Compress ...
+func (storedCompression) Compress(decompressed []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(decompressed)+len(decompressed)/65535*5+16))
+	w, _ := flate.NewWriter(buf, flate.NoCompression)
+	if _, err := w.Write(decompressed); err != nil {
+		return nil, fmt.Errorf("store flate: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("store flate: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// compressionStats holds the amount of bytes before and after compression and the time spent on it in one
+// direction.
+type compressionStats struct {
+	batches, raw, wire, nanos atomic.Int64
+}
+
+// record records a batch of raw bytes, which was wire bytes when sent, that took the time since start to process.
+func (stats *compressionStats) record(raw, wire int, start time.Time) {
+	stats.batches.Add(1)
+	stats.raw.Add(int64(raw))
+	stats.wire.Add(int64(wire))
+	stats.nanos.Add(int64(time.Since(start)))
+}
+
+// String ...
+func (stats *compressionStats) String() string {
+	raw, wire, batches := stats.raw.Load(), stats.wire.Load(), stats.batches.Load()
+	ratio := 0.0
+	if raw > 0 {
+		ratio = float64(wire) * 100 / float64(raw)
+	}
+	perBatch := time.Duration(0)
+	if batches > 0 {
+		perBatch = time.Duration(stats.nanos.Load() / batches)
+	}
+	return fmt.Sprintf("%d batches, %s raw, %s on the wire (%.1f%%), %v CPU (%v per batch)", batches, formatBytes(raw),
+		formatBytes(wire), ratio, time.Duration(stats.nanos.Load()).Round(time.Microsecond), perBatch)
+}
+
+// measuredCompression is a compression that records the bytes it processes and the time it takes.
+type measuredCompression struct {
+	packet.Compression
+	name string
+	// sent holds the statistics of batches compressed for clients, received those of batches decompressed from
+	// clients.
+	sent, received compressionStats
+}
+
+// activeCompression is the compression used by the listener of the proxy.
+var activeCompression *measuredCompression
+
+// Compress ...
+func (c *measuredCompression) Compress(decompressed []byte) ([]byte, error) {
+	start := time.Now()
+	data, err := c.Compression.Compress(decompressed)
+	c.sent.record(len(decompressed), len(data), start)
+	return data, err
+}
+
+// Decompress ...
+func (c *measuredCompression) Decompress(compressed []byte) ([]byte, error) {
+	start := time.Now()
+	data, err := c.Compression.Decompress(compressed)
+	c.received.record(len(data), len(compressed), start)
+	return data, err
+}
+
+// formatBytes formats an amount of bytes using the largest fitting binary unit.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// logCompressionStats logs the statistics of the compression used toward clients.
+func logCompressionStats() {
+	if activeCompression == nil {
+		return
+	}
+	log.Printf("Client compression %s, sent: %s\n", activeCompression.name, &activeCompression.sent)
+	log.Printf("Client compression %s, received: %s\n", activeCompression.name, &activeCompression.received)
+}
+
+func init() {
+	registerCommand("compression", consoleCommand{
+		description: "Shows the bytes saved by compressing packets for clients and the CPU time spent on it.",
+		run: func([]string) {
+			logCompressionStats()
+		},
+	})
+}
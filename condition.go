@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// packetConditions holds the conditions packets must match to be logged, indexed by the name of the packet. If a
+// packet has a condition, it is logged if and only if it matches, regardless of filters.
+var packetConditions = struct {
+	sync.RWMutex
+	m map[string]conditionEntry
+}{m: map[string]conditionEntry{}}
+
+// conditionEntry is a condition together with the expression it was parsed from.
+type conditionEntry struct {
+	source string
+	cond   condition
+}
+
+// condition is a boolean expression evaluated against the fields of a packet.
+type condition interface {
+	eval(v reflect.Value) bool
+}
+
+// addConditions parses a list of expressions separated by semicolons, in the format
+// Packet where condition, such as Text where Message contains "teleport", and adds them to the state.
+func (st *logFilterState) addConditions(list string) error {
+	for _, expr := range strings.Split(list, ";") {
+		if expr = strings.TrimSpace(expr); expr == "" {
+			continue
+		}
+		if err := st.addCondition(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCondition parses an expression in the format Packet where condition and adds it, replacing the conditions
+// previously set for the packets it refers to. The packet may also be a wildcard pattern or @group. Conditions
+// compare fields, which may be nested using dots, to literals using ==, !=, <, <=, >, >=, contains, startswith
+// and matches, which takes a regular expression, and may be combined using and, or, not and parentheses. If a
+// field is held by slices, the comparison matches if it matches any element.
+func addCondition(expr string) error {
+	packetConditions.Lock()
+	defer packetConditions.Unlock()
+	return applyCondition(packetConditions.m, expr)
+}
+
+// addCondition parses an expression in the format Packet where condition and adds it to the state.
+func (st *logFilterState) addCondition(expr string) error {
+	return applyCondition(st.conditions, expr)
+}
+
+// applyCondition parses an expression in the format Packet where condition and sets it in the map passed for the
+// packets it refers to.
+func applyCondition(m map[string]conditionEntry, expr string) error {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return fmt.Errorf("condition %q: %w", expr, err)
+	}
+	if len(tokens) < 3 || !strings.EqualFold(tokens[1].text, "where") {
+		return fmt.Errorf("condition %q: expected Packet where condition", expr)
+	}
+	names, err := expandPacketNames([]string{tokens[0].text})
+	if err != nil {
+		return fmt.Errorf("condition %q: %w", expr, err)
+	}
+	p := &conditionParser{tokens: tokens[2:]}
+	cond, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return fmt.Errorf("condition %q: %w", expr, err)
+	}
+	for _, name := range names {
+		m[name] = conditionEntry{source: expr, cond: cond}
+	}
+	return nil
+}
+
+// packetConditionMatches checks if the packet passed matches the condition set for it. False is returned as
+// second value if no condition is set for the packet.
+func packetConditionMatches(name string, pk packet.Packet) (matched, ok bool) {
+	packetConditions.RLock()
+	entry, ok := packetConditions.m[name]
+	packetConditions.RUnlock()
+	if !ok {
+		return false, false
+	}
+	return entry.cond.eval(reflect.ValueOf(pk)), true
+}
+
+// conditionToken is a token of a condition expression. str is set for string literals.
+type conditionToken struct {
+	text string
+	str  bool
+}
+
+// tokenizeCondition splits a condition expression into tokens.
+func tokenizeCondition(expr string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %w", expr[i:j+1], err)
+			}
+			tokens = append(tokens, conditionToken{text: s, str: true})
+			i = j + 1
+		case c == '(' || c == ')':
+			tokens = append(tokens, conditionToken{text: string(c)})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			j := i + 1
+			if j < len(expr) && expr[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, conditionToken{text: expr[i:j]})
+			i = j
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t\"()=!<>", rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, conditionToken{text: expr[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// conditionParser is a recursive descent parser of condition expressions.
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+// peek returns the text of the next token in lower case, or an empty string if there are no tokens left.
+func (p *conditionParser) peek() string {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].str {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos].text)
+}
+
+// parseOr parses conditions combined using or.
+func (p *conditionParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "or" {
+		p.pos++
+		var right condition
+		if right, err = p.parseAnd(); err == nil {
+			left = orCondition{left, right}
+		}
+	}
+	return left, err
+}
+
+// parseAnd parses conditions combined using and.
+func (p *conditionParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek() == "and" {
+		p.pos++
+		var right condition
+		if right, err = p.parseUnary(); err == nil {
+			left = andCondition{left, right}
+		}
+	}
+	return left, err
+}
+
+// parseUnary parses a negated condition, a condition in parentheses or a comparison.
+func (p *conditionParser) parseUnary() (condition, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		c, err := p.parseUnary()
+		return notCondition{c}, err
+	case "(":
+		p.pos++
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("expected )")
+		}
+		p.pos++
+		return c, nil
+	}
+	if p.pos+3 > len(p.tokens) {
+		return nil, fmt.Errorf("expected field, operator and value")
+	}
+	field, op, value := p.tokens[p.pos], strings.ToLower(p.tokens[p.pos+1].text), p.tokens[p.pos+2]
+	p.pos += 3
+	if field.str || !unicode.IsUpper(rune(field.text[0])) {
+		return nil, fmt.Errorf("invalid field %q", field.text)
+	}
+	c := comparison{path: strings.Split(field.text, "."), op: op, value: value.text, str: value.str}
+	switch op {
+	case "==", "!=", "contains", "startswith":
+	case "<", "<=", ">", ">=":
+		n, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s requires a number, got %q", op, value.text)
+		}
+		c.number = n
+	case "matches":
+		re, err := regexp.Compile(value.text)
+		if err != nil {
+			return nil, err
+		}
+		c.re = re
+	default:
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+	return c, nil
+}
+
+// andCondition matches if both of its conditions match.
+type andCondition [2]condition
+
+// eval ...
+func (c andCondition) eval(v reflect.Value) bool {
+	return c[0].eval(v) && c[1].eval(v)
+}
+
+// orCondition matches if either of its conditions match.
+type orCondition [2]condition
+
+// eval ...
+func (c orCondition) eval(v reflect.Value) bool {
+	return c[0].eval(v) || c[1].eval(v)
+}
+
+// notCondition matches if its condition does not match.
+type notCondition struct {
+	c condition
+}
+
+// eval ...
+func (c notCondition) eval(v reflect.Value) bool {
+	return !c.c.eval(v)
+}
+
+// comparison compares a field of a packet with a literal.
+type comparison struct {
+	path   []string
+	op     string
+	value  string
+	str    bool
+	number float64
+	re     *regexp.Regexp
+}
+
+// eval ...
+func (c comparison) eval(v reflect.Value) bool {
+	for _, field := range conditionFields(v, c.path) {
+		if c.compare(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare compares a single value of the field of the comparison with its literal.
+func (c comparison) compare(v reflect.Value) bool {
+	var number float64
+	isNumber := true
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		number = v.Float()
+	default:
+		isNumber = false
+	}
+	var s string
+	if v.Kind() == reflect.String {
+		s = v.String()
+	} else {
+		s = fmt.Sprint(v)
+	}
+	switch c.op {
+	case "==", "!=":
+		equal := s == c.value
+		if n, err := strconv.ParseFloat(c.value, 64); err == nil && isNumber && !c.str {
+			equal = number == n
+		}
+		return equal == (c.op == "==")
+	case "<":
+		return isNumber && number < c.number
+	case "<=":
+		return isNumber && number <= c.number
+	case ">":
+		return isNumber && number > c.number
+	case ">=":
+		return isNumber && number >= c.number
+	case "contains":
+		return strings.Contains(strings.ToLower(s), strings.ToLower(c.value))
+	case "startswith":
+		return strings.HasPrefix(s, c.value)
+	case "matches":
+		return c.re.MatchString(s)
+	}
+	return false
+}
+
+// conditionFields returns the values of the field at the path passed in v. Multiple values are returned if the
+// path passes through slices, and none if the field does not exist.
+func conditionFields(v reflect.Value, path []string) []reflect.Value {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if len(path) == 0 {
+		return []reflect.Value{v}
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		field := v.FieldByName(path[0])
+		if !field.IsValid() {
+			return nil
+		}
+		return conditionFields(field, path[1:])
+	case reflect.Slice, reflect.Array:
+		var values []reflect.Value
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, conditionFields(v.Index(i), path)...)
+		}
+		return values
+	}
+	return nil
+}
+
+func init() {
+	const usage = "Usage: where [<Packet> where <condition>|clear [packet]]"
+	registerCommand("where", consoleCommand{
+		usage:       "[<Packet> where <condition>|clear [packet]]",
+		description: "Only logs packets matching a condition, such as Text where Message contains \"teleport\".",
+		run: func(args []string) {
+			if len(args) == 0 {
+				packetConditions.RLock()
+				names := make([]string, 0, len(packetConditions.m))
+				for name := range packetConditions.m {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					log.Printf("%-32s %s\n", name, packetConditions.m[name].source)
+				}
+				packetConditions.RUnlock()
+				if len(names) == 0 {
+					log.Println("No conditions are set.")
+				}
+				return
+			}
+			if args[0] == "clear" {
+				packetConditions.Lock()
+				if len(args) > 1 {
+					delete(packetConditions.m, args[1])
+				} else {
+					packetConditions.m = map[string]conditionEntry{}
+				}
+				packetConditions.Unlock()
+				log.Println("Cleared conditions.")
+				return
+			}
+			if err := addCondition(strings.Join(args, " ")); err != nil {
+				log.Println(err)
+				log.Println(usage)
+			}
+		},
+	})
+}
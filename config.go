@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configFiles are the config files that are looked for if no config file is passed with -config, in order of
+// preference.
+var configFiles = []string{"config.toml", "config.yaml", "config.yml"}
+
+// configListSeparators holds the separators that lists in the config file are joined with for flags that don't
+// take comma separated lists.
+var configListSeparators = map[string]string{
+	"where": ";",
+}
+
+// envPrefix is the prefix of environment variables setting flags, such as BDSMITM_LOG_FILE for -log-file.
+const envPrefix = "BDSMITM_"
+
+// applyEnv sets flags from environment variables named after them, such as BDSMITM_HOST for -host and
+// BDSMITM_LOG_FILE for -log-file, so that the proxy can be configured in containers without arguments.
+// BDSMITM_UPSTREAM sets both -host and -port from a host:port address. Flags passed on the command line take
+// precedence over environment variables, which take precedence over the config file.
+func applyEnv() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if upstream, ok := os.LookupEnv(envPrefix + "UPSTREAM"); ok {
+		host, port, err := net.SplitHostPort(upstream)
+		if err != nil {
+			return fmt.Errorf("%sUPSTREAM: %w", envPrefix, err)
+		}
+		for name, value := range map[string]string{"host": host, "port": port} {
+			if set[name] {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%sUPSTREAM: %w", envPrefix, err)
+			}
+		}
+	}
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	})
+	return err
+}
+
+// findConfig returns the first of the default config files that exists, or config.toml if none of them exist.
+func findConfig() string {
+	for _, path := range configFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return configFiles[0]
+}
+
+// readConfig reads the options in the TOML or YAML config file at the path passed, depending on its extension.
+func readConfig(path string) (map[string]any, error) {
+	options := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &options); err != nil {
+			return nil, err
+		}
+	default:
+		if _, err := toml.DecodeFile(path, &options); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+// flattenConfig adds the options in the map passed to the flat map of options passed. Options in tables or
+// sections are prefixed by the name of the table, so that file in a log table sets the log-file flag.
+func flattenConfig(prefix string, options, flat map[string]any) {
+	for name, value := range options {
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		if table, ok := value.(map[string]any); ok {
+			flattenConfig(name, table, flat)
+			continue
+		}
+		flat[name] = value
+	}
+}
+
+// configValue formats a value of the config file as flag value. Lists are joined with commas.
+func configValue(name string, value any) string {
+	list, ok := value.([]any)
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	sep, ok := configListSeparators[name]
+	if !ok {
+		sep = ","
+	}
+	values := make([]string, len(list))
+	for i, v := range list {
+		values[i] = fmt.Sprint(v)
+	}
+	return strings.Join(values, sep)
+}
+
+// applyConfig sets the flags listed in the TOML or YAML config file at the path passed, such as host = "127.0.0.1".
+// Options may be grouped in tables named after the prefix of the flags, such as a log table holding file and
+// format, and lists may be used for flags taking comma separated lists. Flags passed on the command line take
+// precedence over the config file. No error is returned if the file does not exist.
+func applyConfig(path string) error {
+	options, err := readConfig(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read config %s: %w", path, err)
+	}
+	flat := map[string]any{}
+	flattenConfig("", options, flat)
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	names := make([]string, 0, len(flat))
+	for name := range flat {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("config %s: unknown option %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, configValue(name, flat[name])); err != nil {
+			return fmt.Errorf("config %s: option %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// writeConfig writes the options passed, indexed by their flag name, to a TOML or YAML config file at the path
+// passed, depending on its extension.
+func writeConfig(path string, options map[string]any) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		enc := yaml.NewEncoder(f)
+		if err = enc.Encode(options); err == nil {
+			err = enc.Close()
+		}
+	default:
+		err = toml.NewEncoder(f).Encode(options)
+	}
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
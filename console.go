@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// consoleCommand represents a command that may be typed into the console while the proxy is running.
+type consoleCommand struct {
+	// usage is a short description of the arguments the command accepts.
+	usage string
+	// description explains what the command does. It is shown when running the help command.
+	description string
+	// run executes the command with the arguments passed after the command name.
+	run func(args []string)
+}
+
+// consoleCommands holds all commands that may be executed from the console, indexed by their name.
+var consoleCommands = map[string]consoleCommand{}
+
+// registerCommand registers a console command under the name passed.
+func registerCommand(name string, cmd consoleCommand) {
+	consoleCommands[name] = cmd
+}
+
+func init() {
+	registerCommand("help", consoleCommand{
+		description: "Lists all available console commands.",
+		run: func([]string) {
+			names := make([]string, 0, len(consoleCommands))
+			for name := range consoleCommands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				cmd := consoleCommands[name]
+				log.Printf("%s %s - %s\n", name, cmd.usage, cmd.description)
+			}
+		},
+	})
+	registerCommand("history", consoleCommand{
+		usage:       "[count]",
+		description: "Shows the most recently executed console commands.",
+		run: func(args []string) {
+			count := 20
+			if len(args) > 0 {
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					log.Printf("Invalid count %q.\n", args[0])
+					return
+				}
+				count = n
+			}
+			history.Lock()
+			defer history.Unlock()
+			start := len(history.lines) - count
+			if start < 0 {
+				start = 0
+			}
+			for i := start; i < len(history.lines); i++ {
+				log.Printf("%5d  %s\n", i+1, history.lines[i])
+			}
+		},
+	})
+	registerCommand("source", consoleCommand{
+		usage:       "<file>",
+		description: "Executes all console commands listed in a file.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println("Usage: source <file>")
+				return
+			}
+			if err := runScript(args[0]); err != nil {
+				log.Printf("An error occurred whilst running script: %v\n", err)
+			}
+		},
+	})
+}
+
+// history holds the console commands executed, including those executed in previous runs of the proxy.
+var history struct {
+	sync.Mutex
+	path  string
+	lines []string
+}
+
+// loadHistory loads the console history from the file at the path passed. Commands executed from the console
+// afterwards are appended to the same file.
+func loadHistory(path string) {
+	history.Lock()
+	defer history.Unlock()
+	history.path = path
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		history.lines = append(history.lines, scanner.Text())
+	}
+}
+
+// appendHistory adds a line to the console history and persists it to the history file.
+func appendHistory(line string) {
+	history.Lock()
+	defer history.Unlock()
+	history.lines = append(history.lines, line)
+	if history.path == "" {
+		return
+	}
+	f, err := os.OpenFile(history.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Unable to write console history: %v\n", err)
+		return
+	}
+	_, _ = fmt.Fprintln(f, line)
+	_ = f.Close()
+}
+
+// runScript executes the console commands in the file at the path passed, one command per line. Empty lines
+// and lines starting with # are ignored.
+func runScript(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		log.Printf("> %s\n", line)
+		executeCommand(line)
+	}
+	return scanner.Err()
+}
+
+// readConsole reads commands from stdin line by line and executes them until stdin is closed.
+func readConsole() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		appendHistory(line)
+		executeCommand(line)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println(err)
+	}
+}
+
+// executeCommand parses a line of console input and executes the command it refers to.
+func executeCommand(line string) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+	cmd, ok := consoleCommands[strings.ToLower(args[0])]
+	if !ok {
+		log.Printf("Unknown command %q. Type 'help' for a list of commands.\n", args[0])
+		return
+	}
+	cmd.run(args[1:])
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// captureDedupMinSize is the minimum size of payloads that are deduplicated in captures written by the proxy,
+// or 0 to not deduplicate payloads. Identical large payloads, such as chunks and resource pack chunks sent to
+// every client, are then stored once and referred to by their hash.
+var captureDedupMinSize = 0
+
+func init() {
+	registerSubcommand("dedup", "Rewrites a capture file storing identical large payloads only once", runDedup)
+}
+
+// runDedup runs the dedup subcommand, which rewrites a capture file with payloads of at least the minimum size
+// deduplicated, or with deduplication undone if the minimum size is 0.
+func runDedup(args []string) error {
+	fs := flag.NewFlagSet("dedup", flag.ExitOnError)
+	out := fs.String("o", "", "Output file (defaults to <input>.dedup)")
+	minSize := fs.Int("min-size", 256, "Minimum size of payloads that are deduplicated, or 0 to undo deduplication")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *minSize < 0 {
+		return errors.New("usage: dedup [-o output] [-min-size bytes] <capture>")
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		*out = in + ".dedup"
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dec, err := capture.NewDecoder(src)
+	if err != nil {
+		return err
+	}
+	h := dec.Header()
+	h.DedupMinSize = uint32(*minSize)
+
+	dst, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	enc, err := capture.NewEncoder(dst, h)
+	if err != nil {
+		return err
+	}
+	var records int
+	for {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", records, err)
+		}
+		capture.Migrate(dec.Header(), &r)
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		records++
+	}
+	before, _ := src.Stat()
+	after, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote %d records to %s: %d bytes of duplicate payloads omitted, %d bytes before and %d bytes after\n", records, *out, enc.Saved(), before.Size(), after.Size())
+	return nil
+}
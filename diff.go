@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerSubcommand("diff", "Compares the packets of two captures, aligned by type and order, and reports where they diverge", runDiff)
+}
+
+// diffDefaultIgnores are the fields ignored by the diff subcommand by default, as they differ between any two
+// sessions without indicating a difference in behaviour.
+const diffDefaultIgnores = "Timestamp,Tick,ClientTick,Time,EntityRuntimeID,EntityUniqueID,MultiPlayerCorrelationID,WorldSeed"
+
+// diffMaxValue is the maximum length of a value printed in a divergence, after which it is truncated.
+const diffMaxValue = 80
+
+// diffPacket is a packet of a capture compared by the diff subcommand.
+type diffPacket struct {
+	index int
+	key   string
+	// fields holds the packet as generic JSON values, or nil if the payload could not be decoded, in which case the
+	// payload is compared byte by byte.
+	fields  any
+	payload []byte
+}
+
+// diffIgnores holds the fields ignored when comparing packets. Fields are referred to by their name, which
+// ignores them at any depth, or by the name of the packet and the dotted path of the field, such as
+// MovePlayer.Position.
+type diffIgnores map[string]bool
+
+// ignored checks if the field at the dotted path passed of the packet with the name passed is ignored.
+func (ignores diffIgnores) ignored(packetName, path string) bool {
+	name := path
+	if i := strings.LastIndexByte(path, '.'); i != -1 {
+		name = path[i+1:]
+	}
+	if i := strings.IndexByte(name, '['); i != -1 {
+		name = name[:i]
+	}
+	return ignores[name] || ignores[packetName+"."+stripIndices(path)]
+}
+
+// stripIndices removes the slice indices from the dotted path passed, such as turning Items[3].Name into
+// Items.Name.
+func stripIndices(path string) string {
+	var b strings.Builder
+	depth := 0
+	for _, c := range path {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// readDiffPackets reads the packets of a session of the capture at the path passed, or of its first session if
+// the session passed is 0. Only the packets with the names passed are read if any are passed.
+func readDiffPackets(path string, session uint64, packets map[string]bool, shieldID int32) ([]diffPacket, error) {
+	files, err := capture.Files(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []diffPacket
+	var index int
+	for _, file := range files {
+		err := forEachRecord(file, func(r capture.Record) error {
+			if session == 0 {
+				session = r.Session
+			}
+			if r.Session != session || r.IsAnnotation() {
+				return nil
+			}
+			index++
+			if len(packets) > 0 && !packets[r.PacketName] {
+				return nil
+			}
+			p := diffPacket{index: index, key: "serverbound/" + r.PacketName, payload: r.Payload}
+			if r.Direction == capture.DirectionClientbound {
+				p.key = "clientbound/" + r.PacketName
+			}
+			if pk, err := decodePacket(r.PacketID, r.Payload, shieldID); err == nil {
+				if b, err := json.Marshal(pk); err == nil {
+					_ = json.Unmarshal(b, &p.fields)
+				}
+			}
+			list = append(list, p)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return list, nil
+}
+
+// diffValues compares two generic JSON values and calls f with the dotted path of every field that differs and
+// its value on either side. Fields ignored are skipped.
+func diffValues(packetName, path string, a, b any, ignores diffIgnores, f func(path string, a, b any)) {
+	if path != "" && ignores.ignored(packetName, path) {
+		return
+	}
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a))
+		for key := range a {
+			keys = append(keys, key)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffValues(packetName, join(key), a[key], b[key], ignores, f)
+		}
+		return
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			break
+		}
+		if len(a) != len(b) {
+			f(path+".len", len(a), len(b))
+		}
+		for i := 0; i < len(a) && i < len(b); i++ {
+			diffValues(packetName, path+"["+strconv.Itoa(i)+"]", a[i], b[i], ignores, f)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		f(path, a, b)
+	}
+}
+
+// formatDiffValue formats a generic JSON value for a divergence, truncating it if it is long.
+func formatDiffValue(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(b) > diffMaxValue {
+		return string(b[:diffMaxValue]) + "..."
+	}
+	return string(b)
+}
+
+// runDiff runs the diff subcommand, which compares the packets of a session of two captures, such as captures of
+// the same actions on two versions of a server. The n-th packet of a type and direction in one capture is compared
+// with the n-th packet of the same type and direction in the other, so that packets of other types sent in
+// between don't shift the comparison.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	sessionA := fs.Uint64("session-a", 0, "Session of the first capture to compare, or 0 for its first session")
+	sessionB := fs.Uint64("session-b", 0, "Session of the second capture to compare, or 0 for its first session")
+	packets := fs.String("packets", "", "Comma separated packets or @groups to compare, all packets by default")
+	ignore := fs.String("ignore", diffDefaultIgnores, "Comma separated fields to ignore, by name at any depth or as Packet.Field.Path")
+	limit := fs.Int("max", 50, "Maximum amount of divergent packets to report, or 0 for all")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: diff [-session-a id] [-session-b id] [-packets list] [-ignore fields] [-max 50] [-shield-id id] <capture|manifest> <capture|manifest>")
+	}
+	selected := map[string]bool{}
+	if *packets != "" {
+		names, err := expandPacketNames(strings.Split(*packets, ","))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			selected[name] = true
+		}
+	}
+	ignores := diffIgnores{}
+	for _, field := range strings.Split(*ignore, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignores[field] = true
+		}
+	}
+	a, err := readDiffPackets(fs.Arg(0), *sessionA, selected, int32(*shieldID))
+	if err != nil {
+		return err
+	}
+	b, err := readDiffPackets(fs.Arg(1), *sessionB, selected, int32(*shieldID))
+	if err != nil {
+		return err
+	}
+
+	byKey := map[string][]diffPacket{}
+	for _, p := range b {
+		byKey[p.key] = append(byKey[p.key], p)
+	}
+	counts := map[string][2]int{}
+	var aligned, divergent int
+	for _, p := range a {
+		c := counts[p.key]
+		c[0]++
+		counts[p.key] = c
+		others := byKey[p.key]
+		if c[0] > len(others) {
+			continue
+		}
+		other := others[c[0]-1]
+		aligned++
+		name := p.key[strings.IndexByte(p.key, '/')+1:]
+		var lines []string
+		if p.fields == nil || other.fields == nil {
+			if !bytes.Equal(p.payload, other.payload) {
+				lines = append(lines, fmt.Sprintf("payload: %d bytes != %d bytes", len(p.payload), len(other.payload)))
+			}
+		} else {
+			diffValues(name, "", p.fields, other.fields, ignores, func(path string, x, y any) {
+				lines = append(lines, fmt.Sprintf("%s: %s != %s", path, formatDiffValue(x), formatDiffValue(y)))
+			})
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		divergent++
+		if *limit > 0 && divergent > *limit {
+			continue
+		}
+		log.Printf("%s #%d: packet %d of the first capture, packet %d of the second\n", p.key, c[0], p.index, other.index)
+		for _, line := range lines {
+			log.Printf("  %s\n", line)
+		}
+	}
+	if *limit > 0 && divergent > *limit {
+		log.Printf("%d more divergent packets not shown\n", divergent-*limit)
+	}
+	for key, list := range byKey {
+		c := counts[key]
+		c[1] = len(list)
+		counts[key] = c
+	}
+	keys := make([]string, 0, len(counts))
+	for key, c := range counts {
+		if c[0] != c[1] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		log.Printf("%s: %d in the first capture, %d in the second\n", key, counts[key][0], counts[key][1])
+	}
+	log.Printf("%d of %d aligned packets diverge, %d packet types differ in count\n", divergent, aligned, len(keys))
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// driftFactor is the factor by which the rate of a packet in a session must differ from the baseline of its
+// upstream server to be reported, or 0 to disable drift detection.
+var driftFactor = 10.0
+
+const (
+	// driftInterval is the interval at which the packet rates of sessions are compared to the baselines.
+	driftInterval = time.Minute
+	// driftMinPackets is the minimum amount of packets per minute of either the session or the baseline for a
+	// difference to be reported, so that rare packets don't cause alerts.
+	driftMinPackets = 100
+	// driftMinSessions is the amount of sessions a baseline must be learned from before it is used.
+	driftMinSessions = 3
+	// driftLearnRate is the weight of the rates of a new session in the baseline.
+	driftLearnRate = 0.2
+)
+
+// driftSession holds the packet counts of a session used to detect drift and learn baselines.
+type driftSession struct {
+	upstream string
+	started  time.Time
+	window   time.Time
+	// counts holds the amount of packets received in the current window, totals those received in the session,
+	// indexed by direction and name of the packet.
+	counts, totals map[string]int64
+	// alerted holds the packets of which a difference was reported and that have not returned to normal since.
+	alerted map[string]bool
+}
+
+// driftSessions holds the drift state of all active sessions, indexed by session ID.
+var driftSessions = struct {
+	sync.Mutex
+	m map[int64]*driftSession
+}{m: map[int64]*driftSession{}}
+
+// enableDriftDetection starts learning the packet rates of upstream servers and reporting sessions deviating
+// from them.
+func enableDriftDetection() {
+	addPacketListener(countDriftPacket)
+	addSessionCloseListener(learnBaseline)
+	go detectDrift()
+}
+
+// countDriftPacket counts a packet for the drift state of its session.
+func countDriftPacket(e packetEvent) {
+	driftSessions.Lock()
+	defer driftSessions.Unlock()
+	d, ok := driftSessions.m[e.Session]
+	if !ok {
+		s, found := sessionByID(e.Session)
+		if !found {
+			return
+		}
+		d = &driftSession{upstream: s.upstream, started: s.started, window: e.Time, counts: map[string]int64{}, totals: map[string]int64{}, alerted: map[string]bool{}}
+		driftSessions.m[e.Session] = d
+	}
+	key := e.Direction + "/" + e.Name
+	d.counts[key]++
+	d.totals[key]++
+}
+
+// detectDrift compares the packet rates of all sessions to the baselines of their upstream servers every drift
+// interval.
+func detectDrift() {
+	for now := range time.Tick(driftInterval) {
+		driftSessions.Lock()
+		knowledgeBase.Lock()
+		ids := make([]int64, 0, len(driftSessions.m))
+		for id := range driftSessions.m {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i] < ids[j]
+		})
+		for _, id := range ids {
+			d := driftSessions.m[id]
+			if k := knowledgeOf(d.upstream); k.RateSessions >= driftMinSessions {
+				d.compare(id, k, now)
+			}
+			d.counts, d.window = map[string]int64{}, now
+		}
+		knowledgeBase.Unlock()
+		driftSessions.Unlock()
+	}
+}
+
+// compare reports the packets of which the rate in the current window differs from the baseline passed by at
+// least the drift factor.
+func (d *driftSession) compare(id int64, k *upstreamKnowledge, now time.Time) {
+	minutes := now.Sub(d.window).Minutes()
+	if minutes <= 0 {
+		return
+	}
+	keys := make([]string, 0, len(k.Rates)+len(d.counts))
+	for key := range k.Rates {
+		keys = append(keys, key)
+	}
+	for key := range d.counts {
+		if _, ok := k.Rates[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rate, baseline := float64(d.counts[key])/minutes, k.Rates[key]
+		var description string
+		switch {
+		case rate >= driftMinPackets && rate >= baseline*driftFactor:
+			if baseline == 0 {
+				description = "which is never seen normally"
+			} else {
+				description = fmt.Sprintf("%.1fx the baseline of %.0f/min", rate/baseline, baseline)
+			}
+		case baseline >= driftMinPackets && rate*driftFactor <= baseline:
+			description = fmt.Sprintf("far below the baseline of %.0f/min", baseline)
+		default:
+			delete(d.alerted, key)
+			continue
+		}
+		if d.alerted[key] {
+			continue
+		}
+		d.alerted[key] = true
+		log.Printf("Drift in session %d: %s at %.0f/min is %s of %s\n", id, key, rate, description, d.upstream)
+	}
+}
+
+// learnBaseline updates the baseline of the upstream server of a closed session with the packet rates of the
+// session. Sessions shorter than the drift interval are not learned from.
+func learnBaseline(id int64) {
+	driftSessions.Lock()
+	d, ok := driftSessions.m[id]
+	delete(driftSessions.m, id)
+	driftSessions.Unlock()
+	if !ok {
+		return
+	}
+	minutes := time.Since(d.started).Minutes()
+	if minutes < driftInterval.Minutes() {
+		return
+	}
+	knowledgeBase.Lock()
+	k := knowledgeOf(d.upstream)
+	if k.Rates == nil {
+		k.Rates = map[string]float64{}
+	}
+	for key := range d.totals {
+		if _, ok := k.Rates[key]; !ok {
+			k.Rates[key] = 0
+		}
+	}
+	for key, baseline := range k.Rates {
+		rate := float64(d.totals[key]) / minutes
+		if k.RateSessions == 0 {
+			k.Rates[key] = rate
+		} else {
+			k.Rates[key] = baseline*(1-driftLearnRate) + rate*driftLearnRate
+		}
+	}
+	k.RateSessions++
+	knowledgeBase.Unlock()
+	storeKnowledge()
+}
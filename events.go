@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"time"
+)
+
+// packetEvent describes a packet passing through the proxy.
+type packetEvent struct {
+	Time    time.Time `json:"time"`
+	Session int64     `json:"session"`
+	// Direction is either "serverbound" for packets sent by the client or "clientbound" for packets sent by the
+	// server.
+	Direction string        `json:"direction"`
+	Name      string        `json:"packet"`
+	ID        uint32        `json:"id"`
+	Size      int           `json:"size"`
+	Packet    packet.Packet `json:"payload"`
+	// Raw holds the encoded payload of the packet, excluding its header, if the packet was forwarded without being
+	// decoded in raw mode. Packet is nil in that case.
+	Raw []byte `json:"-"`
+}
+
+// packetListeners holds functions called for every packet passing through the proxy. Listeners are called on
+// the goroutine reading the packet, so they should not block.
+var packetListeners []func(e packetEvent)
+
+// addPacketListener adds a function called for every packet passing through the proxy. It must be called
+// before any client connects.
+func addPacketListener(f func(e packetEvent)) {
+	packetListeners = append(packetListeners, f)
+}
+
+// notifyPacketListeners calls all packet listeners with the event passed.
+func notifyPacketListeners(e packetEvent) {
+	for _, f := range packetListeners {
+		f(e)
+	}
+}
+
+// sessionCloseListeners holds functions called with the ID of a session when it is closed.
+var sessionCloseListeners []func(id int64)
+
+// addSessionCloseListener adds a function called with the ID of every session that is closed. It must be called
+// before any client connects.
+func addSessionCloseListener(f func(id int64)) {
+	sessionCloseListeners = append(sessionCloseListeners, f)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/zip"
+	"bds-mitm/capture"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportDir is the directory that session export bundles are written to.
+var exportDir = "exports"
+
+// transcriptLimit is the maximum amount of chat lines kept per session, and transcriptSessions the amount of
+// closed sessions of which the transcript is kept so that they may still be exported.
+const (
+	transcriptLimit    = 10000
+	transcriptSessions = 32
+)
+
+// chatTranscript is the chat of a session.
+type chatTranscript struct {
+	lines  []string
+	closed time.Time
+}
+
+// chatTranscripts holds the chat transcripts of active and recently closed sessions, indexed by session ID.
+var chatTranscripts = struct {
+	sync.Mutex
+	m map[int64]*chatTranscript
+}{m: map[int64]*chatTranscript{}}
+
+// recordChat adds Text packets to the chat transcript of their session.
+func recordChat(e packetEvent) {
+	text, ok := e.Packet.(*packet.Text)
+	if !ok {
+		return
+	}
+	line := fmt.Sprintf("%s %-11s", e.Time.Format("15:04:05.000"), e.Direction)
+	if text.SourceName != "" {
+		line += " <" + text.SourceName + ">"
+	}
+	line += " " + text.Message
+	if len(text.Parameters) > 0 {
+		line += " [" + strings.Join(text.Parameters, ", ") + "]"
+	}
+	chatTranscripts.Lock()
+	defer chatTranscripts.Unlock()
+	t, ok := chatTranscripts.m[e.Session]
+	if !ok {
+		t = &chatTranscript{}
+		chatTranscripts.m[e.Session] = t
+	}
+	if len(t.lines) < transcriptLimit {
+		t.lines = append(t.lines, line)
+	}
+}
+
+// closeTranscript marks the transcript of a session as closed and removes the transcripts of the oldest closed
+// sessions if more than transcriptSessions are kept.
+func closeTranscript(id int64) {
+	chatTranscripts.Lock()
+	defer chatTranscripts.Unlock()
+	t, ok := chatTranscripts.m[id]
+	if !ok {
+		return
+	}
+	t.closed = time.Now()
+	var closed []int64
+	for id, t := range chatTranscripts.m {
+		if !t.closed.IsZero() {
+			closed = append(closed, id)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		return chatTranscripts.m[closed[i]].closed.Before(chatTranscripts.m[closed[j]].closed)
+	})
+	for i := 0; i < len(closed)-transcriptSessions; i++ {
+		delete(chatTranscripts.m, closed[i])
+	}
+}
+
+// exportManifest describes the contents of a session export bundle.
+type exportManifest struct {
+	Session  int64     `json:"session"`
+	Exported time.Time `json:"exported"`
+	Active   bool      `json:"active"`
+	Player   string    `json:"player,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+	// Files lists the files in the bundle, and Missing the kinds of data that were not available.
+	Files   []string `json:"files"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+// exportSession writes a zip bundle holding all data recorded about the session with the ID passed: its
+// captures, chat transcript, stats, registry dumps and forensic dumps, with a manifest describing them. The path
+// of the bundle is returned.
+func exportSession(id int64) (string, error) {
+	manifest := exportManifest{Session: id, Exported: time.Now()}
+	var hashes map[string]string
+	var stats any
+	if s, ok := sessionByID(id); ok {
+		manifest.Active, manifest.Player, manifest.Upstream, manifest.Started = true, s.client.IdentityData().DisplayName, s.upstream, s.started
+		hashes = s.componentHashes()
+		packetStats.Lock()
+		counters := map[string]packetCounter{}
+		for key, c := range packetStats.sessions[id] {
+			counters[key] = *c
+		}
+		packetStats.Unlock()
+		stats = struct {
+			Serverbound int64                    `json:"serverbound_bytes"`
+			Clientbound int64                    `json:"clientbound_bytes"`
+			Packets     map[string]packetCounter `json:"packets"`
+		}{s.serverbound.bytes.Load(), s.clientbound.bytes.Load(), counters}
+	} else if agg, ok := sessionAggregateOf(id); ok {
+		manifest.Player, manifest.Upstream, manifest.Started = agg.Player, agg.Upstream, agg.Started
+		hashes = registeredHashes(id, agg.Started)
+		stats = agg
+	} else {
+		return "", fmt.Errorf("no data is known about session %d", id)
+	}
+
+	if err := os.MkdirAll(exportDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(exportDir, fmt.Sprintf("session-%d-%s.zip", id, manifest.Exported.Format("20060102-150405")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	writeJSON := func(name string, v any) error {
+		file, err := w.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(file)
+		enc.SetIndent("", "  ")
+		manifest.Files = append(manifest.Files, name)
+		return enc.Encode(v)
+	}
+	addFile := func(name, src string) error {
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		file, err := w.Create(name)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, name)
+		_, err = io.Copy(file, in)
+		return err
+	}
+
+	if err := writeJSON("stats.json", stats); err != nil {
+		return "", err
+	}
+	chatTranscripts.Lock()
+	var lines []string
+	if t, ok := chatTranscripts.m[id]; ok {
+		lines = append(lines, t.lines...)
+	}
+	chatTranscripts.Unlock()
+	if len(lines) > 0 {
+		file, err := w.Create("chat.txt")
+		if err != nil {
+			return "", err
+		}
+		manifest.Files = append(manifest.Files, "chat.txt")
+		_, _ = io.WriteString(file, strings.Join(lines, "\n")+"\n")
+	} else {
+		manifest.Missing = append(manifest.Missing, "chat transcript")
+	}
+	if len(hashes) > 0 {
+		if err := writeJSON("registry/hashes.json", hashes); err != nil {
+			return "", err
+		}
+		for component, hash := range hashes {
+			if registryDir == "" {
+				break
+			}
+			if err := addFile("registry/"+component+".json", filepath.Join(registryDir, hash+".json")); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	} else {
+		manifest.Missing = append(manifest.Missing, "registry dumps")
+	}
+	dirs := []struct{ kind, dir, pattern string }{
+		{"captures", portalCaptureDir, fmt.Sprintf("*-session-%d-*.bdscap", id)},
+		{"forensics", forensicsDir, fmt.Sprintf("session-%d-*.zip", id)},
+	}
+	if recordDir != portalCaptureDir {
+		dirs = append(dirs, struct{ kind, dir, pattern string }{"captures", recordDir, fmt.Sprintf("record-session-%d-*.bdscap", id)})
+		dirs = append(dirs, struct{ kind, dir, pattern string }{"captures", recordDir, fmt.Sprintf("record-session-%d-*%s", id, capture.ManifestSuffix)})
+	}
+	found := map[string]bool{}
+	for _, dir := range dirs {
+		matches := sessionFiles(dir.dir, dir.pattern, manifest.Started)
+		for _, match := range matches {
+			if err := addFile(dir.kind+"/"+filepath.Base(match), match); err != nil {
+				return "", err
+			}
+			found[dir.kind] = true
+		}
+	}
+	for _, kind := range []string{"captures", "forensics"} {
+		if !found[kind] {
+			manifest.Missing = append(manifest.Missing, kind)
+		}
+	}
+	if err := writeJSON("manifest.json", manifest); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// sessionFiles returns the files in the directory passed matching the pattern that were modified after the
+// session was started. Session IDs restart at 1 when the proxy restarts, so older files may belong to other
+// sessions with the same ID.
+func sessionFiles(dir, pattern string, started time.Time) []string {
+	if dir == "" {
+		return nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+	files := matches[:0]
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.ModTime().Before(started) {
+			files = append(files, match)
+		}
+	}
+	return files
+}
+
+// sessionAggregateOf returns the aggregate of the most recent closed session with the ID passed from the stats
+// database.
+func sessionAggregateOf(id int64) (sessionAggregate, bool) {
+	if statsDBFile == "" {
+		return sessionAggregate{}, false
+	}
+	aggs, err := sessionAggregatesSince(time.Time{})
+	if err != nil {
+		log.Printf("Unable to read the stats database: %v\n", err)
+		return sessionAggregate{}, false
+	}
+	for i := len(aggs) - 1; i >= 0; i-- {
+		if aggs[i].Session == id {
+			return aggs[i], true
+		}
+	}
+	return sessionAggregate{}, false
+}
+
+// registeredHashes returns the hashes of the login-phase data of the closed session with the ID and start time
+// passed from the session index of the registry directory.
+func registeredHashes(id int64, started time.Time) map[string]string {
+	if registryDir == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(registryDir, "sessions.jsonl"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry struct {
+			Session int64             `json:"session"`
+			Started time.Time         `json:"started"`
+			Hashes  map[string]string `json:"hashes"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Session == id && entry.Started.Equal(started) {
+			return entry.Hashes
+		}
+	}
+	return nil
+}
+
+func init() {
+	addPacketListener(recordChat)
+	addSessionCloseListener(closeTranscript)
+	registerCommand("export", consoleCommand{
+		usage:       "<session ID>",
+		description: "Writes a zip bundle of the captures, chat, stats, registry and forensic dumps of a session.",
+		run: func(args []string) {
+			if len(args) != 1 {
+				log.Println("Usage: export <session ID>")
+				return
+			}
+			id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+			if err != nil {
+				log.Println("Usage: export <session ID>")
+				return
+			}
+			path, err := exportSession(id)
+			if err != nil {
+				log.Printf("Unable to export session %d: %v\n", id, err)
+				return
+			}
+			log.Printf("Exported session %d to %s\n", id, path)
+		},
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// extHTTPHosts holds the hosts that plugins may send HTTP requests to.
+	// Hosts may hold wildcards, such as *.example.com. Plugins may not send any requests if it is empty.
+	extHTTPHosts []string
+	// extHTTPRate is the maximum amount of HTTP requests a single plugin may send per minute.
+	extHTTPRate = 60
+)
+
+// extHTTPMaxResponse is the maximum size of a response body returned to plugins.
+const extHTTPMaxResponse = 1 << 20
+
+// extHTTPRequests holds the times of the recent HTTP requests of each plugin, indexed by its namespace.
+var extHTTPRequests = struct {
+	sync.Mutex
+	m map[string][]time.Time
+}{m: map[string][]time.Time{}}
+
+// parseHTTPHosts parses a comma separated list of hosts that plugins may send HTTP requests to.
+func parseHTTPHosts(list string) ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host == "" {
+			continue
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", host, err)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// httpHostAllowed checks if plugins may send HTTP requests to the host passed.
+func httpHostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range extHTTPHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// extHTTPClient is the HTTP client of a single plugin. It only sends requests to allowlisted hosts and
+// limits the amount of requests the plugin sends. It implements handler.HTTPClient.
+type extHTTPClient struct {
+	namespace string
+	client    *http.Client
+}
+
+// httpClientOf returns the HTTP client of the plugin with the namespace passed.
+func httpClientOf(namespace string) extHTTPClient {
+	c := extHTTPClient{namespace: namespace}
+	c.client = &http.Client{
+		Timeout: time.Second * 10,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return c.check(req.URL)
+		},
+	}
+	return c
+}
+
+// check returns an error if the plugin may not send a request to the URL passed.
+func (c extHTTPClient) check(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if !httpHostAllowed(u.Hostname()) {
+		return fmt.Errorf("host %s is not allowlisted, add it using -http-allow", u.Hostname())
+	}
+	return nil
+}
+
+// allow counts a request of the plugin and checks if the plugin exceeded its rate limit.
+func (c extHTTPClient) allow(now time.Time) error {
+	extHTTPRequests.Lock()
+	defer extHTTPRequests.Unlock()
+	recent := extHTTPRequests.m[c.namespace][:0]
+	for _, t := range extHTTPRequests.m[c.namespace] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= extHTTPRate {
+		extHTTPRequests.m[c.namespace] = recent
+		return fmt.Errorf("%s exceeded the limit of %d HTTP requests per minute", c.namespace, extHTTPRate)
+	}
+	extHTTPRequests.m[c.namespace] = append(recent, now)
+	return nil
+}
+
+// Request sends an HTTP request with the method, URL and body passed, which may be nil, and returns the status
+// code and body of the response. Response bodies are truncated to extHTTPMaxResponse bytes.
+func (c extHTTPClient) Request(method, rawURL, contentType string, body []byte) (status int, resp []byte, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := c.check(u); err != nil {
+		return 0, nil, err
+	}
+	if err := c.allow(time.Now()); err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("User-Agent", "bds-mitm/"+c.namespace)
+	r, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer r.Body.Close()
+	resp, err = io.ReadAll(io.LimitReader(r.Body, extHTTPMaxResponse))
+	return r.StatusCode, resp, err
+}
+
+// Get sends a GET request to the URL passed and returns the status code and body of the response.
+func (c extHTTPClient) Get(rawURL string) (int, []byte, error) {
+	return c.Request(http.MethodGet, rawURL, "", nil)
+}
+
+// PostJSON sends a POST request with v encoded as JSON to the URL passed and returns the status code and body of
+// the response.
+func (c extHTTPClient) PostJSON(rawURL string, v any) (int, []byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.Request(http.MethodPost, rawURL, "application/json", body)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// filterScope specifies the directions in which a packet is filtered from logging.
+type filterScope byte
+
+const (
+	// filterServerbound filters packets sent by the client to the server.
+	filterServerbound filterScope = 1 << iota
+	// filterClientbound filters packets sent by the server to the client.
+	filterClientbound
+	// filterBoth filters packets in both directions.
+	filterBoth = filterServerbound | filterClientbound
+)
+
+// parseFilterScope parses a direction of a filter entry: serverbound, clientbound or both.
+func parseFilterScope(s string) (filterScope, error) {
+	switch strings.ToLower(s) {
+	case "serverbound":
+		return filterServerbound, nil
+	case "clientbound":
+		return filterClientbound, nil
+	case "both", "":
+		return filterBoth, nil
+	}
+	return 0, fmt.Errorf("invalid direction %q: expected serverbound, clientbound or both", s)
+}
+
+// String ...
+func (scope filterScope) String() string {
+	switch scope {
+	case filterServerbound:
+		return "serverbound"
+	case filterClientbound:
+		return "clientbound"
+	case filterBoth:
+		return "both"
+	}
+	return "none"
+}
+
+// packetFilters holds the directions in which packets are filtered from logging, indexed by the name of the
+// packet. It is initialised with the filteredPackets, which are filtered in both directions.
+var packetFilters = struct {
+	sync.RWMutex
+	m map[string]filterScope
+}{m: map[string]filterScope{}}
+
+func init() {
+	for name := range filteredPackets {
+		packetFilters.m[name] = filterBoth
+	}
+}
+
+// packetFiltered checks if a packet with the name passed sent by the client, or by the server if fromServer is
+// true, is filtered from logging.
+func packetFiltered(name string, fromServer bool) bool {
+	scope := filterServerbound
+	if fromServer {
+		scope = filterClientbound
+	}
+	packetFilters.RLock()
+	defer packetFilters.RUnlock()
+	return packetFilters.m[name]&scope != 0
+}
+
+// filterScopeOf returns the directions in which the packet with the name passed is filtered from logging.
+func filterScopeOf(name string) filterScope {
+	packetFilters.RLock()
+	defer packetFilters.RUnlock()
+	return packetFilters.m[name]
+}
+
+// addFilterEntries parses a comma separated list of filter entries in the format packet[:direction], such as
+// InventoryContent:clientbound, Move* or @movement, and filters the packets from logging in the direction
+// specified. Entries prefixed with + are shown in the direction specified instead.
+func (st *logFilterState) addFilterEntries(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		show := strings.HasPrefix(entry, "+")
+		if err := applyFilterEntry(st.filters, strings.TrimPrefix(entry, "+"), show); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFilterEntry parses a single filter entry in the format packet[:direction] and filters the packets it refers
+// to from logging in the direction specified, or shows them if show is true.
+func addFilterEntry(entry string, show bool) error {
+	packetFilters.Lock()
+	defer packetFilters.Unlock()
+	return applyFilterEntry(packetFilters.m, entry, show)
+}
+
+// applyFilterEntry parses a single filter entry in the format packet[:direction] and updates the directions in
+// which the packets it refers to are filtered in the map passed.
+func applyFilterEntry(m map[string]filterScope, entry string, show bool) error {
+	name, direction, _ := strings.Cut(entry, ":")
+	scope, err := parseFilterScope(direction)
+	if err != nil {
+		return fmt.Errorf("filter entry %q: %w", entry, err)
+	}
+	names, err := expandPacketNames([]string{name})
+	if err != nil {
+		return fmt.Errorf("filter entry %q: %w", entry, err)
+	}
+	for _, name := range names {
+		if show {
+			m[name] &^= scope
+		} else {
+			m[name] |= scope
+		}
+		if m[name] == 0 {
+			delete(m, name)
+		}
+	}
+	return nil
+}
+
+// allowlistMode specifies if only the packets shown using -only are logged. In allowlist mode, packets that are
+// normally always logged, such as ChangeDimension, are hidden too unless they are shown explicitly.
+var allowlistMode bool
+
+// onlyShow hides all packets in both directions and shows only the packets referred to by the filter entries
+// passed, in the format packet[:direction].
+func onlyShow(entries []string) error {
+	st := &logFilterState{}
+	if err := st.onlyShow(entries); err != nil {
+		return err
+	}
+	packetFilters.Lock()
+	packetFilters.m = st.filters
+	packetFilters.Unlock()
+	allowlistMode = true
+	return nil
+}
+
+// onlyShow replaces the filters of the state with filters hiding all packets but those referred to by the filter
+// entries passed, and puts the state in allowlist mode.
+func (st *logFilterState) onlyShow(entries []string) error {
+	m := make(map[string]filterScope, len(knownPackets))
+	for _, info := range knownPackets {
+		m[info.name] = filterBoth
+	}
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := applyFilterEntry(m, entry, true); err != nil {
+			return err
+		}
+	}
+	st.filters, st.allowlist = m, true
+	return nil
+}
+
+// filterFiles holds the files that filters are loaded from if no filter file is passed explicitly, in order of
+// preference.
+var filterFiles = []string{"filters.json", "filters.yaml", "filters.yml"}
+
+// filterConfig is the format of a filter file. Entries have the same format as those passed to -filter, but without
+// the + prefix.
+type filterConfig struct {
+	// Defaults specifies if the default filters are kept. If false, only the packets listed in Hide are filtered.
+	Defaults bool `json:"defaults" yaml:"defaults"`
+	// Only holds the entries of the only packets logged. If set, all other packets are hidden and Defaults and
+	// Hide are ignored.
+	Only []string `json:"only" yaml:"only"`
+	// Hide holds the entries of packets filtered from logging.
+	Hide []string `json:"hide" yaml:"hide"`
+	// Show holds the entries of packets shown, even if they are hidden by an entry in Hide or by default. It is
+	// applied after Hide, so that Move* may be hidden while MovePlayer is shown.
+	Show []string `json:"show" yaml:"show"`
+	// Rules holds filter rules scoped to a direction, applied in order after Hide and Show.
+	Rules []filterRule `json:"rules" yaml:"rules"`
+	// Hexdump holds the packets of which the serialized bytes are logged in addition to their fields.
+	Hexdump []string `json:"hexdump" yaml:"hexdump"`
+	// Pretty holds the packets that are logged as indented trees of their fields.
+	Pretty []string `json:"pretty" yaml:"pretty"`
+	// Redact holds rules masking or truncating fields of packets in logs, such as Text.Message=mask or
+	// Login.ConnectionRequest=truncate:64.
+	Redact []string `json:"redact" yaml:"redact"`
+	// Where holds conditions that packets are only logged if they match, such as
+	// PlayerAction where ActionType == 18.
+	Where []string `json:"where" yaml:"where"`
+}
+
+// filterRule is a rule of a filter file that hides or shows a packet in a specific direction, such as hiding
+// LevelChunk sent by the server while still showing SubChunkRequest sent by the client.
+type filterRule struct {
+	// Packet is the name, wildcard pattern or @group of the packets the rule applies to.
+	Packet string `json:"packet" yaml:"packet"`
+	// Direction is the direction the rule applies to: serverbound, clientbound or both. It defaults to both.
+	Direction string `json:"direction" yaml:"direction"`
+	// Action is either hide or show. It defaults to hide.
+	Action string `json:"action" yaml:"action"`
+}
+
+// loadFilterFile loads the filter file at the path passed, replacing the default filters unless the file keeps
+// them. If path is empty, the first of the filterFiles that exists is loaded, and the defaults remain in place if
+// none exist.
+func (st *logFilterState) loadFilterFile(path string) error {
+	if path == "" {
+		for _, name := range filterFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+		if path == "" {
+			return nil
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file := filterConfig{Defaults: true}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &file)
+	default:
+		err = json.Unmarshal(b, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("read filters %s: %w", path, err)
+	}
+	if len(file.Only) > 0 {
+		if err := st.onlyShow(file.Only); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	} else if !file.Defaults {
+		st.filters = map[string]filterScope{}
+	}
+	for _, entry := range file.Hide {
+		if len(file.Only) > 0 {
+			break
+		}
+		if err := applyFilterEntry(st.filters, entry, false); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	}
+	for _, entry := range file.Show {
+		if err := applyFilterEntry(st.filters, entry, true); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	}
+	for _, rule := range file.Rules {
+		if rule.Action != "" && rule.Action != "hide" && rule.Action != "show" {
+			return fmt.Errorf("filters %s: rule for %q: invalid action %q: expected hide or show", path, rule.Packet, rule.Action)
+		}
+		if err := applyFilterEntry(st.filters, rule.Packet+":"+rule.Direction, rule.Action == "show"); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	}
+	for _, entry := range file.Hexdump {
+		if err := st.hexdump.add(entry); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	}
+	for _, entry := range file.Pretty {
+		if err := st.pretty.add(entry); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	}
+	for _, entry := range file.Redact {
+		rule, err := parseRedactionRule(entry)
+		if err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+		st.redactions = append(st.redactions, rule)
+	}
+	for _, expr := range file.Where {
+		if err := st.addCondition(expr); err != nil {
+			return fmt.Errorf("filters %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	const usage = "Usage: filter <add|remove|only|list> [packet[:direction] or @group...] [serverbound|clientbound|both]"
+	registerCommand("filter", consoleCommand{
+		usage:       "<add|remove|only|list> [packet[:direction] or @group...] [serverbound|clientbound|both]",
+		description: "Manages packets that are hidden from logging, optionally only in one direction.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println(usage)
+				return
+			}
+			switch args[0] {
+			case "add", "remove", "only":
+				entries := args[1:]
+				if len(entries) > 1 {
+					// A trailing direction applies to all entries that don't specify one themselves, such as in
+					// filter add LevelChunk SubChunk clientbound.
+					if _, err := parseFilterScope(entries[len(entries)-1]); err == nil {
+						direction := entries[len(entries)-1]
+						entries = append([]string(nil), entries[:len(entries)-1]...)
+						for i, entry := range entries {
+							if !strings.Contains(entry, ":") {
+								entries[i] = entry + ":" + direction
+							}
+						}
+					}
+				}
+				if len(entries) == 0 {
+					log.Println(usage)
+					return
+				}
+				if args[0] == "only" {
+					if err := onlyShow(entries); err != nil {
+						log.Println(err)
+						return
+					}
+					log.Printf("Only logging %s.\n", strings.Join(entries, ", "))
+					return
+				}
+				for _, entry := range entries {
+					if err := addFilterEntry(entry, args[0] == "remove"); err != nil {
+						log.Println(err)
+						return
+					}
+				}
+				log.Printf("Updated %d filter entries.\n", len(entries))
+			case "list":
+				packetFilters.RLock()
+				names := make([]string, 0, len(packetFilters.m))
+				for name := range packetFilters.m {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					log.Printf("%-40s %s\n", name, packetFilters.m[name])
+				}
+				packetFilters.RUnlock()
+				if len(names) == 0 {
+					log.Println("No packets are filtered.")
+				}
+			default:
+				log.Println(usage)
+			}
+		},
+	})
+}
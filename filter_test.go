@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseFilterScope(t *testing.T) {
+	for s, want := range map[string]filterScope{
+		"":            filterBoth,
+		"both":        filterBoth,
+		"serverbound": filterServerbound,
+		"Clientbound": filterClientbound,
+	} {
+		if got, err := parseFilterScope(s); err != nil || got != want {
+			t.Errorf("parseFilterScope(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := parseFilterScope("upstream"); err == nil {
+		t.Errorf("parseFilterScope accepted an invalid direction")
+	}
+}
+
+func TestApplyFilterEntry(t *testing.T) {
+	m := map[string]filterScope{}
+	if err := applyFilterEntry(m, "Text:clientbound", false); err != nil {
+		t.Fatal(err)
+	}
+	if m["Text"] != filterClientbound {
+		t.Errorf("Text filtered %v, want clientbound", m["Text"])
+	}
+	if err := applyFilterEntry(m, "Text:serverbound", false); err != nil {
+		t.Fatal(err)
+	}
+	if m["Text"] != filterBoth {
+		t.Errorf("Text filtered %v, want both", m["Text"])
+	}
+	if err := applyFilterEntry(m, "Text", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["Text"]; ok {
+		t.Errorf("Text is still filtered after showing it in both directions")
+	}
+
+	if err := applyFilterEntry(m, "@sounds:serverbound", false); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := groupPackets("sounds")
+	for _, name := range names {
+		if m[name] != filterServerbound {
+			t.Errorf("%s filtered %v, want serverbound", name, m[name])
+		}
+	}
+
+	for _, entry := range []string{"Text:upstream", "NoSuchPacket", "@nosuchgroup", "NoSuch*"} {
+		if err := applyFilterEntry(map[string]filterScope{}, entry, false); err == nil {
+			t.Errorf("filter entry %q was accepted", entry)
+		}
+	}
+}
+
+func TestOnlyShow(t *testing.T) {
+	st := &logFilterState{}
+	if err := st.onlyShow([]string{"Text", "PlayStatus:clientbound"}); err != nil {
+		t.Fatal(err)
+	}
+	if !st.allowlist {
+		t.Errorf("state is not in allowlist mode")
+	}
+	if scope, ok := st.filters["Text"]; ok {
+		t.Errorf("Text is filtered %v, want shown", scope)
+	}
+	if st.filters["PlayStatus"] != filterServerbound {
+		t.Errorf("PlayStatus filtered %v, want serverbound", st.filters["PlayStatus"])
+	}
+	if st.filters["MovePlayer"] != filterBoth {
+		t.Errorf("MovePlayer filtered %v, want both", st.filters["MovePlayer"])
+	}
+}
+
+func TestParseLogFilters(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "filters.yaml")
+	err := os.WriteFile(file, []byte(`defaults: false
+hide: [LevelChunk]
+show: [MovePlayer]
+rules:
+  - packet: Text
+    direction: clientbound
+hexdump: [Text]
+redact: [Text.Message=mask]
+where: ['PlayerAction where ActionType == 18']
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{"filters": file, "filter": "+LevelChunk:serverbound,@movement", "pretty": "@chat"}
+	st, err := parseLogFilters(func(name string) string {
+		return values[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]filterScope{"LevelChunk": filterClientbound, "Text": filterClientbound}
+	movement, _ := groupPackets("movement")
+	for _, name := range movement {
+		want[name] = filterBoth
+	}
+	if !reflect.DeepEqual(st.filters, want) {
+		t.Errorf("filters = %v, want %v", st.filters, want)
+	}
+	if !st.hexdump.contains("Text") || st.hexdump.contains("MovePlayer") {
+		t.Errorf("hex dumped packets are wrong")
+	}
+	if !st.pretty.contains("CommandRequest") {
+		t.Errorf("@chat is not pretty printed")
+	}
+	if len(st.redactions) != 1 || st.redactions[0].packet != "Text" || st.redactions[0].action != "mask" {
+		t.Errorf("redactions = %+v", st.redactions)
+	}
+	if _, ok := st.conditions["PlayerAction"]; !ok || len(st.conditions) != 1 {
+		t.Errorf("conditions = %v", st.conditions)
+	}
+}
+
+func TestParseLogFiltersInvalid(t *testing.T) {
+	for name, value := range map[string]string{
+		"filter": "Text:upstream",
+		"only":   "NoSuchPacket",
+		"redact": "Text.Message=bogus",
+		"where":  "Text where",
+	} {
+		_, err := parseLogFilters(func(n string) string {
+			if n == name {
+				return value
+			}
+			return ""
+		})
+		if err == nil {
+			t.Errorf("-%s %q was accepted", name, value)
+		}
+	}
+}
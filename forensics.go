@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// forensicPackets is the amount of most recent packets per direction kept for forensic dumps.
+const forensicPackets = 500
+
+// forensicsDir is the directory forensic dumps are written to when the upstream server disconnects a session,
+// or an empty string to not write them.
+var forensicsDir = "forensics"
+
+// packetRing holds the most recent packets travelling in one direction of a session, together with statistics
+// of the gaps between them.
+type packetRing struct {
+	mu      sync.Mutex
+	entries [forensicPackets]packetEvent
+	next    int
+	full    bool
+	last    time.Time
+	maxGap  time.Duration
+	// size is the total size of the packets held by the ring.
+	size int64
+}
+
+// add adds a packet to the ring, overwriting the oldest packet if the ring is full.
+func (r *packetRing) add(e packetEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.last.IsZero() {
+		if gap := e.Time.Sub(r.last); gap > r.maxGap {
+			r.maxGap = gap
+		}
+	}
+	r.last = e.Time
+	r.size += int64(e.Size - r.entries[r.next].Size)
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % forensicPackets
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// bytes returns the total size of the packets held by the ring.
+func (r *packetRing) bytes() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+// snapshot returns the packets in the ring from oldest to newest, the time the last packet was added and the
+// largest gap between two consecutive packets.
+func (r *packetRing) snapshot() (events []packetEvent, last time.Time, maxGap time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		events = append(events, r.entries[r.next:]...)
+	}
+	events = append(events, r.entries[:r.next]...)
+	return events, r.last, r.maxGap
+}
+
+// forensicDirection summarises one direction of a session in a forensic dump.
+type forensicDirection struct {
+	Packets         int64  `json:"packets"`
+	Bytes           int64  `json:"bytes"`
+	QueuedPackets   int64  `json:"queued_packets"`
+	QueuedBytes     int64  `json:"queued_bytes"`
+	Dropped         int64  `json:"dropped"`
+	Suppressed      int64  `json:"suppressed"`
+	LastPacket      string `json:"last_packet,omitempty"`
+	SinceLastPacket string `json:"since_last_packet,omitempty"`
+	MaxPacketGap    string `json:"max_packet_gap"`
+}
+
+// forensicSummary describes the state of a session at the time the upstream server disconnected it.
+type forensicSummary struct {
+	Session         int64             `json:"session"`
+	Player          string            `json:"player"`
+	Upstream        string            `json:"upstream"`
+	LocalAddr       string            `json:"local_addr"`
+	RemoteAddr      string            `json:"remote_addr"`
+	Started         time.Time         `json:"started"`
+	Disconnected    time.Time         `json:"disconnected"`
+	Duration        string            `json:"duration"`
+	Reason          string            `json:"reason"`
+	Kicked          bool              `json:"kicked"`
+	ClientLatency   string            `json:"client_latency"`
+	UpstreamLatency string            `json:"upstream_latency"`
+	Serverbound     forensicDirection `json:"serverbound"`
+	Clientbound     forensicDirection `json:"clientbound"`
+}
+
+// upstreamLost is called when reading from the upstream server fails with the error passed. If the session was
+// not already closed by the client, a forensic dump of the session is written in the background.
+func (s *session) upstreamLost(err error) {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	if forensicsDir == "" {
+		return
+	}
+	now := time.Now()
+	var disconnect minecraft.DisconnectError
+	summary := forensicSummary{
+		Session:         s.id,
+		Player:          s.client.IdentityData().DisplayName,
+		Upstream:        s.upstream,
+		LocalAddr:       s.server.LocalAddr().String(),
+		RemoteAddr:      s.server.RemoteAddr().String(),
+		Started:         s.started,
+		Disconnected:    now,
+		Duration:        now.Sub(s.started).Round(time.Millisecond).String(),
+		Reason:          err.Error(),
+		Kicked:          errors.As(err, &disconnect),
+		ClientLatency:   s.client.Latency().String(),
+		UpstreamLatency: s.server.Latency().String(),
+	}
+	serverbound, sbDir := s.forensicDirection(&s.serverboundRecent, &s.serverbound, now)
+	clientbound, cbDir := s.forensicDirection(&s.clientboundRecent, &s.clientbound, now)
+	summary.Serverbound, summary.Clientbound = sbDir, cbDir
+
+	go func() {
+		var serverLines []serverLogLine
+		if serverLogSource != "" {
+			// Give the server some time to log why the session was disconnected.
+			time.Sleep(time.Second * 2)
+			serverLines = serverLogBetween(s.started, time.Now())
+		}
+		path, err := writeForensics(summary, serverbound, clientbound, serverLines)
+		if err != nil {
+			log.Printf("An error occurred whilst writing forensic dump of session %d: %v\n", s.id, err)
+			return
+		}
+		log.Printf("Upstream disconnected session %d (%s), wrote forensic dump to %s\n", s.id, summary.Reason, path)
+	}()
+}
+
+// forensicDirection returns the recent packets held by the ring passed and a summary of the direction.
+func (s *session) forensicDirection(ring *packetRing, stats *directionStats, now time.Time) ([]packetEvent, forensicDirection) {
+	events, last, maxGap := ring.snapshot()
+	dir := forensicDirection{
+		Packets:       stats.packets.Load(),
+		Bytes:         stats.bytes.Load(),
+		QueuedPackets: stats.queuedPackets.Load(),
+		QueuedBytes:   stats.queuedBytes.Load(),
+		Dropped:       stats.dropped.Load(),
+		Suppressed:    stats.suppressed.Load(),
+		MaxPacketGap:  maxGap.String(),
+	}
+	if !last.IsZero() {
+		dir.LastPacket = events[len(events)-1].Name
+		dir.SinceLastPacket = now.Sub(last).String()
+	}
+	return events, dir
+}
+
+// writeForensics writes a zip archive holding the summary, recent packets and server log lines passed to the
+// forensics directory and returns its path.
+func writeForensics(summary forensicSummary, serverbound, clientbound []packetEvent, serverLines []serverLogLine) (string, error) {
+	if err := os.MkdirAll(forensicsDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(forensicsDir, fmt.Sprintf("session-%d-%s.zip", summary.Session, summary.Disconnected.Format("20060102-150405")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	summaryFile, err := w.Create("summary.json")
+	if err != nil {
+		return "", err
+	}
+	enc := json.NewEncoder(summaryFile)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		return "", err
+	}
+	for _, direction := range []struct {
+		name   string
+		events []packetEvent
+	}{{"serverbound.jsonl", serverbound}, {"clientbound.jsonl", clientbound}} {
+		file, err := w.Create(direction.name)
+		if err != nil {
+			return "", err
+		}
+		enc := json.NewEncoder(file)
+		for _, e := range direction.events {
+			if err := enc.Encode(e); err != nil {
+				// Some packets can't be encoded as JSON, such as those holding NaN values. Still record that
+				// they were sent.
+				e.Packet = nil
+				_ = enc.Encode(e)
+			}
+		}
+	}
+	if len(serverLines) > 0 {
+		file, err := w.Create("timeline.txt")
+		if err != nil {
+			return "", err
+		}
+		writeTimeline(file, serverbound, clientbound, serverLines)
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// writeTimeline writes the packets and server log lines passed to w, interleaved in order of time.
+func writeTimeline(w io.Writer, serverbound, clientbound []packetEvent, serverLines []serverLogLine) {
+	type timelineEntry struct {
+		time time.Time
+		line string
+	}
+	entries := make([]timelineEntry, 0, len(serverbound)+len(clientbound)+len(serverLines))
+	for _, e := range append(append([]packetEvent(nil), serverbound...), clientbound...) {
+		entries = append(entries, timelineEntry{time: e.Time, line: fmt.Sprintf("%-11s %s (%d bytes)", e.Direction, e.Name, e.Size)})
+	}
+	if len(entries) > 0 {
+		// Only server log lines overlapping the recent packets are of interest.
+		first := entries[0].time
+		if len(serverbound) > 0 && len(clientbound) > 0 && clientbound[0].Time.Before(first) {
+			first = clientbound[0].Time
+		}
+		for _, line := range serverLines {
+			if !line.Time.Before(first) {
+				entries = append(entries, timelineEntry{time: line.Time, line: "server      " + line.Text})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(w, "%s %s\n", e.time.Format("15:04:05.000000"), e.line)
+	}
+}
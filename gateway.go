@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// gatewayMode specifies if the proxy runs as a gateway in front of a public server. In gateway mode, payloads of
+// packets holding sensitive data are never logged, packet injection is disabled and clients are subject to rate
+// limits so that a single client can't starve others.
+var gatewayMode bool
+
+var (
+	// gatewaySessionsPerIP is the maximum amount of concurrent sessions of clients with the same IP address.
+	gatewaySessionsPerIP = 2
+	// gatewayConnectRate is the maximum amount of connections a single IP address may open per minute.
+	gatewayConnectRate = 10
+	// gatewayPacketRate is the maximum amount of packets a client may send per second before it is disconnected.
+	gatewayPacketRate = 500
+)
+
+// sensitivePackets holds the names of packets that may hold private data of players, such as chat messages,
+// commands, credentials and skins. Their payloads are not logged in gateway mode.
+var sensitivePackets = map[string]bool{
+	getType(&packet.Login{}, false):                   true,
+	getType(&packet.SubClientLogin{}, false):          true,
+	getType(&packet.ServerToClientHandshake{}, false): true,
+	getType(&packet.ClientToServerHandshake{}, false): true,
+	getType(&packet.Text{}, false):                    true,
+	getType(&packet.CommandRequest{}, false):          true,
+	getType(&packet.SettingsCommand{}, false):         true,
+	getType(&packet.ModalFormResponse{}, false):       true,
+	getType(&packet.BookEdit{}, false):                true,
+	getType(&packet.PlayerSkin{}, false):              true,
+	getType(&packet.PlayerList{}, false):              true,
+	getType(&packet.AddPlayer{}, false):               true,
+	getType(&packet.Transfer{}, false):                true,
+}
+
+// payloadRedacted checks if the payload of a packet with the name passed must not be logged.
+func payloadRedacted(name string) bool {
+	return gatewayMode && sensitivePackets[name]
+}
+
+// injectionDisabled checks if packet injection is disabled because the proxy runs in gateway mode, logging that
+// it is if so.
+func injectionDisabled() bool {
+	if gatewayMode {
+		log.Println("Packet injection is disabled in gateway mode.")
+	}
+	return gatewayMode
+}
+
+// gatewayClients holds the amount of active sessions and the times of recent connections of each IP address.
+var gatewayClients = struct {
+	sync.Mutex
+	sessions map[string]int
+	connects map[string][]time.Time
+}{sessions: map[string]int{}, connects: map[string][]time.Time{}}
+
+// gatewayHost returns the IP address of the address passed.
+func gatewayHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admitClient checks if a client connecting from the address passed may connect in gateway mode. If it may, it
+// is counted as a session of the address until releaseClient is called.
+func admitClient(addr net.Addr) error {
+	if !gatewayMode {
+		return nil
+	}
+	host, now := gatewayHost(addr), time.Now()
+	gatewayClients.Lock()
+	defer gatewayClients.Unlock()
+
+	recent := gatewayClients.connects[host][:0]
+	for _, t := range gatewayClients.connects[host] {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	gatewayClients.connects[host] = append(recent, now)
+	if len(recent) >= gatewayConnectRate {
+		return fmt.Errorf("too many connections from %s, try again in a minute", host)
+	}
+	if gatewayClients.sessions[host] >= gatewaySessionsPerIP {
+		return fmt.Errorf("too many sessions from %s", host)
+	}
+	gatewayClients.sessions[host]++
+	return nil
+}
+
+// releaseClient releases a session of the address passed that was admitted by admitClient.
+func releaseClient(addr net.Addr) {
+	if !gatewayMode {
+		return
+	}
+	host := gatewayHost(addr)
+	gatewayClients.Lock()
+	defer gatewayClients.Unlock()
+	if gatewayClients.sessions[host]--; gatewayClients.sessions[host] <= 0 {
+		delete(gatewayClients.sessions, host)
+	}
+	if len(gatewayClients.connects[host]) == 0 {
+		delete(gatewayClients.connects, host)
+	}
+}
+
+// packetRateExceeded counts a packet sent by the client of the session and checks if the client exceeded the
+// packet rate of gateway mode. It must only be called by the goroutine reading from the client.
+func (s *session) packetRateExceeded(now time.Time) bool {
+	if !gatewayMode {
+		return false
+	}
+	if now.Sub(s.rateWindow) >= time.Second {
+		s.rateWindow, s.rateCount = now, 0
+	}
+	s.rateCount++
+	return s.rateCount > gatewayPacketRate
+}
+
+// checkGatewayOptions returns an error if any of the options passed inject packets, which is not allowed in
+// gateway mode.
+func checkGatewayOptions(options map[string]bool) error {
+	if !gatewayMode {
+		return nil
+	}
+	for name, set := range options {
+		if set {
+			return fmt.Errorf("-%s injects packets and can't be used in gateway mode", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// packetGroups holds curated lists of packets that may be referred to as a whole in filters using their name
+// prefixed with @, such as @movement.
+var packetGroups = map[string][]packet.Packet{
+	"movement": {
+		&packet.MovePlayer{}, &packet.PlayerAuthInput{}, &packet.MoveActorAbsolute{}, &packet.MoveActorDelta{},
+		&packet.SetActorMotion{}, &packet.CorrectPlayerMovePrediction{}, &packet.MotionPredictionHints{},
+	},
+	"chunks": {
+		&packet.LevelChunk{}, &packet.SubChunk{}, &packet.SubChunkRequest{}, &packet.NetworkChunkPublisherUpdate{},
+		&packet.ChunkRadiusUpdated{}, &packet.RequestChunkRadius{}, &packet.UpdateBlock{}, &packet.UpdateSubChunkBlocks{},
+	},
+	"inventory": {
+		&packet.InventoryContent{}, &packet.InventorySlot{}, &packet.InventoryTransaction{}, &packet.ItemStackRequest{},
+		&packet.ItemStackResponse{}, &packet.ContainerOpen{}, &packet.ContainerClose{}, &packet.MobEquipment{},
+		&packet.MobArmourEquipment{}, &packet.CreativeContent{}, &packet.PlayerHotBar{},
+	},
+	"entities": {
+		&packet.AddActor{}, &packet.RemoveActor{}, &packet.AddItemActor{}, &packet.AddPlayer{}, &packet.SetActorData{},
+		&packet.ActorEvent{}, &packet.UpdateAttributes{}, &packet.MobEffect{}, &packet.SetActorLink{},
+		&packet.AddPainting{},
+	},
+	"sounds": {
+		&packet.LevelSoundEvent{}, &packet.PlaySound{}, &packet.StopSound{},
+	},
+	"chat": {
+		&packet.Text{}, &packet.CommandRequest{}, &packet.CommandOutput{}, &packet.SettingsCommand{}, &packet.SetTitle{},
+		&packet.ToastRequest{},
+	},
+	"ui": {
+		&packet.ModalFormRequest{}, &packet.ModalFormResponse{}, &packet.ServerSettingsRequest{},
+		&packet.ServerSettingsResponse{}, &packet.NPCDialogue{}, &packet.NPCRequest{}, &packet.ShowProfile{},
+		&packet.ShowStoreOffer{}, &packet.BossEvent{}, &packet.SetDisplayObjective{}, &packet.SetScore{},
+		&packet.SetScoreboardIdentity{}, &packet.RemoveObjective{}, &packet.SetTitle{}, &packet.ToastRequest{},
+		&packet.ContainerOpen{}, &packet.ContainerClose{}, &packet.ContainerSetData{}, &packet.InventoryContent{},
+		&packet.InventorySlot{},
+	},
+	"world": {
+		&packet.SetTime{}, &packet.LevelEvent{}, &packet.LevelEventGeneric{}, &packet.BlockEvent{},
+		&packet.BlockActorData{}, &packet.GameRulesChanged{}, &packet.SetSpawnPosition{}, &packet.ChangeDimension{},
+		&packet.SetDifficulty{},
+	},
+}
+
+// groupPackets returns the names of the packets in the group with the name passed, excluding the @ prefix.
+// False is returned if no such group exists.
+func groupPackets(group string) ([]string, bool) {
+	packets, ok := packetGroups[strings.ToLower(group)]
+	if !ok {
+		return nil, false
+	}
+	names := make([]string, len(packets))
+	for i, pk := range packets {
+		names[i] = getType(pk, false)
+	}
+	return names, true
+}
+
+// packetGroupIndex holds the names of the groups each packet is in, indexed by the name of the packet. It is
+// built the first time it is needed.
+var packetGroupIndex = struct {
+	sync.Once
+	m map[string][]string
+}{}
+
+// groupsOfPacket returns the names of the groups the packet with the name passed is in, in sorted order.
+func groupsOfPacket(name string) []string {
+	packetGroupIndex.Do(func() {
+		packetGroupIndex.m = map[string][]string{}
+		groups := make([]string, 0, len(packetGroups))
+		for group := range packetGroups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		for _, group := range groups {
+			names, _ := groupPackets(group)
+			for _, name := range names {
+				packetGroupIndex.m[name] = append(packetGroupIndex.m[name], group)
+			}
+		}
+	})
+	return packetGroupIndex.m[name]
+}
+
+// expandPacketNames replaces all references to packet groups in the names passed by the packets in the group, and
+// all wildcard patterns such as Move* by the packets matching them. An error is returned if a group or packet does
+// not exist, or if a pattern matches no packets.
+func expandPacketNames(names []string) ([]string, error) {
+	var expanded []string
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, "@") {
+			packets, ok := groupPackets(name[1:])
+			if !ok {
+				return nil, fmt.Errorf("unknown packet group %q", name)
+			}
+			expanded = append(expanded, packets...)
+			continue
+		}
+		if strings.ContainsAny(name, "*?[") {
+			matches, err := matchPacketPattern(name)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, matches...)
+			continue
+		}
+		if !packetKnown(name) {
+			return nil, fmt.Errorf("unknown packet %q", name)
+		}
+		expanded = append(expanded, name)
+	}
+	return expanded, nil
+}
+
+// matchPacketPattern returns the names of all known packets matching the wildcard pattern passed, in the syntax
+// of path.Match.
+func matchPacketPattern(pattern string) ([]string, error) {
+	var matches []string
+	for _, info := range knownPackets {
+		ok, err := path.Match(pattern, info.name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid packet pattern %q: %w", pattern, err)
+		}
+		if ok {
+			matches = append(matches, info.name)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("packet pattern %q matches no packets", pattern)
+	}
+	return matches, nil
+}
+
+// packetSelection is a set of packets selected by name, @group or wildcard pattern, such as the packets of which
+// hex dumps are logged.
+type packetSelection struct {
+	sync.RWMutex
+	all bool
+	m   map[string]bool
+}
+
+// newPacketSelection returns an empty packetSelection.
+func newPacketSelection() *packetSelection {
+	return &packetSelection{m: map[string]bool{}}
+}
+
+// addList adds a comma separated list of packets, wildcard patterns and @groups to the selection.
+func (sel *packetSelection) addList(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if err := sel.add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adds the packets referred to by the entry passed to the selection. The entry all selects all packets.
+func (sel *packetSelection) add(entry string) error {
+	sel.Lock()
+	defer sel.Unlock()
+	if entry == "all" {
+		sel.all = true
+		return nil
+	}
+	names, err := expandPacketNames([]string{entry})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		sel.m[name] = true
+	}
+	return nil
+}
+
+// replace replaces the packets in the selection with those of the selection passed, which must not be used
+// anymore afterwards.
+func (sel *packetSelection) replace(other *packetSelection) {
+	sel.Lock()
+	defer sel.Unlock()
+	sel.all, sel.m = other.all, other.m
+}
+
+// contains checks if the packet with the name passed is selected.
+func (sel *packetSelection) contains(name string) bool {
+	sel.RLock()
+	defer sel.RUnlock()
+	return sel.all || sel.m[name]
+}
+
+func init() {
+	registerCommand("groups", consoleCommand{
+		usage:       "[group]",
+		description: "Lists the packet groups that may be used in filters, such as @movement.",
+		run: func(args []string) {
+			groups := make([]string, 0, len(packetGroups))
+			for group := range packetGroups {
+				if len(args) == 0 || strings.EqualFold(strings.TrimPrefix(args[0], "@"), group) {
+					groups = append(groups, group)
+				}
+			}
+			if len(groups) == 0 {
+				log.Printf("Unknown packet group %q.\n", args[0])
+				return
+			}
+			sort.Strings(groups)
+			for _, group := range groups {
+				names, _ := groupPackets(group)
+				log.Printf("@%s: %s\n", group, strings.Join(names, ", "))
+			}
+		},
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandPacketNames(t *testing.T) {
+	names, err := expandPacketNames([]string{"@sounds", " Text ", "", "MoveActor*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"LevelSoundEvent", "PlaySound", "StopSound", "Text", "MoveActorAbsolute", "MoveActorDelta"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %v, want %v", names, want)
+	}
+	for _, name := range []string{"@nosuchgroup", "NoSuchPacket", "Zzz*", "[Text"} {
+		if _, err := expandPacketNames([]string{name}); err == nil {
+			t.Errorf("%q was expanded without error", name)
+		}
+	}
+}
+
+func TestGroupsOfPacket(t *testing.T) {
+	if groups := groupsOfPacket("SetTitle"); !reflect.DeepEqual(groups, []string{"chat", "ui"}) {
+		t.Errorf("groups of SetTitle = %v, want [chat ui]", groups)
+	}
+	if groups := groupsOfPacket("Login"); len(groups) != 0 {
+		t.Errorf("groups of Login = %v, want none", groups)
+	}
+	for group := range packetGroups {
+		names, ok := groupPackets(strings.ToUpper(group))
+		if !ok || len(names) == 0 {
+			t.Errorf("group %s could not be looked up case insensitively", group)
+		}
+		for _, name := range names {
+			if !packetKnown(name) {
+				t.Errorf("group %s holds unknown packet %s", group, name)
+			}
+		}
+	}
+}
+
+func TestPacketSelection(t *testing.T) {
+	sel := newPacketSelection()
+	if err := sel.addList("Text, @sounds"); err != nil {
+		t.Fatal(err)
+	}
+	if !sel.contains("Text") || !sel.contains("PlaySound") || sel.contains("MovePlayer") {
+		t.Errorf("selection holds the wrong packets")
+	}
+	if err := sel.addList("NoSuchPacket"); err == nil {
+		t.Errorf("selection accepted an unknown packet")
+	}
+	all := newPacketSelection()
+	if err := all.add("all"); err != nil {
+		t.Fatal(err)
+	}
+	if !all.contains("MovePlayer") {
+		t.Errorf("selection of all packets does not contain MovePlayer")
+	}
+	sel.replace(all)
+	if !sel.contains("Login") {
+		t.Errorf("replaced selection does not contain all packets")
+	}
+}
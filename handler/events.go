@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionEvent is sent when a session starts or closes.
+type SessionEvent struct {
+	Time    time.Time
+	Session int64
+}
+
+// ChatEvent is sent for every chat message, whether sent by a client or by the server.
+type ChatEvent struct {
+	Time    time.Time
+	Session int64
+	// Direction is "serverbound" for messages sent by the client and "clientbound" for messages sent by the
+	// server.
+	Direction string
+	// TextType is the type of the Text packet, such as packet.TextTypeChat.
+	TextType byte
+	Source   string
+	Message  string
+	XUID     string
+}
+
+// CommandEvent is sent for every command executed by a client.
+type CommandEvent struct {
+	Time    time.Time
+	Session int64
+	// Command is the command line including the leading slash, such as /gamemode creative.
+	Command string
+}
+
+// DimensionEvent is sent when the server moves the player of a session to another dimension.
+type DimensionEvent struct {
+	Time    time.Time
+	Session int64
+	// Dimension is the dimension the player is moved to: 0 for the overworld, 1 for the nether and 2 for the end.
+	Dimension int32
+	Respawn   bool
+}
+
+// Events is a Handler that turns packets into typed events sent on channels, so that embedders interested in
+// session lifecycle, chat, commands or dimension changes don't need to implement a full packet handler. Channels
+// that are nil are skipped. Because handlers must not block, events are dropped when a channel is full.
+//
+// Sessions are reported as started when their first packet passes through the proxy. Packets of which the payload
+// is redacted, such as chat in gateway mode, produce no events.
+//
+//	func New(host handler.Host) (handler.Handler, error) {
+//		events := handler.NewEvents("chatlog", 64)
+//		go func() {
+//			for e := range events.Chat {
+//				host.Logf("#%d %s: %s", e.Session, e.Source, e.Message)
+//			}
+//		}()
+//		return events, nil
+//	}
+type Events struct {
+	SessionStarted   chan SessionEvent
+	SessionClosed    chan SessionEvent
+	Chat             chan ChatEvent
+	Commands         chan CommandEvent
+	DimensionChanges chan DimensionEvent
+
+	name     string
+	dropped  atomic.Uint64
+	mu       sync.Mutex
+	sessions map[int64]bool
+}
+
+// NewEvents returns Events with the name passed and all channels created with the buffer size passed.
+func NewEvents(name string, buffer int) *Events {
+	return &Events{
+		SessionStarted:   make(chan SessionEvent, buffer),
+		SessionClosed:    make(chan SessionEvent, buffer),
+		Chat:             make(chan ChatEvent, buffer),
+		Commands:         make(chan CommandEvent, buffer),
+		DimensionChanges: make(chan DimensionEvent, buffer),
+		name:             name,
+	}
+}
+
+// Dropped returns the amount of events dropped because their channel was full.
+func (ev *Events) Dropped() uint64 {
+	return ev.dropped.Load()
+}
+
+// Name ...
+func (ev *Events) Name() string {
+	return ev.name
+}
+
+// HandlePacket ...
+func (ev *Events) HandlePacket(e Event) {
+	ev.mu.Lock()
+	if ev.sessions == nil {
+		ev.sessions = map[int64]bool{}
+	}
+	started := !ev.sessions[e.Session]
+	ev.sessions[e.Session] = true
+	ev.mu.Unlock()
+	if started {
+		send(ev, ev.SessionStarted, SessionEvent{Time: e.Time, Session: e.Session})
+	}
+
+	switch pk := e.Packet.(type) {
+	case *packet.Text:
+		send(ev, ev.Chat, ChatEvent{
+			Time:      e.Time,
+			Session:   e.Session,
+			Direction: e.Direction,
+			TextType:  pk.TextType,
+			Source:    pk.SourceName,
+			Message:   pk.Message,
+			XUID:      pk.XUID,
+		})
+	case *packet.CommandRequest:
+		send(ev, ev.Commands, CommandEvent{Time: e.Time, Session: e.Session, Command: pk.CommandLine})
+	case *packet.ChangeDimension:
+		if e.Direction == "clientbound" {
+			send(ev, ev.DimensionChanges, DimensionEvent{Time: e.Time, Session: e.Session, Dimension: pk.Dimension, Respawn: pk.Respawn})
+		}
+	}
+}
+
+// HandleSessionClose ...
+func (ev *Events) HandleSessionClose(session int64) {
+	ev.mu.Lock()
+	delete(ev.sessions, session)
+	ev.mu.Unlock()
+	send(ev, ev.SessionClosed, SessionEvent{Time: time.Now(), Session: session})
+}
+
+// send sends the event passed on the channel passed without blocking, counting it as dropped if the channel is
+// full.
+func send[T any](ev *Events, c chan T, e T) {
+	if c == nil {
+		return
+	}
+	select {
+	case c <- e:
+	default:
+		ev.dropped.Add(1)
+	}
+}
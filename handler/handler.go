@@ -0,0 +1,125 @@
+// Package handler defines the interface between bds-mitm and packet handler plugins built using
+// go build -buildmode=plugin. A plugin must be built against the same version of this package and of gophertunnel
+// as the proxy loading it, and must export a function named New of the type NewFunc.
+//
+//	package main
+//
+//	import "bds-mitm/handler"
+//
+//	var APIVersion = handler.APIVersion
+//
+//	func New(host handler.Host) (handler.Handler, error) {
+//		return &myHandler{host: host}, nil
+//	}
+package handler
+
+import (
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"time"
+)
+
+// APIVersion is the version of the handler interface. Plugins may export a variable named APIVersion holding
+// the version they were built against, in which case the proxy refuses to load them if it differs.
+const APIVersion = 2
+
+// Event describes a packet passing through the proxy.
+type Event struct {
+	Time    time.Time
+	Session int64
+	// Direction is either "serverbound" for packets sent by the client or "clientbound" for packets sent by the
+	// server.
+	Direction string
+	Name      string
+	ID        uint32
+	Size      int
+	Packet    packet.Packet
+}
+
+// Handler is a packet handler implemented by a plugin.
+type Handler interface {
+	// Name returns the name of the plugin, which is used to refer to it in the console.
+	Name() string
+	// HandlePacket is called for every packet passing through the proxy. The packet is queued for the workers of
+	// the handler pool of the proxy when it is read, before it is forwarded, and handled asynchronously, so it may
+	// be handled before or after it was forwarded, possibly concurrently and out of order. A plugin that takes
+	// longer than the handler timeout to handle packets several times in a row is disabled. The packet must not be
+	// modified.
+	HandlePacket(e Event)
+	// HandleSessionClose is called with the ID of every session that is closed, on the goroutine closing it, so it
+	// must not block.
+	HandleSessionClose(session int64)
+}
+
+// Interceptor may be implemented by a Handler to modify or cancel packets before they are forwarded. Unlike
+// HandlePacket, InterceptPacket is called on the goroutine reading the packet before it is forwarded, so the packet
+// is delayed for as long as it runs, and it must not block. Packets are not intercepted in gateway mode or if their
+// payload is redacted.
+type Interceptor interface {
+	// InterceptPacket returns the packet to forward in place of the packet of the event, which may be the same
+	// packet modified, or nil to cancel the packet. Handlers and listeners receive the packet returned.
+	InterceptPacket(e Event) packet.Packet
+}
+
+// Host is implemented by the proxy and passed to plugins so that they may act on sessions.
+type Host interface {
+	// Logf logs a message formatted using the format and arguments passed, prefixed with the name of the plugin.
+	Logf(format string, args ...any)
+	// SendToClient sends a packet to the client of the session with the ID passed.
+	SendToClient(session int64, pk packet.Packet) error
+	// SendToServer sends a packet to the upstream server of the session with the ID passed, as if the client sent
+	// it.
+	SendToServer(session int64, pk packet.Packet) error
+	// Disconnect disconnects the client of the session with the ID passed with the message passed.
+	Disconnect(session int64, message string) error
+	// KV returns the persistent key-value store of the plugin.
+	KV() KV
+	// After runs f once for the session with the ID passed after the delay passed. The task is cancelled when the
+	// session closes.
+	After(session int64, delay time.Duration, f func()) (Task, error)
+	// Every runs f for the session with the ID passed every interval passed, starting one interval from now, until
+	// the task is cancelled or the session closes. Intervals are at least one tick long, and a run is skipped if
+	// the previous run is still in progress.
+	Every(session int64, interval time.Duration, f func()) (Task, error)
+	// HTTP returns the HTTP client of the plugin.
+	HTTP() HTTPClient
+}
+
+// HTTPClient sends HTTP requests on behalf of a plugin. Requests may only be sent to the hosts allowlisted by the
+// proxy, and the amount of requests a plugin sends per minute is limited. Requests block until a response is
+// received, so they should not be sent from HandlePacket.
+type HTTPClient interface {
+	// Request sends a request with the method, URL and body passed, which may be nil, and returns the status code
+	// and body of the response. Large response bodies are truncated.
+	Request(method, url, contentType string, body []byte) (status int, resp []byte, err error)
+	// Get sends a GET request to the URL passed and returns the status code and body of the response.
+	Get(url string) (status int, resp []byte, err error)
+	// PostJSON sends a POST request with v encoded as JSON to the URL passed and returns the status code and body
+	// of the response.
+	PostJSON(url string, v any) (status int, resp []byte, err error)
+}
+
+// Task is a function scheduled by a plugin using Host.After or Host.Every.
+type Task interface {
+	// Cancel stops the task. It does not interrupt a run of the task that is in progress.
+	Cancel()
+}
+
+// KV is a persistent key-value store. Values survive restarts of the proxy, and the values of a plugin are kept
+// apart from those of other plugins.
+type KV interface {
+	// Get returns the value stored under the key passed. False is returned if no value is stored under the key.
+	Get(key string) (value []byte, ok bool, err error)
+	// Set stores the value passed under the key passed, overwriting any value already stored under it.
+	Set(key string, value []byte) error
+	// Delete removes the value stored under the key passed, if any.
+	Delete(key string) error
+	// Increment atomically adds delta to the counter stored under the key passed and returns the new value.
+	// Counters start at 0.
+	Increment(key string, delta int64) (int64, error)
+	// Keys returns the keys that start with the prefix passed, in sorted order.
+	Keys(prefix string) ([]string, error)
+}
+
+// NewFunc is the type of the function named New that plugins must export. It is called once when the plugin is
+// loaded.
+type NewFunc = func(host Host) (Handler, error)
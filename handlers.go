@@ -0,0 +1,235 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handlerWorkers is the amount of workers that user handlers are run on.
+var handlerWorkers = 4
+
+// handlerTimeout is the time a user handler may take to handle a single packet before it counts as a strike.
+var handlerTimeout = time.Millisecond * 50
+
+// handlerMaxStrikes is the amount of times in a row a user handler may exceed handlerTimeout before it is
+// disabled.
+var handlerMaxStrikes int64 = 3
+
+// handlerQueueSize is the amount of packet events that may wait for a worker before new events are dropped.
+const handlerQueueSize = 4096
+
+// userHandler is a packet handler provided by a plugin. User handlers run on
+// the handler pool so that they can't slow down forwarding packets.
+type userHandler struct {
+	name string
+	f    func(e packetEvent)
+
+	disabled   atomic.Bool
+	calls      atomic.Int64
+	timeouts   atomic.Int64
+	strikes    atomic.Int64
+	totalNanos atomic.Int64
+}
+
+// handlerJob is a packet event waiting to be handled by a user handler.
+type handlerJob struct {
+	h *userHandler
+	e packetEvent
+}
+
+// handlerWorker is a worker of the handler pool, running one user handler at a time.
+type handlerWorker struct {
+	mu        sync.Mutex
+	h         *userHandler
+	start     time.Time
+	abandoned bool
+}
+
+// handlerPool runs user handlers on a bounded amount of workers. Events are handled asynchronously, so handlers
+// may observe events of the same session out of order when more than one worker is used.
+var handlerPool = struct {
+	sync.Mutex
+	handlers []*userHandler
+	workers  map[*handlerWorker]struct{}
+	jobs     chan handlerJob
+	dropped  atomic.Int64
+}{}
+
+// startHandlerPool starts the workers of the handler pool and registers the listener passing packets to them, if
+// the pool is not yet running. It must be called before any client connects, after which user handlers may be
+// added at any time.
+func startHandlerPool() {
+	handlerPool.Lock()
+	defer handlerPool.Unlock()
+	if handlerPool.jobs != nil {
+		return
+	}
+	handlerPool.jobs = make(chan handlerJob, handlerQueueSize)
+	handlerPool.workers = map[*handlerWorker]struct{}{}
+	for i := 0; i < handlerWorkers; i++ {
+		startHandlerWorker()
+	}
+	go watchHandlerWorkers()
+	addPacketListener(dispatchUserHandlers)
+}
+
+// addUserHandler registers a user handler called with every packet passing through the proxy and returns it. The
+// handler pool is started if it is not yet running, so handlers added after clients may have connected require
+// startHandlerPool to have been called on startup.
+func addUserHandler(name string, f func(e packetEvent)) *userHandler {
+	startHandlerPool()
+	handlerPool.Lock()
+	defer handlerPool.Unlock()
+	h := &userHandler{name: name, f: f}
+	handlerPool.handlers = append(handlerPool.handlers, h)
+	return h
+}
+
+// dispatchUserHandlers queues the packet event passed for all enabled user handlers. Events are dropped if the
+// queue is full, so that reading packets never blocks on user handlers.
+func dispatchUserHandlers(e packetEvent) {
+	handlerPool.Lock()
+	handlers := handlerPool.handlers
+	handlerPool.Unlock()
+	for _, h := range handlers {
+		if h.disabled.Load() {
+			continue
+		}
+		select {
+		case handlerPool.jobs <- handlerJob{h: h, e: e}:
+		default:
+			handlerPool.dropped.Add(1)
+		}
+	}
+}
+
+// startHandlerWorker starts a new worker of the handler pool. The pool must be locked.
+func startHandlerWorker() {
+	w := &handlerWorker{}
+	handlerPool.workers[w] = struct{}{}
+	go w.run()
+}
+
+// run runs queued user handlers until the worker is abandoned by the watchdog, in which case it stops once the
+// handler it is running returns, as a new worker has taken its place.
+func (w *handlerWorker) run() {
+	for job := range handlerPool.jobs {
+		h := job.h
+		if h.disabled.Load() {
+			continue
+		}
+		w.mu.Lock()
+		w.h, w.start = h, time.Now()
+		w.mu.Unlock()
+
+		runUserHandler(h, job.e)
+
+		w.mu.Lock()
+		took, abandoned := time.Since(w.start), w.abandoned
+		w.h = nil
+		w.mu.Unlock()
+		h.calls.Add(1)
+		h.totalNanos.Add(int64(took))
+		if abandoned {
+			return
+		}
+		h.strikes.Store(0)
+	}
+}
+
+// runUserHandler calls the user handler passed with the event passed, recovering from panics.
+func runUserHandler(h *userHandler, e packetEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Handler %s panicked: %v\n", h.name, r)
+		}
+	}()
+	h.f(e)
+}
+
+// watchHandlerWorkers checks the workers of the handler pool for handlers exceeding the timeout. A worker running
+// such a handler is abandoned and replaced by a new worker, so that the pool keeps handling events while the
+// handler runs to completion in the background. Handlers exceeding the timeout too many times in a row are
+// disabled, which bounds the amount of abandoned workers.
+func watchHandlerWorkers() {
+	t := time.NewTicker(handlerTimeout / 2)
+	defer t.Stop()
+	for range t.C {
+		handlerPool.Lock()
+		for w := range handlerPool.workers {
+			w.mu.Lock()
+			h := w.h
+			exceeded := h != nil && !w.abandoned && time.Since(w.start) > handlerTimeout
+			if exceeded {
+				w.abandoned = true
+			}
+			w.mu.Unlock()
+			if !exceeded {
+				continue
+			}
+			delete(handlerPool.workers, w)
+			startHandlerWorker()
+			h.timeouts.Add(1)
+			if h.strikes.Add(1) >= handlerMaxStrikes && h.disabled.CompareAndSwap(false, true) {
+				log.Printf("Disabled handler %s: it exceeded its time limit of %v %d times in a row\n", h.name, handlerTimeout, handlerMaxStrikes)
+			}
+		}
+		handlerPool.Unlock()
+	}
+}
+
+// userHandlerByName returns the user handler with the name passed, or nil if no such handler exists.
+func userHandlerByName(name string) *userHandler {
+	handlerPool.Lock()
+	defer handlerPool.Unlock()
+	for _, h := range handlerPool.handlers {
+		if h.name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerCommand("handlers", consoleCommand{
+		usage:       "[enable|disable <handler>]",
+		description: "Lists user handlers with their execution times, or enables or disables a handler.",
+		run: func(args []string) {
+			if len(args) == 2 && (args[0] == "enable" || args[0] == "disable") {
+				h := userHandlerByName(args[1])
+				if h == nil {
+					log.Printf("Unknown handler %q.\n", args[1])
+					return
+				}
+				h.strikes.Store(0)
+				h.disabled.Store(args[0] == "disable")
+				log.Printf("Handler %s is now %sd.\n", h.name, args[0])
+				return
+			}
+			handlerPool.Lock()
+			handlers := append([]*userHandler(nil), handlerPool.handlers...)
+			handlerPool.Unlock()
+			if len(handlers) == 0 {
+				log.Println("No handlers are registered.")
+				return
+			}
+			sort.Slice(handlers, func(i, j int) bool {
+				return handlers[i].name < handlers[j].name
+			})
+			for _, h := range handlers {
+				status, avg := "enabled", time.Duration(0)
+				if h.disabled.Load() {
+					status = "disabled"
+				}
+				if calls := h.calls.Load(); calls > 0 {
+					avg = time.Duration(h.totalNanos.Load() / calls)
+				}
+				log.Printf("%-24s %-8s calls=%d avg=%v timeouts=%d\n", h.name, status, h.calls.Load(), avg.Round(time.Microsecond), h.timeouts.Load())
+			}
+			log.Printf("%d events were dropped because all workers were busy.\n", handlerPool.dropped.Load())
+		},
+	})
+}
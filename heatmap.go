@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSubcommand("heatmap", "Writes a heatmap per chunk of the movement and interactions of the players of a capture as JSON and PNG", runHeatmap)
+}
+
+// heatmapDir is the directory that heatmaps of sessions are written to when they close, or an empty string to not
+// write heatmaps.
+var heatmapDir string
+
+// heatmapScale is the width and height in pixels of a chunk in heatmap images.
+var heatmapScale = 8
+
+// heatmapMaxSize is the maximum width and height in pixels of a heatmap image. Chunks are drawn smaller if the area
+// visited is too large to be drawn at the heatmap scale.
+const heatmapMaxSize = 4096
+
+// heatmapCell holds the activity of a player in a single chunk.
+type heatmapCell struct {
+	X int32 `json:"x"`
+	Z int32 `json:"z"`
+	// Movement is the amount of movement packets sent in the chunk. Clients send a movement packet every tick
+	// while moving, or every tick regardless if movement is server authoritative, so it is a measure of the time
+	// spent in the chunk.
+	Movement int `json:"movement"`
+	// Interactions is the amount of blocks broken, placed or used in the chunk.
+	Interactions int `json:"interactions"`
+}
+
+// heatmap aggregates the movement and interaction packets of a session per chunk and dimension.
+type heatmap struct {
+	dimension int32
+	cells     map[int32]map[protocol.ChunkPos]*heatmapCell
+}
+
+// newHeatmap returns an empty heatmap of a player starting in the dimension passed.
+func newHeatmap(dimension int32) *heatmap {
+	return &heatmap{dimension: dimension, cells: map[int32]map[protocol.ChunkPos]*heatmapCell{}}
+}
+
+// cell returns the cell of the chunk at the block coordinates passed in the current dimension.
+func (h *heatmap) cell(x, z int32) *heatmapCell {
+	cells, ok := h.cells[h.dimension]
+	if !ok {
+		cells = map[protocol.ChunkPos]*heatmapCell{}
+		h.cells[h.dimension] = cells
+	}
+	pos := protocol.ChunkPos{x >> 4, z >> 4}
+	c, ok := cells[pos]
+	if !ok {
+		c = &heatmapCell{X: pos.X(), Z: pos.Z()}
+		cells[pos] = c
+	}
+	return c
+}
+
+// move counts a movement packet at the position passed.
+func (h *heatmap) move(x, z float32) {
+	h.cell(int32(math.Floor(float64(x))), int32(math.Floor(float64(z)))).Movement++
+}
+
+// interact counts an interaction with the block at the position passed.
+func (h *heatmap) interact(pos protocol.BlockPos) {
+	h.cell(pos.X(), pos.Z()).Interactions++
+}
+
+// add counts the packet passed, sent by the server if fromServer is true, if it is a movement or interaction
+// packet of the player.
+func (h *heatmap) add(pk packet.Packet, fromServer bool) {
+	if fromServer {
+		switch pk := pk.(type) {
+		case *packet.StartGame:
+			h.dimension = pk.Dimension
+		case *packet.ChangeDimension:
+			h.dimension = pk.Dimension
+		}
+		return
+	}
+	switch pk := pk.(type) {
+	case *packet.PlayerAuthInput:
+		h.move(pk.Position[0], pk.Position[2])
+		for _, action := range pk.BlockActions {
+			if action.Action == protocol.PlayerActionPredictDestroyBlock {
+				h.interact(action.BlockPos)
+			}
+		}
+	case *packet.MovePlayer:
+		h.move(pk.Position[0], pk.Position[2])
+	case *packet.PlayerAction:
+		if pk.ActionType == protocol.PlayerActionCreativePlayerDestroyBlock {
+			h.interact(pk.BlockPosition)
+		}
+	case *packet.InventoryTransaction:
+		if data, ok := pk.TransactionData.(*protocol.UseItemTransactionData); ok && data.ActionType != protocol.UseItemActionClickAir {
+			h.interact(data.BlockPosition)
+		}
+	}
+}
+
+// heatmapReport is a heatmap of a session written as JSON.
+type heatmapReport struct {
+	Session  int64  `json:"session"`
+	Player   string `json:"player,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	// Dimensions holds the cells visited in each dimension, indexed by the name of the dimension.
+	Dimensions map[string][]*heatmapCell `json:"dimensions"`
+}
+
+// dimensionName returns the name of the dimension passed used in heatmap files.
+func dimensionName(dimension int32) string {
+	switch dimension {
+	case 0:
+		return "overworld"
+	case 1:
+		return "nether"
+	case 2:
+		return "end"
+	}
+	return fmt.Sprintf("dimension-%d", dimension)
+}
+
+// write writes the heatmap as JSON to the base path passed with the .json extension, and as an image per dimension
+// to the base path with the name of the dimension and the .png extension.
+func (h *heatmap) write(base string, report heatmapReport) error {
+	report.Dimensions = map[string][]*heatmapCell{}
+	for dimension, cells := range h.cells {
+		list := make([]*heatmapCell, 0, len(cells))
+		for _, c := range cells {
+			list = append(list, c)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].X != list[j].X {
+				return list[i].X < list[j].X
+			}
+			return list[i].Z < list[j].Z
+		})
+		report.Dimensions[dimensionName(dimension)] = list
+		if err := writeHeatmapImage(fmt.Sprintf("%s.%s.png", base, dimensionName(dimension)), list); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(base+".json", b, 0644)
+}
+
+// heatColour returns the colour of a cell with the fraction of the maximum activity passed, ranging from dark blue
+// for little activity to red and yellow for the most activity.
+func heatColour(f float64) color.RGBA {
+	switch {
+	case f < 0.5:
+		return color.RGBA{R: uint8(f * 2 * 255), B: uint8((1 - f*2) * 200), A: 255}
+	default:
+		return color.RGBA{R: 255, G: uint8((f - 0.5) * 2 * 255), A: 255}
+	}
+}
+
+// writeHeatmapImage draws the cells passed to a PNG image at the path passed. The colour of a chunk depends on the
+// logarithm of its movement, and chunks with interactions are outlined in white.
+func writeHeatmapImage(path string, cells []*heatmapCell) error {
+	if len(cells) == 0 {
+		return nil
+	}
+	minX, maxX, minZ, maxZ := cells[0].X, cells[0].X, cells[0].Z, cells[0].Z
+	var most int
+	for _, c := range cells {
+		minX, maxX = min(minX, c.X), max(maxX, c.X)
+		minZ, maxZ = min(minZ, c.Z), max(maxZ, c.Z)
+		most = max(most, c.Movement)
+	}
+	width, height := int(maxX-minX+1), int(maxZ-minZ+1)
+	if width > heatmapMaxSize || height > heatmapMaxSize {
+		log.Printf("Not drawing %s: the area visited is %dx%d chunks, which is too large\n", path, width, height)
+		return nil
+	}
+	scale := heatmapScale
+	for scale > 1 && (width*scale > heatmapMaxSize || height*scale > heatmapMaxSize) {
+		scale /= 2
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width*scale, height*scale))
+	for _, c := range cells {
+		f := 0.0
+		if most > 0 {
+			f = math.Log1p(float64(c.Movement)) / math.Log1p(float64(most))
+		}
+		colour := heatColour(f)
+		x0, y0 := int(c.X-minX)*scale, int(c.Z-minZ)*scale
+		for dx := 0; dx < scale; dx++ {
+			for dy := 0; dy < scale; dy++ {
+				border := dx == 0 || dy == 0 || dx == scale-1 || dy == scale-1
+				if c.Interactions > 0 && border && scale > 2 {
+					img.SetRGBA(x0+dx, y0+dy, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+					continue
+				}
+				img.SetRGBA(x0+dx, y0+dy, colour)
+			}
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// sessionHeatmap is the heatmap of an active session with the path it is written to when the session closes.
+type sessionHeatmap struct {
+	*heatmap
+	base   string
+	report heatmapReport
+}
+
+// heatmaps holds the heatmaps of active sessions, indexed by session ID.
+var heatmaps = struct {
+	sync.Mutex
+	m map[int64]*sessionHeatmap
+}{m: map[int64]*sessionHeatmap{}}
+
+// startHeatmaps starts aggregating the movement and interactions of players of all sessions, writing a heatmap to
+// the heatmap directory when a session closes.
+func startHeatmaps() error {
+	if err := os.MkdirAll(heatmapDir, 0755); err != nil {
+		return err
+	}
+	addPacketListener(func(e packetEvent) {
+		if e.Packet == nil {
+			return
+		}
+		heatmaps.Lock()
+		defer heatmaps.Unlock()
+		h, ok := heatmaps.m[e.Session]
+		if !ok {
+			s, found := sessionByID(e.Session)
+			if !found {
+				return
+			}
+			h = &sessionHeatmap{
+				heatmap: newHeatmap(s.server.GameData().Dimension),
+				base:    filepath.Join(heatmapDir, fmt.Sprintf("heatmap-session-%d-%s", s.id, s.started.Format("20060102-150405"))),
+				report:  heatmapReport{Session: s.id, Player: s.client.IdentityData().DisplayName, Upstream: s.upstream},
+			}
+			heatmaps.m[e.Session] = h
+		}
+		h.add(e.Packet, e.Direction == "clientbound")
+	})
+	addSessionCloseListener(func(id int64) {
+		heatmaps.Lock()
+		h, ok := heatmaps.m[id]
+		delete(heatmaps.m, id)
+		heatmaps.Unlock()
+		if !ok {
+			return
+		}
+		if err := h.write(h.base, h.report); err != nil {
+			log.Printf("An error occurred whilst writing the heatmap of session %d: %v\n", id, err)
+			return
+		}
+		log.Printf("Wrote heatmap of session %d to %s.json\n", id, h.base)
+	})
+	return nil
+}
+
+// runHeatmap runs the heatmap subcommand, which writes a heatmap of every session of a capture.
+func runHeatmap(args []string) error {
+	fs := flag.NewFlagSet("heatmap", flag.ExitOnError)
+	out := fs.String("o", ".", "Directory to write the heatmaps to")
+	sessionID := fs.Uint64("session", 0, "Session to write a heatmap of, or 0 for all sessions")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	fs.IntVar(&heatmapScale, "scale", heatmapScale, "Width and height in pixels of a chunk in heatmap images")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || heatmapScale < 1 {
+		return errors.New("usage: heatmap [-o directory] [-session id] [-scale 8] [-shield-id id] <capture|manifest>")
+	}
+	files, err := capture.Files(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sessions := map[uint64]*heatmap{}
+	var start int64
+	for _, file := range files {
+		err := forEachRecord(file, func(r capture.Record) error {
+			if *sessionID != 0 && r.Session != *sessionID || r.IsAnnotation() {
+				return nil
+			}
+			if start == 0 {
+				start = r.TimeUnixNano
+			}
+			pk, err := decodePacket(r.PacketID, r.Payload, int32(*shieldID))
+			if err != nil {
+				return nil
+			}
+			h, ok := sessions[r.Session]
+			if !ok {
+				h = newHeatmap(0)
+				sessions[r.Session] = h
+			}
+			h.add(pk, r.Direction == capture.DirectionClientbound)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	for id, h := range sessions {
+		base := filepath.Join(*out, fmt.Sprintf("heatmap-session-%d-%s", id, time.Unix(0, start).Format("20060102-150405")))
+		if err := h.write(base, heatmapReport{Session: int64(id)}); err != nil {
+			return err
+		}
+		log.Printf("Wrote heatmap of session %d to %s.json\n", id, base)
+	}
+	return nil
+}
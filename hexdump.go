@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+)
+
+// hexdumpPackets holds the packets of which the serialized bytes are logged in addition to their decoded
+// fields.
+var hexdumpPackets = newPacketSelection()
+
+// rawPacket returns the serialized payload of a packet of the session, excluding its header. Packets are
+// re-encoded after being decoded, which produces the bytes sent over the wire as gophertunnel rejects packets
+// that are not decoded completely. Packets unknown to gophertunnel hold their bytes as they were received.
+func (s *session) rawPacket(pk packet.Packet) []byte {
+	if unknown, ok := pk.(*packet.Unknown); ok {
+		return unknown.Payload
+	}
+	var id int32
+	if s.server != nil {
+		id = shieldID(s.server.GameData())
+	}
+	return encodePacket(pk, id)
+}
+
+// logHexdump logs the serialized bytes of a packet of the session in the canonical hex and ASCII format.
+func (s *session) logHexdump(fields logFields, pk packet.Packet) {
+	b := s.rawPacket(pk)
+	logf(fields, "Raw Data (%d bytes):\n%s", len(b), hex.Dump(b))
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+func init() {
+	registerSubcommand("import", "Converts a pcap or pcapng capture of Bedrock traffic, or packets exported as NDJSON, to a capture file", runImport)
+}
+
+// runImport runs the import subcommand, which reassembles the RakNet connections in a packet capture taken by
+// another tool, such as Wireshark or tcpdump, and writes the game packets they carried to a capture file that the
+// other tools of the proxy can read. Connections that are encrypted can only be decoded if their key is passed.
+// Files ending in .ndjson or .jsonl are instead read as packets written by the export subcommand.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	out := fs.String("o", "", "Output file (defaults to <input>.bdscap)")
+	server := fs.String("server", "", "Address of the server in the capture, detected from connection requests by default")
+	key := fs.String("key", "", "Hex encoded 32 byte encryption key of the connections in the capture")
+	keyFile := fs.String("keys", "", "File of client address and hex encoded key pairs, one pair per line")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to encode item stacks of NDJSON packets")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: import [-o output] [-server host:port] [-key hex] [-keys file] [-shield-id id] <capture.pcap|capture.ndjson>")
+	}
+	in := fs.Arg(0)
+	if strings.HasSuffix(in, ".ndjson") || strings.HasSuffix(in, ".jsonl") {
+		return runNDJSONImport(in, *out, *server, int32(*shieldID))
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(strings.TrimSuffix(in, ".pcapng"), ".pcap") + ".bdscap"
+	}
+	imp := &pcapImporter{keys: map[string][32]byte{}, conns: map[[2]netip.AddrPort]*raknetConn{}}
+	if *server != "" {
+		addr, err := netip.ParseAddrPort(*server)
+		if err != nil {
+			return fmt.Errorf("invalid server address: %w", err)
+		}
+		imp.server = addr
+	}
+	if *key != "" {
+		k, err := parseImportKey(*key)
+		if err != nil {
+			return err
+		}
+		imp.keys["*"] = k
+	}
+	if *keyFile != "" {
+		if err := imp.readKeys(*keyFile); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	imp.out = dst
+	if err := readUDPDatagrams(src, imp.handle); err != nil {
+		return err
+	}
+	if imp.enc == nil {
+		return errors.New("no Bedrock connections found in the capture")
+	}
+	for _, c := range imp.sortedConns() {
+		if c.undecodable > 0 {
+			log.Printf("Session %d (%s): %d batches could not be decoded: %v\n", c.session, c.client, c.undecodable, c.lastErr)
+		}
+	}
+	log.Printf("Imported %d packets of %d sessions to %s\n", imp.records, len(imp.conns), *out)
+	return dst.Close()
+}
+
+// parseImportKey parses a hex encoded 32 byte encryption key.
+func parseImportKey(s string) ([32]byte, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != 32 {
+		return [32]byte{}, fmt.Errorf("invalid key %q: expected 64 hex characters", s)
+	}
+	return [32]byte(b), nil
+}
+
+// pcapImporter converts the RakNet connections in a packet capture to a capture file.
+type pcapImporter struct {
+	server netip.AddrPort
+	// keys holds the encryption keys of connections indexed by the address of the client, or * for the key of
+	// all connections.
+	keys  map[string][32]byte
+	conns map[[2]netip.AddrPort]*raknetConn
+
+	out     *os.File
+	enc     *capture.Encoder
+	records int
+}
+
+// readKeys reads client address and key pairs from the file at the path passed.
+func (imp *pcapImporter) readKeys(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("keys %s: expected client address and key, got %q", path, scanner.Text())
+		}
+		k, err := parseImportKey(fields[1])
+		if err != nil {
+			return fmt.Errorf("keys %s: %w", path, err)
+		}
+		imp.keys[fields[0]] = k
+	}
+	return scanner.Err()
+}
+
+// sortedConns returns the connections found in the capture sorted by session number.
+func (imp *pcapImporter) sortedConns() []*raknetConn {
+	conns := make([]*raknetConn, 0, len(imp.conns))
+	for _, c := range imp.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].session < conns[j].session
+	})
+	return conns
+}
+
+// IDs of RakNet messages handled when importing captures.
+const (
+	raknetOpenConnectionRequest1 = 0x05
+	raknetGamePacket             = 0xfe
+)
+
+// handle handles a UDP datagram of the capture.
+func (imp *pcapImporter) handle(d udpDatagram) error {
+	if len(d.payload) == 0 {
+		return nil
+	}
+	key := [2]netip.AddrPort{d.src, d.dst}
+	c, ok := imp.conns[key]
+	if !ok {
+		c, ok = imp.conns[[2]netip.AddrPort{d.dst, d.src}]
+	}
+	if !ok {
+		// Connections are detected by their first connection request, which is sent by the client, unless the
+		// server address was passed.
+		switch {
+		case imp.server.IsValid() && d.dst == imp.server:
+		case imp.server.IsValid() && d.src == imp.server:
+			key = [2]netip.AddrPort{d.dst, d.src}
+		case !imp.server.IsValid() && d.payload[0] == raknetOpenConnectionRequest1:
+		default:
+			return nil
+		}
+		c = newRaknetConn(imp, key[0], key[1], len(imp.conns)+1)
+		imp.conns[key] = c
+	}
+	if d.payload[0]&0x80 == 0 || d.payload[0]&0x60 != 0 || len(d.payload) < 4 {
+		// Offline messages, ACKs and NACKs carry no game packets.
+		return nil
+	}
+	return c.handleDatagram(d.src == c.server, d)
+}
+
+// write writes a packet of a connection to the capture file, creating it when the first packet is written.
+func (imp *pcapImporter) write(c *raknetConn, fromServer bool, d udpDatagram, data []byte) error {
+	if imp.enc == nil {
+		proto := c.protocol
+		if proto == 0 {
+			proto = protocol.CurrentProtocol
+		}
+		var err error
+		imp.enc, err = capture.NewEncoder(imp.out, capture.Header{
+			CreatedUnixNano:  d.time.UnixNano(),
+			Upstream:         c.server.String(),
+			Protocol:         proto,
+			MinecraftVersion: protocol.CurrentVersion,
+			DedupMinSize:     uint32(captureDedupMinSize),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	id, payload := splitPacketHeader(data)
+	direction := capture.DirectionServerbound
+	if fromServer {
+		direction = capture.DirectionClientbound
+	}
+	imp.records++
+	return imp.enc.Encode(capture.Record{
+		TimeUnixNano: d.time.UnixNano(),
+		Session:      uint64(c.session),
+		Direction:    direction,
+		PacketID:     id,
+		PacketName:   packetName(id),
+		Payload:      payload,
+	})
+}
+
+// raknetConn is a RakNet connection between a client and a server reassembled from a packet capture.
+type raknetConn struct {
+	imp            *pcapImporter
+	client, server netip.AddrPort
+	session        int
+	protocol       int32
+	// directions holds the state of the serverbound and clientbound directions of the connection.
+	directions [2]*raknetDirection
+
+	undecodable int
+	lastErr     error
+}
+
+// raknetDirection holds the reassembly and decoding state of one direction of a RakNet connection.
+type raknetDirection struct {
+	seen   map[uint32]bool
+	splits map[uint16]map[uint32][]byte
+	// nextOrder holds the next order index expected on every channel, and pending messages received ahead of
+	// it.
+	nextOrder [32]uint32
+	pending   [32]map[uint32][]byte
+
+	batches *batchReader
+	dec     *packet.Decoder
+	broken  bool
+}
+
+// newRaknetConn returns a connection between the client and server passed.
+func newRaknetConn(imp *pcapImporter, client, server netip.AddrPort, session int) *raknetConn {
+	c := &raknetConn{imp: imp, client: client, server: server, session: session}
+	for i := range c.directions {
+		batches := &batchReader{}
+		dec := packet.NewDecoder(batches)
+		dec.DisableBatchPacketLimit()
+		c.directions[i] = &raknetDirection{seen: map[uint32]bool{}, splits: map[uint16]map[uint32][]byte{}, batches: batches, dec: dec}
+	}
+	return c
+}
+
+// handleDatagram handles a datagram holding frames of the connection.
+func (c *raknetConn) handleDatagram(fromServer bool, d udpDatagram) error {
+	dir := c.directions[0]
+	if fromServer {
+		dir = c.directions[1]
+	}
+	b := d.payload[4:]
+	for len(b) >= 3 {
+		flags := b[0]
+		reliability, split := flags>>5, flags&0x10 != 0
+		length := int(binary.BigEndian.Uint16(b[1:])+7) / 8
+		b = b[3:]
+		var messageIndex, orderIndex uint32
+		var channel byte
+		if reliability == 2 || reliability == 3 || reliability == 4 || reliability == 6 || reliability == 7 {
+			if len(b) < 3 {
+				return nil
+			}
+			messageIndex, b = uint24(b), b[3:]
+		}
+		if reliability == 1 || reliability == 4 {
+			if len(b) < 3 {
+				return nil
+			}
+			b = b[3:]
+		}
+		ordered := reliability == 1 || reliability == 3 || reliability == 4 || reliability == 7
+		if ordered {
+			if len(b) < 4 {
+				return nil
+			}
+			orderIndex, channel, b = uint24(b), b[3]&31, b[4:]
+		}
+		var splitCount, splitIndex uint32
+		var splitID uint16
+		if split {
+			if len(b) < 10 {
+				return nil
+			}
+			splitCount, splitID, splitIndex, b = binary.BigEndian.Uint32(b), binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint32(b[6:]), b[10:]
+		}
+		if len(b) < length {
+			return nil
+		}
+		content := b[:length]
+		b = b[length:]
+
+		if reliability >= 2 && reliability != 5 {
+			if dir.seen[messageIndex] {
+				// Retransmission of a message already handled.
+				continue
+			}
+			dir.seen[messageIndex] = true
+		}
+		if split {
+			parts, ok := dir.splits[splitID]
+			if !ok {
+				parts = map[uint32][]byte{}
+				dir.splits[splitID] = parts
+			}
+			parts[splitIndex] = append([]byte(nil), content...)
+			if uint32(len(parts)) < splitCount {
+				continue
+			}
+			delete(dir.splits, splitID)
+			content = nil
+			for i := uint32(0); i < splitCount; i++ {
+				content = append(content, parts[i]...)
+			}
+		}
+		if !ordered {
+			if err := c.handleMessage(fromServer, dir, d, content); err != nil {
+				return err
+			}
+			continue
+		}
+		if dir.pending[channel] == nil {
+			dir.pending[channel] = map[uint32][]byte{}
+		}
+		dir.pending[channel][orderIndex] = content
+		for {
+			msg, ok := dir.pending[channel][dir.nextOrder[channel]]
+			if !ok {
+				break
+			}
+			delete(dir.pending[channel], dir.nextOrder[channel])
+			dir.nextOrder[channel]++
+			if err := c.handleMessage(fromServer, dir, d, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleMessage handles a complete RakNet message of the connection. Game packet batches are decoded and their
+// packets written to the capture.
+func (c *raknetConn) handleMessage(fromServer bool, dir *raknetDirection, d udpDatagram, msg []byte) error {
+	if len(msg) == 0 || msg[0] != raknetGamePacket || dir.broken {
+		return nil
+	}
+	dir.batches.next = msg
+	packets, err := dir.dec.Decode()
+	if err != nil {
+		c.undecodable++
+		c.lastErr = err
+		if dir.batches.encrypted {
+			// The decryption state is lost once a batch fails to decode, so no further batches can be read.
+			dir.broken = true
+		}
+		return nil
+	}
+	for _, data := range packets {
+		c.handlePacket(fromServer, data)
+		if err := c.imp.write(c, fromServer, d, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePacket updates the decoding state of the connection after a packet that enables compression or
+// encryption.
+func (c *raknetConn) handlePacket(fromServer bool, data []byte) {
+	id, payload := splitPacketHeader(data)
+	switch {
+	case id == packet.IDRequestNetworkSettings && !fromServer && len(payload) >= 4:
+		c.protocol = int32(binary.BigEndian.Uint32(payload))
+	case id == packet.IDNetworkSettings && fromServer && len(payload) >= 4:
+		algorithm := binary.LittleEndian.Uint16(payload[2:])
+		compression, ok := packet.CompressionByID(algorithm)
+		if !ok {
+			compression = packet.FlateCompression{}
+		}
+		if c.protocol >= 649 {
+			// Batches start with the ID of the algorithm they are compressed with since 1.20.60.
+			compression = prefixedCompression{compression}
+		}
+		for _, dir := range c.directions {
+			dir.dec.EnableCompression(compression)
+		}
+	case id == packet.IDServerToClientHandshake && fromServer:
+		key, ok := c.imp.keys[c.client.String()]
+		if !ok {
+			key, ok = c.imp.keys[c.client.Addr().String()]
+		}
+		if !ok {
+			key, ok = c.imp.keys["*"]
+		}
+		if !ok {
+			log.Printf("Session %d (%s) is encrypted, but no key was passed for it: only the login was imported\n", c.session, c.client)
+			for _, dir := range c.directions {
+				dir.broken = true
+			}
+			return
+		}
+		for _, dir := range c.directions {
+			dir.dec.EnableEncryption(key)
+			dir.batches.encrypted = true
+		}
+	}
+}
+
+// prefixedCompression decompresses batches prefixed with the ID of the compression algorithm used, or 0xff if
+// the batch is not compressed.
+type prefixedCompression struct {
+	packet.Compression
+}
+
+// Decompress ...
+func (c prefixedCompression) Decompress(compressed []byte) ([]byte, error) {
+	if len(compressed) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	if compressed[0] == 0xff {
+		return compressed[1:], nil
+	}
+	compression, ok := packet.CompressionByID(uint16(compressed[0]))
+	if !ok {
+		return nil, fmt.Errorf("unknown compression algorithm %d", compressed[0])
+	}
+	return compression.Decompress(compressed[1:])
+}
+
+// batchReader passes one batch at a time to a packet.Decoder.
+type batchReader struct {
+	next      []byte
+	encrypted bool
+}
+
+// Read ...
+func (r *batchReader) Read([]byte) (int, error) {
+	return 0, errors.New("batches must be read using ReadPacket")
+}
+
+// ReadPacket ...
+func (r *batchReader) ReadPacket() ([]byte, error) {
+	b := r.next
+	r.next = nil
+	return b, nil
+}
+
+// splitPacketHeader splits an encoded packet into the ID in its header and its payload.
+func splitPacketHeader(data []byte) (uint32, []byte) {
+	header, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil
+	}
+	return uint32(header) & 0x3ff, data[n:]
+}
+
+// uint24 reads a little endian 24-bit integer as used by RakNet.
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// injection is a packet to inject described by a line of NDJSON read from stdin, for example:
+//
+//	{"session": 1, "direction": "clientbound", "packet": "Text", "fields": {"TextType": 1, "Message": "Hello"}}
+type injection struct {
+	// Session is the ID of the session to inject the packet into, or 0 to inject it into all active sessions.
+	Session int64 `json:"session"`
+	// Direction is clientbound to send the packet to the client or serverbound to send it to the server.
+	Direction string `json:"direction"`
+	stubResponse
+}
+
+// inject injects the packet described into the sessions it targets and returns the amount of sessions it was
+// injected into.
+func (inj injection) inject() (int, error) {
+	if inj.Direction != "clientbound" && inj.Direction != "serverbound" {
+		return 0, fmt.Errorf("invalid direction %q: expected clientbound or serverbound", inj.Direction)
+	}
+	pk, err := inj.decode()
+	if err != nil {
+		return 0, err
+	}
+	var targets []*session
+	if inj.Session == 0 {
+		targets = activeSessions()
+	} else if s, ok := sessionByID(inj.Session); ok {
+		targets = append(targets, s)
+	} else {
+		return 0, fmt.Errorf("no session with ID %d", inj.Session)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].id < targets[j].id
+	})
+	for _, s := range targets {
+		send := s.sendToClient
+		if inj.Direction == "serverbound" {
+			send = s.sendToServer
+		}
+		if err := send(pk); err != nil {
+			return 0, fmt.Errorf("session %d: %w", s.id, err)
+		}
+	}
+	return len(targets), nil
+}
+
+// readInjections reads NDJSON packet descriptions from the reader passed, one per line, and injects them until the
+// reader is exhausted, so that the proxy can be controlled by an external program writing to its stdin. Lines that
+// can't be decoded or injected are logged and skipped.
+func readInjections(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var inj injection
+		if err := json.Unmarshal(scanner.Bytes(), &inj); err != nil {
+			log.Printf("Unable to decode injection on line %d: %v\n", line, err)
+			continue
+		}
+		n, err := inj.inject()
+		if err != nil {
+			log.Printf("Unable to inject %s on line %d: %v\n", inj.Packet, line, err)
+			continue
+		}
+		logf(logFields{"packet": inj.Packet, "direction": inj.Direction}, "Injected %s %s into %d sessions\n", inj.Direction, inj.Packet, n)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("An error occurred whilst reading injections: %v\n", err)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// knowledgeFile is the file that the knowledge base is persisted in. If empty, the knowledge base is only kept
+// in memory for the duration of the run.
+var knowledgeFile = "knowledge.json"
+
+// upstreamKnowledge holds everything learned about a single upstream server across all sessions proxied to it.
+type upstreamKnowledge struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Sessions  int       `json:"sessions"`
+	// Versions holds the base game versions reported by the server.
+	Versions []string `json:"versions"`
+	// Entities holds the amount of times each entity type was spawned by the server.
+	Entities map[string]int64 `json:"entities"`
+	// Items holds the runtime IDs of the items in the item palette of the server, indexed by their name.
+	Items map[string]int32 `json:"items"`
+	// Commands holds the descriptions of the commands sent by the server, indexed by their name.
+	Commands map[string]string `json:"commands"`
+	// Packets holds the amount of packets observed, indexed by direction and name of the packet.
+	Packets map[string]int64 `json:"packets"`
+	// Rates holds the baseline rate per minute of each packet, indexed by direction and name of the packet, and
+	// RateSessions the amount of sessions it was learned from.
+	Rates        map[string]float64 `json:"rates,omitempty"`
+	RateSessions int                `json:"rate_sessions,omitempty"`
+	// Shapes holds the packet shapes seen on the server if the novelty detector is enabled with the upstream
+	// scope.
+	Shapes bloomFilter `json:"shapes,omitempty"`
+}
+
+// knowledgeBase holds the knowledge of each upstream server seen, indexed by its address.
+var knowledgeBase = struct {
+	sync.Mutex
+	loaded bool
+	m      map[string]*upstreamKnowledge
+	// sessions holds the upstream address of active sessions, indexed by session ID.
+	sessions map[int64]string
+}{m: map[string]*upstreamKnowledge{}, sessions: map[int64]string{}}
+
+// loadKnowledge reads the knowledge base from the knowledge file if it was not yet loaded. knowledgeBase must be
+// locked.
+func loadKnowledge() {
+	if !knowledgeBase.loaded && knowledgeFile != "" {
+		if b, err := ioutil.ReadFile(knowledgeFile); err == nil {
+			if err := json.Unmarshal(b, &knowledgeBase.m); err != nil {
+				log.Printf("Unable to read knowledge base: %v\n", err)
+			}
+		}
+	}
+	knowledgeBase.loaded = true
+}
+
+// knowledgeOf returns the knowledge of the upstream server with the address passed, creating it if nothing is
+// known about the server yet. knowledgeBase must be locked.
+func knowledgeOf(upstream string) *upstreamKnowledge {
+	loadKnowledge()
+	k, ok := knowledgeBase.m[upstream]
+	if !ok {
+		k = &upstreamKnowledge{FirstSeen: time.Now()}
+		knowledgeBase.m[upstream] = k
+	}
+	if k.Entities == nil {
+		k.Entities = map[string]int64{}
+	}
+	if k.Items == nil {
+		k.Items = map[string]int32{}
+	}
+	if k.Commands == nil {
+		k.Commands = map[string]string{}
+	}
+	if k.Packets == nil {
+		k.Packets = map[string]int64{}
+	}
+	return k
+}
+
+// learnGameData records the game data of a session that was just started in the knowledge of its upstream server.
+func (s *session) learnGameData(data minecraft.GameData) {
+	knowledgeBase.Lock()
+	defer knowledgeBase.Unlock()
+	knowledgeBase.sessions[s.id] = s.upstream
+	k := knowledgeOf(s.upstream)
+	k.Sessions++
+	k.LastSeen = time.Now()
+	if data.BaseGameVersion != "" && !containsString(k.Versions, data.BaseGameVersion) {
+		k.Versions = append(k.Versions, data.BaseGameVersion)
+	}
+	for _, item := range data.Items {
+		k.Items[item.Name] = int32(item.RuntimeID)
+	}
+}
+
+// learnPacket records the packet event passed in the knowledge of the upstream server of its session.
+func learnPacket(e packetEvent) {
+	knowledgeBase.Lock()
+	defer knowledgeBase.Unlock()
+	upstream, ok := knowledgeBase.sessions[e.Session]
+	if !ok {
+		return
+	}
+	k := knowledgeOf(upstream)
+	k.Packets[e.Direction+"/"+e.Name]++
+	k.LastSeen = e.Time
+	switch pk := e.Packet.(type) {
+	case *packet.AddActor:
+		k.Entities[pk.EntityType]++
+	case *packet.AvailableCommands:
+		for _, c := range pk.Commands {
+			k.Commands[c.Name] = c.Description
+		}
+	}
+}
+
+// storeKnowledge writes the knowledge base to the knowledge file, if set.
+func storeKnowledge() {
+	if knowledgeFile == "" {
+		return
+	}
+	knowledgeBase.Lock()
+	b, err := json.MarshalIndent(knowledgeBase.m, "", "  ")
+	knowledgeBase.Unlock()
+	if err != nil {
+		log.Printf("Unable to encode knowledge base: %v\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(knowledgeFile, b, 0644); err != nil {
+		log.Printf("Unable to store knowledge base: %v\n", err)
+	}
+}
+
+// containsString checks if the list passed contains the string s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedCounts returns the keys of the map passed that contain the search string, ordered by their count from
+// high to low.
+func sortedCounts(m map[string]int64, search string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if strings.Contains(strings.ToLower(k), search) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func init() {
+	addPacketListener(learnPacket)
+	addSessionCloseListener(func(id int64) {
+		knowledgeBase.Lock()
+		delete(knowledgeBase.sessions, id)
+		knowledgeBase.Unlock()
+		storeKnowledge()
+	})
+	registerCommand("kb", consoleCommand{
+		usage:       "[upstream] [entities|items|commands|packets] [search]",
+		description: "Queries the knowledge accumulated about upstream servers across sessions.",
+		run: func(args []string) {
+			knowledgeBase.Lock()
+			defer knowledgeBase.Unlock()
+			loadKnowledge()
+			if len(args) == 0 {
+				upstreams := make([]string, 0, len(knowledgeBase.m))
+				for upstream := range knowledgeBase.m {
+					upstreams = append(upstreams, upstream)
+				}
+				sort.Strings(upstreams)
+				if len(upstreams) == 0 {
+					log.Println("No upstream servers are known yet.")
+				}
+				for _, upstream := range upstreams {
+					k := knowledgeBase.m[upstream]
+					log.Printf("%s: %d sessions, last seen %s\n", upstream, k.Sessions, k.LastSeen.Format(time.RFC3339))
+				}
+				return
+			}
+			k, ok := knowledgeBase.m[args[0]]
+			if !ok {
+				log.Printf("Nothing is known about upstream %s.\n", args[0])
+				return
+			}
+			if len(args) == 1 {
+				log.Printf("%s: first seen %s, last seen %s, %d sessions\n", args[0], k.FirstSeen.Format(time.RFC3339), k.LastSeen.Format(time.RFC3339), k.Sessions)
+				log.Printf("    versions  %s\n", strings.Join(k.Versions, ", "))
+				log.Printf("    entities  %d types\n", len(k.Entities))
+				log.Printf("    items     %d\n", len(k.Items))
+				log.Printf("    commands  %d\n", len(k.Commands))
+				log.Printf("    packets   %d types\n", len(k.Packets))
+				return
+			}
+			var search string
+			if len(args) > 2 {
+				search = strings.ToLower(args[2])
+			}
+			switch args[1] {
+			case "entities", "packets":
+				m := k.Entities
+				if args[1] == "packets" {
+					m = k.Packets
+				}
+				for _, name := range sortedCounts(m, search) {
+					log.Printf("%-50s %d\n", name, m[name])
+				}
+			case "items":
+				names := make([]string, 0, len(k.Items))
+				for name := range k.Items {
+					if strings.Contains(strings.ToLower(name), search) {
+						names = append(names, name)
+					}
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					log.Printf("%-50s %d\n", name, k.Items[name])
+				}
+			case "commands":
+				names := make([]string, 0, len(k.Commands))
+				for name := range k.Commands {
+					if strings.Contains(strings.ToLower(name), search) {
+						names = append(names, name)
+					}
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					log.Printf("/%-30s %s\n", name, k.Commands[name])
+				}
+			default:
+				log.Println("Usage: kb [upstream] [entities|items|commands|packets] [search]")
+			}
+		},
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"go.etcd.io/bbolt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kvStoreFile is the file that the key-value store of plugins is persisted in.
+var kvStoreFile = "kv.db"
+
+// kvStore is the database backing the key-value store of plugins, opened the
+// first time a namespace is used. Each namespace is stored in its own bucket so that plugins can't overwrite
+// each other's state.
+var kvStore struct {
+	sync.Mutex
+	db  *bbolt.DB
+	err error
+}
+
+// kvDB returns the database of the key-value store, opening it if it is not yet open.
+func kvDB() (*bbolt.DB, error) {
+	kvStore.Lock()
+	defer kvStore.Unlock()
+	if kvStore.db == nil && kvStore.err == nil {
+		kvStore.db, kvStore.err = bbolt.Open(kvStoreFile, 0644, &bbolt.Options{Timeout: time.Second})
+		if kvStore.err == nil {
+			onShutdown(func() {
+				_ = kvStore.db.Close()
+			})
+		}
+	}
+	return kvStore.db, kvStore.err
+}
+
+// kvNamespace is the part of the key-value store belonging to a single plugin. State stored in it survives
+// restarts of the proxy. It implements handler.KV.
+type kvNamespace struct {
+	name string
+}
+
+// errKVNamespace is returned when an empty namespace is used.
+var errKVNamespace = errors.New("key-value namespace must not be empty")
+
+// kvNamespaceOf returns the namespace of the key-value store with the name passed, usually the name of the
+// plugin using it.
+func kvNamespaceOf(name string) kvNamespace {
+	return kvNamespace{name: name}
+}
+
+// view runs f with the bucket of the namespace in a read-only transaction. The bucket is nil if nothing was
+// ever stored in the namespace.
+func (ns kvNamespace) view(f func(b *bbolt.Bucket) error) error {
+	if ns.name == "" {
+		return errKVNamespace
+	}
+	db, err := kvDB()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bbolt.Tx) error {
+		return f(tx.Bucket([]byte(ns.name)))
+	})
+}
+
+// update runs f with the bucket of the namespace in a read-write transaction, creating the bucket if needed.
+func (ns kvNamespace) update(f func(b *bbolt.Bucket) error) error {
+	if ns.name == "" {
+		return errKVNamespace
+	}
+	db, err := kvDB()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(ns.name))
+		if err != nil {
+			return err
+		}
+		return f(b)
+	})
+}
+
+// Get returns the value stored under the key passed. False is returned if no value is stored under the key.
+func (ns kvNamespace) Get(key string) (value []byte, ok bool, err error) {
+	err = ns.view(func(b *bbolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			value, ok = append([]byte(nil), v...), true
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+// Set stores the value passed under the key passed, overwriting any value already stored under it.
+func (ns kvNamespace) Set(key string, value []byte) error {
+	return ns.update(func(b *bbolt.Bucket) error {
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete removes the value stored under the key passed, if any.
+func (ns kvNamespace) Delete(key string) error {
+	return ns.update(func(b *bbolt.Bucket) error {
+		return b.Delete([]byte(key))
+	})
+}
+
+// Increment atomically adds delta to the counter stored under the key passed and returns the new value.
+// Counters are stored as 8 byte big endian integers and start at 0.
+func (ns kvNamespace) Increment(key string, delta int64) (n int64, err error) {
+	err = ns.update(func(b *bbolt.Bucket) error {
+		if v := b.Get([]byte(key)); len(v) == 8 {
+			n = int64(binary.BigEndian.Uint64(v))
+		} else if v != nil {
+			return errors.New("value of " + key + " is not a counter")
+		}
+		n += delta
+		return b.Put([]byte(key), binary.BigEndian.AppendUint64(nil, uint64(n)))
+	})
+	return n, err
+}
+
+// Keys returns the keys stored in the namespace that start with the prefix passed, in sorted order.
+func (ns kvNamespace) Keys(prefix string) (keys []string, err error) {
+	err = ns.view(func(b *bbolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// kvNamespaces returns the names of all namespaces holding data, in sorted order.
+func kvNamespaces() (names []string, err error) {
+	db, err := kvDB()
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// kvDisplayValue formats a value of the key-value store for display, showing counters as numbers.
+func kvDisplayValue(v []byte) string {
+	if len(v) == 8 {
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(v)), 10) + " (counter)"
+	}
+	return strconv.Quote(string(v))
+}
+
+func init() {
+	const usage = "Usage: kv [namespace] [get|set|delete <key> [value]]"
+	registerCommand("kv", consoleCommand{
+		usage:       "[namespace] [get|set|delete <key> [value]]",
+		description: "Inspects and edits the persistent key-value store of plugins.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				names, err := kvNamespaces()
+				if err != nil {
+					log.Printf("Unable to read key-value store: %v\n", err)
+					return
+				}
+				log.Printf("Namespaces: %s\n", strings.Join(names, ", "))
+				return
+			}
+			ns := kvNamespaceOf(args[0])
+			if len(args) == 1 {
+				keys, err := ns.Keys("")
+				if err != nil {
+					log.Printf("Unable to read key-value store: %v\n", err)
+					return
+				}
+				for _, key := range keys {
+					v, _, _ := ns.Get(key)
+					log.Printf("%-32s %s\n", key, kvDisplayValue(v))
+				}
+				return
+			}
+			if len(args) < 3 {
+				log.Println(usage)
+				return
+			}
+			var err error
+			switch args[1] {
+			case "get":
+				var v []byte
+				var ok bool
+				if v, ok, err = ns.Get(args[2]); err == nil && !ok {
+					log.Printf("%s is not set.\n", args[2])
+					return
+				} else if err == nil {
+					log.Printf("%s = %s\n", args[2], kvDisplayValue(v))
+				}
+			case "set":
+				err = ns.Set(args[2], []byte(strings.Join(args[3:], " ")))
+			case "delete":
+				err = ns.Delete(args[2])
+			default:
+				log.Println(usage)
+				return
+			}
+			if err != nil {
+				log.Printf("Unable to access key-value store: %v\n", err)
+			}
+		},
+	})
+}
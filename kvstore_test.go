@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// useTempKVStore makes the key-value store use a new database in a temporary directory for the duration of the
+// test.
+func useTempKVStore(t *testing.T) {
+	prev := kvStoreFile
+	kvStoreFile = filepath.Join(t.TempDir(), "kv.db")
+	t.Cleanup(func() {
+		kvStore.Lock()
+		defer kvStore.Unlock()
+		if kvStore.db != nil {
+			_ = kvStore.db.Close()
+		}
+		kvStore.db, kvStore.err = nil, nil
+		kvStoreFile = prev
+	})
+}
+
+func TestKVIncrement(t *testing.T) {
+	useTempKVStore(t)
+	ns := kvNamespaceOf("test")
+	if n, err := ns.Increment("joins", 1); err != nil || n != 1 {
+		t.Fatalf("Increment = %d, %v, want 1", n, err)
+	}
+	if n, err := ns.Increment("joins", 4); err != nil || n != 5 {
+		t.Fatalf("Increment = %d, %v, want 5", n, err)
+	}
+	if n, err := ns.Increment("joins", -7); err != nil || n != -2 {
+		t.Fatalf("Increment = %d, %v, want -2", n, err)
+	}
+	if n, err := kvNamespaceOf("other").Increment("joins", 1); err != nil || n != 1 {
+		t.Errorf("Increment in another namespace = %d, %v, want 1", n, err)
+	}
+}
+
+func TestKVIncrementConcurrent(t *testing.T) {
+	useTempKVStore(t)
+	ns := kvNamespaceOf("test")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, err := ns.Increment("counter", 1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := ns.Increment("counter", 0); err != nil || n != 200 {
+		t.Errorf("counter = %d, %v, want 200", n, err)
+	}
+}
+
+func TestKVIncrementNonCounter(t *testing.T) {
+	useTempKVStore(t)
+	ns := kvNamespaceOf("test")
+	if err := ns.Set("name", []byte("steve")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Increment("name", 1); err == nil {
+		t.Errorf("incrementing a value that is not a counter succeeded")
+	}
+	if v, _, _ := ns.Get("name"); string(v) != "steve" {
+		t.Errorf("value changed to %q by a failed increment", v)
+	}
+	if _, err := kvNamespaceOf("").Increment("joins", 1); err != errKVNamespace {
+		t.Errorf("err = %v, want %v", err, errKVNamespace)
+	}
+}
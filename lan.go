@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// lanDiscoveryPorts are the ports that Minecraft clients send LAN discovery pings to and listen for
+// advertisements on.
+var lanDiscoveryPorts = []int{19132, 19133}
+
+// idUnconnectedPong is the ID of the RakNet unconnected pong message, which is also used to advertise a server
+// on the local network.
+const idUnconnectedPong = 0x1c
+
+// lanGUID is the RakNet GUID the proxy advertises itself with on the local network.
+var lanGUID = rand.Int63()
+
+// raknetOfflineMagic is the magic sequence included in RakNet messages sent outside of a connection.
+var raknetOfflineMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// runLANAdvertiser broadcasts the status of the proxy on the local network at the interval passed, so that the
+// proxy shows up in the LAN games list of clients on the same network.
+func runLANAdvertiser(provider minecraft.ServerStatusProvider, interval time.Duration) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		log.Printf("An error occurred whilst starting LAN broadcast: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		msg := lanAdvertisement(provider)
+		for _, ip := range broadcastAddresses() {
+			for _, port := range lanDiscoveryPorts {
+				if port == listenPort {
+					// The listener of the proxy already answers discovery pings on this port and would log an
+					// error for every advertisement it receives.
+					continue
+				}
+				if _, err := conn.WriteToUDP(msg, &net.UDPAddr{IP: ip, Port: port}); err != nil {
+					log.Printf("An error occurred whilst broadcasting to %v: %v\n", ip, err)
+				}
+			}
+		}
+	}
+}
+
+// lanAdvertisement encodes an unconnected pong advertising the status of the proxy.
+func lanAdvertisement(provider minecraft.ServerStatusProvider) []byte {
+	status := provider.ServerStatus(len(activeSessions()), 0)
+	if status.MaxPlayers == 0 {
+		status.MaxPlayers = status.PlayerCount + 1
+	}
+	data := fmt.Sprintf("MCPE;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;",
+		status.ServerName, protocol.CurrentProtocol, protocol.CurrentVersion, status.PlayerCount, status.MaxPlayers,
+		lanGUID, "bds-mitm", "Survival", 1, listenPort, listenPort,
+	)
+	buf := new(bytes.Buffer)
+	buf.WriteByte(idUnconnectedPong)
+	_ = binary.Write(buf, binary.BigEndian, time.Now().UnixMilli())
+	_ = binary.Write(buf, binary.BigEndian, lanGUID)
+	buf.Write(raknetOfflineMagic)
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.WriteString(data)
+	return buf.Bytes()
+}
+
+// broadcastAddresses returns the limited broadcast address and the directed broadcast addresses of all IPv4
+// networks this machine is connected to.
+func broadcastAddresses() []net.IP {
+	ips := []net.IP{net.IPv4bcast}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		ip, mask := ipNet.IP.To4(), net.IP(ipNet.Mask).To4()
+		if mask == nil {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ip[i] | ^mask[i]
+		}
+		ips = append(ips, bcast)
+	}
+	return ips
+}
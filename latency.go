@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of packet latency histograms.
+var latencyBuckets = []time.Duration{
+	time.Microsecond * 10, time.Microsecond * 50, time.Microsecond * 100, time.Microsecond * 250,
+	time.Microsecond * 500, time.Millisecond, time.Microsecond * 2500, time.Millisecond * 5,
+	time.Millisecond * 10, time.Millisecond * 50, time.Millisecond * 100, time.Millisecond * 500, time.Second,
+}
+
+// latencyHistogram is a histogram of the time packets of a single type spent in the proxy between being
+// received from one side and written to the other.
+type latencyHistogram struct {
+	// counts holds the amount of packets per bucket, with the last element counting packets exceeding the
+	// largest bucket.
+	counts [14]atomic.Int64
+	sum    atomic.Int64
+	max    atomic.Int64
+}
+
+// observe adds a latency to the histogram.
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return d <= latencyBuckets[i]
+	})
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	for {
+		max := h.max.Load()
+		if int64(d) <= max || h.max.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// packetLatency is a snapshot of the latency histogram of a packet type.
+type packetLatency struct {
+	packet string
+	// cumulative holds the amount of packets with a latency of at most the bucket of the same index in
+	// latencyBuckets.
+	cumulative []int64
+	count      int64
+	sum, max   time.Duration
+}
+
+// snapshot returns a snapshot of the histogram for the packet passed.
+func (h *latencyHistogram) snapshot(name string) packetLatency {
+	l := packetLatency{packet: name, cumulative: make([]int64, len(latencyBuckets)), sum: time.Duration(h.sum.Load()), max: time.Duration(h.max.Load())}
+	for i := range h.counts {
+		l.count += h.counts[i].Load()
+		if i < len(latencyBuckets) {
+			l.cumulative[i] = l.count
+		}
+	}
+	return l
+}
+
+// quantile estimates the latency below which the fraction q of packets fell, as the upper bound of the bucket
+// holding the quantile.
+func (l packetLatency) quantile(q float64) time.Duration {
+	target := int64(q * float64(l.count))
+	for i, n := range l.cumulative {
+		if n >= target && n > 0 {
+			return latencyBuckets[i]
+		}
+	}
+	return l.max
+}
+
+// latencyHistograms holds the latency histogram of every packet type, indexed by packet name.
+var latencyHistograms = struct {
+	sync.RWMutex
+	m map[string]*latencyHistogram
+}{m: map[string]*latencyHistogram{}}
+
+// observeLatency records the time a packet with the name passed spent in the proxy.
+func observeLatency(name string, d time.Duration) {
+	latencyHistograms.RLock()
+	h, ok := latencyHistograms.m[name]
+	latencyHistograms.RUnlock()
+	if !ok {
+		latencyHistograms.Lock()
+		if h, ok = latencyHistograms.m[name]; !ok {
+			h = &latencyHistogram{}
+			latencyHistograms.m[name] = h
+		}
+		latencyHistograms.Unlock()
+	}
+	h.observe(d)
+}
+
+// packetLatencies returns snapshots of the latency histograms of all packet types, sorted by packet name.
+func packetLatencies() []packetLatency {
+	latencyHistograms.RLock()
+	list := make([]packetLatency, 0, len(latencyHistograms.m))
+	for name, h := range latencyHistograms.m {
+		list = append(list, h.snapshot(name))
+	}
+	latencyHistograms.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].packet < list[j].packet
+	})
+	return list
+}
+
+// bucketLabel returns the label of the latency bucket with the index passed, such as le_250us.
+func bucketLabel(i int) string {
+	return "le_" + strings.ReplaceAll(latencyBuckets[i].String(), "µ", "u")
+}
+
+func init() {
+	registerCommand("latency", consoleCommand{
+		usage:       "[packet]",
+		description: "Shows the time packets spend in the proxy between being received and forwarded, per type.",
+		run: func(args []string) {
+			list := packetLatencies()
+			if len(list) == 0 {
+				log.Println("No packets were forwarded yet.")
+				return
+			}
+			for _, l := range list {
+				if len(args) > 0 && !strings.EqualFold(args[0], l.packet) {
+					continue
+				}
+				log.Printf("%-40s n=%-8d avg=%-10s p50<=%-8s p99<=%-8s max=%s\n", l.packet, l.count, (l.sum / time.Duration(l.count)).Round(time.Microsecond), l.quantile(0.5), l.quantile(0.99), l.max.Round(time.Microsecond))
+				if len(args) > 0 {
+					for i, n := range l.cumulative {
+						log.Printf("    %-10s %d\n", bucketLabel(i), n)
+					}
+				}
+			}
+		},
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileSink is a logSink writing entries to a file in the log format, rotating the file once it exceeds a
+// maximum size. Rotated files are renamed with the time of rotation appended and removed once they exceed the
+// maximum age or the maximum amount of backups.
+type logFileSink struct {
+	path string
+	// maxSize is the size in bytes after which the file is rotated, or 0 to never rotate it.
+	maxSize int64
+	// maxAge is the age after which rotated files are removed, or 0 to keep them regardless of their age.
+	maxAge time.Duration
+	// maxBackups is the maximum amount of rotated files kept, or 0 to keep all of them.
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// newLogFileSink opens the log file at the path passed for appending, creating it if it does not exist.
+func newLogFileSink(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*logFileSink, error) {
+	sink := &logFileSink{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	sink.removeBackups()
+	return sink, nil
+}
+
+// open opens the log file for appending.
+func (sink *logFileSink) open() error {
+	if dir := filepath.Dir(sink.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(sink.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	sink.f, sink.size = f, info.Size()
+	return nil
+}
+
+// write ...
+func (sink *logFileSink) write(e logEntry) error {
+	var line []byte
+	if logFormat == "json" {
+		line = jsonLogLine(e)
+	} else {
+		line = []byte(fmt.Sprintf("%s %s\n", e.time.Format("2006/01/02 15:04:05"), e.message))
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.maxSize > 0 && sink.size > 0 && sink.size+int64(len(line)) > sink.maxSize {
+		if err := sink.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := sink.f.Write(line)
+	sink.size += int64(n)
+	return err
+}
+
+// rotate renames the current log file to a backup and opens a new log file. sink.mu must be held.
+func (sink *logFileSink) rotate() error {
+	if err := sink.f.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(sink.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(sink.path, ext), time.Now().Format("20060102-150405.000"), ext)
+	if err := os.Rename(sink.path, backup); err != nil {
+		return err
+	}
+	if err := sink.open(); err != nil {
+		return err
+	}
+	go sink.removeBackups()
+	return nil
+}
+
+// removeBackups removes rotated log files that exceed the maximum age or the maximum amount of backups.
+func (sink *logFileSink) removeBackups() {
+	ext := filepath.Ext(sink.path)
+	backups, _ := filepath.Glob(strings.TrimSuffix(sink.path, ext) + "-*" + ext)
+	// Backups are named after the time they were rotated at, so sorting them by name sorts them by age.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, backup := range backups {
+		remove := sink.maxBackups > 0 && i >= sink.maxBackups
+		if info, err := os.Stat(backup); err == nil && sink.maxAge > 0 && time.Since(info.ModTime()) > sink.maxAge {
+			remove = true
+		}
+		if remove {
+			_ = os.Remove(backup)
+		}
+	}
+}
+
+// reopen closes the log file and opens it again, so that the file is recreated if it was moved or removed by an
+// external log rotation tool.
+func (sink *logFileSink) reopen() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_ = sink.f.Close()
+	return sink.open()
+}
+
+// close closes the log file.
+func (sink *logFileSink) close() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_ = sink.f.Close()
+}
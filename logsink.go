@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logFields holds structured fields describing a log entry, such as the session and packet it refers to.
+type logFields map[string]string
+
+// logEntry is a single line logged by the proxy.
+type logEntry struct {
+	time    time.Time
+	message string
+	fields  logFields
+	// payload is the packet described by the entry, if any. It is only set when logging in the JSON format.
+	payload interface{}
+}
+
+// logSink is a destination that log entries are forwarded to in addition to the console.
+type logSink interface {
+	write(e logEntry) error
+}
+
+// logSinks holds the sinks that all log entries are forwarded to.
+var logSinks struct {
+	sync.Mutex
+	sinks []logSink
+}
+
+// addLogSink adds a sink that all log entries logged after this call are forwarded to.
+func addLogSink(sink logSink) {
+	logSinks.Lock()
+	logSinks.sinks = append(logSinks.sinks, sink)
+	logSinks.Unlock()
+}
+
+// consoleWriter is the writer that log entries are written to in the format of the standard logger.
+var consoleWriter io.Writer = os.Stderr
+
+// logFormat is the format that log entries are written to the console in: text, or json to write every entry as
+// a single line of JSON holding its fields.
+var logFormat = "text"
+
+// logf logs a message formatted using the format and arguments passed, attaching the fields passed to it for
+// sinks that support structured data.
+func logf(fields logFields, format string, args ...interface{}) {
+	emit(logEntry{time: time.Now(), message: strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), fields: fields})
+}
+
+// emit writes the entry to the console and forwards it to all log sinks.
+func emit(e logEntry) {
+	logSinks.Lock()
+	defer logSinks.Unlock()
+	if consoleVisible(e) && streamVisible(e) && consoleRateAllowed(e) {
+		if logFormat == "json" {
+			_, _ = consoleWriter.Write(jsonLogLine(e))
+		} else {
+			_, _ = io.WriteString(consoleWriter, consoleLine(e))
+		}
+	}
+	for _, sink := range logSinks.sinks {
+		if err := sink.write(e); err != nil {
+			_, _ = fmt.Fprintf(consoleWriter, "%s Unable to forward log entry: %v\n", e.time.Format("2006/01/02 15:04:05"), err)
+		}
+	}
+}
+
+// jsonLogLine encodes the log entry passed as a single line of JSON, holding its time, message, fields and the
+// payload of the packet it describes, if any.
+func jsonLogLine(e logEntry) []byte {
+	m := make(map[string]interface{}, len(e.fields)+3)
+	for k, v := range e.fields {
+		m[k] = v
+	}
+	m["time"], m["message"] = e.time.Format(time.RFC3339Nano), e.message
+	if e.payload != nil {
+		m["payload"] = e.payload
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		// Some packets can't be encoded as JSON, such as those holding NaN values.
+		m["payload"], m["payload_error"] = nil, err.Error()
+		b, _ = json.Marshal(m)
+	}
+	return append(b, '\n')
+}
+
+// logPacket logs a packet of a session as a single entry holding its payload, as done when logging in the JSON
+// format. fromServer specifies if the packet was sent by the server.
+func (s *session) logPacket(pk packet.Packet, fromServer bool) {
+	name, direction := getType(pk, false), "serverbound"
+	if fromServer {
+		direction = "clientbound"
+	}
+	fields := logFields{"session": strconv.FormatInt(s.id, 10), "direction": direction, "packet": name, "id": strconv.FormatUint(uint64(pk.ID()), 10), "size": strconv.Itoa(packetSize(pk))}
+	var payload interface{} = redactPacket(name, pk)
+	if payloadRedacted(name) {
+		payload = "[redacted]"
+	} else if hexdumpPackets.contains(name) {
+		fields["raw"] = hex.EncodeToString(s.rawPacket(payload.(packet.Packet)))
+	}
+	emit(logEntry{time: time.Now(), message: "Received " + name, fields: fields, payload: payload})
+}
+
+// stdLogWriter is set as the output of the standard logger, so that lines logged using the log package are
+// forwarded to the log sinks too.
+type stdLogWriter struct{}
+
+// Write ...
+func (stdLogWriter) Write(b []byte) (int, error) {
+	emit(logEntry{time: time.Now(), message: strings.TrimSuffix(string(b), "\n")})
+	return len(b), nil
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+// sortedFieldKeys returns the keys of the fields in alphabetical order.
+func sortedFieldKeys(fields logFields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// remoteSinkBuffer is the amount of log entries buffered for a remote sink before new entries are dropped.
+const remoteSinkBuffer = 4096
+
+// remoteSinkMaxBackoff is the maximum time waited before sending to an unreachable remote sink again.
+const remoteSinkMaxBackoff = time.Minute
+
+// remoteSink is a logSink forwarding entries to a remote server on its own goroutine, so that logging never waits
+// for the network. Entries are dropped while the buffer is full. While the server is unreachable, the entry that
+// failed is dropped and the next one is only sent after a backoff that grows up to remoteSinkMaxBackoff.
+type remoteSink struct {
+	name    string
+	send    func(e logEntry) error
+	entries chan logEntry
+	dropped atomic.Int64
+}
+
+// newRemoteSink returns a remoteSink sending entries using the function passed. The name is used in messages
+// about the connection to the server.
+func newRemoteSink(name string, send func(e logEntry) error) *remoteSink {
+	sink := &remoteSink{name: name, send: send, entries: make(chan logEntry, remoteSinkBuffer)}
+	go sink.run()
+	return sink
+}
+
+// write ...
+func (sink *remoteSink) write(e logEntry) error {
+	select {
+	case sink.entries <- e:
+	default:
+		sink.dropped.Add(1)
+	}
+	return nil
+}
+
+// run sends the buffered entries until the process exits.
+func (sink *remoteSink) run() {
+	var backoff time.Duration
+	for e := range sink.entries {
+		if err := sink.send(e); err != nil {
+			sink.dropped.Add(1)
+			if backoff == 0 {
+				sinkNotice("Unable to forward log entries to %s, retrying: %v", sink.name, err)
+				backoff = time.Second
+			} else {
+				backoff = min(backoff*2, remoteSinkMaxBackoff)
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		if backoff != 0 {
+			sinkNotice("Forwarding log entries to %s again, %d entries were dropped", sink.name, sink.dropped.Swap(0))
+			backoff = 0
+		}
+	}
+}
+
+// sinkNotice writes a message about a log sink to the console only, as forwarding it to the sinks may fail too.
+func sinkNotice(format string, args ...interface{}) {
+	logSinks.Lock()
+	defer logSinks.Unlock()
+	_, _ = fmt.Fprintf(consoleWriter, "%s %s\n", time.Now().Format("2006/01/02 15:04:05"), fmt.Sprintf(format, args...))
+}
+
+// syslogSink sends entries to a remote syslog server in the RFC 5424 format. It is wrapped in a remoteSink so
+// that entries are sent asynchronously.
+type syslogSink struct {
+	network  string
+	addr     string
+	hostname string
+
+	conn net.Conn
+}
+
+// newSyslogSink creates a syslogSink from a URL such as udp://localhost:514 or tcp://localhost:601.
+func newSyslogSink(rawURL string) (*syslogSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network %q", u.Scheme)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+}
+
+// syslogEscaper escapes parameter values of structured data in RFC 5424 messages.
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// send sends a single entry, connecting to the server first if not connected.
+func (sink *syslogSink) send(e logEntry) error {
+	if sink.conn == nil {
+		conn, err := net.DialTimeout(sink.network, sink.addr, time.Second*5)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	data := "-"
+	if len(e.fields) > 0 {
+		buf := new(strings.Builder)
+		buf.WriteString("[bdsmitm@32473")
+		for _, k := range sortedFieldKeys(e.fields) {
+			_, _ = fmt.Fprintf(buf, ` %s="%s"`, k, syslogEscaper.Replace(e.fields[k]))
+		}
+		buf.WriteString("]")
+		data = buf.String()
+	}
+	// Facility user (1) with severity informational (6).
+	msg := fmt.Sprintf("<14>1 %s %s bds-mitm %d - %s %s", e.time.Format(time.RFC3339Nano), sink.hostname, os.Getpid(), data, e.message)
+	if sink.network == "tcp" {
+		// Messages sent over TCP are framed using octet counting as described in RFC 6587.
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	_ = sink.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err := sink.conn.Write([]byte(msg)); err != nil {
+		_ = sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+// journalSink is a logSink sending entries to the systemd journal using its native protocol, attaching the
+// fields of entries as journal fields.
+type journalSink struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+// newJournalSink connects to the socket of the systemd journal.
+func newJournalSink() (*journalSink, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn, addr: &net.UnixAddr{Name: "/run/systemd/journal/socket", Net: "unixgram"}}, nil
+}
+
+// write ...
+func (sink *journalSink) write(e logEntry) error {
+	buf := new(bytes.Buffer)
+	writeJournalField(buf, "MESSAGE", e.message)
+	writeJournalField(buf, "PRIORITY", "6")
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", "bds-mitm")
+	for _, k := range sortedFieldKeys(e.fields) {
+		writeJournalField(buf, "BDSMITM_"+strings.ToUpper(k), e.fields[k])
+	}
+	_, err := sink.conn.WriteToUnix(buf.Bytes(), sink.addr)
+	return err
+}
+
+// writeJournalField writes a field in the format of the native journal protocol. Values holding a newline are
+// written in the binary format, prefixed with their length.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(key + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(key + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// gelfSink sends entries to Graylog or Logstash in the GELF format over UDP or TCP. The fields of entries are sent
+// as additional fields. It is wrapped in a remoteSink so that entries are sent asynchronously.
+type gelfSink struct {
+	network  string
+	addr     string
+	hostname string
+
+	conn net.Conn
+}
+
+// gelfChunkSize is the maximum size of a single GELF chunk sent over UDP.
+const gelfChunkSize = 8192
+
+// newGELFSink creates a gelfSink from a URL such as udp://localhost:12201 or tcp://localhost:12201.
+func newGELFSink(rawURL string) (*gelfSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported GELF network %q", u.Scheme)
+	}
+	hostname, _ := os.Hostname()
+	return &gelfSink{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+}
+
+// send sends a single entry, connecting to the server first if not connected.
+func (sink *gelfSink) send(e logEntry) error {
+	if sink.conn == nil {
+		conn, err := net.DialTimeout(sink.network, sink.addr, time.Second*5)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          sink.hostname,
+		"short_message": e.message,
+		"timestamp":     float64(e.time.UnixNano()) / float64(time.Second),
+		"level":         6,
+	}
+	for k, v := range e.fields {
+		m["_"+k] = v
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_ = sink.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if sink.network == "tcp" {
+		// Messages sent over TCP are uncompressed and delimited by a null byte.
+		_, err = sink.conn.Write(append(b, 0))
+	} else {
+		err = sink.writeChunked(b)
+	}
+	if err != nil {
+		_ = sink.conn.Close()
+		sink.conn = nil
+	}
+	return err
+}
+
+// writeChunked writes a GELF message over UDP, splitting it into chunks if it does not fit in one datagram.
+func (sink *gelfSink) writeChunked(b []byte) error {
+	if len(b) <= gelfChunkSize {
+		_, err := sink.conn.Write(b)
+		return err
+	}
+	const headerSize = 12
+	count := (len(b) + gelfChunkSize - headerSize - 1) / (gelfChunkSize - headerSize)
+	if count > 128 {
+		return fmt.Errorf("GELF message of %d bytes is too large", len(b))
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	for i := 0; i < count; i++ {
+		start := i * (gelfChunkSize - headerSize)
+		end := start + gelfChunkSize - headerSize
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := append([]byte{0x1e, 0x0f}, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		if _, err := sink.conn.Write(append(chunk, b[start:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/sandertv/go-raknet"
+	"log"
+	"time"
+)
+
+// minecraftPackageFamily is the package family name of Minecraft for Windows, which needs a loopback exemption
+// to connect to a proxy running on the same machine.
+const minecraftPackageFamily = "Microsoft.MinecraftUWP_8wekyb3d8bbwe"
+
+func init() {
+	registerSubcommand("loopback", "Allow Minecraft for Windows to connect to the proxy on 127.0.0.1 (requires administrator)", func([]string) error {
+		return exemptLoopback()
+	})
+}
+
+// checkLocalConnectivity pings the proxy on the address it listens on, or the loopback address if it listens on
+// all interfaces, to validate that it accepts local connections.
+func checkLocalConnectivity() {
+	addr := localListenAddr()
+	if _, err := raknet.PingTimeout(addr, time.Second*3); err != nil {
+		log.Printf("The proxy did not respond to a ping on %s: %v\n", addr, err)
+		return
+	}
+	if err := loopbackExempted(); err != nil {
+		log.Printf("The proxy is reachable on %s, but Minecraft may not be able to connect to it: %v\n", addr, err)
+		return
+	}
+	log.Printf("The proxy is reachable on %s.\n", addr)
+}
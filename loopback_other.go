@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// exemptLoopback is only needed on Windows, where UWP apps may not connect to the loopback address by default.
+func exemptLoopback() error {
+	return fmt.Errorf("loopback exemptions are only needed on Windows")
+}
+
+// loopbackExempted always succeeds, as only Windows restricts connections to the loopback address.
+func loopbackExempted() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// exemptLoopback adds a loopback exemption for Minecraft for Windows using CheckNetIsolation, which UWP apps
+// need to connect to servers running on the same machine, and verifies that it was applied.
+func exemptLoopback() error {
+	out, err := exec.Command("CheckNetIsolation", "LoopbackExempt", "-a", "-n="+minecraftPackageFamily).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("add loopback exemption: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := loopbackExempted(); err != nil {
+		return err
+	}
+	fmt.Println("Minecraft for Windows may now connect to the proxy on 127.0.0.1.")
+	return nil
+}
+
+// loopbackExempted checks if Minecraft for Windows has a loopback exemption.
+func loopbackExempted() error {
+	out, err := exec.Command("CheckNetIsolation", "LoopbackExempt", "-s").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("list loopback exemptions: %w", err)
+	}
+	if !strings.Contains(strings.ToLower(string(out)), strings.ToLower(minecraftPackageFamily)) {
+		return errNoLoopbackExemption
+	}
+	return nil
+}
+
+// errNoLoopbackExemption is returned by loopbackExempted if Minecraft is not allowed to connect to the loopback
+// address.
+var errNoLoopbackExemption = errors.New("Minecraft for Windows has no loopback exemption, run the loopback subcommand as administrator")
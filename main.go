@@ -1,27 +1,25 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"github.com/sandertv/gophertunnel/minecraft"
-	"github.com/sandertv/gophertunnel/minecraft/auth"
 	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
-	"golang.org/x/oauth2"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-// filteredPackets represents a list of packets that should be filtered out when logging.
-// Packet listed in here will NOT be printed to the console.
+// filteredPackets represents a list of packets that should be filtered out when logging by default.
+// Packet listed in here will NOT be printed to the console, unless shown using -filter or a filter file.
 var filteredPackets = map[string]bool{
 	getType(&packet.MovePlayer{}, false):                  true,
 	getType(&packet.PlayerAuthInput{}, false):             true,
@@ -52,46 +50,479 @@ var filteredPackets = map[string]bool{
 	getType(&packet.CraftingData{}, false):                true,
 }
 
+// subcommand is a command that may be passed as first argument to run a tool instead of the proxy.
+type subcommand struct {
+	description string
+	run         func(args []string) error
+}
+
+// subcommands holds all subcommands registered, indexed by their name.
+var subcommands = map[string]subcommand{}
+
+// registerSubcommand registers a subcommand under the name passed.
+func registerSubcommand(name, description string, run func(args []string) error) {
+	subcommands[name] = subcommand{description: description, run: run}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+	}
 	var host string
 	var port int
+	var rcFile, historyFile string
+	var authMode, tokenFile, tokenEnv, tokenURL string
+	var only, colors, suppress, stubFile, filters, filterFile, geoIPFile, sessionWarningList, hexdump, pretty, redact, where, httpAllow, pluginDir string
+	var influxURL, influxToken, graphiteAddr string
+	var metricsInterval, statsInterval time.Duration
+	var syslogURL, gelfURL, logFile string
+	var logMaxSize, logMaxBackups, recordMaxSizeMB int
+	var logMaxAge time.Duration
+	var journald bool
+	var kafkaBrokers, natsAddr, publishPrefix string
+	var publishPerGroup bool
+	var parquetDir, sqliteFile string
+	var watchdogFile, chaosDrops, chaosDuplicates, chaosReorders, chaosSkews string
+	var watchdogInterval, motdInterval, portalProfile time.Duration
+	var migratable, tray, lan, loopback, noColor, injectStdin bool
+	var dashboardURL, configFile, statsHTTP, motd, listen, stream, aggregateOnly string
 
 	flag.StringVar(&host, "host", "127.0.0.1", "Host to connect to") // blame minecraft for this
 	flag.IntVar(&port, "port", 19134, "Port to connect to")
+	flag.StringVar(&listen, "listen", listenAddr, "Address to accept clients on, such as 127.0.0.1:19132 or :19142")
+	flag.StringVar(&motd, "motd", "", "MOTD to show in the server list instead of the MOTD of the upstream server")
+	flag.StringVar(&rcFile, "rc", "", "File of console commands to execute on startup")
+	flag.StringVar(&historyFile, "history", "console_history.txt", "File to persist console command history to")
+	flag.StringVar(&authMode, "auth", "device", "Identity provider to authenticate with: device, env, url, or offline to log in and accept clients without authentication")
+	flag.StringVar(&tokenFile, "token", "token.tok", "File to cache the Live token in when using the device provider")
+	flag.StringVar(&tokenEnv, "token-env", "BDSMITM_REFRESH_TOKEN", "Environment variable holding a refresh token when using the env provider")
+	flag.StringVar(&tokenURL, "token-url", "", "URL of a token service returning JSON tokens when using the url provider")
+	flag.DurationVar(&tokenRefreshMargin, "token-refresh-margin", tokenRefreshMargin, "Time before expiry at which the token is refreshed")
+	flag.Int64Var(&bufferLimit, "buffer-limit", bufferLimit, "Bytes that may be buffered per direction of a session before the backpressure policy applies")
+	flag.StringVar(&backpressurePolicy, "backpressure", backpressurePolicy, "Policy when a session exceeds the buffer limit: warn, block, drop-oldest or disconnect")
+	flag.StringVar(&filterFile, "filters", "", "JSON or YAML file listing packets to hide or show, filters.json or filters.yaml by default")
+	flag.StringVar(&only, "only", "", "Comma separated packet[:direction] entries, wildcards or @groups that are the only packets logged")
+	flag.StringVar(&filters, "filter", "", "Comma separated packet[:direction] entries, wildcards or @groups to hide from logging, prefixed with + to show them instead")
+	flag.StringVar(&stream, "stream", "", "Stream packets to stdout without any other console output: ndjson to write one JSON line per packet")
+	flag.BoolVar(&injectStdin, "inject-stdin", false, "Read NDJSON packet descriptions to inject from stdin instead of console commands")
+	flag.StringVar(&logFormat, "log-format", logFormat, "Format of console output: text, or json to write one JSON line per log entry including packet payloads")
+	flag.BoolVar(&noColor, "no-color", false, "Disable colours in console output, such as when piping it to a file")
+	flag.StringVar(&colors, "colors", "", "Comma separated colours of packet categories, groups or packets, such as movement=cyan,Text=red")
+	flag.StringVar(&logVerbosity, "v", logVerbosity, "Verbosity of packet logging: quiet to only log connections, summary to log packet counts or full to log payloads")
+	flag.Float64Var(&driftFactor, "drift-factor", driftFactor, "Factor by which packet rates of a session must differ from the baseline of the upstream server to be reported, or 0 to disable it")
+	flag.StringVar(&noveltyScope, "novelty", "", "Only log packets with shapes not seen before in their session or on their upstream server: session or upstream")
+	flag.StringVar(&redact, "redact", "", "Comma separated Packet.Field=action rules masking fields in logs, with action mask, hash or truncate:n, such as *.XUID=hash")
+	flag.StringVar(&where, "where", "", "Semicolon separated conditions packets are only logged if they match, such as Text where Message contains \"teleport\"")
+	flag.StringVar(&pretty, "pretty", "", "Comma separated packets, wildcards or @groups logged as indented trees of their fields, or all")
+	flag.StringVar(&hexdump, "hexdump", "", "Comma separated packets, wildcards or @groups of which the serialized bytes are logged as hex dump, or all")
+	flag.IntVar(&logRateLimit, "log-rate", logRateLimit, "Maximum log lines per second per packet type written to the console, or 0 for no limit")
+	flag.StringVar(&suppress, "suppress", "", "Comma separated list of packets or @groups that are never forwarded to the client")
+	flag.StringVar(&stubFile, "stubs", "", "JSON file of client packets answered locally instead of by the server")
+	flag.StringVar(&influxURL, "influx-url", "", "InfluxDB write endpoint to push session metrics to")
+	flag.StringVar(&influxToken, "influx-token", "", "API token used when pushing metrics to InfluxDB")
+	flag.StringVar(&graphiteAddr, "graphite", "", "Graphite plaintext address (host:port) to push session metrics to")
+	flag.DurationVar(&statsInterval, "stats-interval", 0, "Interval at which a line with packet and byte rates and the amount of sessions is logged, or 0 to disable it")
+	flag.StringVar(&statsDBFile, "stats-db", statsDBFile, "Database to store the aggregates of closed sessions in, or empty to not store them")
+	flag.StringVar(&statsHTTP, "stats-http", "", "Address to serve charts of the sessions stored in the stats database on, such as 127.0.0.1:8081")
+	flag.StringVar(&aggregateOnly, "aggregate-only", "", "Never log or store payloads and write differentially private packet distributions and timings to this file when stopped")
+	flag.Float64Var(&aggregateEpsilon, "aggregate-epsilon", aggregateEpsilon, "Privacy budget of the aggregate statistics, where lower values add more noise")
+	flag.DurationVar(&metricsInterval, "metrics-interval", time.Second*10, "Interval at which session metrics are pushed")
+	flag.StringVar(&logFile, "log-file", "", "File to write logs to in addition to the console")
+	flag.IntVar(&logMaxSize, "log-max-size", 100, "Size in megabytes after which the log file is rotated, or 0 to never rotate it")
+	flag.DurationVar(&logMaxAge, "log-max-age", time.Hour*24*7, "Age after which rotated log files are removed, or 0 to keep them")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 10, "Maximum amount of rotated log files kept, or 0 to keep all of them")
+	flag.StringVar(&syslogURL, "syslog", "", "Remote syslog server to forward logs to, such as udp://localhost:514")
+	flag.BoolVar(&journald, "journald", false, "Forward logs to the systemd journal")
+	flag.StringVar(&gelfURL, "gelf", "", "GELF input to forward logs to, such as udp://localhost:12201")
+	flag.StringVar(&kafkaBrokers, "kafka", "", "Comma separated list of Kafka brokers to publish packet events to")
+	flag.StringVar(&natsAddr, "nats", "", "Address of a NATS server to publish packet events to")
+	flag.StringVar(&publishPrefix, "publish-prefix", "bdsmitm", "Prefix of the topics packet events are published to")
+	flag.BoolVar(&publishPerGroup, "publish-per-group", false, "Publish packet events to one topic per packet group, such as movement, instead of one per direction")
+	flag.StringVar(&parquetDir, "parquet", "", "Directory to export packets to as Parquet files partitioned by date and session")
+	flag.StringVar(&sqliteFile, "sqlite", "", "SQLite database to store packets in with their payload as JSON, which may be queried with the query subcommand")
+	flag.StringVar(&transcriptFile, "transcript", "", "File to append a readable transcript of the actions of players to, such as blocks broken and commands used")
+	flag.StringVar(&heatmapDir, "heatmap-dir", "", "Directory to write a heatmap per chunk of the movement and interactions of the player of every session to as JSON and PNG")
+	flag.StringVar(&registryDir, "registry-dir", "", "Directory to store login-phase data of sessions in, deduplicated by hash")
+	flag.StringVar(&knowledgeFile, "kb-file", knowledgeFile, "File to persist the knowledge accumulated about upstream servers in, or empty to keep it in memory")
+	flag.StringVar(&geoIPFile, "geoip", "", "GeoIP database in CSV format (first address, last address, country) used to resolve the country of clients")
+	flag.StringVar(&clientReportFile, "client-report", "", "File to write the aggregate of connected clients to as JSON when the proxy is stopped")
+	flag.StringVar(&serverLogSource, "server-log", "", "Log of the upstream server to interleave with packets: a file path, ssh://user@host/path or http://addr/path to receive it by webhook")
+	flag.DurationVar(&serverLogOffset, "server-log-offset", 0, "Offset added to timestamps in the server log to correct for clock differences")
+	flag.StringVar(&watchdogFile, "watchdog-file", "upstream_history.jsonl", "File to record changes of the upstream version and MOTD in")
+	flag.DurationVar(&watchdogInterval, "watchdog-interval", time.Minute, "Interval at which the upstream is pinged by the watchdog, or 0 to disable it")
+	flag.StringVar(&profileDir, "profile-dir", profileDir, "Directory that tokens of profiles used with the login command are stored in")
+	flag.StringVar(&chaosDrops, "chaos-drop", "", "Comma separated packet:direction:percentage rules of packets to drop deliberately")
+	flag.StringVar(&chaosDuplicates, "chaos-duplicate", "", "Comma separated packet:direction:percentage rules of packets to duplicate deliberately")
+	flag.StringVar(&chaosReorders, "chaos-reorder", "", "Comma separated packet:direction:percentage rules of packets to reorder deliberately")
+	flag.StringVar(&chaosSkews, "chaos-skew", "", "Comma separated packet:offset pairs of tick and timestamp offsets to apply to packets, such as PlayerAuthInput:20")
+	flag.IntVar(&chaosReorderWindow, "chaos-reorder-window", chaosReorderWindow, "Maximum amount of packets that may overtake a reordered packet")
+	flag.BoolVar(&migratable, "migratable", false, "Dial the upstream server over sockets that may be rebound mid-session to emulate a client switching networks")
+	flag.DurationVar(&migrationDelay, "rebind-after", 0, "Rebind the upstream socket of every session after this duration, implies -migratable")
+	flag.BoolVar(&tray, "tray", false, "Show the proxy in the system tray")
+	flag.StringVar(&dashboardURL, "dashboard-url", "", "URL of the dashboard opened from the system tray")
+	flag.DurationVar(&clientProbeInterval, "client-probe", 0, "Interval at which NetworkStackLatency probes are sent to clients to measure client lag, or 0 to disable them")
+	flag.DurationVar(&sessionLimit, "session-limit", 0, "Maximum duration of a session after which the client is disconnected, or 0 for no limit")
+	flag.StringVar(&sessionWarningList, "session-warnings", "5m,1m,10s", "Comma separated times before the session limit at which players are warned")
+	flag.BoolVar(&gatewayMode, "gateway", false, "Run as a gateway in front of a public server: redact sensitive payloads, disable packet injection and rate limit clients")
+	flag.IntVar(&gatewaySessionsPerIP, "gateway-sessions-per-ip", gatewaySessionsPerIP, "Maximum concurrent sessions per IP address in gateway mode")
+	flag.IntVar(&gatewayConnectRate, "gateway-connect-rate", gatewayConnectRate, "Maximum connections per IP address per minute in gateway mode")
+	flag.IntVar(&gatewayPacketRate, "gateway-packet-rate", gatewayPacketRate, "Maximum packets per second a client may send in gateway mode before it is disconnected")
+	flag.StringVar(&clientCompression, "compression", clientCompression, "Compression of packets exchanged with clients: flate, snappy, or none to save CPU for clients on localhost or the LAN")
+	flag.BoolVar(&lan, "lan", false, "Broadcast the proxy on the local network so it shows up in the LAN games list")
+	flag.BoolVar(&loopback, "loopback", false, "Add a loopback exemption for Minecraft for Windows on startup and validate local connectivity")
+	flag.StringVar(&forensicsDir, "forensics-dir", forensicsDir, "Directory to write forensic dumps to when the upstream server disconnects a session, or empty to disable them")
+	flag.StringVar(&exportDir, "export-dir", exportDir, "Directory that bundles written by the export command are stored in")
+	flag.DurationVar(&motdInterval, "motd-status", 0, "Alternate the MOTD with a status of the proxy at this interval, or 0 to disable it")
+	flag.DurationVar(&portalProfile, "portal-profile", 0, "Log and capture all packets of a session for this duration after a dimension change, or 0 to disable it")
+	flag.StringVar(&portalCaptureDir, "portal-dir", portalCaptureDir, "Directory to write captures of the portal profile to")
+	flag.Func("record", "Comma separated display names or XUIDs of players whose sessions are recorded to capture files, or * for all sessions", func(list string) error {
+		parseRecordSelectors(list)
+		return nil
+	})
+	flag.StringVar(&recordDir, "record-dir", recordDir, "Directory to write session recordings to")
+	flag.IntVar(&recordMaxSizeMB, "record-max-size", 0, "Size in megabytes after which a session recording continues in a new file linked by a manifest, or 0 to never split it")
+	flag.DurationVar(&recordMaxAge, "record-max-age", 0, "Duration after which a session recording continues in a new file linked by a manifest, or 0 to never split it")
+	flag.Func("record-packets", "Comma separated packets, wildcards or @groups that are recorded, or logged to record the packets not hidden by the log filters, instead of all packets", parseRecordPackets)
+	flag.BoolVar(&clientOnly, "client-only", false, "Log clients in with cached game data of the upstream server and record everything they send, without connecting to the upstream server")
+	flag.BoolVar(&rawForwarding, "raw", false, "Relay and record packets without decoding them, which lowers latency under heavy traffic but disables handlers and packet logging")
+	flag.StringVar(&loginCacheDir, "login-cache", loginCacheDir, "Directory to cache the game data of upstream servers in for -client-only, or an empty string to not cache it")
+	flag.IntVar(&captureDedupMinSize, "capture-dedup", 0, "Store identical payloads of at least this many bytes only once in captures, or 0 to disable it")
+	flag.StringVar(&kvStoreFile, "kv-file", kvStoreFile, "File that the persistent key-value store of plugins is kept in")
+	flag.StringVar(&pluginDir, "plugins", "", "Directory of Go handler plugins (.so files, Linux only) to load on startup")
+	flag.StringVar(&httpAllow, "http-allow", "", "Comma separated hosts that plugins may send HTTP requests to, such as *.example.com")
+	flag.IntVar(&extHTTPRate, "http-rate", extHTTPRate, "Maximum amount of HTTP requests a single plugin may send per minute")
+	flag.IntVar(&handlerWorkers, "handler-workers", handlerWorkers, "Amount of workers that plugin handlers run on")
+	flag.DurationVar(&handlerTimeout, "handler-timeout", handlerTimeout, "Time a plugin handler may take per packet before it is counted as exceeding its budget")
+	flag.StringVar(&configFile, "config", "", "TOML or YAML file of options to use when they are not passed as flags, config.toml or config.yaml by default")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		_, _ = fmt.Fprintf(out, "Usage: %s [flags]\n       %s <subcommand> [arguments]\n\nSubcommands:\n", os.Args[0], os.Args[0])
+		names := make([]string, 0, len(subcommands))
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			_, _ = fmt.Fprintf(out, "  %-12s %s\n", name, subcommands[name].description)
+		}
+		_, _ = fmt.Fprintln(out, "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := applyEnv(); err != nil {
+		panic(err)
+	}
+	if configFile == "" {
+		configFile = findConfig()
+	}
+	setReloadableConfig(configFile)
+	if firstRun(configFile) {
+		if err := runSetup(configFile); err != nil {
+			panic(err)
+		}
+	}
+	if err := applyConfig(configFile); err != nil {
+		panic(err)
+	}
+	if err := parseListenAddr(listen); err != nil {
+		panic(err)
+	}
+	if listensOn(host, port) {
+		panic(fmt.Errorf("the upstream server %s:%d is the address the proxy listens on: pass another address with -listen", host, port))
+	}
 
-	log.Println("Binding on 0.0.0.0:19132")
-	log.Printf("Connecting to %s:%d\n", host, port)
-
+	go func() {
+		c := make(chan os.Signal, 3)
+		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+		<-c
+		shutdown()
+	}()
 	hostString := host + ":" + strconv.Itoa(port)
 
-	token, err := tokenSource().Token()
+	if logFile != "" {
+		sink, err := newLogFileSink(logFile, int64(logMaxSize)<<20, logMaxAge, logMaxBackups)
+		if err != nil {
+			panic(err)
+		}
+		addLogSink(sink)
+		onShutdown(sink.close)
+		reloadState.logFile = sink
+	}
+	if syslogURL != "" {
+		sink, err := newSyslogSink(syslogURL)
+		if err != nil {
+			panic(err)
+		}
+		addLogSink(newRemoteSink("syslog server "+sink.addr, sink.send))
+	}
+	if gelfURL != "" {
+		sink, err := newGELFSink(gelfURL)
+		if err != nil {
+			panic(err)
+		}
+		addLogSink(newRemoteSink("GELF input "+sink.addr, sink.send))
+	}
+	if journald {
+		sink, err := newJournalSink()
+		if err != nil {
+			panic(err)
+		}
+		addLogSink(sink)
+	}
+
+	if logFormat != "text" && logFormat != "json" {
+		panic(fmt.Sprintf("invalid log format %q: expected text or json", logFormat))
+	}
+	if stream != "" {
+		if err := enableStream(stream); err != nil {
+			panic(err)
+		}
+	}
+	if err := parseVerbosity(logVerbosity); err != nil {
+		panic(err)
+	}
+	if logVerbosity == "summary" {
+		startPacketSummaries()
+	}
+	if statsInterval > 0 {
+		go reportStats(statsInterval)
+	}
+	if statsHTTP != "" && statsDBFile != "" {
+		go serveStatsHistory(statsHTTP)
+	}
+	if driftFactor > 0 {
+		enableDriftDetection()
+	}
+	if noveltyScope != "" && noveltyScope != "session" && noveltyScope != "upstream" {
+		panic(fmt.Sprintf("invalid novelty scope %q: expected session or upstream", noveltyScope))
+	}
+	go logRateSummaries()
+	if err := applyLogFilters(); err != nil {
+		panic(err)
+	}
+	go handleReloadSignal()
+	if noColor {
+		consoleColor = false
+	}
+	if err := parseColors(colors); err != nil {
+		panic(err)
+	}
+	suppressed, err := expandPacketNames(strings.Split(suppress, ","))
 	if err != nil {
 		panic(err)
 	}
-	src := auth.RefreshTokenSource(token)
-	p, err := minecraft.NewForeignStatusProvider(hostString)
-
+	suppressPackets(suppressed, true)
+	err = checkGatewayOptions(map[string]bool{
+		"chaos-drop": chaosDrops != "", "chaos-duplicate": chaosDuplicates != "", "chaos-reorder": chaosReorders != "",
+		"chaos-skew": chaosSkews != "", "stubs": stubFile != "", "migratable": migratable, "rebind-after": migrationDelay > 0,
+		"client-probe": clientProbeInterval > 0, "inject-stdin": injectStdin,
+	})
 	if err != nil {
 		panic(err)
 	}
+	err = checkRawOptions(map[string]bool{
+		"chaos-skew": chaosSkews != "", "stubs": stubFile != "", "client-only": clientOnly, "portal-profile": portalProfile > 0,
+		"transcript": transcriptFile != "", "heatmap-dir": heatmapDir != "", "plugins": pluginDir != "",
+	})
+	if err != nil {
+		panic(err)
+	}
+	if aggregateOnly != "" {
+		err := enableAggregateMode(aggregateOnly, map[string]bool{
+			"stream": stream != "", "record": len(recordSelectors) > 0, "parquet": parquetDir != "", "kafka": kafkaBrokers != "",
+			"nats": natsAddr != "", "portal-profile": portalProfile > 0, "registry-dir": registryDir != "",
+			"sqlite": sqliteFile != "", "transcript": transcriptFile != "",
+			"heatmap-dir": heatmapDir != "",
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := addChaosRules("drop", chaosDrops); err != nil {
+		panic(err)
+	}
+	if err := addChaosRules("duplicate", chaosDuplicates); err != nil {
+		panic(err)
+	}
+	if err := addChaosRules("reorder", chaosReorders); err != nil {
+		panic(err)
+	}
+	if err := addChaosSkews(chaosSkews); err != nil {
+		panic(err)
+	}
+	if migratable || migrationDelay > 0 {
+		upstreamNetwork = migratableNetworkID
+	}
+	if stubFile != "" {
+		if err := loadStubs(stubFile); err != nil {
+			panic(err)
+		}
+	}
+	if clientProbeInterval > 0 {
+		enableClientProbes()
+	}
+	if kafkaBrokers != "" {
+		addPacketListener(newPacketPublisher(newKafkaPublisher(strings.Split(kafkaBrokers, ",")), publishPrefix, publishPerGroup).handlePacket)
+	}
+	if natsAddr != "" {
+		addPacketListener(newPacketPublisher(newNATSPublisher(natsAddr), publishPrefix, publishPerGroup).handlePacket)
+	}
+	if portalProfile > 0 {
+		enablePortalProfile(portalProfile)
+	}
+	if parquetDir != "" {
+		exp := newParquetExporter(parquetDir)
+		addPacketListener(exp.handlePacket)
+		addSessionCloseListener(exp.handleSessionClose)
+		onShutdown(exp.close)
+	}
+	recordMaxSize = int64(recordMaxSizeMB) << 20
+	if sqliteFile != "" {
+		store, err := newSQLiteStore(sqliteFile)
+		if err != nil {
+			panic(err)
+		}
+		addPacketListener(store.handlePacket)
+		onShutdown(store.close)
+	}
+	if transcriptFile != "" {
+		if err := startTranscripts(transcriptFile); err != nil {
+			panic(err)
+		}
+	}
+	if heatmapDir != "" {
+		if err := startHeatmaps(); err != nil {
+			panic(err)
+		}
+	}
+	if sessionWarnings, err = parseSessionWarnings(sessionWarningList); err != nil {
+		panic(err)
+	}
+	if extHTTPHosts, err = parseHTTPHosts(httpAllow); err != nil {
+		panic(err)
+	}
+	if pluginDir != "" {
+		if err := loadPlugins(pluginDir); err != nil {
+			panic(err)
+		}
+	}
+	if geoIPFile != "" {
+		if err := loadGeoIP(geoIPFile); err != nil {
+			panic(err)
+		}
+	}
+	if clientReportFile != "" {
+		onShutdown(writeClientReport)
+	}
+	if serverLogSource != "" {
+		if err := tailServerLog(serverLogSource); err != nil {
+			panic(err)
+		}
+	}
+	if watchdogInterval > 0 {
+		runUpstreamWatchdog(hostString, watchdogFile, watchdogInterval)
+	}
+	var sinks []metricsSink
+	if influxURL != "" {
+		sinks = append(sinks, influxSink{url: influxURL, token: influxToken, client: &http.Client{Timeout: time.Second * 10}})
+	}
+	if graphiteAddr != "" {
+		sinks = append(sinks, graphiteSink{addr: graphiteAddr})
+	}
+	if len(sinks) > 0 {
+		go pushMetrics(metricsInterval, sinks...)
+	}
+
+	log.Printf("Connecting to %s:%d\n", host, port)
 
+	var p minecraft.ServerStatusProvider
+	if clientOnly {
+		// The upstream server is never connected to, so neither a token nor its status is needed.
+		p = minecraft.NewStatusProvider("bds-mitm client-only")
+	} else {
+		provider, err := newIdentityProvider(authMode, map[string]string{
+			"device": tokenFile,
+			"env":    tokenEnv,
+			"url":    tokenURL,
+		}[authMode])
+		if err != nil {
+			panic(err)
+		}
+		src, err := provider.TokenSource()
+		if err != nil {
+			panic(err)
+		}
+		activeIdentity.set("default", src)
+		p, err = minecraft.NewForeignStatusProvider(hostString)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if motd != "" {
+		p = motdOverride{upstream: p, motd: motd}
+	}
+	if motdInterval > 0 {
+		p = newStatusRotator(p, hostString, motdInterval)
+	}
+
+	activeCompression, err = parseClientCompression(clientCompression)
+	if err != nil {
+		panic(err)
+	}
 	listener, err := minecraft.ListenConfig{
 		StatusProvider: p,
-	}.Listen("raknet", ":19132")
-	go func() {
-		for {
-			var input string
-			_, err := fmt.Scanln(&input)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			if input == "stop" {
-				listener.Close()
-				os.Exit(0)
-			}
+		Compression:    activeCompression,
+		// Clients may connect without authentication if the proxy logs in without it too, so that it can be used
+		// with bots and the mock server entirely offline.
+		AuthenticationDisabled: authMode == "offline",
+	}.Listen("raknet", listenAddr)
+	if err != nil {
+		panic(fmt.Errorf("listen on %s: %w (pass another address with -listen to run several proxies side by side)", listenAddr, err))
+	}
+	log.Printf("Accepting clients on %s\n", listener.Addr())
+	if lan {
+		go runLANAdvertiser(p, time.Millisecond*1500)
+	}
+	if loopback {
+		if err := exemptLoopback(); err != nil {
+			log.Printf("An error occurred whilst adding the loopback exemption: %v\n", err)
 		}
-	}()
+		go checkLocalConnectivity()
+	}
+	registerCommand("stop", consoleCommand{
+		description: "Stops the proxy.",
+		run: func([]string) {
+			listener.Close()
+			shutdown()
+		},
+	})
+	loadHistory(historyFile)
+	if rcFile != "" {
+		if err := runScript(rcFile); err != nil {
+			log.Printf("An error occurred whilst running %s: %v\n", rcFile, err)
+		}
+	}
+	if injectStdin {
+		go readInjections(os.Stdin)
+	} else if !streaming {
+		go readConsole()
+	}
+	if tray {
+		go acceptConns(listener, hostString)
+		runTray(hostString, dashboardURL)
+		return
+	}
+	acceptConns(listener, hostString)
+}
+
+// acceptConns accepts clients from the listener passed and proxies them to the upstream server until the
+// listener is closed. Clients are disconnected immediately while the proxy is not accepting connections.
+func acceptConns(listener *minecraft.Listener, hostString string) {
 	defer listener.Close()
 	for {
 		c, err := listener.Accept()
@@ -99,161 +530,126 @@ func main() {
 			log.Printf("An error occurred whilst accepting client: %v\n", err)
 			continue
 		}
+		if !acceptingConnections.Load() {
+			_ = listener.Disconnect(c.(*minecraft.Conn), rejectMessage())
+			continue
+		}
+		if err := admitClient(c.RemoteAddr()); err != nil {
+			log.Printf("Refused client: %v\n", err)
+			_ = listener.Disconnect(c.(*minecraft.Conn), "Too many connections, please try again later.")
+			continue
+		}
+		if clientOnly {
+			go func() {
+				if err := handleClientOnly(c.(*minecraft.Conn), hostString); err != nil {
+					log.Printf("An error occurred whilst handling client: %v\n", err)
+				}
+				releaseClient(c.RemoteAddr())
+			}()
+			continue
+		}
 		go func() {
-			err := handleConn(c.(*minecraft.Conn), listener, hostString, src)
+			err := handleConn(c.(*minecraft.Conn), listener, hostString, activeIdentity.tokenSource())
 			if err != nil {
+				releaseClient(c.RemoteAddr())
 				log.Printf("An error occurred whilst handling client: %v\n", err)
 			}
 		}()
 	}
 }
 
-// handleConn accepts the connection from the client and tries to connect to the target server.
-func handleConn(conn *minecraft.Conn, listener *minecraft.Listener, hostString string, src oauth2.TokenSource) error {
-	serverConn, err := minecraft.Dialer{
-		TokenSource: src,
-		ClientData:  conn.ClientData(),
-	}.Dial("raknet", hostString)
-	if err != nil {
-		return err
-	}
-	var g sync.WaitGroup
-	g.Add(2)
-	go func() {
-		if err := conn.StartGame(serverConn.GameData()); err != nil {
-			log.Printf("An error occurred whilst starting game: %v\n", err)
-		}
-		g.Done()
-	}()
-	go func() {
-		if err := serverConn.DoSpawn(); err != nil {
-			log.Printf("An error occurred whilst spawning: %v\n", err)
-		}
-		g.Done()
-	}()
-	g.Wait()
-	go func() {
-		defer listener.Disconnect(conn, "connection lost")
-		defer serverConn.Close()
-		for {
-			pk, err := conn.ReadPacket()
-			if err != nil {
-				return
-			}
-			onClientPacketReceived(conn, pk)
-			if err := serverConn.WritePacket(pk); err != nil {
-				if disconnect, ok := errors.Unwrap(err).(minecraft.DisconnectError); ok {
-					_ = listener.Disconnect(conn, disconnect.Error())
-				}
-				return
-			}
-		}
-	}()
+// shutdownHooks holds functions that are called when the proxy is stopped.
+var shutdownHooks struct {
+	sync.Mutex
+	hooks []func()
+}
 
-	go func() {
-		defer serverConn.Close()
-		defer listener.Disconnect(conn, "connection lost")
-		for {
-			pk, err := serverConn.ReadPacket()
-			if err != nil {
-				if disconnect, ok := errors.Unwrap(err).(minecraft.DisconnectError); ok {
-					_ = listener.Disconnect(conn, disconnect.Error())
-				}
-				return
-			}
-			onServerPacketReceived(conn, pk)
-			if err := conn.WritePacket(pk); err != nil {
-				return
-			}
-		}
-	}()
-	return nil
+// onShutdown registers a function that is called when the proxy is stopped, such as to flush files.
+func onShutdown(f func()) {
+	shutdownHooks.Lock()
+	shutdownHooks.hooks = append(shutdownHooks.hooks, f)
+	shutdownHooks.Unlock()
 }
 
-// onClientPacketReceived is called when a packet is received from the client.
-// A Packet which is listed in filteredPackets will be ignored.
-func onClientPacketReceived(conn *minecraft.Conn, pk packet.Packet) {
-	if p, ok := pk.(*packet.ChangeDimension); ok {
-		log.Printf("Received Change Dimension on client with dimension ID %d on time: %s\n", p.Dimension, time.Now().String())
-		log.Printf("Additional Data: %v(Respawn), %v(Position)\n", p.Respawn, p.Position)
-	} else if p, ok := pk.(*packet.PlayStatus); ok {
-		log.Printf("Received Play Status on client with status type %d on time: %s\n", p.Status, time.Now().String())
-		log.Printf("Additional Data: %v\n", p.Status)
-	} else if p, ok := pk.(*packet.PlayerAction); ok {
-		log.Printf("Received Player Action on client with action type %d on time: %s\n", p.ActionType, time.Now().String())
-		log.Printf("Additional Data: %v(BlockPosition), %v(BlockFace), %v(ResultPos)\n", p.BlockPosition, p.BlockFace, p.ResultPosition)
-	} else if _, ok := pk.(*packet.SetLocalPlayerAsInitialised); ok {
-		log.Printf("Received Set Local Player As Initialised on client on time: %s\n", time.Now().String())
-	} else {
-		t := getType(pk, false)
-		if _, ok := filteredPackets[t]; ok {
-			return // ignore spam
-		}
-		log.Printf("Received "+t+" on client on time: %s\n", time.Now().String())
-		log.Printf("Additional Data: %v\n", pk)
+// shutdown calls all shutdown hooks in the reverse order of registration and exits the program.
+func shutdown() {
+	shutdownHooks.Lock()
+	for i := len(shutdownHooks.hooks) - 1; i >= 0; i-- {
+		shutdownHooks.hooks[i]()
 	}
+	os.Exit(0)
 }
 
-// onServerPacketReceived is called when a packet is received from the server.
-// A Packet which is listed in filteredPackets will be ignored.
-func onServerPacketReceived(conn *minecraft.Conn, pk packet.Packet) {
+// alwaysLoggedPackets holds the packets that are logged regardless of filters.
+var alwaysLoggedPackets = map[string]bool{
+	getType(&packet.ChangeDimension{}, false):             true,
+	getType(&packet.PlayStatus{}, false):                  true,
+	getType(&packet.PlayerAction{}, false):                true,
+	getType(&packet.SetLocalPlayerAsInitialised{}, false): true,
+}
+
+// onPacketReceived is called when a packet is received from the client, or from the server if fromServer is
+// true. A Packet which is filtered in the direction it was sent in will be ignored.
+func onPacketReceived(s *session, pk packet.Packet, fromServer bool) {
+	source := "client"
+	if fromServer {
+		source = "server"
+	}
+	t := getType(pk, false)
+	fields := s.logFields(source, t)
+	observePacket(t, !fromServer)
+	if !s.packetLoggedInFull(t, fromServer) {
+		return
+	}
+	hidden := s.noveltyHidden(pk, t, fromServer) || packetFiltered(t, fromServer)
+	if matched, ok := packetConditionMatches(t, pk); ok {
+		hidden = !matched
+	}
+	if hidden && allowlistMode && !tailWants(s.id, t) && !portalVerbose(s.id) {
+		return
+	}
+	if logFormat == "json" {
+		if alwaysLoggedPackets[t] || !hidden || tailWants(s.id, t) || portalVerbose(s.id) {
+			s.logPacket(pk, fromServer)
+		}
+		return
+	}
 	if p, ok := pk.(*packet.ChangeDimension); ok {
-		log.Printf("Received Change Dimension on server with dimension ID %d on time: %s\n", p.Dimension, time.Now().String())
-		log.Printf("Additional Data: %v(Respawn), %v(Position)\n", p.Respawn, p.Position)
+		logf(fields, "Received Change Dimension %s on %s with dimension ID %d on time: %s\n", packetIDAndSize(pk), source, p.Dimension, time.Now().String())
+		logf(fields, "Additional Data: %v(Respawn), %v(Position)\n", p.Respawn, p.Position)
 	} else if p, ok := pk.(*packet.PlayStatus); ok {
-		log.Printf("Received Play Status on server with status type %d on time: %s\n", p.Status, time.Now().String())
-		log.Printf("Additional Data: %v\n", p.Status)
+		logf(fields, "Received Play Status %s on %s with status type %d on time: %s\n", packetIDAndSize(pk), source, p.Status, time.Now().String())
+		logf(fields, "Additional Data: %v\n", p.Status)
 	} else if p, ok := pk.(*packet.PlayerAction); ok {
-		log.Printf("Received Player Action on server with action type %d on time: %s\n", p.ActionType, time.Now().String())
-		log.Printf("Additional Data: %v(BlockPosition), %v(BlockFace), %v(ResultPos)\n", p.BlockPosition, p.BlockFace, p.ResultPosition)
+		logf(fields, "Received Player Action %s on %s with action type %d on time: %s\n", packetIDAndSize(pk), source, p.ActionType, time.Now().String())
+		logf(fields, "Additional Data: %v(BlockPosition), %v(BlockFace), %v(ResultPos)\n", p.BlockPosition, p.BlockFace, p.ResultPosition)
 	} else if _, ok := pk.(*packet.SetLocalPlayerAsInitialised); ok {
-		log.Printf("Received Set Local Player As Initialised on server on time: %s\n", time.Now().String())
+		logf(fields, "Received Set Local Player As Initialised %s on %s on time: %s\n", packetIDAndSize(pk), source, time.Now().String())
 	} else {
-		t := getType(pk, false)
-		if _, ok := filteredPackets[t]; ok {
+		if hidden && !tailWants(s.id, t) && !portalVerbose(s.id) {
 			return // ignore spam
 		}
-		log.Printf("Received "+t+" on server on time: %s\n", time.Now().String())
-		log.Printf("Additional Data: %v\n", pk)
-	}
-}
-
-// tokenSource returns a token source for using with a gophertunnel client. It either reads it from the
-// token.tok file if cached or requests logging in with a device code.
-func tokenSource() oauth2.TokenSource {
-	check := func(err error) {
-		if err != nil {
-			panic(err)
+		logf(fields, "Received "+t+" %s on %s on time: %s\n", packetIDAndSize(pk), source, time.Now().String())
+		if payloadRedacted(t) {
+			logf(fields, "Additional Data: [redacted]\n")
+			return
+		}
+		logged := redactPacket(t, pk)
+		if prettyPackets.contains(t) {
+			logf(fields, "Additional Data: %s\n", prettyPacket(logged))
+		} else {
+			logf(fields, "Additional Data: %v\n", logged)
+		}
+		if hexdumpPackets.contains(t) {
+			s.logHexdump(fields, logged)
 		}
 	}
-	token := new(oauth2.Token)
-	tokenData, err := ioutil.ReadFile("token.tok")
-	if err == nil {
-		_ = json.Unmarshal(tokenData, token)
-	} else {
-		token, err = auth.RequestLiveToken()
-		check(err)
-	}
-	src := auth.RefreshTokenSource(token)
-	_, err = src.Token()
-	if err != nil {
-		// The cached refresh token expired and can no longer be used to obtain a new token. We require the
-		// user to log in again and use that token instead.
-		token, err = auth.RequestLiveToken()
-		check(err)
-		src = auth.RefreshTokenSource(token)
-	}
-	go func() {
-		c := make(chan os.Signal, 3)
-		signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
-		<-c
+}
 
-		tok, _ := src.Token()
-		b, _ := json.Marshal(tok)
-		_ = ioutil.WriteFile("token.tok", b, 0644)
-		os.Exit(0)
-	}()
-	return src
+// packetIDAndSize describes the ID and encoded size of a packet, so that log lines may be correlated with wire
+// captures.
+func packetIDAndSize(pk packet.Packet) string {
+	return fmt.Sprintf("(ID %d, %d bytes)", pk.ID(), packetSize(pk))
 }
 
 // getType returns the name of given type.
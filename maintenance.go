@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"strings"
+	"sync"
+)
+
+// defaultRejectMessage is the message clients are disconnected with when they connect whilst the proxy does not
+// accept connections and no maintenance message is set.
+const defaultRejectMessage = "The proxy is currently stopped."
+
+// maintenanceMessage holds the message clients connecting during maintenance are disconnected with.
+var maintenanceMessage struct {
+	sync.Mutex
+	message string
+}
+
+// rejectMessage returns the message that clients connecting whilst connections are not accepted are
+// disconnected with.
+func rejectMessage() string {
+	maintenanceMessage.Lock()
+	defer maintenanceMessage.Unlock()
+	if maintenanceMessage.message == "" {
+		return defaultRejectMessage
+	}
+	return maintenanceMessage.message
+}
+
+// broadcastMessage sends a raw text message to the clients of all active sessions and returns the amount of
+// clients it was sent to.
+func broadcastMessage(message string) int {
+	var n int
+	for _, s := range activeSessions() {
+		if err := s.sendToClient(&packet.Text{TextType: packet.TextTypeRaw, Message: message}); err != nil {
+			log.Printf("Unable to send message to session %d: %v\n", s.id, err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+func init() {
+	registerCommand("maintenance", consoleCommand{
+		usage:       "<on|off> [kick message]",
+		description: "Rejects new connections with a kick message, without affecting active sessions.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				if acceptingConnections.Load() {
+					log.Println("Maintenance mode is off.")
+				} else {
+					log.Printf("Maintenance mode is on, new clients are disconnected with %q.\n", rejectMessage())
+				}
+				return
+			}
+			switch args[0] {
+			case "on":
+				maintenanceMessage.Lock()
+				maintenanceMessage.message = strings.Join(args[1:], " ")
+				maintenanceMessage.Unlock()
+				acceptingConnections.Store(false)
+				log.Printf("Maintenance mode is on, new clients are disconnected with %q. %d sessions remain active.\n", rejectMessage(), len(activeSessions()))
+			case "off":
+				maintenanceMessage.Lock()
+				maintenanceMessage.message = ""
+				maintenanceMessage.Unlock()
+				acceptingConnections.Store(true)
+				log.Println("Maintenance mode is off, new clients are accepted again.")
+			default:
+				log.Println("Usage: maintenance <on|off> [kick message]")
+			}
+		},
+	})
+	registerCommand("broadcast", consoleCommand{
+		usage:       "<message>",
+		description: "Sends a chat message to the players of all active sessions.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println("Usage: broadcast <message>")
+				return
+			}
+			n := broadcastMessage(strings.Join(args, " "))
+			log.Printf("Sent message to %d sessions.\n", n)
+		},
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metricsSink is a time-series database that per-session metrics are periodically pushed to.
+type metricsSink interface {
+	// push writes the metrics of all sessions and the packet latency histograms passed, sampled at the time
+	// passed.
+	push(t time.Time, metrics []sessionMetrics, latencies []packetLatency) error
+}
+
+// sessionMetrics holds the metrics of a single session sampled at a point in time.
+type sessionMetrics struct {
+	id     int64
+	player string
+	values map[string]int64
+}
+
+// sampleMetrics samples the metrics of the session.
+func (s *session) sampleMetrics() sessionMetrics {
+	return sessionMetrics{
+		id:     s.id,
+		player: s.client.IdentityData().DisplayName,
+		values: map[string]int64{
+			"goroutines":                   s.goroutines.Load(),
+			"memory_estimate_bytes":        s.memoryEstimate(),
+			"uptime_seconds":               int64(time.Since(s.started).Seconds()),
+			"client_latency_ms":            s.client.Latency().Milliseconds(),
+			"server_latency_ms":            s.server.Latency().Milliseconds(),
+			"serverbound_packets":          s.serverbound.packets.Load(),
+			"serverbound_bytes":            s.serverbound.bytes.Load(),
+			"serverbound_queued_bytes":     s.serverbound.queuedBytes.Load(),
+			"serverbound_dropped":          s.serverbound.dropped.Load(),
+			"serverbound_chaos_dropped":    s.serverbound.chaosDropped.Load(),
+			"serverbound_chaos_duplicated": s.serverbound.chaosDuplicated.Load(),
+			"serverbound_chaos_reordered":  s.serverbound.chaosReordered.Load(),
+			"serverbound_chaos_skewed":     s.serverbound.chaosSkewed.Load(),
+			"clientbound_packets":          s.clientbound.packets.Load(),
+			"clientbound_bytes":            s.clientbound.bytes.Load(),
+			"clientbound_queued_bytes":     s.clientbound.queuedBytes.Load(),
+			"clientbound_dropped":          s.clientbound.dropped.Load(),
+			"clientbound_suppressed":       s.clientbound.suppressed.Load(),
+			"clientbound_chaos_dropped":    s.clientbound.chaosDropped.Load(),
+			"clientbound_chaos_duplicated": s.clientbound.chaosDuplicated.Load(),
+			"clientbound_chaos_reordered":  s.clientbound.chaosReordered.Load(),
+			"clientbound_chaos_skewed":     s.clientbound.chaosSkewed.Load(),
+		},
+	}
+}
+
+// sortedKeys returns the names of the metric values in alphabetical order.
+func (m sessionMetrics) sortedKeys() []string {
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pushMetrics samples the metrics of all active sessions every interval and pushes them to the sinks passed.
+func pushMetrics(interval time.Duration, sinks ...metricsSink) {
+	for t := range time.Tick(interval) {
+		list, latencies := activeSessions(), packetLatencies()
+		if len(list) == 0 && len(latencies) == 0 {
+			continue
+		}
+		metrics := make([]sessionMetrics, len(list))
+		for i, s := range list {
+			metrics[i] = s.sampleMetrics()
+		}
+		for _, sink := range sinks {
+			if err := sink.push(t, metrics, latencies); err != nil {
+				log.Printf("An error occurred whilst pushing metrics: %v\n", err)
+			}
+		}
+	}
+}
+
+// influxSink is a metricsSink writing metrics to the HTTP write endpoint of InfluxDB using the line protocol.
+type influxSink struct {
+	// url is the full URL of the write endpoint, including the database or bucket, for example
+	// http://localhost:8086/api/v2/write?org=org&bucket=bucket.
+	url string
+	// token is the API token sent with each request. It may be empty.
+	token  string
+	client *http.Client
+}
+
+// influxEscaper escapes tag values in the InfluxDB line protocol.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// push ...
+func (sink influxSink) push(t time.Time, metrics []sessionMetrics, latencies []packetLatency) error {
+	buf := new(bytes.Buffer)
+	for _, m := range metrics {
+		player := m.player
+		if player == "" {
+			player = "unknown"
+		}
+		_, _ = fmt.Fprintf(buf, "bdsmitm_session,session=%d,player=%s ", m.id, influxEscaper.Replace(player))
+		for i, k := range m.sortedKeys() {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(buf, "%s=%di", k, m.values[k])
+		}
+		_, _ = fmt.Fprintf(buf, " %d\n", t.UnixNano())
+	}
+	for _, l := range latencies {
+		_, _ = fmt.Fprintf(buf, "bdsmitm_latency,packet=%s count=%di,sum_us=%di,max_us=%di", l.packet, l.count, l.sum.Microseconds(), l.max.Microseconds())
+		for i, n := range l.cumulative {
+			_, _ = fmt.Fprintf(buf, ",%s=%di", bucketLabel(i), n)
+		}
+		_, _ = fmt.Fprintf(buf, " %d\n", t.UnixNano())
+	}
+	req, err := http.NewRequest(http.MethodPost, sink.url, buf)
+	if err != nil {
+		return err
+	}
+	if sink.token != "" {
+		req.Header.Set("Authorization", "Token "+sink.token)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influxdb responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// graphiteSink is a metricsSink writing metrics to Graphite using the plaintext protocol over TCP.
+type graphiteSink struct {
+	addr string
+}
+
+// push ...
+func (sink graphiteSink) push(t time.Time, metrics []sessionMetrics, latencies []packetLatency) error {
+	conn, err := net.DialTimeout("tcp", sink.addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := new(bytes.Buffer)
+	for _, m := range metrics {
+		for _, k := range m.sortedKeys() {
+			_, _ = fmt.Fprintf(buf, "bdsmitm.session.%d.%s %d %d\n", m.id, k, m.values[k], t.Unix())
+		}
+	}
+	for _, l := range latencies {
+		_, _ = fmt.Fprintf(buf, "bdsmitm.latency.%s.count %d %d\n", l.packet, l.count, t.Unix())
+		_, _ = fmt.Fprintf(buf, "bdsmitm.latency.%s.sum_us %d %d\n", l.packet, l.sum.Microseconds(), t.Unix())
+		_, _ = fmt.Fprintf(buf, "bdsmitm.latency.%s.max_us %d %d\n", l.packet, l.max.Microseconds(), t.Unix())
+		for i, n := range l.cumulative {
+			_, _ = fmt.Fprintf(buf, "bdsmitm.latency.%s.%s %d %d\n", l.packet, bucketLabel(i), n, t.Unix())
+		}
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
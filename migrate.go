@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"io"
+	"log"
+	"os"
+)
+
+func init() {
+	registerSubcommand("migrate", "Upgrades capture files to the current capture format and packet encoding", runMigrate)
+}
+
+// runMigrate runs the migrate subcommand, which rewrites capture files using the current capture format. Every
+// payload is decoded with the packets compiled into this build and, if the capture holds packets of the protocol
+// of this build, encoded again so that it follows the current encoding of the packet. A build only holds the
+// packets of a single protocol, so payloads of other protocols are copied unchanged and packets that can no longer
+// be read are reported.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	out := fs.String("o", "", "Output file (defaults to <input>.migrated)")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: migrate [-o output] [-shield-id id] <capture>")
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		*out = in + ".migrated"
+	}
+
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dec, err := capture.NewDecoder(src)
+	if err != nil {
+		return err
+	}
+	h := dec.Header()
+	log.Printf("Migrating %s from capture version %d to %d\n", in, h.Version, capture.Version)
+	// Packets of another protocol may decode without errors into the wrong fields, so they are never encoded
+	// again, as that would corrupt them.
+	reencode := h.Protocol == 0 || h.Protocol == protocol.CurrentProtocol
+	if !reencode {
+		log.Printf("Capture holds protocol %d, but this build decodes protocol %d: payloads are copied unchanged and decode errors are expected\n", h.Protocol, protocol.CurrentProtocol)
+	}
+
+	dst, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	enc, err := capture.NewEncoder(dst, h)
+	if err != nil {
+		return err
+	}
+	var records, failed, reencoded, changed int
+	for {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", records, err)
+		}
+		capture.Migrate(h, &r)
+		if r.IsAnnotation() {
+			// Annotations hold no packet, so they are copied as they are.
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			records++
+			continue
+		}
+		pk, err := decodePacket(r.PacketID, r.Payload, int32(*shieldID))
+		if err != nil {
+			failed++
+			log.Printf("Record %d: %v\n", records, err)
+		} else if reencode {
+			payload := encodePacket(pk, int32(*shieldID))
+			if !bytes.Equal(payload, r.Payload) {
+				changed++
+			}
+			r.Payload, r.PacketName = payload, getType(pk, false)
+			reencoded++
+		}
+		if r.PacketName == "" {
+			r.PacketName = getType(pk, false)
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		records++
+	}
+	log.Printf("Migrated %d records to %s: %d payloads were encoded again, %d of which changed, and %d could not be decoded\n", records, *out, reencoded, changed, failed)
+	return nil
+}
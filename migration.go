@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sandertv/go-raknet"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upstreamNetwork is the network used to dial the upstream server. It is set to migratableNetworkID to allow
+// rebinding the socket of upstream connections.
+var upstreamNetwork = "raknet"
+
+// migratableNetworkID is the ID of the migratableNetwork registered with gophertunnel.
+const migratableNetworkID = "raknet-migratable"
+
+// migrationDelay is the time after which the upstream socket of every session is rebound automatically, or 0 to
+// only rebind sockets using the rebind command.
+var migrationDelay time.Duration
+
+// migrationCheckDuration is the time after rebinding an upstream socket within which packets must be received
+// from the upstream server for the session to be considered to have survived the migration.
+const migrationCheckDuration = time.Second * 10
+
+// migratableNetwork is a RakNet minecraft.Network dialing connections over a rebindableConn, so that the local
+// socket of a connection may be swapped mid-session to emulate a client switching networks.
+type migratableNetwork struct {
+	minecraft.RakNet
+}
+
+// DialContext ...
+func (migratableNetwork) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	return raknet.Dialer{UpstreamDialer: rebindDialer{}}.DialContext(ctx, address)
+}
+
+func init() {
+	minecraft.RegisterNetwork(migratableNetworkID, migratableNetwork{})
+}
+
+// rebindableConns holds all open rebindable connections, indexed by the local address they were initially
+// bound to.
+var rebindableConns = struct {
+	sync.Mutex
+	m map[string]*rebindableConn
+}{m: map[string]*rebindableConn{}}
+
+// rebindableConnFor returns the rebindable connection underlying the upstream connection passed, or nil if the
+// connection was not dialed over the migratable network.
+func rebindableConnFor(conn *minecraft.Conn) *rebindableConn {
+	rebindableConns.Lock()
+	defer rebindableConns.Unlock()
+	return rebindableConns.m[conn.LocalAddr().String()]
+}
+
+// rebindDialer is a raknet.UpstreamDialer returning rebindable UDP connections.
+type rebindDialer struct{}
+
+// Dial ...
+func (rebindDialer) Dial(network, address string) (net.Conn, error) {
+	udpConn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &rebindableConn{network: network, address: address, conn: udpConn.(*net.UDPConn), initial: udpConn.LocalAddr().String()}
+	rebindableConns.Lock()
+	rebindableConns.m[c.initial] = c
+	rebindableConns.Unlock()
+	return c, nil
+}
+
+// rebindableConn is a connected UDP socket of which the local socket may be replaced by a new one while it is in
+// use. Packets in flight to the old socket are lost, just like when a client changes networks.
+type rebindableConn struct {
+	network, address string
+	initial          string
+
+	mu       sync.Mutex
+	conn     *net.UDPConn
+	deadline time.Time
+	rebinds  int
+	closed   bool
+}
+
+// current returns the UDP socket currently in use.
+func (c *rebindableConn) current() *net.UDPConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// retry checks if an operation that failed on the socket passed should be retried on the current socket, which
+// is the case if the socket was replaced while the operation was in progress.
+func (c *rebindableConn) retry(conn *net.UDPConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed && c.conn != conn
+}
+
+// rebind replaces the local socket by a newly bound one and closes the old socket. The old and new local
+// addresses are returned.
+func (c *rebindableConn) rebind() (from, to net.Addr, err error) {
+	udpConn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = udpConn.Close()
+		return nil, nil, net.ErrClosed
+	}
+	if !c.deadline.IsZero() {
+		_ = udpConn.SetDeadline(c.deadline)
+	}
+	previous := c.conn
+	c.conn = udpConn.(*net.UDPConn)
+	c.rebinds++
+	_ = previous.Close()
+	return previous.LocalAddr(), c.conn.LocalAddr(), nil
+}
+
+// Read ...
+func (c *rebindableConn) Read(b []byte) (int, error) {
+	for {
+		conn := c.current()
+		n, err := conn.Read(b)
+		if err != nil && c.retry(conn) {
+			continue
+		}
+		return n, err
+	}
+}
+
+// ReadFrom ...
+func (c *rebindableConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		conn := c.current()
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil && c.retry(conn) {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// Write ...
+func (c *rebindableConn) Write(b []byte) (int, error) {
+	return c.current().Write(b)
+}
+
+// WriteTo ...
+func (c *rebindableConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.current().Write(b)
+}
+
+// Close ...
+func (c *rebindableConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	rebindableConns.Lock()
+	delete(rebindableConns.m, c.initial)
+	rebindableConns.Unlock()
+	return conn.Close()
+}
+
+// LocalAddr returns the address the socket was initially bound to, so that the connection may still be looked
+// up after rebinding it.
+func (c *rebindableConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, _ := net.ResolveUDPAddr(c.network, c.initial)
+	if addr == nil {
+		return c.conn.LocalAddr()
+	}
+	return addr
+}
+
+// RemoteAddr ...
+func (c *rebindableConn) RemoteAddr() net.Addr {
+	return c.current().RemoteAddr()
+}
+
+// SetDeadline ...
+func (c *rebindableConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline ...
+func (c *rebindableConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+// SetWriteDeadline ...
+func (c *rebindableConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
+
+// migrate rebinds the upstream socket of the session to emulate the client switching networks and reports
+// whether the session survived it, which is the case if the upstream server keeps sending packets.
+func (s *session) migrate() error {
+	c := rebindableConnFor(s.server)
+	if c == nil {
+		return errors.New("upstream connection is not migratable, restart the proxy with -migratable")
+	}
+	before := s.clientbound.packets.Load()
+	from, to, err := c.rebind()
+	if err != nil {
+		return fmt.Errorf("rebind upstream socket: %w", err)
+	}
+	log.Printf("Session %d: rebound upstream socket from %v to %v.\n", s.id, from, to)
+	go func() {
+		select {
+		case <-s.closed:
+			log.Printf("Session %d did not survive migration: the session was closed.\n", s.id)
+			return
+		case <-time.After(migrationCheckDuration):
+		}
+		if received := s.clientbound.packets.Load() - before; received > 0 {
+			log.Printf("Session %d survived migration: received %d packets from the upstream server within %v.\n", s.id, received, migrationCheckDuration)
+			return
+		}
+		log.Printf("Session %d may not have survived migration: no packets were received from the upstream server within %v.\n", s.id, migrationCheckDuration)
+	}()
+	return nil
+}
+
+func init() {
+	registerCommand("rebind", consoleCommand{
+		usage:       "<session>",
+		description: "Rebinds the upstream socket of a session to emulate the client switching networks.",
+		run: func(args []string) {
+			if len(args) != 1 {
+				log.Println("Usage: rebind <session>")
+				return
+			}
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				log.Printf("Invalid session %q.\n", args[0])
+				return
+			}
+			s, ok := sessionByID(id)
+			if !ok {
+				log.Printf("Session %d does not exist.\n", id)
+				return
+			}
+			if injectionDisabled() {
+				return
+			}
+			if err := s.migrate(); err != nil {
+				log.Printf("An error occurred whilst migrating session %d: %v\n", id, err)
+			}
+		},
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("minimize", "Strips fields of the packets of a crashing capture to defaults while the crash still reproduces", runMinimize)
+}
+
+// packetFields returns the index paths of all exported fields of the packet passed that are not set to their
+// zero value. Fields of nested structs are returned instead of the struct itself, so that they may be reset one
+// by one.
+func packetFields(pk packet.Packet) [][]int {
+	var paths [][]int
+	var walk func(v reflect.Value, path []int)
+	walk = func(v reflect.Value, path []int) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			f := v.Field(i)
+			p := append(append([]int(nil), path...), i)
+			if f.Kind() == reflect.Struct && f.NumField() > 0 {
+				walk(f, p)
+				continue
+			}
+			if !f.IsZero() {
+				paths = append(paths, p)
+			}
+		}
+	}
+	walk(reflect.ValueOf(pk).Elem(), nil)
+	return paths
+}
+
+// packetFieldName returns the dotted name of the field of the packet at the index path passed.
+func packetFieldName(pk packet.Packet, path []int) string {
+	t := reflect.TypeOf(pk).Elem()
+	names := make([]string, len(path))
+	for i, index := range path {
+		f := t.Field(index)
+		names[i], t = f.Name, f.Type
+	}
+	return strings.Join(names, ".")
+}
+
+// stripField decodes the payload passed, resets the field at the index path passed to its zero value and returns
+// the payload encoded again. False is returned if the packet could not be encoded with the field reset.
+func stripField(id uint32, payload []byte, shieldID int32, path []int) (stripped []byte, ok bool) {
+	pk, err := decodePacket(id, payload, shieldID)
+	if err != nil {
+		return nil, false
+	}
+	f := reflect.ValueOf(pk).Elem().FieldByIndex(path)
+	f.Set(reflect.Zero(f.Type()))
+	defer func() {
+		// Some fields, such as NBT maps, cannot be encoded when they are nil.
+		if recover() != nil {
+			stripped, ok = nil, false
+		}
+	}()
+	return encodePacket(pk, shieldID), true
+}
+
+// runMinimize runs the minimize subcommand, which complements bisect: every field of the packets of a capture
+// that crashes a client is reset to its zero value in turn, keeping the change only if replaying the capture
+// still crashes the client. The result is the smallest repro case that can be attached to a bug report.
+func runMinimize(args []string) error {
+	fs := flag.NewFlagSet("minimize", flag.ExitOnError)
+	out := fs.String("o", "", "Output file of the stripped capture (defaults to <capture>-stripped.bdscap)")
+	addr := fs.String("listen", "127.0.0.1:19133", "Address to listen on for the client")
+	sessionID := fs.Uint64("session", 0, "Session of the capture to replay, or 0 for the first session")
+	wait := fs.Duration("wait", 5*time.Second, "Time the client is given to crash after the last packet was replayed")
+	delay := fs.Duration("delay", 0, "Time waited between replayed packets")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: minimize [-o output] [-listen address] [-session id] [-wait duration] [-delay duration] [-shield-id id] <capture>")
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(in, ".bdscap") + "-stripped.bdscap"
+	}
+	replayer, h, err := newCrashReplayer(in, *sessionID, *addr, *wait, *delay)
+	if err != nil {
+		return err
+	}
+	defer replayer.listener.Close()
+	all := make([]int, len(replayer.records))
+	for i := range all {
+		all[i] = i
+	}
+	if ok, err := replayer.crashes(all); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("replaying the capture does not crash the client")
+	}
+
+	var stripped []string
+	for i := range replayer.records {
+		r := &replayer.records[i]
+		pk, err := decodePacket(r.PacketID, r.Payload, int32(*shieldID))
+		if err != nil {
+			log.Printf("Keeping %s unchanged: %v\n", r.PacketName, err)
+			continue
+		}
+		if _, ok := pk.(*packet.Unknown); ok {
+			continue
+		}
+		for _, path := range packetFields(pk) {
+			payload, ok := stripField(r.PacketID, r.Payload, int32(*shieldID), path)
+			if !ok || bytes.Equal(payload, r.Payload) {
+				continue
+			}
+			original := r.Payload
+			r.Payload = payload
+			crashed, err := replayer.crashes(all)
+			if err != nil {
+				return err
+			}
+			if !crashed {
+				r.Payload = original
+				continue
+			}
+			stripped = append(stripped, fmt.Sprintf("%s.%s", r.PacketName, packetFieldName(pk, path)))
+		}
+	}
+
+	log.Printf("Reset %d fields to their defaults after %d trials:\n", len(stripped), replayer.trials)
+	for _, field := range stripped {
+		log.Printf("  %s\n", field)
+	}
+	if err := writeReplayCapture(*out, h, replayer.records); err != nil {
+		return err
+	}
+	log.Printf("Wrote the stripped capture to %s\n", *out)
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSubcommand("mockserver", "Runs a minimal Bedrock server with a flat world to develop against without a real server", runMockServer)
+}
+
+// mockFloorY is the Y coordinate of the lowest block of the overworld, where the floor of the flat world of the
+// mock server starts. The floor fills the lowest sub-chunk.
+const mockFloorY = -64
+
+// mockKeepAliveInterval is the interval at which the mock server sends NetworkStackLatency packets to clients.
+const mockKeepAliveInterval = time.Second * 5
+
+// mockServer is a minimal Bedrock server accepting unauthenticated clients, spawning them in a flat world and
+// relaying chat between them.
+type mockServer struct {
+	listener *minecraft.Listener
+	radius   int32
+	chunk    []byte
+
+	mu    sync.Mutex
+	conns map[*minecraft.Conn]bool
+}
+
+// flatChunkPayload returns the payload of a LevelChunk holding a single sub-chunk filled with the block with the
+// runtime ID passed, followed by plains biomes for all 24 sub-chunks of the overworld.
+func flatChunkPayload(block int32) []byte {
+	buf := new(bytes.Buffer)
+	// Sub-chunk version 9 with one storage and the Y index of the sub-chunk.
+	index := int8(mockFloorY >> 4)
+	buf.Write([]byte{9, 1, byte(index)})
+	// A storage of one bit per block, of which all indices are 0 so that every block is the first in the palette.
+	buf.WriteByte(1<<1 | 1)
+	buf.Write(make([]byte, 4096/32*4))
+	_ = protocol.WriteVarint32(buf, 1)
+	_ = protocol.WriteVarint32(buf, block)
+	for i := 0; i < 24; i++ {
+		// A biome storage with a single value: plains.
+		buf.WriteByte(0<<1 | 1)
+		_ = protocol.WriteVarint32(buf, 1)
+	}
+	// No border blocks.
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// run accepts clients until the listener is closed.
+func (srv *mockServer) run() error {
+	for {
+		c, err := srv.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.handle(c.(*minecraft.Conn))
+	}
+}
+
+// handle spawns the client of the connection passed and handles its packets until it disconnects.
+func (srv *mockServer) handle(conn *minecraft.Conn) {
+	defer conn.Close()
+	name := conn.IdentityData().DisplayName
+	data := minecraft.GameData{
+		WorldName:       "bds-mitm mock",
+		EntityUniqueID:  1,
+		EntityRuntimeID: 1,
+		PlayerGameMode:  1,
+		WorldGameMode:   1,
+		ChunkRadius:     srv.radius,
+		BaseGameVersion: "*",
+		Time:            6000,
+	}
+	data.PlayerPosition[1] = mockFloorY + 16 + 1.62
+	data.WorldSpawn = protocol.BlockPos{0, mockFloorY + 16, 0}
+	if err := conn.StartGame(data); err != nil {
+		log.Printf("An error occurred whilst starting the game of %s: %v\n", name, err)
+		return
+	}
+	log.Printf("%s joined the mock server\n", name)
+	srv.mu.Lock()
+	srv.conns[conn] = true
+	srv.mu.Unlock()
+	srv.broadcast(&packet.Text{TextType: packet.TextTypeTranslation, Message: "§e%multiplayer.player.joined", Parameters: []string{name}, NeedsTranslation: true})
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		srv.broadcast(&packet.Text{TextType: packet.TextTypeTranslation, Message: "§e%multiplayer.player.left", Parameters: []string{name}, NeedsTranslation: true})
+		log.Printf("%s left the mock server\n", name)
+	}()
+
+	_ = conn.WritePacket(&packet.NetworkChunkPublisherUpdate{Position: data.WorldSpawn, Radius: uint32(srv.radius) << 4})
+	for x := -srv.radius; x <= srv.radius; x++ {
+		for z := -srv.radius; z <= srv.radius; z++ {
+			_ = conn.WritePacket(&packet.LevelChunk{Position: protocol.ChunkPos{x, z}, SubChunkCount: 1, RawPayload: srv.chunk})
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(mockKeepAliveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				_ = conn.WritePacket(&packet.NetworkStackLatency{Timestamp: time.Now().UnixMilli(), NeedsResponse: true})
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		pk, err := conn.ReadPacket()
+		if err != nil {
+			return
+		}
+		switch pk := pk.(type) {
+		case *packet.Text:
+			if pk.TextType == packet.TextTypeChat {
+				srv.broadcast(&packet.Text{TextType: packet.TextTypeChat, SourceName: name, Message: pk.Message})
+			}
+		case *packet.CommandRequest:
+			_ = conn.WritePacket(&packet.Text{TextType: packet.TextTypeRaw, Message: fmt.Sprintf("§cThe mock server does not run commands: %s", pk.CommandLine)})
+		case *packet.NetworkStackLatency:
+			if pk.NeedsResponse {
+				_ = conn.WritePacket(&packet.NetworkStackLatency{Timestamp: pk.Timestamp})
+			}
+		}
+	}
+}
+
+// broadcast sends the packet passed to all connected clients.
+func (srv *mockServer) broadcast(pk packet.Packet) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for conn := range srv.conns {
+		_ = conn.WritePacket(pk)
+	}
+}
+
+// runMockServer runs the mockserver subcommand, which runs a minimal Bedrock server so that the proxy and plugins
+// can be developed without a real server or Xbox Live authentication. Clients spawn in a flat world of a single
+// block type and may chat with each other. Run the proxy with -auth offline to connect to it.
+func runMockServer(args []string) error {
+	fs := flag.NewFlagSet("mockserver", flag.ExitOnError)
+	addr := fs.String("listen", "127.0.0.1:19134", "Address to accept clients on")
+	motd := fs.String("motd", "bds-mitm mock server", "MOTD shown in the server list")
+	radius := fs.Int("radius", 4, "Radius in chunks of the flat world sent to clients")
+	block := fs.Int("floor-block", 1, "Runtime ID of the block the floor is made of, which depends on the block palette of the client")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 || *radius < 1 {
+		return errors.New("usage: mockserver [-listen address] [-motd motd] [-radius 4] [-floor-block id]")
+	}
+	listener, err := minecraft.ListenConfig{
+		AuthenticationDisabled: true,
+		StatusProvider:         minecraft.NewStatusProvider(*motd),
+	}.Listen("raknet", *addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Printf("Mock server listening on %s\n", listener.Addr())
+	srv := &mockServer{listener: listener, radius: int32(*radius), chunk: flatChunkPayload(int32(*block)), conns: map[*minecraft.Conn]bool{}}
+	return srv.run()
+}
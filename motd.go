@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/go-raknet"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"sync"
+	"time"
+)
+
+// motdOverride is a minecraft.ServerStatusProvider that shows a fixed MOTD instead of the MOTD of the upstream
+// server, while still showing its player counts.
+type motdOverride struct {
+	upstream minecraft.ServerStatusProvider
+	motd     string
+}
+
+// ServerStatus ...
+func (o motdOverride) ServerStatus(playerCount, maxPlayers int) minecraft.ServerStatus {
+	status := o.upstream.ServerStatus(playerCount, maxPlayers)
+	status.ServerName = o.motd
+	return status
+}
+
+// statusRotator is a minecraft.ServerStatusProvider that alternates the MOTD of the upstream server with a
+// compact status of the proxy, so that the health of the proxy is visible by refreshing the server list.
+type statusRotator struct {
+	upstream minecraft.ServerStatusProvider
+	addr     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	summary string
+}
+
+// newStatusRotator returns a statusRotator showing the status of the upstream server and the proxy for the
+// interval passed each. It measures the ping to the upstream server at the address passed.
+func newStatusRotator(upstream minecraft.ServerStatusProvider, addr string, interval time.Duration) *statusRotator {
+	r := &statusRotator{upstream: upstream, addr: addr, interval: interval, summary: "bds-mitm"}
+	go r.run()
+	return r
+}
+
+// ServerStatus ...
+func (r *statusRotator) ServerStatus(playerCount, maxPlayers int) minecraft.ServerStatus {
+	status := r.upstream.ServerStatus(playerCount, maxPlayers)
+	if (time.Now().UnixNano()/int64(r.interval))%2 == 1 {
+		r.mu.Lock()
+		status.ServerName = r.summary
+		r.mu.Unlock()
+	}
+	return status
+}
+
+// run updates the status summary of the proxy every interval.
+func (r *statusRotator) run() {
+	last, lastTime := totalPackets(), time.Now()
+	for range time.Tick(r.interval) {
+		packets, now := totalPackets(), time.Now()
+		pps := float64(packets-last) / now.Sub(lastTime).Seconds()
+		if pps < 0 {
+			// Sessions closed since the last update, so their packets are no longer counted.
+			pps = 0
+		}
+		last, lastTime = packets, now
+
+		ping := "offline"
+		start := time.Now()
+		if _, err := raknet.PingTimeout(r.addr, time.Second*2); err == nil {
+			ping = time.Since(start).Round(time.Millisecond).String()
+		}
+		r.mu.Lock()
+		r.summary = fmt.Sprintf("§bbds-mitm§r %d sessions | %.0f pps | ping %s", len(activeSessions()), pps, ping)
+		r.mu.Unlock()
+	}
+}
+
+// totalPackets returns the amount of packets proxied in both directions by all active sessions.
+func totalPackets() int64 {
+	var n int64
+	for _, s := range activeSessions() {
+		n += s.serverbound.packets.Load() + s.clientbound.packets.Load()
+	}
+	return n
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("export", "Converts a capture file to NDJSON with one decoded packet per line", runExport)
+}
+
+// ndjsonPacket is a packet of a capture written as a line of NDJSON by the export subcommand and read by the
+// import subcommand, for example:
+//
+//	{"time": "2024-01-01T12:00:00Z", "session": 1, "direction": "clientbound", "packet": "Text", "id": 9, "fields": {"Message": "Hello"}}
+//
+// The format is the same as that of packets injected with -inject-stdin, so that exported packets may be injected
+// again. Marks inserted with the mark command are written as a line holding only an annotation.
+type ndjsonPacket struct {
+	Time       time.Time `json:"time"`
+	Session    int64     `json:"session"`
+	Annotation string    `json:"annotation,omitempty"`
+	Direction  string    `json:"direction,omitempty"`
+	stubResponse
+	ID uint32 `json:"id,omitempty"`
+	// Payload holds the serialized packet if it can't be represented by its fields, such as packets that failed
+	// to decode or that are not encoded identically after being decoded from JSON. If set, fields are ignored on
+	// import.
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// ndjsonFromRecord converts a capture record to an NDJSON packet. Fields are only included if encoding the packet
+// decoded from them produces the original payload, so that importing the packet again is lossless.
+func ndjsonFromRecord(r capture.Record, shieldID int32) ndjsonPacket {
+	p := ndjsonPacket{
+		Time:         time.Unix(0, r.TimeUnixNano).UTC(),
+		Session:      int64(r.Session),
+		Direction:    "serverbound",
+		stubResponse: stubResponse{Packet: r.PacketName},
+		ID:           r.PacketID,
+	}
+	if r.IsAnnotation() {
+		return ndjsonPacket{Time: p.Time, Session: p.Session, Annotation: r.Annotation}
+	}
+	if r.Direction == capture.DirectionClientbound {
+		p.Direction = "clientbound"
+	}
+	pk, err := decodePacket(r.PacketID, r.Payload, shieldID)
+	if err == nil {
+		if fields, err := json.Marshal(pk); err == nil {
+			p.Fields = fields
+			if decoded, err := p.decode(); err == nil && bytes.Equal(safeEncodePacket(decoded, shieldID), r.Payload) {
+				return p
+			}
+		}
+	}
+	p.Fields, p.Payload = nil, r.Payload
+	return p
+}
+
+// safeEncodePacket encodes the packet passed, returning nil if it can't be encoded, such as when a field that
+// must be set is nil.
+func safeEncodePacket(pk packet.Packet, shieldID int32) (b []byte) {
+	defer func() {
+		if recover() != nil {
+			b = nil
+		}
+	}()
+	return encodePacket(pk, shieldID)
+}
+
+// record converts an NDJSON packet to a capture record.
+func (p ndjsonPacket) record(shieldID int32) (capture.Record, error) {
+	r := capture.Record{
+		TimeUnixNano: p.Time.UnixNano(),
+		Session:      uint64(p.Session),
+		Direction:    capture.DirectionServerbound,
+		PacketID:     p.ID,
+		PacketName:   p.Packet,
+		Payload:      p.Payload,
+	}
+	if p.Annotation != "" {
+		return capture.Record{TimeUnixNano: r.TimeUnixNano, Session: r.Session, Annotation: p.Annotation}, nil
+	}
+	switch p.Direction {
+	case "clientbound":
+		r.Direction = capture.DirectionClientbound
+	case "serverbound":
+	default:
+		return r, fmt.Errorf("invalid direction %q: expected clientbound or serverbound", p.Direction)
+	}
+	if p.Payload != nil {
+		if r.PacketName == "" {
+			r.PacketName = packetName(p.ID)
+		}
+		return r, nil
+	}
+	pk, err := p.decode()
+	if err != nil {
+		return r, err
+	}
+	r.PacketID, r.Payload = pk.ID(), safeEncodePacket(pk, shieldID)
+	if r.Payload == nil {
+		return r, fmt.Errorf("encode %s: invalid fields", p.Packet)
+	}
+	return r, nil
+}
+
+// runExport runs the export subcommand, which converts a capture file to NDJSON so that it may be processed with
+// tools such as jq.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "Output file (defaults to <capture>.ndjson), or - to write to stdout")
+	sessionID := fs.Uint64("session", 0, "Session to export, or 0 for all sessions")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: export [-o output] [-session id] [-shield-id id] <capture|manifest>")
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(strings.TrimSuffix(in, ".bdscap"), capture.ManifestSuffix) + ".ndjson"
+	}
+	files, err := capture.Files(in)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		dst, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		w = dst
+	}
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	var n, raw int
+	for _, file := range files {
+		err := forEachRecord(file, func(r capture.Record) error {
+			if *sessionID != 0 && r.Session != *sessionID {
+				return nil
+			}
+			p := ndjsonFromRecord(r, int32(*shieldID))
+			if p.Payload != nil {
+				raw++
+			}
+			n++
+			return enc.Encode(p)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if *out != "-" {
+		log.Printf("Exported %d packets to %s, %d of which as raw payload\n", n, *out, raw)
+	}
+	return nil
+}
+
+// forEachRecord calls f with every record of the capture file at the path passed, migrated to the current capture
+// format.
+func forEachRecord(path string, f func(r capture.Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dec, err := capture.NewDecoder(file)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", i, err)
+		}
+		capture.Migrate(dec.Header(), &r)
+		if err := f(r); err != nil {
+			return err
+		}
+	}
+}
+
+// importNDJSON converts the NDJSON packets read from the reader passed to a capture written to the writer passed,
+// returning the amount of packets imported. Packets without a time are given the time of the packet before them,
+// and packets without a session are added to session 1, so that hand-written fixtures only need a direction, a
+// packet name and its fields.
+func importNDJSON(r io.Reader, w io.Writer, upstream string, shieldID int32) (int, error) {
+	enc, err := capture.NewEncoder(w, capture.Header{
+		CreatedUnixNano:  time.Now().UnixNano(),
+		Upstream:         upstream,
+		Protocol:         protocol.CurrentProtocol,
+		MinecraftVersion: protocol.CurrentVersion,
+		DedupMinSize:     uint32(captureDedupMinSize),
+	})
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	last, n := time.Now(), 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var p ndjsonPacket
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		if p.Time.IsZero() {
+			p.Time = last
+		}
+		if p.Session == 0 {
+			p.Session = 1
+		}
+		last = p.Time
+		rec, err := p.record(shieldID)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := enc.Encode(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// runNDJSONImport imports the NDJSON file at the path passed to a capture file, which defaults to the path with
+// the .bdscap extension.
+func runNDJSONImport(in, out, upstream string, shieldID int32) error {
+	if out == "" {
+		out = strings.TrimSuffix(strings.TrimSuffix(in, ".ndjson"), ".jsonl") + ".bdscap"
+	}
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	n, err := importNDJSON(src, dst, upstream, shieldID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d packets to %s\n", n, out)
+	return dst.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// noveltyScope specifies where packet shapes must not have been seen before for packets to be logged: session
+// to log packets with shapes not seen before in their session, upstream to log packets with shapes never seen
+// before on their upstream server, remembered in the knowledge base, or an empty string to disable the novelty
+// detector.
+var noveltyScope string
+
+const (
+	// sessionShapeBits is the size in bits of the bloom filters holding the shapes seen in a session.
+	sessionShapeBits = 1 << 16
+	// upstreamShapeBits is the size in bits of the bloom filters holding the shapes seen on an upstream server.
+	upstreamShapeBits = 1 << 18
+	// shapeHashes is the amount of bits set in a bloom filter for every shape.
+	shapeHashes = 4
+)
+
+// bloomFilter is a bloom filter of packet shapes. It may report a shape that was not seen as seen, but never the
+// other way around.
+type bloomFilter []byte
+
+// add adds the hash passed to the bloom filter and returns true if it was not in the filter yet.
+func (f bloomFilter) add(h uint64) bool {
+	m := uint32(len(f) * 8)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	var added bool
+	for i := uint32(0); i < shapeHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			f[bit/8] |= 1 << (bit % 8)
+			added = true
+		}
+	}
+	return added
+}
+
+// sessionShapes holds the bloom filters of the shapes seen in each active session, indexed by session ID.
+var sessionShapes = struct {
+	sync.Mutex
+	m map[int64]bloomFilter
+}{m: map[int64]bloomFilter{}}
+
+// enumFieldSuffixes holds the suffixes of names of integer fields that hold enum values, which are part of the
+// shape of a packet.
+var enumFieldSuffixes = []string{"Type", "Action", "Event", "Status", "Mode", "Category", "Cause", "Dimension", "Difficulty", "Origin", "Face"}
+
+// packetShape returns the shape of a packet: its name and the values of its fields that determine what the packet
+// means rather than what it holds. Enum fields and booleans are included by value, the types held by interface
+// fields and whether optional fields and slices are set are included too. Fields holding data such as positions,
+// IDs and text are left out, so that packets that mean the same thing have the same shape.
+func packetShape(pk packet.Packet) string {
+	b := new(strings.Builder)
+	b.WriteString(getType(pk, false))
+	v := reflect.Indirect(reflect.ValueOf(pk))
+	if v.Kind() != reflect.Struct {
+		return b.String()
+	}
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Bool:
+			_, _ = fmt.Fprintf(b, " %s=%v", field.Name, fv.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
+			reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if enumField(field.Name) {
+				_, _ = fmt.Fprintf(b, " %s=%v", field.Name, fv)
+			}
+		case reflect.Interface, reflect.Pointer:
+			if fv.IsNil() {
+				_, _ = fmt.Fprintf(b, " %s=nil", field.Name)
+			} else {
+				_, _ = fmt.Fprintf(b, " %s=%T", field.Name, fv.Interface())
+			}
+		case reflect.Slice, reflect.Map:
+			if fv.Len() == 0 {
+				_, _ = fmt.Fprintf(b, " %s=empty", field.Name)
+			}
+		}
+	}
+	return b.String()
+}
+
+// enumField checks if an integer field with the name passed holds an enum value.
+func enumField(name string) bool {
+	for _, suffix := range enumFieldSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// noveltyHidden checks if a packet of the session must not be logged because the novelty detector is enabled
+// and its shape was seen before. The packet is logged as a new shape if it was not.
+func (s *session) noveltyHidden(pk packet.Packet, name string, fromServer bool) bool {
+	if noveltyScope == "" {
+		return false
+	}
+	source, direction := "client", "serverbound"
+	if fromServer {
+		source, direction = "server", "clientbound"
+	}
+	shape := packetShape(pk)
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(direction + " " + shape))
+
+	var novel bool
+	if noveltyScope == "upstream" {
+		knowledgeBase.Lock()
+		k := knowledgeOf(s.upstream)
+		if len(k.Shapes) != upstreamShapeBits/8 {
+			k.Shapes = make(bloomFilter, upstreamShapeBits/8)
+		}
+		novel = k.Shapes.add(hash.Sum64())
+		knowledgeBase.Unlock()
+	} else {
+		sessionShapes.Lock()
+		f, ok := sessionShapes.m[s.id]
+		if !ok {
+			f = make(bloomFilter, sessionShapeBits/8)
+			sessionShapes.m[s.id] = f
+		}
+		novel = f.add(hash.Sum64())
+		sessionShapes.Unlock()
+	}
+	if novel {
+		logf(s.logFields(source, name), "New %s packet shape in session %d: %s\n", direction, s.id, shape)
+	}
+	return !novel
+}
+
+func init() {
+	addSessionCloseListener(func(id int64) {
+		sessionShapes.Lock()
+		delete(sessionShapes.m, id)
+		sessionShapes.Unlock()
+	})
+}
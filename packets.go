@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// packetInfo holds metadata of a packet known to the proxy.
+type packetInfo struct {
+	name string
+	id   uint32
+}
+
+// knownPackets holds all packets registered in gophertunnel, sorted by their ID.
+var knownPackets = func() []packetInfo {
+	var packets []packetInfo
+	for id, f := range packet.NewPool() {
+		packets = append(packets, packetInfo{name: getType(f(), false), id: id})
+	}
+	sort.Slice(packets, func(i, j int) bool {
+		return packets[i].id < packets[j].id
+	})
+	return packets
+}()
+
+// packetKnown checks if a packet with the name passed is registered in gophertunnel.
+func packetKnown(name string) bool {
+	_, ok := packetsByName[name]
+	return ok
+}
+
+// packetsByName holds functions returning a new packet, indexed by the name of the packet.
+var packetsByName = func() map[string]func() packet.Packet {
+	m := map[string]func() packet.Packet{}
+	for _, f := range packet.NewPool() {
+		m[getType(f(), false)] = f
+	}
+	return m
+}()
+
+// newPacket returns a new, empty packet with the name passed. False is returned if no such packet exists.
+func newPacket(name string) (packet.Packet, bool) {
+	f, ok := packetsByName[name]
+	if !ok {
+		return nil, false
+	}
+	return f(), true
+}
+
+// packetPool holds all packets registered in gophertunnel, indexed by their ID.
+var packetPool = packet.NewPool()
+
+// packetNames holds the names of all packets registered in gophertunnel, indexed by their ID, so that the name of a
+// packet can be looked up without creating it.
+var packetNames = func() map[uint32]string {
+	m := map[uint32]string{}
+	for id, f := range packetPool {
+		m[id] = getType(f(), false)
+	}
+	return m
+}()
+
+// packetName returns the name of the packet with the ID passed, or Unknown(id) if no packet has that ID.
+func packetName(id uint32) string {
+	if name, ok := packetNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", id)
+}
+
+// decodePacket decodes the payload of a packet with the ID passed. Packets with an unknown ID are returned as
+// *packet.Unknown. An error is returned if the payload could not be decoded completely.
+func decodePacket(id uint32, payload []byte, shieldID int32) (pk packet.Packet, err error) {
+	if f, ok := packetPool[id]; ok {
+		pk = f()
+	} else {
+		pk = &packet.Unknown{PacketID: id}
+	}
+	buf := bytes.NewBuffer(payload)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decode %T: %v", pk, r)
+		}
+	}()
+	pk.Unmarshal(protocol.NewReader(buf, shieldID))
+	if buf.Len() != 0 {
+		return pk, fmt.Errorf("decode %T: %d unread bytes left", pk, buf.Len())
+	}
+	return pk, nil
+}
+
+// encodePacket encodes the packet passed, excluding its header.
+func encodePacket(pk packet.Packet, shieldID int32) []byte {
+	buf := new(bytes.Buffer)
+	pk.Marshal(protocol.NewWriter(buf, shieldID))
+	return buf.Bytes()
+}
+
+// shieldID returns the runtime ID of the shield item in the game data passed, which is needed to encode and
+// decode item stacks.
+func shieldID(data minecraft.GameData) int32 {
+	for _, item := range data.Items {
+		if item.Name == "minecraft:shield" {
+			return int32(item.RuntimeID)
+		}
+	}
+	return 0
+}
+
+// seenDirections holds the directions each packet has been observed in during this run. It is used as a hint of
+// which side of the connection sends a specific packet.
+var seenDirections = struct {
+	sync.Mutex
+	m map[string]byte
+}{m: map[string]byte{}}
+
+const (
+	seenFromClient byte = 1 << iota
+	seenFromServer
+)
+
+// observePacket records that a packet with the name passed was received from the client or the server.
+func observePacket(name string, fromClient bool) {
+	flag := seenFromServer
+	if fromClient {
+		flag = seenFromClient
+	}
+	seenDirections.Lock()
+	seenDirections.m[name] |= flag
+	seenDirections.Unlock()
+}
+
+// directionHint returns a short description of the directions a packet was observed in.
+func directionHint(name string) string {
+	seenDirections.Lock()
+	defer seenDirections.Unlock()
+	switch seenDirections.m[name] {
+	case seenFromClient:
+		return "client->server"
+	case seenFromServer:
+		return "server->client"
+	case seenFromClient | seenFromServer:
+		return "both"
+	}
+	return "not seen"
+}
+
+// fuzzyScore returns how well the query passed matches the name. The query matches if all of its characters
+// occur in the name in order, case-insensitively. A negative score is returned if the query does not match.
+// Lower scores are better matches.
+func fuzzyScore(name, query string) int {
+	name, query = strings.ToLower(name), strings.ToLower(query)
+	if query == "" {
+		return 0
+	}
+	if i := strings.Index(name, query); i >= 0 {
+		// Substring matches always rank above scattered matches, with prefixes ranking highest.
+		return i
+	}
+	score, last := len(name), -1
+	for _, r := range query {
+		i := strings.IndexRune(name[last+1:], r)
+		if i < 0 {
+			return -1
+		}
+		score += i
+		last += i + 1
+	}
+	return score
+}
+
+// matchPackets returns all known packets matching the query passed, ordered from best to worst match.
+func matchPackets(query string) []packetInfo {
+	type match struct {
+		packetInfo
+		score int
+	}
+	var matches []match
+	for _, info := range knownPackets {
+		if score := fuzzyScore(info.name, query); score >= 0 {
+			matches = append(matches, match{packetInfo: info, score: score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score < matches[j].score
+	})
+	packets := make([]packetInfo, len(matches))
+	for i, m := range matches {
+		packets[i] = m.packetInfo
+	}
+	return packets
+}
+
+func init() {
+	registerCommand("packets", consoleCommand{
+		usage:       "[search]",
+		description: "Lists known packets with their IDs, observed directions and filter status.",
+		run: func(args []string) {
+			packets := matchPackets(strings.Join(args, ""))
+			if len(packets) == 0 {
+				log.Printf("No packets matching %q were found.\n", strings.Join(args, " "))
+				return
+			}
+			for _, info := range packets {
+				status := "shown"
+				if scope := filterScopeOf(info.name); scope != 0 {
+					status = "filtered " + scope.String()
+				}
+				if packetSuppressed(info.name) {
+					status += ", suppressed"
+				}
+				log.Printf("%-40s id=%-4d %-15s %s\n", info.name, info.id, directionHint(info.name), status)
+			}
+		},
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/parquet-go/parquet-go"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	registerSubcommand("parquet", "Converts a capture to Parquet files partitioned by date and session", runParquet)
+}
+
+// parquetRow is a row of a Parquet file written by the parquetExporter. Each row holds a single packet.
+type parquetRow struct {
+	Time      int64  `parquet:"time,timestamp(millisecond)"`
+	Session   int64  `parquet:"session"`
+	Direction string `parquet:"direction,dict"`
+	Packet    string `parquet:"packet,dict"`
+	ID        int32  `parquet:"id"`
+	Size      int32  `parquet:"size"`
+	// Payload holds the packet encoded as JSON.
+	Payload string `parquet:"payload,zstd"`
+}
+
+// parquetFile is a Parquet file that rows of a single session are written to.
+type parquetFile struct {
+	f    *os.File
+	w    *parquet.GenericWriter[parquetRow]
+	date string
+	rows []parquetRow
+}
+
+// parquetExporter writes packets passing through the proxy to Parquet files partitioned by date and session, in
+// the layout dir/date=2006-01-02/session=1/part-<unix time>.parquet, so that they may be queried using tools
+// such as DuckDB or Spark. Packets are dropped if the disk can't keep up, so that a slow disk does not slow down
+// the proxy.
+type parquetExporter struct {
+	dir string
+
+	queue   chan parquetEvent
+	dropped atomic.Int64
+	mu      sync.Mutex
+	files   map[int64]*parquetFile
+	closed  chan struct{}
+}
+
+// parquetEvent is either a packet event to write or, if closed is true, a notification that a session closed.
+type parquetEvent struct {
+	e      packetEvent
+	closed bool
+}
+
+// parquetBatchSize is the amount of rows buffered before they are written to a file.
+const parquetBatchSize = 512
+
+// newParquetExporter creates a parquetExporter writing to the directory passed and starts processing events.
+func newParquetExporter(dir string) *parquetExporter {
+	exp := &parquetExporter{dir: dir, queue: make(chan parquetEvent, 4096), files: map[int64]*parquetFile{}, closed: make(chan struct{})}
+	go exp.run()
+	return exp
+}
+
+// handlePacket queues a packet event to be written. It may be passed to addPacketListener.
+func (exp *parquetExporter) handlePacket(e packetEvent) {
+	select {
+	case exp.queue <- parquetEvent{e: e}:
+	default:
+		if exp.dropped.Add(1)%1000 == 1 {
+			log.Printf("Parquet exporter can't keep up, %d packet events dropped so far\n", exp.dropped.Load())
+		}
+	}
+}
+
+// handleSessionClose queues closing the file of a session. It may be passed to addSessionCloseListener. If the
+// queue is full, the event is queued in the background instead of being dropped, as the file would otherwise stay
+// open until the proxy stops.
+func (exp *parquetExporter) handleSessionClose(id int64) {
+	ev := parquetEvent{e: packetEvent{Session: id}, closed: true}
+	select {
+	case exp.queue <- ev:
+	default:
+		go func() {
+			select {
+			case exp.queue <- ev:
+			case <-exp.closed:
+			}
+		}()
+	}
+}
+
+// run processes events until the exporter is closed.
+func (exp *parquetExporter) run() {
+	for {
+		select {
+		case ev := <-exp.queue:
+			exp.mu.Lock()
+			if ev.closed {
+				exp.closeFile(ev.e.Session)
+			} else if err := exp.write(ev.e); err != nil {
+				log.Printf("Unable to export packet to Parquet: %v\n", err)
+			}
+			exp.mu.Unlock()
+		case <-exp.closed:
+			return
+		}
+	}
+}
+
+// write adds a packet to the file of its session. The exporter must be locked.
+func (exp *parquetExporter) write(e packetEvent) error {
+	date := e.Time.Format("2006-01-02")
+	file, ok := exp.files[e.Session]
+	if ok && file.date != date {
+		// Start a new file when the date changes, so that each file belongs to exactly one partition.
+		exp.closeFile(e.Session)
+		ok = false
+	}
+	if !ok {
+		dir := filepath.Join(exp.dir, "date="+date, fmt.Sprintf("session=%d", e.Session))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("part-%d.parquet", time.Now().UnixNano())))
+		if err != nil {
+			return err
+		}
+		file = &parquetFile{f: f, w: parquet.NewGenericWriter[parquetRow](f), date: date}
+		exp.files[e.Session] = file
+	}
+	payload, err := json.Marshal(e.Packet)
+	if err != nil {
+		payload = []byte("null")
+	}
+	file.rows = append(file.rows, parquetRow{
+		Time:      e.Time.UnixMilli(),
+		Session:   e.Session,
+		Direction: e.Direction,
+		Packet:    e.Name,
+		ID:        int32(e.ID),
+		Size:      int32(e.Size),
+		Payload:   string(payload),
+	})
+	if len(file.rows) >= parquetBatchSize {
+		return file.flush()
+	}
+	return nil
+}
+
+// flush writes the rows buffered to the file.
+func (file *parquetFile) flush() error {
+	if len(file.rows) == 0 {
+		return nil
+	}
+	_, err := file.w.Write(file.rows)
+	file.rows = file.rows[:0]
+	return err
+}
+
+// closeFile flushes and closes the file of the session passed. The exporter must be locked.
+func (exp *parquetExporter) closeFile(id int64) {
+	file, ok := exp.files[id]
+	if !ok {
+		return
+	}
+	delete(exp.files, id)
+	if err := file.flush(); err != nil {
+		log.Printf("Unable to export packets to Parquet: %v\n", err)
+	}
+	if err := file.w.Close(); err != nil {
+		log.Printf("Unable to close Parquet file: %v\n", err)
+	}
+	_ = file.f.Close()
+}
+
+// close closes all files that are still open. Events that are still queued are discarded.
+func (exp *parquetExporter) close() {
+	close(exp.closed)
+	exp.mu.Lock()
+	defer exp.mu.Unlock()
+	for id := range exp.files {
+		exp.closeFile(id)
+	}
+}
+
+// runParquet runs the parquet subcommand, which converts the packets of a capture to Parquet files in the same
+// layout as -parquet, so that captures made without it can be queried too.
+func runParquet(args []string) error {
+	fs := flag.NewFlagSet("parquet", flag.ExitOnError)
+	out := fs.String("o", "parquet", "Directory to write the Parquet files to")
+	sessionID := fs.Uint64("session", 0, "Session to convert, or 0 for all sessions")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: parquet [-o directory] [-session id] [-shield-id id] <capture|manifest>")
+	}
+	files, err := capture.Files(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	exp := &parquetExporter{dir: *out, files: map[int64]*parquetFile{}}
+	var n int
+	for _, file := range files {
+		err := forEachRecord(file, func(r capture.Record) error {
+			if *sessionID != 0 && r.Session != *sessionID || r.IsAnnotation() {
+				return nil
+			}
+			e := packetEvent{Time: time.Unix(0, r.TimeUnixNano), Session: int64(r.Session), Direction: "serverbound", Name: r.PacketName, ID: r.PacketID, Size: len(r.Payload)}
+			if r.Direction == capture.DirectionClientbound {
+				e.Direction = "clientbound"
+			}
+			if pk, err := decodePacket(r.PacketID, r.Payload, int32(*shieldID)); err == nil {
+				e.Packet = pk
+			}
+			n++
+			return exp.write(e)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	for id := range exp.files {
+		exp.closeFile(id)
+	}
+	log.Printf("Wrote %d packets to %s\n", n, *out)
+	return nil
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("pcapng", "Converts a capture file to pcapng with the packet name and direction as comment of every packet", runPcapng)
+}
+
+// Link types of packet captures supported when reading UDP datagrams.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+	// linkTypeUser0 is the first link type reserved for private use, which frames exported from captures are
+	// written with. Wireshark can be configured to decode it with a dissector of choice under DLT_USER.
+	linkTypeUser0 = 147
+)
+
+// udpDatagram is a UDP datagram read from a packet capture.
+type udpDatagram struct {
+	time     time.Time
+	src, dst netip.AddrPort
+	payload  []byte
+}
+
+// readUDPDatagrams reads all UDP datagrams from a packet capture in the pcap or pcapng format and calls f with
+// each of them in order. Frames that are not UDP over IPv4 or IPv6, and fragmented IP packets, are skipped.
+func readUDPDatagrams(r io.Reader, f func(d udpDatagram) error) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return fmt.Errorf("read capture magic: %w", err)
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return readPcap(br, f)
+	case 0x0a0d0d0a:
+		return readPcapng(br, f)
+	}
+	return errors.New("not a pcap or pcapng capture")
+}
+
+// readPcap reads the frames of a capture in the classic pcap format.
+func readPcap(r io.Reader, f func(d udpDatagram) error) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("read pcap header: %w", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header)
+	if magic == 0xd4c3b2a1 || magic == 0x4d3cb2a1 {
+		order = binary.BigEndian
+		magic = order.Uint32(header)
+	}
+	resolution := time.Microsecond
+	if magic == 0xa1b23c4d {
+		resolution = time.Nanosecond
+	}
+	linkType := order.Uint32(header[20:]) & 0xffff
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read pcap record: %w", err)
+		}
+		ts := time.Unix(int64(order.Uint32(record)), int64(order.Uint32(record[4:]))*int64(resolution))
+		frame := make([]byte, order.Uint32(record[8:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return fmt.Errorf("read pcap frame: %w", err)
+		}
+		if d, ok := parseFrame(linkType, frame, ts); ok {
+			if err := f(d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pcapngInterface is an interface described in a pcapng capture.
+type pcapngInterface struct {
+	linkType uint32
+	// resolution is the amount of timestamp units per second.
+	resolution float64
+}
+
+// readPcapng reads the frames of a capture in the pcapng format.
+func readPcapng(r io.Reader, f func(d udpDatagram) error) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterface
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read pcapng block: %w", err)
+		}
+		blockType := order.Uint32(head)
+		if blockType == 0x0a0d0d0a {
+			// The section header block determines the byte order of the section, so its length is read in the byte
+			// order of the magic that follows it.
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return fmt.Errorf("read pcapng section header: %w", err)
+			}
+			order = binary.LittleEndian
+			if binary.BigEndian.Uint32(magic) == 0x1a2b3c4d {
+				order = binary.BigEndian
+			}
+			length := order.Uint32(head[4:])
+			if length < 16 {
+				return fmt.Errorf("invalid pcapng section header length %d", length)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(length-12)); err != nil {
+				return fmt.Errorf("read pcapng section header: %w", err)
+			}
+			interfaces = nil
+			continue
+		}
+		length := order.Uint32(head[4:])
+		if length < 12 || length%4 != 0 {
+			return fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("read pcapng block: %w", err)
+		}
+		body = body[:len(body)-4]
+		switch blockType {
+		case 1:
+			// Interface description block.
+			if len(body) < 8 {
+				return errors.New("invalid pcapng interface description block")
+			}
+			iface := pcapngInterface{linkType: uint32(order.Uint16(body)), resolution: 1e6}
+			for opts := body[8:]; len(opts) >= 4; {
+				code, optLen := order.Uint16(opts), int(order.Uint16(opts[2:]))
+				if 4+optLen > len(opts) {
+					break
+				}
+				if code == 9 && optLen == 1 {
+					if v := opts[4]; v&0x80 != 0 {
+						iface.resolution = math.Pow(2, float64(v&0x7f))
+					} else {
+						iface.resolution = math.Pow(10, float64(v))
+					}
+				}
+				opts = opts[4+(optLen+3)/4*4:]
+			}
+			interfaces = append(interfaces, iface)
+		case 6:
+			// Enhanced packet block.
+			if len(body) < 20 {
+				return errors.New("invalid pcapng enhanced packet block")
+			}
+			id := order.Uint32(body)
+			if int(id) >= len(interfaces) {
+				return fmt.Errorf("pcapng packet of unknown interface %d", id)
+			}
+			iface := interfaces[id]
+			units := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			seconds := float64(units) / iface.resolution
+			ts := time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second)))
+			captured := order.Uint32(body[12:])
+			if int(captured) > len(body)-20 {
+				return errors.New("invalid pcapng enhanced packet block length")
+			}
+			if d, ok := parseFrame(iface.linkType, body[20:20+captured], ts); ok {
+				if err := f(d); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// parseFrame parses a frame of the link type passed and returns the UDP datagram it holds, if any.
+func parseFrame(linkType uint32, frame []byte, ts time.Time) (udpDatagram, bool) {
+	var etherType uint16
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return udpDatagram{}, false
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for etherType == 0x8100 && len(frame) >= 4 {
+			// VLAN tag.
+			etherType, frame = binary.BigEndian.Uint16(frame[2:]), frame[4:]
+		}
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return udpDatagram{}, false
+		}
+		// The address family is stored in the byte order of the capturing machine. IPv4 is 2, IPv6 is 24, 28
+		// or 30 depending on the operating system.
+		family := binary.LittleEndian.Uint32(frame)
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(frame)
+		}
+		etherType, frame = 0x0800, frame[4:]
+		if family != 2 {
+			etherType = 0x86dd
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return udpDatagram{}, false
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[14:]), frame[16:]
+	case linkTypeSLL2:
+		if len(frame) < 20 {
+			return udpDatagram{}, false
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame), frame[20:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		if len(frame) == 0 {
+			return udpDatagram{}, false
+		}
+		etherType = 0x0800
+		if frame[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+	default:
+		return udpDatagram{}, false
+	}
+
+	var src, dst netip.Addr
+	switch etherType {
+	case 0x0800:
+		if len(frame) < 20 || frame[0]>>4 != 4 {
+			return udpDatagram{}, false
+		}
+		headerLen := int(frame[0]&0x0f) * 4
+		if frame[9] != 17 || len(frame) < headerLen || binary.BigEndian.Uint16(frame[6:])&0x3fff != 0 {
+			// Not UDP, or a fragment.
+			return udpDatagram{}, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(frame[12:16])), netip.AddrFrom4([4]byte(frame[16:20]))
+		frame = frame[headerLen:]
+	case 0x86dd:
+		if len(frame) < 40 || frame[6] != 17 {
+			return udpDatagram{}, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(frame[8:24])), netip.AddrFrom16([16]byte(frame[24:40]))
+		frame = frame[40:]
+	default:
+		return udpDatagram{}, false
+	}
+	if len(frame) < 8 {
+		return udpDatagram{}, false
+	}
+	length := int(binary.BigEndian.Uint16(frame[4:]))
+	if length < 8 || length > len(frame) {
+		length = len(frame)
+	}
+	return udpDatagram{
+		time:    ts,
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(frame)),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(frame[2:])),
+		payload: frame[8:length],
+	}, true
+}
+
+// pcapngWriter writes frames to a pcapng file with a single interface.
+type pcapngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// pcapngOption appends a pcapng option with the code and value passed to the block passed, padded to 32 bits.
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// newPcapngWriter writes the section header and the description of an interface of the link type passed with
+// nanosecond timestamps to the writer passed, and returns a pcapngWriter writing frames to it.
+func newPcapngWriter(w io.Writer, linkType uint16, name string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, math.MaxUint64)
+	shb = pcapngOption(shb, 4, []byte("bds-mitm"))
+	shb = pcapngOption(shb, 0, nil)
+	if err := pw.block(0x0a0d0d0a, shb); err != nil {
+		return nil, err
+	}
+	idb := binary.LittleEndian.AppendUint16(nil, linkType)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = pcapngOption(idb, 2, []byte(name))
+	idb = pcapngOption(idb, 9, []byte{9})
+	idb = pcapngOption(idb, 0, nil)
+	return pw, pw.block(1, idb)
+}
+
+// block writes a block of the type passed holding the body passed.
+func (pw *pcapngWriter) block(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	pw.buf = binary.LittleEndian.AppendUint32(pw.buf[:0], blockType)
+	pw.buf = binary.LittleEndian.AppendUint32(pw.buf, length)
+	pw.buf = append(pw.buf, body...)
+	pw.buf = binary.LittleEndian.AppendUint32(pw.buf, length)
+	_, err := pw.w.Write(pw.buf)
+	return err
+}
+
+// writeFrame writes an enhanced packet block holding the frame passed, captured at the time passed. The comment
+// is shown alongside the frame in Wireshark, and inbound specifies the direction of the frame.
+func (pw *pcapngWriter) writeFrame(t time.Time, frame []byte, comment string, inbound bool) error {
+	ts := uint64(t.UnixNano())
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+	epb = append(epb, frame...)
+	epb = append(epb, make([]byte, (4-len(frame)%4)%4)...)
+	epb = pcapngOption(epb, 1, []byte(comment))
+	// The epb_flags option holds the direction of the frame in its lowest two bits: 1 for inbound, 2 for outbound.
+	flags := uint32(2)
+	if inbound {
+		flags = 1
+	}
+	epb = pcapngOption(epb, 2, binary.LittleEndian.AppendUint32(nil, flags))
+	epb = pcapngOption(epb, 0, nil)
+	return pw.block(6, epb)
+}
+
+// runPcapng runs the pcapng subcommand, which writes the records of a capture as frames of the DLT_USER0 link type
+// to a pcapng file, so that sessions can be opened in Wireshark. Every frame holds the varuint32 header of the
+// packet followed by its payload, and is commented with the session, direction and name of the packet.
+// Clientbound packets are marked inbound and serverbound packets outbound.
+func runPcapng(args []string) error {
+	fs := flag.NewFlagSet("pcapng", flag.ExitOnError)
+	out := fs.String("o", "", "Output file (defaults to <capture>.pcapng)")
+	sessionID := fs.Uint64("session", 0, "Session to export, or 0 to export all sessions")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: pcapng [-o output] [-session id] <capture>")
+	}
+	in := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(in, ".bdscap") + ".pcapng"
+	}
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec, err := capture.NewDecoder(f)
+	if err != nil {
+		return err
+	}
+	h := dec.Header()
+	o, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	w := bufio.NewWriter(o)
+	pw, err := newPcapngWriter(w, linkTypeUser0, fmt.Sprintf("bds-mitm %s (protocol %d)", h.Upstream, h.Protocol))
+	if err != nil {
+		return err
+	}
+	frames := 0
+	for i := 0; ; i++ {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", i, err)
+		}
+		capture.Migrate(h, &r)
+		if *sessionID != 0 && r.Session != *sessionID || r.IsAnnotation() {
+			continue
+		}
+		direction := "serverbound"
+		if r.Direction == capture.DirectionClientbound {
+			direction = "clientbound"
+		}
+		frame := append(binary.AppendUvarint(nil, uint64(r.PacketID)), r.Payload...)
+		comment := fmt.Sprintf("#%d %s %s", r.Session, direction, r.PacketName)
+		if err := pw.writeFrame(time.Unix(0, r.TimeUnixNano), frame, comment, r.Direction == capture.DirectionClientbound); err != nil {
+			return err
+		}
+		frames++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d packets to %s\n", frames, *out)
+	return o.Close()
+}
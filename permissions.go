@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// abilityNames holds the names of the abilities of a player, indexed by their bit in an ability layer.
+var abilityNames = []string{
+	"build", "mine", "doors_and_switches", "open_containers", "attack_players", "attack_mobs", "operator_commands",
+	"teleport", "invulnerable", "flying", "may_fly", "instant_build", "lightning", "fly_speed", "walk_speed",
+	"muted", "world_builder", "no_clip",
+}
+
+// abilityLayerNames holds the names of ability layers, indexed by their type.
+var abilityLayerNames = map[uint16]string{
+	protocol.AbilityLayerTypeCustomCache: "cache",
+	protocol.AbilityLayerTypeBase:        "base",
+	protocol.AbilityLayerTypeSpectator:   "spectator",
+	protocol.AbilityLayerTypeCommands:    "commands",
+	protocol.AbilityLayerTypeEditor:      "editor",
+}
+
+// playerPermissionNames and commandPermissionNames hold the names of the permission levels of a player.
+var (
+	playerPermissionNames  = []string{"visitor", "member", "operator", "custom"}
+	commandPermissionNames = []string{"normal", "operator", "automation", "host", "owner", "internal"}
+)
+
+// levelName returns the name of the level passed, or its number if it has no name.
+func levelName(names []string, level int) string {
+	if level >= 0 && level < len(names) {
+		return names[level]
+	}
+	return strconv.Itoa(level)
+}
+
+// permissionChange is a single change to the permissions of a player.
+type permissionChange struct {
+	time   time.Time
+	packet string
+	change string
+}
+
+// permissionModel holds the permissions of a single player as last reported by the server, together with the
+// history of changes to them.
+type permissionModel struct {
+	entity  int64
+	state   map[string]string
+	history []permissionChange
+}
+
+// update sets the permission values passed, recording every value that changed in the history. The changes are
+// returned.
+func (m *permissionModel) update(packetName string, values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var changes []string
+	for _, k := range keys {
+		old, ok := m.state[k]
+		if ok && old == values[k] {
+			continue
+		}
+		if !ok {
+			old = "unset"
+		}
+		change := fmt.Sprintf("%s: %s -> %s", k, old, values[k])
+		m.state[k] = values[k]
+		m.history = append(m.history, permissionChange{time: time.Now(), packet: packetName, change: change})
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// permissionModels holds the permission models of the players seen by each session, indexed by session ID and
+// entity unique ID.
+var permissionModels = struct {
+	sync.Mutex
+	m map[int64]map[int64]*permissionModel
+}{m: map[int64]map[int64]*permissionModel{}}
+
+// trackPermissions updates the permission models of the session the packet event passed belongs to.
+func trackPermissions(e packetEvent) {
+	var entity int64
+	values := map[string]string{}
+	switch pk := e.Packet.(type) {
+	case *packet.UpdateAbilities:
+		entity = pk.AbilityData.EntityUniqueID
+		values["player_permissions"] = levelName(playerPermissionNames, int(pk.AbilityData.PlayerPermissions))
+		values["command_permissions"] = levelName(commandPermissionNames, int(pk.AbilityData.CommandPermissions))
+		for _, layer := range pk.AbilityData.Layers {
+			layerName, ok := abilityLayerNames[layer.Type]
+			if !ok {
+				layerName = strconv.Itoa(int(layer.Type))
+			}
+			for bit, name := range abilityNames {
+				if layer.Abilities&(1<<bit) != 0 {
+					values[layerName+"."+name] = strconv.FormatBool(layer.Values&(1<<bit) != 0)
+				}
+			}
+		}
+	case *packet.UpdateAdventureSettings:
+		// Adventure settings apply to the world rather than a specific player, so they are recorded for the
+		// local player, which has entity unique ID 0 in the model.
+		values["no_pvm"] = strconv.FormatBool(pk.NoPvM)
+		values["no_mvp"] = strconv.FormatBool(pk.NoMvP)
+		values["immutable_world"] = strconv.FormatBool(pk.ImmutableWorld)
+		values["show_name_tags"] = strconv.FormatBool(pk.ShowNameTags)
+		values["auto_jump"] = strconv.FormatBool(pk.AutoJump)
+	case *packet.RequestPermissions:
+		entity = pk.EntityUniqueID
+		values["requested_player_permissions"] = levelName(playerPermissionNames, int(pk.PermissionLevel))
+		values["requested_flags"] = fmt.Sprintf("%#x", pk.RequestedPermissions)
+	default:
+		return
+	}
+
+	permissionModels.Lock()
+	models, ok := permissionModels.m[e.Session]
+	if !ok {
+		models = map[int64]*permissionModel{}
+		permissionModels.m[e.Session] = models
+	}
+	m, ok := models[entity]
+	if !ok {
+		m = &permissionModel{entity: entity, state: map[string]string{}}
+		models[entity] = m
+	}
+	changes := m.update(e.Name, values)
+	permissionModels.Unlock()
+
+	fields := logFields{"session": strconv.FormatInt(e.Session, 10), "direction": e.Direction, "packet": e.Name}
+	for _, change := range changes {
+		logf(fields, "Permissions of entity %d changed by %s: %s\n", entity, e.Name, change)
+	}
+}
+
+func init() {
+	addPacketListener(trackPermissions)
+	addSessionCloseListener(func(id int64) {
+		permissionModels.Lock()
+		delete(permissionModels.m, id)
+		permissionModels.Unlock()
+	})
+	registerCommand("permissions", consoleCommand{
+		usage:       "<session> [history]",
+		description: "Shows the permissions and abilities of the players of a session, or their change history.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println("Usage: permissions <session> [history]")
+				return
+			}
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				log.Printf("Invalid session %q.\n", args[0])
+				return
+			}
+			permissionModels.Lock()
+			defer permissionModels.Unlock()
+			models := permissionModels.m[id]
+			if len(models) == 0 {
+				log.Printf("No permissions were recorded for session %d.\n", id)
+				return
+			}
+			entities := make([]int64, 0, len(models))
+			for entity := range models {
+				entities = append(entities, entity)
+			}
+			sort.Slice(entities, func(i, j int) bool { return entities[i] < entities[j] })
+			for _, entity := range entities {
+				m := models[entity]
+				log.Printf("Entity %d:\n", entity)
+				if len(args) > 1 && args[1] == "history" {
+					for _, c := range m.history {
+						log.Printf("    %s %-24s %s\n", c.time.Format("15:04:05.000"), c.packet, c.change)
+					}
+					continue
+				}
+				keys := make([]string, 0, len(m.state))
+				for k := range m.state {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					log.Printf("    %-32s %s\n", k, m.state[k])
+				}
+			}
+		},
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bds-mitm/handler"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadedPlugin is a Go plugin loaded from a shared object. Packets are passed to it by a user handler, so that it
+// runs on the handler pool with a time budget and is disabled when it exceeds it.
+type loadedPlugin struct {
+	name    string
+	path    string
+	h       handler.Handler
+	handler *userHandler
+}
+
+// plugins holds the Go plugins loaded, indexed by their name. It is nil if plugins are not enabled using
+// -plugins.
+var plugins = struct {
+	sync.RWMutex
+	m map[string]*loadedPlugin
+}{}
+
+// loadPlugins loads all plugins in the directory passed, starts the handler pool that packets are passed to them on
+// and registers the listener notifying them of closed sessions. Plugins added to the directory later on may be
+// loaded using the plugins command.
+func loadPlugins(dir string) error {
+	plugins.Lock()
+	plugins.m = map[string]*loadedPlugin{}
+	plugins.Unlock()
+	startHandlerPool()
+	addSessionCloseListener(dispatchPluginSessionClose)
+
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := loadPlugin(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPlugin loads the plugin at the path passed and enables it.
+func loadPlugin(path string) error {
+	plugins.RLock()
+	enabled := plugins.m != nil
+	plugins.RUnlock()
+	if !enabled {
+		return fmt.Errorf("plugins are not enabled, set a plugin directory using -plugins")
+	}
+	h, err := openPlugin(path, pluginHost{path: path})
+	if err != nil {
+		return fmt.Errorf("load plugin %s: %w", path, err)
+	}
+	plugins.Lock()
+	defer plugins.Unlock()
+	name := h.Name()
+	if _, ok := plugins.m[name]; ok {
+		return fmt.Errorf("load plugin %s: a plugin named %s is already loaded", path, name)
+	}
+	p := &loadedPlugin{name: name, path: path, h: h}
+	p.handler = addUserHandler("plugin "+name, func(e packetEvent) {
+		ev := pluginEvent(e)
+		p.call(func(h handler.Handler) {
+			h.HandlePacket(ev)
+		})
+	})
+	plugins.m[name] = p
+	if _, ok := h.(handler.Interceptor); ok {
+		pluginInterceptors.Add(1)
+	}
+	log.Printf("Loaded plugin %s from %s.\n", name, path)
+	return nil
+}
+
+// enabledPlugins returns the plugins that are currently enabled.
+func enabledPlugins() []*loadedPlugin {
+	plugins.RLock()
+	defer plugins.RUnlock()
+	enabled := make([]*loadedPlugin, 0, len(plugins.m))
+	for _, p := range plugins.m {
+		if !p.handler.disabled.Load() {
+			enabled = append(enabled, p)
+		}
+	}
+	return enabled
+}
+
+// call calls f with the handler of the plugin, disabling the plugin if it panics so that a faulty plugin does not
+// crash the proxy.
+func (p *loadedPlugin) call(f func(h handler.Handler)) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("Plugin %s panicked and was disabled: %v\n", p.name, v)
+			p.handler.disabled.Store(true)
+		}
+	}()
+	f(p.h)
+}
+
+// pluginInterceptors is the amount of loaded plugins implementing handler.Interceptor, so that packets are only
+// passed to interceptors if any are loaded.
+var pluginInterceptors atomic.Int32
+
+// interceptPluginPacket passes the packet of the event passed to all enabled plugins implementing
+// handler.Interceptor in turn, and returns the packet to forward, or nil if a plugin cancelled it.
+func interceptPluginPacket(e packetEvent) packet.Packet {
+	pk := e.Packet
+	for _, p := range enabledPlugins() {
+		interceptor, ok := p.h.(handler.Interceptor)
+		if !ok {
+			continue
+		}
+		ev := pluginEvent(e)
+		ev.Packet = pk
+		p.call(func(handler.Handler) {
+			pk = interceptor.InterceptPacket(ev)
+		})
+		if pk == nil {
+			return nil
+		}
+	}
+	return pk
+}
+
+// pluginEvent converts a packet event to the event passed to plugins.
+func pluginEvent(e packetEvent) handler.Event {
+	return handler.Event{Time: e.Time, Session: e.Session, Direction: e.Direction, Name: e.Name, ID: e.ID, Size: e.Size, Packet: e.Packet}
+}
+
+// dispatchPluginSessionClose notifies all enabled plugins that a session was closed.
+func dispatchPluginSessionClose(id int64) {
+	for _, p := range enabledPlugins() {
+		p.call(func(h handler.Handler) {
+			h.HandleSessionClose(id)
+		})
+	}
+}
+
+// pluginHost implements handler.Host for a plugin.
+type pluginHost struct {
+	path string
+}
+
+// namespace returns the name that the state of the plugin is stored under, which is the name of its file without
+// extension.
+func (host pluginHost) namespace() string {
+	return strings.TrimSuffix(filepath.Base(host.path), filepath.Ext(host.path))
+}
+
+// Logf ...
+func (host pluginHost) Logf(format string, args ...any) {
+	logf(logFields{"plugin": filepath.Base(host.path)}, "[%s] %s", filepath.Base(host.path), fmt.Sprintf(format, args...))
+}
+
+// SendToClient ...
+func (host pluginHost) SendToClient(id int64, pk packet.Packet) error {
+	s, ok := sessionByID(id)
+	if !ok {
+		return fmt.Errorf("no session with ID %d", id)
+	}
+	if gatewayMode {
+		return fmt.Errorf("packet injection is disabled in gateway mode")
+	}
+	return s.sendToClient(pk)
+}
+
+// SendToServer ...
+func (host pluginHost) SendToServer(id int64, pk packet.Packet) error {
+	s, ok := sessionByID(id)
+	if !ok {
+		return fmt.Errorf("no session with ID %d", id)
+	}
+	if gatewayMode {
+		return fmt.Errorf("packet injection is disabled in gateway mode")
+	}
+	return s.sendToServer(pk)
+}
+
+// Disconnect ...
+func (host pluginHost) Disconnect(id int64, message string) error {
+	s, ok := sessionByID(id)
+	if !ok {
+		return fmt.Errorf("no session with ID %d", id)
+	}
+	s.close(fmt.Errorf("disconnected by plugin %s: %w", filepath.Base(host.path), minecraft.DisconnectError(message)))
+	return nil
+}
+
+// KV ...
+func (host pluginHost) KV() handler.KV {
+	return kvNamespaceOf(host.namespace())
+}
+
+// After ...
+func (host pluginHost) After(id int64, delay time.Duration, f func()) (handler.Task, error) {
+	s, ok := sessionByID(id)
+	if !ok {
+		return nil, fmt.Errorf("no session with ID %d", id)
+	}
+	return s.after("plugin "+host.namespace(), delay, func(*session) { f() }), nil
+}
+
+// Every ...
+func (host pluginHost) Every(id int64, interval time.Duration, f func()) (handler.Task, error) {
+	s, ok := sessionByID(id)
+	if !ok {
+		return nil, fmt.Errorf("no session with ID %d", id)
+	}
+	return s.every("plugin "+host.namespace(), interval, func(*session) { f() }), nil
+}
+
+// HTTP ...
+func (host pluginHost) HTTP() handler.HTTPClient {
+	return httpClientOf(host.namespace())
+}
+
+func init() {
+	const usage = "Usage: plugins [load <path>|enable <name>|disable <name>]"
+	registerCommand("plugins", consoleCommand{
+		usage:       "[load <path>|enable <name>|disable <name>]",
+		description: "Lists the loaded Go plugins, loads a new one or enables or disables one.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				plugins.RLock()
+				loaded := make([]*loadedPlugin, 0, len(plugins.m))
+				for _, p := range plugins.m {
+					loaded = append(loaded, p)
+				}
+				plugins.RUnlock()
+				sort.Slice(loaded, func(i, j int) bool {
+					return loaded[i].name < loaded[j].name
+				})
+				if len(loaded) == 0 {
+					log.Println("No plugins are loaded.")
+				}
+				for _, p := range loaded {
+					state := "enabled"
+					if p.handler.disabled.Load() {
+						state = "disabled"
+					}
+					log.Printf("%s (%s): %s\n", p.name, p.path, state)
+				}
+				return
+			}
+			if len(args) != 2 {
+				log.Println(usage)
+				return
+			}
+			switch args[0] {
+			case "load":
+				if err := loadPlugin(args[1]); err != nil {
+					log.Printf("Unable to load plugin: %v\n", err)
+				}
+			case "enable", "disable":
+				plugins.RLock()
+				p, ok := plugins.m[args[1]]
+				plugins.RUnlock()
+				if ok {
+					p.handler.strikes.Store(0)
+					p.handler.disabled.Store(args[0] == "disable")
+				}
+				if !ok {
+					log.Printf("No plugin named %s is loaded.\n", args[1])
+					return
+				}
+				log.Printf("Plugin %s is now %sd.\n", args[1], args[0])
+			default:
+				log.Println(usage)
+			}
+		},
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bds-mitm/handler"
+	"fmt"
+	"plugin"
+)
+
+// openPlugin opens the Go plugin at the path passed and creates its handler using the New function it exports.
+func openPlugin(path string, host handler.Host) (handler.Handler, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if sym, err := p.Lookup("APIVersion"); err == nil {
+		if v, ok := sym.(*int); ok && *v != handler.APIVersion {
+			return nil, fmt.Errorf("plugin was built against handler API version %d, expected %d", *v, handler.APIVersion)
+		}
+	}
+	sym, err := p.Lookup("New")
+	if err != nil {
+		return nil, err
+	}
+	newHandler, ok := sym.(handler.NewFunc)
+	if !ok {
+		return nil, fmt.Errorf("New has type %T, expected func(handler.Host) (handler.Handler, error)", sym)
+	}
+	return newHandler(host)
+}
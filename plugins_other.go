@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"bds-mitm/handler"
+	"fmt"
+)
+
+// openPlugin is only supported on Linux, as Go plugins are not available on Windows.
+func openPlugin(string, handler.Host) (handler.Handler, error) {
+	return nil, fmt.Errorf("Go plugins are only supported on Linux")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// portalProfileDuration is the time after a ChangeDimension packet during which all packets of the session are
+// logged and captured, or 0 to disable the portal profile.
+var portalProfileDuration time.Duration
+
+// portalCaptureDir is the directory captures written by the portal profile are stored in.
+var portalCaptureDir = "captures"
+
+// portalCapture is a capture of a session started by a dimension change.
+type portalCapture struct {
+	path     string
+	until    time.Time
+	f        *os.File
+	enc      *capture.Encoder
+	shieldID int32
+	records  int
+}
+
+// portalCaptures holds the portal captures in progress, indexed by session ID.
+var portalCaptures = struct {
+	sync.Mutex
+	m map[int64]*portalCapture
+}{m: map[int64]*portalCapture{}}
+
+// portalVerbose checks if the portal profile is active for the session passed, in which case all its packets
+// are logged regardless of filters.
+func portalVerbose(session int64) bool {
+	portalCaptures.Lock()
+	defer portalCaptures.Unlock()
+	c, ok := portalCaptures.m[session]
+	return ok && time.Now().Before(c.until)
+}
+
+// handlePortalPacket starts or extends the portal capture of a session when a ChangeDimension packet is sent to
+// the client, and writes the packet event passed to the capture of its session if one is in progress.
+func handlePortalPacket(e packetEvent) {
+	portalCaptures.Lock()
+	defer portalCaptures.Unlock()
+	c, ok := portalCaptures.m[e.Session]
+	if ok && e.Time.After(c.until) {
+		finishPortalCapture(e.Session, c)
+		ok = false
+	}
+	if _, dimension := e.Packet.(*packet.ChangeDimension); dimension && e.Direction == "clientbound" {
+		if !ok {
+			s, found := sessionByID(e.Session)
+			if !found {
+				return
+			}
+			var err error
+			if c, err = startPortalCapture(s, e.Time); err != nil {
+				log.Printf("An error occurred whilst starting portal capture of session %d: %v\n", e.Session, err)
+				return
+			}
+			portalCaptures.m[e.Session] = c
+			ok = true
+			log.Printf("Dimension change in session %d: logging and capturing all packets for %v to %s\n", e.Session, portalProfileDuration, c.path)
+		}
+		c.until = e.Time.Add(portalProfileDuration)
+	}
+	if !ok {
+		return
+	}
+	direction := capture.DirectionServerbound
+	if e.Direction == "clientbound" {
+		direction = capture.DirectionClientbound
+	}
+	var payload []byte
+	if e.Packet != nil {
+		payload = encodePacket(e.Packet, c.shieldID)
+	}
+	err := c.enc.Encode(capture.Record{
+		TimeUnixNano: e.Time.UnixNano(),
+		Session:      uint64(e.Session),
+		Direction:    direction,
+		PacketID:     e.ID,
+		PacketName:   e.Name,
+		Payload:      payload,
+	})
+	if err != nil {
+		log.Printf("An error occurred whilst writing portal capture of session %d: %v\n", e.Session, err)
+		finishPortalCapture(e.Session, c)
+		return
+	}
+	c.records++
+}
+
+// startPortalCapture creates a capture file for the session passed.
+func startPortalCapture(s *session, start time.Time) (*portalCapture, error) {
+	if err := os.MkdirAll(portalCaptureDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(portalCaptureDir, fmt.Sprintf("portal-session-%d-%s.bdscap", s.id, start.Format("20060102-150405")))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := capture.NewEncoder(f, capture.Header{
+		CreatedUnixNano:  start.UnixNano(),
+		Upstream:         s.upstream,
+		Protocol:         protocol.CurrentProtocol,
+		MinecraftVersion: protocol.CurrentVersion,
+		DedupMinSize:     uint32(captureDedupMinSize),
+	})
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &portalCapture{path: path, f: f, enc: enc, shieldID: shieldID(s.server.GameData())}, nil
+}
+
+// finishPortalCapture closes the portal capture passed of a session. The portal captures must be locked.
+func finishPortalCapture(session int64, c *portalCapture) {
+	delete(portalCaptures.m, session)
+	if err := c.f.Close(); err != nil {
+		log.Printf("An error occurred whilst closing portal capture of session %d: %v\n", session, err)
+		return
+	}
+	if saved := c.enc.Saved(); saved > 0 {
+		log.Printf("Portal capture of session %d finished: wrote %d packets to %s, omitting %d bytes of duplicate payloads\n", session, c.records, c.path, saved)
+		return
+	}
+	log.Printf("Portal capture of session %d finished: wrote %d packets to %s\n", session, c.records, c.path)
+}
+
+// enablePortalProfile enables logging and capturing all packets of a session for the duration passed after each
+// dimension change.
+func enablePortalProfile(duration time.Duration) {
+	portalProfileDuration = duration
+	addPacketListener(handlePortalPacket)
+	addSessionCloseListener(func(id int64) {
+		portalCaptures.Lock()
+		if c, ok := portalCaptures.m[id]; ok {
+			finishPortalCapture(id, c)
+		}
+		portalCaptures.Unlock()
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/nbt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prettyPackets holds the packets that are logged as indented trees of their fields rather than on a single line.
+var prettyPackets = newPacketSelection()
+
+const (
+	// prettyMaxDepth is the depth after which nested values are no longer expanded.
+	prettyMaxDepth = 32
+	// prettyMaxInline is the maximum amount of elements of a slice of numbers written before it is truncated.
+	prettyMaxInline = 64
+	// prettyMaxBytes is the maximum amount of bytes of a byte slice written before it is truncated.
+	prettyMaxBytes = 64
+)
+
+// prettyPacket renders a packet as an indented tree in which every field is labelled with its name. Maps and
+// byte slices holding NBT are rendered as trees of their tags.
+func prettyPacket(pk packet.Packet) string {
+	b := new(strings.Builder)
+	writePretty(b, reflect.ValueOf(pk), 0)
+	return b.String()
+}
+
+// writePretty writes the value passed to b, indenting nested lines by the depth passed.
+func writePretty(b *strings.Builder, v reflect.Value, depth int) {
+	if !v.IsValid() {
+		b.WriteString("<nil>")
+		return
+	}
+	if depth > prettyMaxDepth {
+		b.WriteString("...")
+		return
+	}
+	if v.CanInterface() && v.Kind() != reflect.Struct {
+		if s, ok := v.Interface().(fmt.Stringer); ok && (v.Kind() != reflect.Pointer || !v.IsNil()) {
+			b.WriteString(s.String())
+			return
+		}
+	}
+	indent := strings.Repeat("  ", depth+1)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("<nil>")
+			return
+		}
+		writePretty(b, v.Elem(), depth)
+	case reflect.Struct:
+		b.WriteString(v.Type().Name())
+		t := v.Type()
+		var written bool
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if !written {
+				b.WriteString(" {\n")
+				written = true
+			}
+			b.WriteString(indent + t.Field(i).Name + ": ")
+			writePretty(b, v.Field(i), depth+1)
+			b.WriteString("\n")
+		}
+		if written {
+			b.WriteString(indent[2:] + "}")
+		} else {
+			b.WriteString("{}")
+		}
+	case reflect.Map:
+		if v.Len() == 0 {
+			b.WriteString("{}")
+			return
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		b.WriteString("{\n")
+		for _, key := range keys {
+			b.WriteString(indent + fmt.Sprint(key) + ": ")
+			writePretty(b, v.MapIndex(key), depth+1)
+			b.WriteString("\n")
+		}
+		b.WriteString(indent[2:] + "}")
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writePrettyBytes(b, v.Bytes(), depth)
+			return
+		}
+		if v.Len() == 0 {
+			b.WriteString("[]")
+			return
+		}
+		if prettyInline(v.Type().Elem().Kind()) {
+			b.WriteString("[")
+			for i := 0; i < v.Len() && i < prettyMaxInline; i++ {
+				if i > 0 {
+					b.WriteString(" ")
+				}
+				writePretty(b, v.Index(i), depth+1)
+			}
+			if v.Len() > prettyMaxInline {
+				b.WriteString(fmt.Sprintf(" ... (%d more)", v.Len()-prettyMaxInline))
+			}
+			b.WriteString("]")
+			return
+		}
+		b.WriteString("[\n")
+		for i := 0; i < v.Len(); i++ {
+			b.WriteString(fmt.Sprintf("%s[%d] ", indent, i))
+			writePretty(b, v.Index(i), depth+1)
+			b.WriteString("\n")
+		}
+		b.WriteString(indent[2:] + "]")
+	case reflect.String:
+		b.WriteString(strconv.Quote(v.String()))
+	default:
+		b.WriteString(fmt.Sprint(v))
+	}
+}
+
+// writePrettyBytes writes a byte slice to b. Byte slices holding an NBT compound are decoded and written as a
+// tree, others are written in hex, truncated to prettyMaxBytes bytes.
+func writePrettyBytes(b *strings.Builder, data []byte, depth int) {
+	if len(data) > 0 && data[0] == 10 {
+		var m map[string]any
+		if err := nbt.UnmarshalEncoding(data, &m, nbt.NetworkLittleEndian); err == nil {
+			b.WriteString("(NBT) ")
+			writePretty(b, reflect.ValueOf(m), depth)
+			return
+		}
+	}
+	if len(data) > prettyMaxBytes {
+		b.WriteString(fmt.Sprintf("(%d bytes) % x ...", len(data), data[:prettyMaxBytes]))
+		return
+	}
+	b.WriteString(fmt.Sprintf("(%d bytes) % x", len(data), data))
+}
+
+// prettyInline checks if slices with elements of the kind passed are written on a single line.
+func prettyInline(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
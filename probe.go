@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/go-raknet"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"golang.org/x/oauth2"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("probe", "Connects to a server as a bot and reports which optional protocol features it supports", runProbe)
+}
+
+// probeItemStackRequestID is the ID of the empty item stack request sent to test if the server handles item stack
+// requests. Clients use negative odd request IDs.
+const probeItemStackRequestID = -1
+
+// probeChunkRadius is the chunk radius requested to find out the maximum chunk radius of the server.
+const probeChunkRadius = 64
+
+// probeLatencyTimestamp is the timestamp of the NetworkStackLatency sent to test if the server answers it.
+const probeLatencyTimestamp = clientProbeBase + 1
+
+// probeReport is the capability report of a server produced by the probe subcommand.
+type probeReport struct {
+	Server   string         `json:"server"`
+	Time     time.Time      `json:"time"`
+	Status   upstreamStatus `json:"status"`
+	PingMS   float64        `json:"ping_ms"`
+	SpawnMS  float64        `json:"spawn_ms"`
+	Features []probeFeature `json:"features"`
+	// Packets holds the amount of packets of each type received whilst probing.
+	Packets map[string]int `json:"packets"`
+}
+
+// probeFeature is an optional protocol feature and whether the server supports it.
+type probeFeature struct {
+	Name      string `json:"name"`
+	Supported bool   `json:"supported"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// add adds a feature to the report.
+func (r *probeReport) add(name string, supported bool, format string, args ...any) {
+	r.Features = append(r.Features, probeFeature{Name: name, Supported: supported, Detail: fmt.Sprintf(format, args...)})
+}
+
+// movementModes holds the names of the player movement modes of StartGame.
+var movementModes = map[int32]string{
+	protocol.PlayerMovementModeClient:           "client authoritative",
+	protocol.PlayerMovementModeServer:           "server authoritative",
+	protocol.PlayerMovementModeServerWithRewind: "server authoritative with rewind",
+}
+
+// subChunkModes holds the names of the sub-chunk request modes of LevelChunk.
+var subChunkModes = map[byte]string{
+	protocol.SubChunkRequestModeLegacy:    "legacy",
+	protocol.SubChunkRequestModeLimitless: "limitless",
+	protocol.SubChunkRequestModeLimited:   "limited",
+}
+
+// probeServer connects to the server at the address passed with the client blob cache enabled, spawns, and
+// exercises optional protocol features for the duration passed, reporting which of them the server supports.
+func probeServer(addr string, src oauth2.TokenSource, duration time.Duration) (*probeReport, error) {
+	report := &probeReport{Server: addr, Time: time.Now(), Packets: map[string]int{}}
+	start := time.Now()
+	data, err := raknet.PingTimeout(addr, time.Second*5)
+	if err != nil {
+		return nil, fmt.Errorf("ping: %w", err)
+	}
+	report.PingMS = float64(time.Since(start).Microseconds()) / 1000
+	report.Status = parseUpstreamStatus(data)
+
+	start = time.Now()
+	conn, err := minecraft.Dialer{TokenSource: src, EnableClientCache: true}.DialTimeout("raknet", addr, time.Second*30)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.DoSpawnTimeout(time.Second * 30); err != nil {
+		return nil, fmt.Errorf("spawn: %w", err)
+	}
+	report.SpawnMS = float64(time.Since(start).Microseconds()) / 1000
+	gameData := conn.GameData()
+
+	_ = conn.WritePacket(&packet.RequestChunkRadius{ChunkRadius: probeChunkRadius})
+	_ = conn.WritePacket(&packet.NetworkStackLatency{Timestamp: probeLatencyTimestamp, NeedsResponse: true})
+	_ = conn.WritePacket(&packet.ItemStackRequest{Requests: []protocol.ItemStackRequest{{RequestID: probeItemStackRequestID}}})
+
+	var (
+		chunkRadius                          int32 = -1
+		latencyAnswered, itemStackAnswered   bool
+		itemStackStatus                      uint8
+		chunks, cachedChunks, cacheResponses int
+		subChunkModesSeen                    = map[string]bool{}
+	)
+	_ = conn.SetDeadline(time.Now().Add(duration))
+	for {
+		pk, err := conn.ReadPacket()
+		if err != nil {
+			break
+		}
+		report.Packets[getType(pk, false)]++
+		switch pk := pk.(type) {
+		case *packet.ChunkRadiusUpdated:
+			chunkRadius = pk.ChunkRadius
+		case *packet.NetworkStackLatency:
+			// Servers answer with the timestamp divided or multiplied by 1000 depending on the version.
+			if pk.Timestamp == probeLatencyTimestamp || pk.Timestamp == probeLatencyTimestamp/1000 || pk.Timestamp == probeLatencyTimestamp*1000 {
+				latencyAnswered = true
+			}
+		case *packet.ItemStackResponse:
+			for _, resp := range pk.Responses {
+				if resp.RequestID == probeItemStackRequestID {
+					itemStackAnswered, itemStackStatus = true, resp.Status
+				}
+			}
+		case *packet.LevelChunk:
+			chunks++
+			if pk.CacheEnabled {
+				cachedChunks++
+			}
+			subChunkModesSeen[subChunkModes[pk.SubChunkRequestMode]] = true
+		case *packet.ClientCacheMissResponse:
+			cacheResponses++
+		}
+	}
+
+	report.add("blob cache", cachedChunks > 0, "%d of %d chunks sent with blob hashes, %d cache miss responses", cachedChunks, chunks, cacheResponses)
+	movement := gameData.PlayerMovementSettings
+	report.add("server authoritative movement", movement.MovementType != protocol.PlayerMovementModeClient,
+		"%s, rewind history of %d ticks, server authoritative block breaking %v", movementModes[movement.MovementType], movement.RewindHistorySize, movement.ServerAuthoritativeBlockBreaking)
+	detail := "no response to an empty item stack request"
+	if itemStackAnswered {
+		detail = fmt.Sprintf("empty item stack request answered with status %d", itemStackStatus)
+	}
+	report.add("item stack net manager", gameData.ServerAuthoritativeInventory || itemStackAnswered, "server authoritative inventory %v, %s", gameData.ServerAuthoritativeInventory, detail)
+	modes := make([]string, 0, len(subChunkModesSeen))
+	for mode := range subChunkModesSeen {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	report.add("sub-chunk requests", subChunkModesSeen["limitless"] || subChunkModesSeen["limited"], "chunk modes seen: %s", strings.Join(modes, ", "))
+	report.add("client side generation", gameData.ClientSideGeneration, "")
+	if chunkRadius >= 0 {
+		report.add("chunk radius", true, "requested %d, granted %d", probeChunkRadius, chunkRadius)
+	} else {
+		report.add("chunk radius", false, "no ChunkRadiusUpdated in response to a request of %d", probeChunkRadius)
+	}
+	report.add("network stack latency", latencyAnswered, "")
+	report.add("custom blocks", len(gameData.CustomBlocks) > 0, "%d custom blocks", len(gameData.CustomBlocks))
+	experiments := make([]string, 0, len(gameData.Experiments))
+	for _, e := range gameData.Experiments {
+		if e.Enabled {
+			experiments = append(experiments, e.Name)
+		}
+	}
+	report.add("experiments", len(experiments) > 0, "%s", strings.Join(experiments, ", "))
+	report.add("resource packs", len(conn.ResourcePacks()) > 0, "%d packs", len(conn.ResourcePacks()))
+	return report, nil
+}
+
+// runProbe runs the probe subcommand, which connects to a server as a bot and prints a capability report listing
+// the optional protocol features it supports.
+func runProbe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	tokenFile := fs.String("token", "token.tok", "File the Live token is cached in")
+	duration := fs.Duration("duration", time.Second*15, "Time to observe the server for after spawning")
+	out := fs.String("o", "", "File to write the report to as JSON, in addition to printing it")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: probe [-token file] [-duration 15s] [-o report.json] <host:port>")
+	}
+	addr := fs.Arg(0)
+	if !strings.Contains(addr, ":") {
+		addr += ":19132"
+	}
+	src, err := deviceCodeProvider{path: *tokenFile}.TokenSource()
+	if err != nil {
+		return err
+	}
+	report, err := probeServer(addr, src, *duration)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: %s (%s, protocol %d), ping %.1fms, spawned in %.0fms\n", report.Server, report.Status.MOTD,
+		report.Status.Version, report.Status.Protocol, report.PingMS, report.SpawnMS)
+	for _, f := range report.Features {
+		mark := "no "
+		if f.Supported {
+			mark = "yes"
+		}
+		log.Printf("  %-3s %-30s %s\n", mark, f.Name, f.Detail)
+	}
+	if *out == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*out, b, 0644)
+}
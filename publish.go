@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// publisher publishes messages to a topic of a message broker.
+type publisher interface {
+	publish(topic string, payload []byte) error
+}
+
+// packetPublisher publishes packet events to a message broker. Events are published asynchronously so that a
+// slow broker does not slow down the proxy. Events are dropped if the broker can't keep up.
+type packetPublisher struct {
+	pub    publisher
+	prefix string
+	// perGroup specifies if events are published to one topic per packet group instead of one per direction.
+	perGroup bool
+
+	queue   chan packetEvent
+	dropped atomic.Int64
+}
+
+// newPacketPublisher creates a packetPublisher and starts publishing events added to it.
+func newPacketPublisher(pub publisher, prefix string, perGroup bool) *packetPublisher {
+	p := &packetPublisher{pub: pub, prefix: prefix, perGroup: perGroup, queue: make(chan packetEvent, 4096)}
+	go p.run()
+	return p
+}
+
+// handlePacket queues a packet event to be published. It may be passed to addPacketListener.
+func (p *packetPublisher) handlePacket(e packetEvent) {
+	select {
+	case p.queue <- e:
+	default:
+		if p.dropped.Add(1)%1000 == 1 {
+			log.Printf("Publisher can't keep up, %d packet events dropped so far\n", p.dropped.Load())
+		}
+	}
+}
+
+// run publishes events from the queue until the program ends. Events are published to the topic of their
+// direction, or to the topic of every packet group their packet is in, such as prefix.movement, and to
+// prefix.other if it is in none.
+func (p *packetPublisher) run() {
+	for e := range p.queue {
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Unable to encode %s for publishing: %v\n", e.Name, err)
+			continue
+		}
+		topics := []string{e.Direction}
+		if p.perGroup {
+			if topics = groupsOfPacket(e.Name); len(topics) == 0 {
+				topics = []string{"other"}
+			}
+		}
+		for _, topic := range topics {
+			if err := p.pub.publish(p.prefix+"."+topic, b); err != nil {
+				log.Printf("Unable to publish %s: %v\n", e.Name, err)
+			}
+		}
+	}
+}
+
+// kafkaPublisher is a publisher writing messages to Kafka topics.
+type kafkaPublisher struct {
+	w *kafka.Writer
+}
+
+// newKafkaPublisher creates a kafkaPublisher writing to the brokers passed.
+func newKafkaPublisher(brokers []string) *kafkaPublisher {
+	return &kafkaPublisher{w: &kafka.Writer{
+		Addr:                   kafka.TCP(brokers...),
+		Balancer:               &kafka.LeastBytes{},
+		AllowAutoTopicCreation: true,
+		Async:                  true,
+		BatchTimeout:           time.Millisecond * 50,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Printf("Unable to publish %d messages to Kafka: %v\n", len(messages), err)
+			}
+		},
+	}}
+}
+
+// publish ...
+func (p *kafkaPublisher) publish(topic string, payload []byte) error {
+	return p.w.WriteMessages(context.Background(), kafka.Message{Topic: topic, Value: payload})
+}
+
+// natsPublisher is a publisher writing messages to NATS subjects using the NATS client protocol.
+type natsPublisher struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// newNATSPublisher creates a natsPublisher publishing to the NATS server at the address passed.
+func newNATSPublisher(addr string) *natsPublisher {
+	return &natsPublisher{addr: addr}
+}
+
+// connect connects to the NATS server. The publisher must be locked.
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.addr, time.Second*5)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	info, err := r.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO") {
+		_ = conn.Close()
+		return fmt.Errorf("unexpected greeting from NATS server: %q", info)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if _, err := conn.Write([]byte(`CONNECT {"verbose":false,"pedantic":false,"name":"bds-mitm"}` + "\r\n")); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.conn, p.w = conn, bufio.NewWriter(conn)
+	go p.handleServer(conn, r)
+	return nil
+}
+
+// handleServer answers pings of the NATS server and logs errors it sends until the connection is closed.
+func (p *natsPublisher) handleServer(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			p.mu.Lock()
+			if p.conn == conn {
+				p.conn, p.w = nil, nil
+			}
+			p.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			p.mu.Lock()
+			_, _ = conn.Write([]byte("PONG\r\n"))
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server reported an error: %s\n", strings.TrimSpace(line))
+		}
+	}
+}
+
+// publish ...
+func (p *natsPublisher) publish(topic string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	_, _ = fmt.Fprintf(p.w, "PUB %s %d\r\n", topic, len(payload))
+	_, _ = p.w.Write(payload)
+	_, _ = p.w.WriteString("\r\n")
+	if err := p.w.Flush(); err != nil {
+		_ = p.conn.Close()
+		p.conn, p.w = nil, nil
+		return err
+	}
+	return nil
+}
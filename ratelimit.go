@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logRateLimit is the maximum amount of log lines per second written to the console for a single packet type,
+// or 0 to not limit log lines. Log sinks always receive all lines.
+var logRateLimit = 20
+
+// logRates holds the amount of log lines written and suppressed in the current second, indexed by the name of
+// the packet they describe.
+var logRates = struct {
+	sync.Mutex
+	m map[string]*logRate
+}{m: map[string]*logRate{}}
+
+// logRate holds the log lines of a packet type written in the current window and those suppressed since the
+// last summary.
+type logRate struct {
+	window     time.Time
+	count      int
+	suppressed int
+}
+
+// consoleRateAllowed checks if a log entry may be written to the console without exceeding the rate limit of
+// the packet it describes. Suppressed entries are counted and summarised by logRateSummaries.
+func consoleRateAllowed(e logEntry) bool {
+	name, ok := e.fields["packet"]
+	if !ok || logRateLimit <= 0 {
+		return true
+	}
+	logRates.Lock()
+	defer logRates.Unlock()
+	rate, ok := logRates.m[name]
+	if !ok {
+		rate = &logRate{}
+		logRates.m[name] = rate
+	}
+	if e.time.Sub(rate.window) >= time.Second {
+		rate.window, rate.count = e.time, 0
+	}
+	if rate.count >= logRateLimit {
+		rate.suppressed++
+		return false
+	}
+	rate.count++
+	return true
+}
+
+// logRateSummaries logs a summary of the log lines suppressed by the rate limit every second, so that it is
+// clear that a packet storm is occurring.
+func logRateSummaries() {
+	for range time.Tick(time.Second) {
+		logRates.Lock()
+		suppressed := map[string]int{}
+		for name, rate := range logRates.m {
+			if rate.suppressed > 0 {
+				suppressed[name] = rate.suppressed
+				rate.suppressed = 0
+			}
+		}
+		logRates.Unlock()
+
+		names := make([]string, 0, len(suppressed))
+		for name := range suppressed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			log.Printf("Suppressed %d similar %s log lines\n", suppressed[name], name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// rawForwarding specifies if packets are relayed and recorded as the bytes received, without being decoded. Only
+// the header of a packet is read to find its ID, so that the proxy adds little latency when the server streams
+// many chunks. Handlers and packet logging are skipped, and packet listeners receive events without a decoded
+// packet. Recordings hold the payloads exactly as received and are decoded afterwards by the export and replay
+// subcommands.
+var rawForwarding bool
+
+// rawReadSize is the size of the buffer packets are read into in raw mode. A connection returns an error and
+// discards a packet larger than the buffer passed to Read, so the buffer holds the largest packet a server sends,
+// such as those of the crafting and creative inventory registries. A session is closed if a packet still does not
+// fit, as relaying the packets after it would leave the client out of sync.
+const rawReadSize = 16 << 20
+
+// rawBufferTooSmall checks if the error passed was returned by a read into a buffer smaller than the packet read.
+// The connection discards the packet in that case, so it can't be read again.
+func rawBufferTooSmall(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "read" && strings.Contains(opErr.Err.Error(), "larger than the buffer")
+}
+
+// checkRawOptions returns an error if any of the options passed is set in raw mode. The options are those that
+// need decoded packets.
+func checkRawOptions(options map[string]bool) error {
+	if !rawForwarding {
+		return nil
+	}
+	for name, set := range options {
+		if set {
+			return fmt.Errorf("-%s needs decoded packets and can't be used with -raw", name)
+		}
+	}
+	return nil
+}
+
+// readRaw reads packets from the client, or from the server if fromServer is true, and adds them to the queue of
+// the other side without decoding them, until the connection is closed. Suppression and the chaos rules that
+// only depend on the name of a packet still apply.
+func (s *session) readRaw(fromServer bool) {
+	src, q, stats, recent := s.client, s.serverQueue, &s.serverbound, &s.serverboundRecent
+	direction := "serverbound"
+	if fromServer {
+		src, q, stats, recent = s.server, s.clientQueue, &s.clientbound, &s.clientboundRecent
+		direction = "clientbound"
+	}
+	buf := make([]byte, rawReadSize)
+	for {
+		n, err := src.Read(buf)
+		if err != nil && rawBufferTooSmall(err) {
+			log.Printf("Closing session %d: received a %s packet larger than %d bytes, which can't be relayed in raw mode\n", s.id, direction, rawReadSize)
+			s.close(fmt.Errorf("%s packet larger than %d bytes: %w", direction, rawReadSize, err))
+			return
+		}
+		if err != nil {
+			if fromServer {
+				s.upstreamLost(err)
+			}
+			s.close(err)
+			return
+		}
+		received := time.Now()
+		if !fromServer && s.packetRateExceeded(received) {
+			log.Printf("Closing session %d: client exceeded %d packets per second\n", s.id, gatewayPacketRate)
+			s.close(fmt.Errorf("rate limit: %w", minecraft.DisconnectError("You are sending packets too fast.")))
+			return
+		}
+		// The buffer is reused for the next packet, so the packet is copied before it is queued.
+		data := append([]byte(nil), buf[:n]...)
+		r := bytes.NewReader(data)
+		var h packet.Header
+		if err := h.Read(r); err != nil {
+			log.Printf("Dropping a packet of session %d without a valid header: %v\n", s.id, err)
+			continue
+		}
+		payload := data[len(data)-r.Len():]
+		name := packetName(h.PacketID)
+		observePacket(name, !fromServer)
+
+		e := packetEvent{Time: received, Session: s.id, Direction: direction, Name: name, ID: h.PacketID, Size: len(payload)}
+		if !payloadRedacted(name) {
+			e.Raw = payload
+		}
+		recent.add(e)
+		if len(packetListeners) > 0 {
+			notifyPacketListeners(e)
+		}
+		stats.packets.Add(1)
+		stats.bytes.Add(int64(len(payload)))
+		if fromServer {
+			if _, ok := registryPackets[name]; ok {
+				// Registry packets are only sent once per session, so decoding them costs little.
+				if pk, err := decodePacket(h.PacketID, payload, shieldID(s.server.GameData())); err == nil {
+					s.hashRegistryPacket(name, pk)
+				}
+			}
+		}
+		if fromServer && packetSuppressed(name) {
+			stats.suppressed.Add(1)
+			continue
+		}
+		copies, delay := chaosOutcome(name, direction)
+		if copies == 0 {
+			stats.chaosDropped.Add(1)
+			continue
+		}
+		stats.chaosDuplicated.Add(int64(copies - 1))
+		for i := 0; i < copies; i++ {
+			if err := q.push(queuedPacket{raw: data, size: int64(len(payload)), droppable: droppablePackets[name], delay: delay, name: name, received: received}); err != nil {
+				log.Printf("Closing session %d: %v\n", s.id, err)
+				s.close(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordDir is the directory that recordings of sessions are written to.
+var recordDir = "captures"
+
+// recordSelectors holds the players whose sessions are recorded from the start, by display name or XUID, or * to
+// record all sessions.
+var recordSelectors = map[string]bool{}
+
+// recordMaxSize and recordMaxAge are the size in bytes and the age after which the recording of a session is
+// continued in a new file, or 0 to never split recordings by size or age.
+var (
+	recordMaxSize int64
+	recordMaxAge  time.Duration
+)
+
+// recordBufferSize is the size of the buffer that records are written to before they are written to the file of a
+// recording.
+const recordBufferSize = 64 << 10
+
+// recordSelection holds the packets written to recordings, or nil to record all packets. Recording only some
+// packets, such as @inventory, keeps captures small when only a specific kind of traffic is investigated.
+var recordSelection *packetSelection
+
+// recordLogged specifies if the packets that are not hidden from logging by the filters are recorded, so that
+// recordings contain the same packets as the log.
+var recordLogged bool
+
+// sessionRecording is a capture of every packet of a session. If recordings are split by size or age, the capture
+// consists of multiple segments linked by a manifest.
+type sessionRecording struct {
+	// base is the path of the recording without extension, which the paths of segments and the manifest are
+	// derived from.
+	base string
+	path string
+	f    *os.File
+	// w buffers the records written to f, so that writing a record does not cost a write to the file while the
+	// session recordings are locked.
+	w        *bufio.Writer
+	enc      *capture.Encoder
+	header   capture.Header
+	shieldID int32
+	records  int
+
+	opened   time.Time
+	manifest capture.Manifest
+}
+
+// sessionRecordings holds the recordings of sessions, indexed by session ID. Sessions that were checked against
+// the record selectors but are not recorded hold a nil recording, so that they are not checked again.
+var sessionRecordings = struct {
+	sync.Mutex
+	m map[int64]*sessionRecording
+}{m: map[int64]*sessionRecording{}}
+
+// recordingMemory returns an estimate of the memory held by the recording of the session with the ID passed in
+// bytes, or 0 if the session is not being recorded.
+func recordingMemory(id int64) int64 {
+	sessionRecordings.Lock()
+	defer sessionRecordings.Unlock()
+	r := sessionRecordings.m[id]
+	if r == nil {
+		return 0
+	}
+	return int64(r.w.Size() + r.enc.MemoryUsage())
+}
+
+// parseRecordSelectors parses the comma separated list of players passed to -record.
+func parseRecordSelectors(list string) {
+	for _, player := range strings.Split(list, ",") {
+		if player = strings.TrimSpace(player); player != "" {
+			recordSelectors[strings.ToLower(player)] = true
+		}
+	}
+}
+
+// parseRecordPackets parses the comma separated list of packets, wildcards and @groups passed to -record-packets.
+// The entry logged selects the packets not hidden by the log filters.
+func parseRecordPackets(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		switch entry = strings.TrimSpace(entry); entry {
+		case "":
+		case "logged":
+			recordLogged = true
+		default:
+			if recordSelection == nil {
+				recordSelection = newPacketSelection()
+			}
+			if err := recordSelection.add(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// packetRecorded checks if a packet with the name passed, sent by the server if fromServer is true, is written to
+// recordings. A packet is recorded if it is selected with -record-packets or, if logged packets are recorded, if
+// it is not filtered from logging. Without -record-packets, all packets are recorded.
+func packetRecorded(name string, fromServer bool) bool {
+	if recordSelection != nil && recordSelection.contains(name) {
+		return true
+	}
+	if recordLogged {
+		return !packetFiltered(name, fromServer)
+	}
+	return recordSelection == nil
+}
+
+// recordedFromStart checks if the session passed is selected to be recorded from its first packet.
+func recordedFromStart(s *session) bool {
+	identity := s.client.IdentityData()
+	return recordSelectors["*"] || recordSelectors[strings.ToLower(identity.DisplayName)] || identity.XUID != "" && recordSelectors[identity.XUID]
+}
+
+// recordPacket writes the packet event passed to the recording of its session. Sessions matching the record
+// selectors start being recorded on their first packet.
+func recordPacket(e packetEvent) {
+	sessionRecordings.Lock()
+	defer sessionRecordings.Unlock()
+	r, ok := sessionRecordings.m[e.Session]
+	if !ok {
+		s, found := sessionByID(e.Session)
+		if !found {
+			return
+		}
+		if recordedFromStart(s) {
+			var err error
+			if r, err = startRecording(s, e.Time); err != nil {
+				log.Printf("An error occurred whilst starting the recording of session %d: %v\n", e.Session, err)
+			} else {
+				log.Printf("Recording session %d to %s\n", e.Session, r.path)
+			}
+		}
+		sessionRecordings.m[e.Session] = r
+	}
+	if r == nil || !packetRecorded(e.Name, e.Direction == "clientbound") {
+		return
+	}
+	direction := capture.DirectionServerbound
+	if e.Direction == "clientbound" {
+		direction = capture.DirectionClientbound
+	}
+	if recordMaxSize > 0 && r.enc.Written() >= recordMaxSize || recordMaxAge > 0 && e.Time.Sub(r.opened) >= recordMaxAge {
+		// The segment is only split when the next packet arrives, so that no empty segment is left behind when
+		// the session closes.
+		if err := r.rotate(e.Time); err != nil {
+			log.Printf("An error occurred whilst splitting the recording of session %d: %v\n", e.Session, err)
+			finishRecording(e.Session, r)
+			sessionRecordings.m[e.Session] = nil
+			return
+		}
+	}
+	payload := e.Raw
+	if e.Packet != nil {
+		payload = encodePacket(e.Packet, r.shieldID)
+	}
+	err := r.enc.Encode(capture.Record{
+		TimeUnixNano: e.Time.UnixNano(),
+		Session:      uint64(e.Session),
+		Direction:    direction,
+		PacketID:     e.ID,
+		PacketName:   e.Name,
+		Payload:      payload,
+	})
+	if err != nil {
+		log.Printf("An error occurred whilst writing the recording of session %d: %v\n", e.Session, err)
+		finishRecording(e.Session, r)
+		sessionRecordings.m[e.Session] = nil
+		return
+	}
+	r.records++
+	r.track(e.Time)
+}
+
+// splitRecordings checks if recordings are split into segments.
+func splitRecordings() bool {
+	return recordMaxSize > 0 || recordMaxAge > 0
+}
+
+// startRecording creates a recording file for the session passed.
+func startRecording(s *session, start time.Time) (*sessionRecording, error) {
+	if aggregateFile != "" {
+		return nil, errors.New("sessions are not recorded in aggregate-only mode")
+	}
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		return nil, err
+	}
+	r := &sessionRecording{
+		base: filepath.Join(recordDir, fmt.Sprintf("record-session-%d-%s", s.id, start.Format("20060102-150405"))),
+		header: capture.Header{
+			Upstream:         s.upstream,
+			Protocol:         protocol.CurrentProtocol,
+			MinecraftVersion: protocol.CurrentVersion,
+			DedupMinSize:     uint32(captureDedupMinSize),
+		},
+		shieldID: shieldID(s.server.GameData()),
+		manifest: capture.Manifest{Session: uint64(s.id), Upstream: s.upstream},
+	}
+	if err := r.openSegment(start); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openSegment creates the file of the next segment of the recording. The first segment is named after the
+// recording itself, and later segments have their number appended, such as record-session-1-<time>.2.bdscap.
+func (r *sessionRecording) openSegment(start time.Time) error {
+	path := r.base + ".bdscap"
+	if n := len(r.manifest.Segments); n > 0 {
+		path = fmt.Sprintf("%s.%d.bdscap", r.base, n+1)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := r.header
+	h.CreatedUnixNano = start.UnixNano()
+	w := bufio.NewWriterSize(f, recordBufferSize)
+	enc, err := capture.NewEncoder(w, h)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.path, r.f, r.w, r.enc, r.opened = path, f, w, enc, start
+	r.manifest.Segments = append(r.manifest.Segments, capture.Segment{File: filepath.Base(path)})
+	return nil
+}
+
+// track updates the segment currently written after a record at the time passed was written to it.
+func (r *sessionRecording) track(t time.Time) {
+	seg := &r.manifest.Segments[len(r.manifest.Segments)-1]
+	if seg.Records == 0 {
+		seg.FirstUnixNano = t.UnixNano()
+	}
+	seg.LastUnixNano, seg.Bytes = t.UnixNano(), r.enc.Written()
+	seg.Records++
+}
+
+// closeSegment flushes the records buffered and closes the segment currently written.
+func (r *sessionRecording) closeSegment() error {
+	if err := r.w.Flush(); err != nil {
+		_ = r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// rotate closes the segment currently written and continues the recording in a new segment.
+func (r *sessionRecording) rotate(t time.Time) error {
+	if err := r.closeSegment(); err != nil {
+		return err
+	}
+	if err := r.openSegment(t); err != nil {
+		return err
+	}
+	log.Printf("Recording of session %d continues in %s\n", r.manifest.Session, r.path)
+	return capture.WriteManifest(r.base+capture.ManifestSuffix, r.manifest)
+}
+
+// finishRecording closes the recording passed of a session. The session recordings must be locked.
+func finishRecording(session int64, r *sessionRecording) {
+	delete(sessionRecordings.m, session)
+	if err := r.closeSegment(); err != nil {
+		log.Printf("An error occurred whilst closing the recording of session %d: %v\n", session, err)
+		return
+	}
+	if !splitRecordings() {
+		log.Printf("Recording of session %d finished: wrote %d packets to %s\n", session, r.records, r.path)
+		return
+	}
+	manifest := r.base + capture.ManifestSuffix
+	if err := capture.WriteManifest(manifest, r.manifest); err != nil {
+		log.Printf("An error occurred whilst writing the manifest of the recording of session %d: %v\n", session, err)
+		return
+	}
+	log.Printf("Recording of session %d finished: wrote %d packets to %d files listed in %s\n", session, r.records, len(r.manifest.Segments), manifest)
+}
+
+// markRecordings inserts a mark with the text passed into the recordings of all sessions being recorded, so that
+// the moment can be found again when the capture is analysed. It returns the amount of recordings marked.
+func markRecordings(text string, t time.Time) int {
+	sessionRecordings.Lock()
+	defer sessionRecordings.Unlock()
+	var n int
+	for id, r := range sessionRecordings.m {
+		if r == nil {
+			continue
+		}
+		if err := r.enc.Encode(capture.Record{TimeUnixNano: t.UnixNano(), Session: uint64(id), Annotation: text}); err != nil {
+			log.Printf("An error occurred whilst marking the recording of session %d: %v\n", id, err)
+			continue
+		}
+		r.records++
+		r.track(t)
+		n++
+	}
+	return n
+}
+
+func init() {
+	addPacketListener(recordPacket)
+	addSessionCloseListener(func(id int64) {
+		sessionRecordings.Lock()
+		if r := sessionRecordings.m[id]; r != nil {
+			finishRecording(id, r)
+		}
+		delete(sessionRecordings.m, id)
+		sessionRecordings.Unlock()
+	})
+	registerCommand("mark", consoleCommand{
+		usage:       "<text>",
+		description: "Inserts a mark with the text passed into the log and the recordings of all sessions being recorded.",
+		run: func(args []string) {
+			text := strings.TrimSpace(strings.Join(args, " "))
+			if text == "" {
+				log.Println("Usage: mark <text>")
+				return
+			}
+			n := markRecordings(text, time.Now())
+			logf(logFields{"mark": text}, "Mark: %s (added to %d recordings)\n", text, n)
+		},
+	})
+	const usage = "Usage: record [session ID] [stop]"
+	registerCommand("record", consoleCommand{
+		usage:       "[session ID] [stop]",
+		description: "Lists the sessions being recorded, or starts or stops recording every packet of a session.",
+		run: func(args []string) {
+			sessionRecordings.Lock()
+			defer sessionRecordings.Unlock()
+			if len(args) == 0 {
+				ids := make([]int64, 0, len(sessionRecordings.m))
+				for id, r := range sessionRecordings.m {
+					if r != nil {
+						ids = append(ids, id)
+					}
+				}
+				if len(ids) == 0 {
+					log.Println("No sessions are being recorded.")
+					return
+				}
+				sort.Slice(ids, func(i, j int) bool {
+					return ids[i] < ids[j]
+				})
+				for _, id := range ids {
+					r := sessionRecordings.m[id]
+					log.Printf("#%d: %d packets to %s\n", id, r.records, r.path)
+				}
+				return
+			}
+			id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+			if err != nil || len(args) > 2 || len(args) == 2 && args[1] != "stop" {
+				log.Println(usage)
+				return
+			}
+			r := sessionRecordings.m[id]
+			if len(args) == 2 {
+				if r == nil {
+					log.Printf("Session %d is not being recorded.\n", id)
+					return
+				}
+				finishRecording(id, r)
+				sessionRecordings.m[id] = nil
+				return
+			}
+			if r != nil {
+				log.Printf("Session %d is already being recorded to %s.\n", id, r.path)
+				return
+			}
+			s, ok := sessionByID(id)
+			if !ok {
+				log.Printf("No session with ID %d.\n", id)
+				return
+			}
+			if r, err = startRecording(s, time.Now()); err != nil {
+				log.Printf("An error occurred whilst starting the recording of session %d: %v\n", id, err)
+				return
+			}
+			sessionRecordings.m[id] = r
+			log.Printf("Recording session %d to %s\n", id, r.path)
+		},
+	})
+}
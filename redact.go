@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// redactionRule masks or truncates a field of a packet in logs.
+type redactionRule struct {
+	// packet is the name of the packet the rule applies to, or * for all packets.
+	packet string
+	// path holds the names of the fields leading to the field redacted, such as Entries and XUID. Slices are
+	// descended into element by element.
+	path []string
+	// action is mask, hash or truncate.
+	action string
+	// length is the amount of bytes kept by truncate.
+	length int
+}
+
+// redactionRules holds the redaction rules applied to packets before they are logged.
+var redactionRules = struct {
+	sync.RWMutex
+	rules []redactionRule
+}{}
+
+// addRedactionRules parses a comma separated list of redaction rules in the format Packet.Field[.Field]=action and
+// adds them to the state. Actions are mask to replace a field with its zero value or ***, hash to replace a string by a short
+// hash of it so that values may still be correlated, and truncate:n to keep only the first n bytes. The packet may
+// be * to redact the field in all packets holding a field at that path, such as *.XUID=mask.
+func (st *logFilterState) addRedactionRules(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		rule, err := parseRedactionRule(entry)
+		if err != nil {
+			return err
+		}
+		st.redactions = append(st.redactions, rule)
+	}
+	return nil
+}
+
+// parseRedactionRule parses a single redaction rule.
+func parseRedactionRule(entry string) (redactionRule, error) {
+	target, action, ok := strings.Cut(entry, "=")
+	if !ok {
+		action = "mask"
+	}
+	parts := strings.Split(target, ".")
+	if len(parts) < 2 {
+		return redactionRule{}, fmt.Errorf("redaction rule %q: expected Packet.Field=action", entry)
+	}
+	if parts[0] != "*" && !packetKnown(parts[0]) {
+		return redactionRule{}, fmt.Errorf("redaction rule %q: unknown packet %q", entry, parts[0])
+	}
+	rule := redactionRule{packet: parts[0], path: parts[1:], action: action}
+	if n, found := strings.CutPrefix(action, "truncate:"); found {
+		length, err := strconv.Atoi(n)
+		if err != nil || length < 0 {
+			return redactionRule{}, fmt.Errorf("redaction rule %q: invalid length %q", entry, n)
+		}
+		rule.action, rule.length = "truncate", length
+	} else if action != "mask" && action != "hash" {
+		return redactionRule{}, fmt.Errorf("redaction rule %q: invalid action %q: expected mask, hash or truncate:n", entry, action)
+	}
+	return rule, nil
+}
+
+// redactPacket returns a copy of the packet passed with all redaction rules applying to it applied, or the packet
+// itself if no rules apply. The packet passed is never modified, as it is still forwarded.
+func redactPacket(name string, pk packet.Packet) packet.Packet {
+	redactionRules.RLock()
+	defer redactionRules.RUnlock()
+	v := reflect.ValueOf(pk)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return pk
+	}
+	var cp reflect.Value
+	for _, rule := range redactionRules.rules {
+		if rule.packet != "*" && rule.packet != name {
+			continue
+		}
+		if !cp.IsValid() {
+			cp = reflect.New(v.Elem().Type())
+			cp.Elem().Set(v.Elem())
+		}
+		redactValue(cp.Elem(), rule.path, rule)
+	}
+	if !cp.IsValid() {
+		return pk
+	}
+	return cp.Interface().(packet.Packet)
+}
+
+// redactValue applies a redaction rule to the field at the path passed in v, which must be settable. Slices and
+// pointers on the path are copied before they are modified, so that values shared with the original packet are
+// not modified.
+func redactValue(v reflect.Value, path []string, rule redactionRule) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		cp := reflect.New(v.Elem().Type())
+		cp.Elem().Set(v.Elem())
+		v.Set(cp)
+		redactValue(cp.Elem(), path, rule)
+		return
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 || len(path) == 0 {
+			break
+		}
+		cp := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(cp, v)
+		v.Set(cp)
+		for i := 0; i < cp.Len(); i++ {
+			redactValue(cp.Index(i), path, rule)
+		}
+		return
+	}
+	if len(path) > 0 {
+		if v.Kind() != reflect.Struct {
+			return
+		}
+		if field := v.FieldByName(path[0]); field.IsValid() && field.CanSet() {
+			redactValue(field, path[1:], rule)
+		}
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		switch rule.action {
+		case "mask":
+			v.SetString("***")
+		case "hash":
+			sum := sha256.Sum256([]byte(s))
+			v.SetString("sha256:" + hex.EncodeToString(sum[:6]))
+		case "truncate":
+			if len(s) > rule.length {
+				v.SetString(fmt.Sprintf("%s...(%d bytes)", s[:rule.length], len(s)))
+			}
+		}
+	case reflect.Slice:
+		if rule.action == "truncate" && v.Len() > rule.length {
+			v.Set(v.Slice(0, rule.length))
+		} else if rule.action != "truncate" {
+			v.Set(reflect.Zero(v.Type()))
+		}
+	default:
+		v.Set(reflect.Zero(v.Type()))
+	}
+}
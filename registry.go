@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// registryDir is the directory that login-phase data of sessions is stored in, deduplicated by its hash. If
+// empty, the data is hashed but not stored.
+var registryDir string
+
+// registryPackets holds the packets sent by the server during the login phase that describe the configuration
+// of the server, indexed by their name and mapped to the name of the component they are hashed as.
+var registryPackets = map[string]string{
+	getType(&packet.AvailableCommands{}, false):   "commands",
+	getType(&packet.CraftingData{}, false):        "recipes",
+	getType(&packet.BiomeDefinitionList{}, false): "biomes",
+	getType(&packet.CreativeContent{}, false):     "creative",
+}
+
+// sessionHashes holds the hashes of the login-phase data of a session, indexed by the name of the component.
+type sessionHashes struct {
+	sync.Mutex
+	m map[string]string
+}
+
+// hashGameData hashes the parts of the game data that describe the configuration of the server, leaving out
+// data specific to the player such as its position.
+func (s *session) hashGameData(data minecraft.GameData) {
+	s.hashComponent("items", data.Items)
+	s.hashComponent("blocks", data.CustomBlocks)
+	s.hashComponent("game", struct {
+		BaseGameVersion              string
+		WorldGameMode                int32
+		Difficulty                   int32
+		GameRules                    interface{}
+		Experiments                  interface{}
+		PlayerMovementSettings       interface{}
+		ServerAuthoritativeInventory bool
+		ServerBlockStateChecksum     uint64
+	}{
+		data.BaseGameVersion, data.WorldGameMode, data.Difficulty, data.GameRules, data.Experiments,
+		data.PlayerMovementSettings, data.ServerAuthoritativeInventory, data.ServerBlockStateChecksum,
+	})
+}
+
+// hashRegistryPacket hashes the packet passed if it holds login-phase data describing the server.
+func (s *session) hashRegistryPacket(name string, pk packet.Packet) {
+	if component, ok := registryPackets[name]; ok {
+		s.hashComponent(component, pk)
+	}
+}
+
+// hashComponent computes a deterministic hash of the value passed and stores it as the hash of a component of
+// the login-phase data. The value is encoded as JSON, which sorts map keys, so that equal data always results
+// in the same hash.
+func (s *session) hashComponent(component string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Unable to hash %s of session %d: %v\n", component, s.id, err)
+		return
+	}
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+
+	s.hashes.Lock()
+	if s.hashes.m == nil {
+		s.hashes.m = map[string]string{}
+	}
+	s.hashes.m[component] = hash
+	s.hashes.Unlock()
+	s.checkRegistryChange(component, hash, b)
+
+	if registryDir == "" {
+		return
+	}
+	path := filepath.Join(registryDir, hash+".json")
+	if _, err := os.Stat(path); err == nil {
+		// Identical data was already stored by an earlier session.
+		return
+	}
+	if err := os.MkdirAll(registryDir, 0755); err != nil {
+		log.Printf("Unable to store %s of session %d: %v\n", component, s.id, err)
+		return
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		log.Printf("Unable to store %s of session %d: %v\n", component, s.id, err)
+	}
+}
+
+// componentHashes returns a copy of the hashes of the login-phase data of the session.
+func (s *session) componentHashes() map[string]string {
+	s.hashes.Lock()
+	defer s.hashes.Unlock()
+	m := make(map[string]string, len(s.hashes.m))
+	for k, v := range s.hashes.m {
+		m[k] = v
+	}
+	return m
+}
+
+// storeSessionHashes appends the hashes of the session to the session index of the registry directory.
+func (s *session) storeSessionHashes() {
+	if registryDir == "" {
+		return
+	}
+	b, _ := json.Marshal(struct {
+		Session  int64             `json:"session"`
+		Started  time.Time         `json:"started"`
+		Upstream string            `json:"upstream"`
+		Hashes   map[string]string `json:"hashes"`
+	}{s.id, s.started, s.upstream, s.componentHashes()})
+	f, err := os.OpenFile(filepath.Join(registryDir, "sessions.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Unable to store hashes of session %d: %v\n", s.id, err)
+		return
+	}
+	_, _ = f.Write(append(b, '\n'))
+	_ = f.Close()
+}
+
+func init() {
+	registerCommand("hashes", consoleCommand{
+		usage:       "[session]",
+		description: "Shows the hashes of the login-phase data of sessions.",
+		run: func(args []string) {
+			for _, s := range activeSessions() {
+				if len(args) > 0 && args[0] != strconv.FormatInt(s.id, 10) {
+					continue
+				}
+				hashes := s.componentHashes()
+				components := make([]string, 0, len(hashes))
+				for component := range hashes {
+					components = append(components, component)
+				}
+				sort.Strings(components)
+				log.Printf("#%d %s:\n", s.id, s.client.IdentityData().DisplayName)
+				for _, component := range components {
+					log.Printf("    %-10s %s\n", component, hashes[component])
+				}
+			}
+		},
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// knownRegistries holds the last known hash of each component of the login-phase data of each upstream server,
+// indexed by the address of the server and the name of the component. It is persisted in the registry directory
+// so that changes are also detected across restarts of the proxy.
+var knownRegistries = struct {
+	sync.Mutex
+	loaded bool
+	m      map[string]map[string]string
+	// data holds the encoded data of components, indexed by their hash, for when no registry directory is set.
+	data map[string][]byte
+}{m: map[string]map[string]string{}, data: map[string][]byte{}}
+
+// registryNameFields holds the JSON paths of the names of entries of components of the login-phase data, used to
+// report which entries were added or removed when a component changes.
+var registryNameFields = map[string][2]string{
+	"items":    {"", "Name"},
+	"blocks":   {"", "Name"},
+	"commands": {"Commands", "Name"},
+	"creative": {"Items", "CreativeItemNetworkID"},
+}
+
+// checkRegistryChange compares the hash of a component of the login-phase data of a session with the hash last
+// seen for the same upstream server, logging the differences if the server changed since.
+func (s *session) checkRegistryChange(component, hash string, data []byte) {
+	knownRegistries.Lock()
+	defer knownRegistries.Unlock()
+	if !knownRegistries.loaded && registryDir != "" {
+		if b, err := ioutil.ReadFile(filepath.Join(registryDir, "upstreams.json")); err == nil {
+			_ = json.Unmarshal(b, &knownRegistries.m)
+		}
+	}
+	knownRegistries.loaded = true
+
+	hashes, ok := knownRegistries.m[s.upstream]
+	if !ok {
+		hashes = map[string]string{}
+		knownRegistries.m[s.upstream] = hashes
+	}
+	previous := hashes[component]
+	hashes[component] = hash
+	if registryDir == "" {
+		knownRegistries.data[hash] = data
+	} else if b, err := json.Marshal(knownRegistries.m); err == nil {
+		_ = os.MkdirAll(registryDir, 0755)
+		if err := ioutil.WriteFile(filepath.Join(registryDir, "upstreams.json"), b, 0644); err != nil {
+			log.Printf("Unable to store known registries: %v\n", err)
+		}
+	}
+	if previous == "" || previous == hash {
+		return
+	}
+
+	fields := logFields{"session": strconv.FormatInt(s.id, 10), "upstream": s.upstream, "component": component, "previous": previous, "hash": hash}
+	old, ok := knownRegistries.data[previous]
+	if !ok && registryDir != "" {
+		old, _ = ioutil.ReadFile(filepath.Join(registryDir, previous+".json"))
+	}
+	path, ok := registryNameFields[component]
+	if !ok || old == nil {
+		logf(fields, "Upstream %s changed its %s since it was last seen\n", s.upstream, component)
+		return
+	}
+	added, removed := diffNames(registryNames(old, path), registryNames(data, path))
+	fields["added"], fields["removed"] = strings.Join(added, ","), strings.Join(removed, ",")
+	logf(fields, "Upstream %s changed its %s since it was last seen: %d added, %d removed\n", s.upstream, component, len(added), len(removed))
+	if len(added) > 0 {
+		logf(fields, "Added %s: %s\n", component, strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		logf(fields, "Removed %s: %s\n", component, strings.Join(removed, ", "))
+	}
+}
+
+// registryNames returns the names of the entries of a component encoded as JSON. path holds the field holding
+// the list of entries, or an empty string if the component is a list itself, and the field holding the name of
+// an entry.
+func registryNames(data []byte, path [2]string) []string {
+	var entries []map[string]interface{}
+	if path[0] == "" {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			log.Printf("Unable to decode component: %v\n", err)
+		}
+	} else {
+		var m map[string]json.RawMessage
+		_ = json.Unmarshal(data, &m)
+		_ = json.Unmarshal(m[path[0]], &entries)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		b, _ := json.Marshal(entry[path[1]])
+		names = append(names, strings.Trim(string(b), `"`))
+	}
+	return names
+}
+
+// diffNames returns the names present in b but not in a, and those present in a but not in b, sorted.
+func diffNames(a, b []string) (added, removed []string) {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, name := range a {
+		inA[name] = true
+	}
+	for _, name := range b {
+		inB[name] = true
+		if !inA[name] {
+			added = append(added, name)
+		}
+	}
+	for _, name := range a {
+		if !inB[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
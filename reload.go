@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// reloadableFlags are the flags applied again when the configuration is reloaded. They only affect which packets
+// are logged and how, so they can be changed without dropping the sessions of connected clients.
+var reloadableFlags = []string{"filters", "filter", "only", "hexdump", "pretty", "redact", "where", "log-format", "v"}
+
+// reloadState holds what is needed to reload the configuration: the config file, the flags passed on the
+// command line or through environment variables, which take precedence over the config file and are therefore
+// never changed by a reload, and the log file sink, which is reopened so that it may be rotated externally.
+var reloadState struct {
+	sync.Mutex
+	configFile string
+	fixed      map[string]bool
+	logFile    *logFileSink
+}
+
+// setReloadableConfig records the config file and the flags currently set, which are kept when the configuration
+// is reloaded. It must be called before the config file is applied.
+func setReloadableConfig(configFile string) {
+	reloadState.Lock()
+	defer reloadState.Unlock()
+	reloadState.configFile, reloadState.fixed = configFile, map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		reloadState.fixed[f.Name] = true
+	})
+}
+
+// logFilterState holds the filters, hex dumps, pretty printed packets, redaction rules and conditions of logged
+// packets. It is built from the filter flags and filter file and installed at once, so that the filters in use are
+// left untouched if any of them is invalid.
+type logFilterState struct {
+	filters    map[string]filterScope
+	allowlist  bool
+	hexdump    *packetSelection
+	pretty     *packetSelection
+	redactions []redactionRule
+	conditions map[string]conditionEntry
+}
+
+// parseLogFilters builds a logFilterState from the default filters and the values of the filter flags returned by
+// the function passed.
+func parseLogFilters(value func(name string) string) (*logFilterState, error) {
+	st := &logFilterState{
+		filters:    map[string]filterScope{},
+		hexdump:    newPacketSelection(),
+		pretty:     newPacketSelection(),
+		conditions: map[string]conditionEntry{},
+	}
+	for name := range filteredPackets {
+		st.filters[name] = filterBoth
+	}
+	if err := st.loadFilterFile(value("filters")); err != nil {
+		return nil, err
+	}
+	if only := value("only"); only != "" {
+		if err := st.onlyShow(strings.Split(only, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.addFilterEntries(value("filter")); err != nil {
+		return nil, err
+	}
+	if err := st.hexdump.addList(value("hexdump")); err != nil {
+		return nil, err
+	}
+	if err := st.pretty.addList(value("pretty")); err != nil {
+		return nil, err
+	}
+	if err := st.addRedactionRules(value("redact")); err != nil {
+		return nil, err
+	}
+	if err := st.addConditions(value("where")); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// install replaces the filters, hex dumps, pretty printed packets, redaction rules and conditions in use with
+// those of the state.
+func (st *logFilterState) install() {
+	packetFilters.Lock()
+	packetFilters.m = st.filters
+	packetFilters.Unlock()
+	allowlistMode = st.allowlist
+	hexdumpPackets.replace(st.hexdump)
+	prettyPackets.replace(st.pretty)
+	redactionRules.Lock()
+	redactionRules.rules = st.redactions
+	redactionRules.Unlock()
+	packetConditions.Lock()
+	packetConditions.m = st.conditions
+	packetConditions.Unlock()
+}
+
+// applyLogFilters applies the filter flags to the filters, hex dumps, pretty printing, redaction rules and
+// conditions of logged packets.
+func applyLogFilters() error {
+	st, err := parseLogFilters(func(name string) string {
+		return flag.Lookup(name).Value.String()
+	})
+	if err != nil {
+		return err
+	}
+	st.install()
+	return nil
+}
+
+// reloadConfig reads the config file and filter file again and applies the reloadable flags, reopening the log
+// file. Sessions of connected clients are not affected. Flags that are not set by the command line, environment
+// or config file are reset to their defaults, so that removing an option from the config file takes effect.
+func reloadConfig() error {
+	reloadState.Lock()
+	defer reloadState.Unlock()
+	options, err := readConfig(reloadState.configFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("read config %s: %w", reloadState.configFile, err)
+	}
+	flat := map[string]any{}
+	flattenConfig("", options, flat)
+	values := map[string]string{}
+	for _, name := range reloadableFlags {
+		f := flag.Lookup(name)
+		switch v, ok := flat[name]; {
+		case reloadState.fixed[name]:
+			values[name] = f.Value.String()
+		case ok:
+			values[name] = configValue(name, v)
+		default:
+			values[name] = f.DefValue
+		}
+	}
+	if format := values["log-format"]; format != "text" && format != "json" {
+		return fmt.Errorf("invalid log format %q: expected text or json", format)
+	}
+	if err := parseVerbosity(values["v"]); err != nil {
+		return err
+	}
+	// The filters are parsed before any flag is changed, so that an invalid entry leaves the filters and
+	// redaction rules in use in place.
+	filters, err := parseLogFilters(func(name string) string {
+		return values[name]
+	})
+	if err != nil {
+		return err
+	}
+
+	logSinks.Lock()
+	for _, name := range reloadableFlags {
+		if name == "log-format" && streaming {
+			// The stream is always written in JSON.
+			continue
+		}
+		if err := flag.Set(name, values[name]); err != nil {
+			logSinks.Unlock()
+			return fmt.Errorf("option %q: %w", name, err)
+		}
+	}
+	logSinks.Unlock()
+	if logVerbosity == "summary" {
+		startPacketSummaries()
+	}
+	filters.install()
+	if sink := reloadState.logFile; sink != nil {
+		if err := sink.reopen(); err != nil {
+			return fmt.Errorf("reopen log file: %w", err)
+		}
+	}
+	return nil
+}
+
+// reloadConfigAndLog reloads the configuration and logs the result.
+func reloadConfigAndLog() {
+	if err := reloadConfig(); err != nil {
+		log.Printf("Unable to reload the configuration: %v\n", err)
+		return
+	}
+	log.Println("Reloaded the configuration.")
+}
+
+// handleReloadSignal reloads the configuration every time the process receives SIGHUP.
+func handleReloadSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		reloadConfigAndLog()
+	}
+}
+
+func init() {
+	registerCommand("reload", consoleCommand{
+		description: "Reads the config and filter files again and applies the filter and log options without dropping clients.",
+		run: func([]string) {
+			reloadConfigAndLog()
+		},
+	})
+}
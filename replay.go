@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("replay", "Prints the packets of a capture, or plays its clientbound or only its UI packets back to a connecting client", runReplay)
+}
+
+// printCapture prints every record of the capture at the path passed with its decoded payload. The path may be
+// that of a manifest of a capture split into multiple files. Only the records of the packets passed are printed if
+// any are passed. If pretty is true, payloads are printed as indented trees.
+func printCapture(path string, packets map[string]bool, shieldID int32, pretty bool) error {
+	files, err := capture.Files(path)
+	if err != nil {
+		return err
+	}
+	var start int64
+	for _, file := range files {
+		if err := printCaptureFile(file, packets, shieldID, pretty, &start); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// printCaptureFile prints the records of a single capture file. Offsets are printed relative to the start passed,
+// which is set to the time of the first record if it is 0.
+func printCaptureFile(path string, packets map[string]bool, shieldID int32, pretty bool, start *int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec, err := capture.NewDecoder(f)
+	if err != nil {
+		return err
+	}
+	h := dec.Header()
+	log.Printf("Capture of %s (protocol %d, %s) created at %s\n", h.Upstream, h.Protocol, h.MinecraftVersion, time.Unix(0, h.CreatedUnixNano).Format(time.RFC3339))
+	for i := 0; ; i++ {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", i, err)
+		}
+		capture.Migrate(h, &r)
+		if *start == 0 {
+			*start = r.TimeUnixNano
+		}
+		if r.IsAnnotation() {
+			log.Printf("[+%v] #%d Mark: %s\n", time.Duration(r.TimeUnixNano-*start).Round(time.Millisecond), r.Session, r.Annotation)
+			continue
+		}
+		if len(packets) > 0 && !packets[r.PacketName] {
+			continue
+		}
+		direction := "serverbound"
+		if r.Direction == capture.DirectionClientbound {
+			direction = "clientbound"
+		}
+		offset := time.Duration(r.TimeUnixNano - *start).Round(time.Millisecond)
+		log.Printf("[+%v] #%d %s %s (ID %d, %d bytes)\n", offset, r.Session, direction, r.PacketName, r.PacketID, len(r.Payload))
+		pk, err := decodePacket(r.PacketID, r.Payload, shieldID)
+		if err != nil {
+			log.Printf("  Unable to decode payload: %v\n", err)
+			continue
+		}
+		if pretty {
+			log.Printf("  %s\n", prettyPacket(pk))
+		} else {
+			log.Printf("  %+v\n", pk)
+		}
+	}
+}
+
+// playCapture plays the records of the replayer back to every client that connects, waiting between packets for
+// the time that passed between them in the capture, divided by the speed passed.
+func playCapture(replayer *crashReplayer, speed float64) error {
+	for {
+		log.Printf("Waiting for a client to connect to %s to replay %d packets\n", replayer.listener.Addr(), len(replayer.records))
+		c, err := replayer.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn *minecraft.Conn) {
+			if err := conn.StartGame(replayer.data); err != nil {
+				log.Printf("An error occurred whilst starting game: %v\n", err)
+				return
+			}
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				for {
+					if _, err := conn.ReadPacket(); err != nil {
+						return
+					}
+				}
+			}()
+			start, first := time.Now(), replayer.records[0].TimeUnixNano
+			for i, r := range replayer.records {
+				due := start.Add(time.Duration(float64(r.TimeUnixNano-first) / speed))
+				select {
+				case <-closed:
+					log.Printf("%s disconnected after %d of %d packets\n", conn.IdentityData().DisplayName, i, len(replayer.records))
+					return
+				case <-time.After(time.Until(due)):
+				}
+				if _, err := conn.Write(append(binary.AppendUvarint(nil, uint64(r.PacketID)), r.Payload...)); err != nil {
+					return
+				}
+				_ = conn.Flush()
+			}
+			log.Printf("Replayed all %d packets to %s\n", len(replayer.records), conn.IdentityData().DisplayName)
+		}(c.(*minecraft.Conn))
+	}
+}
+
+// runReplay runs the replay subcommand, which prints the packets of a capture offline, or plays the clientbound
+// packets of a session of it back to vanilla clients connecting to a local listener with their original timing,
+// so that a session can be examined again without the server it was captured on. With -ui, only the forms and UI of
+// the session are played back.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	printOnly := fs.Bool("print", false, "Print the decoded packets of the capture instead of playing them back")
+	pretty := fs.Bool("pretty", false, "Print payloads as indented trees of their fields")
+	packets := fs.String("packets", "", "Comma separated packets or @groups to print, all packets by default")
+	addr := fs.String("listen", "127.0.0.1:19133", "Address to listen on for clients to play the capture back to")
+	sessionID := fs.Uint64("session", 0, "Session of the capture to play back, or 0 for the first session")
+	speed := fs.Float64("speed", 1, "Speed at which the capture is played back, such as 2 for twice as fast")
+	ui := fs.Bool("ui", false, "Only play back the StartGame data and the form and UI packets, answering everything else minimally")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *speed <= 0 {
+		return errors.New("usage: replay [-print [-pretty] [-packets list] [-shield-id id]] [-listen address] [-session id] [-speed 1] [-ui] <capture|manifest>")
+	}
+	if *printOnly {
+		selected := map[string]bool{}
+		if *packets != "" {
+			names, err := expandPacketNames(strings.Split(*packets, ","))
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				selected[name] = true
+			}
+		}
+		return printCapture(fs.Arg(0), selected, int32(*shieldID), *pretty)
+	}
+	replayer, _, err := newCrashReplayer(fs.Arg(0), *sessionID, *addr, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer replayer.listener.Close()
+	if *ui {
+		return playUIFlow(replayer, *speed)
+	}
+	return playCapture(replayer, *speed)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// respawnSteps are the steps of a complete death and respawn sequence, in the order they are expected.
+var respawnSteps = []string{
+	"death", "server_searching_for_spawn", "client_ready_to_spawn", "player_action_respawn", "server_ready_to_spawn",
+	"position", "health_restored",
+}
+
+// respawnTimeout is the time after which a respawn sequence that was not completed is reported as incomplete.
+const respawnTimeout = time.Minute
+
+// respawnTimeline is a single death and respawn sequence of a player.
+type respawnTimeline struct {
+	started time.Time
+	steps   map[string]time.Time
+	order   []string
+	reason  string
+}
+
+// record records that a step of the sequence occurred, if it did not occur yet.
+func (t *respawnTimeline) record(step string, at time.Time) {
+	if _, ok := t.steps[step]; ok {
+		return
+	}
+	t.steps[step] = at
+	t.order = append(t.order, step)
+}
+
+// report returns a human readable report of the timeline, listing the time of every step relative to the death
+// and flagging missing steps and steps that occurred out of order.
+func (t *respawnTimeline) report() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "respawn at %s (%s):", t.started.Format("15:04:05.000"), t.reason)
+	last := -1
+	for _, step := range t.order {
+		_, _ = fmt.Fprintf(&b, " %s +%s", step, t.steps[step].Sub(t.started).Round(time.Millisecond))
+		index := 0
+		for index < len(respawnSteps) && respawnSteps[index] != step {
+			index++
+		}
+		if index < last {
+			b.WriteString(" (out of order)")
+			continue
+		}
+		last = index
+	}
+	var missing []string
+	for _, step := range respawnSteps {
+		if _, ok := t.steps[step]; !ok {
+			missing = append(missing, step)
+		}
+	}
+	if len(missing) > 0 {
+		_, _ = fmt.Fprintf(&b, "; MISSING: %s", strings.Join(missing, ", "))
+	}
+	return b.String()
+}
+
+// respawnTracker correlates the death and respawn related packets of a session into timelines.
+type respawnTracker struct {
+	runtimeID uint64
+	current   *respawnTimeline
+	reports   []string
+}
+
+// respawnTrackers holds the respawn tracker of every session, indexed by session ID.
+var respawnTrackers = struct {
+	sync.Mutex
+	m map[int64]*respawnTracker
+}{m: map[int64]*respawnTracker{}}
+
+// maxRespawnReports is the maximum amount of respawn reports kept per session.
+const maxRespawnReports = 10
+
+// trackRespawn feeds the packet event passed to the respawn tracker of its session.
+func trackRespawn(e packetEvent) {
+	var step string
+	switch pk := e.Packet.(type) {
+	case *packet.SetHealth:
+		step = "health_restored"
+		if pk.Health <= 0 {
+			step = "death"
+		}
+	case *packet.DeathInfo:
+		step = "death"
+	case *packet.UpdateAttributes:
+		for _, a := range pk.Attributes {
+			if a.Name != "minecraft:health" {
+				continue
+			}
+			step = "health_restored"
+			if a.Value <= 0 {
+				step = "death"
+			}
+		}
+		if step != "" && !isLocalPlayer(e.Session, pk.EntityRuntimeID) {
+			return
+		}
+	case *packet.Respawn:
+		switch pk.State {
+		case packet.RespawnStateSearchingForSpawn:
+			step = "server_searching_for_spawn"
+		case packet.RespawnStateReadyToSpawn:
+			step = "server_ready_to_spawn"
+		case packet.RespawnStateClientReadyToSpawn:
+			step = "client_ready_to_spawn"
+		}
+	case *packet.PlayerAction:
+		if pk.ActionType == protocol.PlayerActionRespawn {
+			step = "player_action_respawn"
+		}
+	case *packet.MovePlayer:
+		if e.Direction == "clientbound" && isLocalPlayer(e.Session, pk.EntityRuntimeID) {
+			step = "position"
+		}
+	}
+	if step == "" {
+		return
+	}
+
+	respawnTrackers.Lock()
+	defer respawnTrackers.Unlock()
+	t, ok := respawnTrackers.m[e.Session]
+	if !ok {
+		t = &respawnTracker{}
+		respawnTrackers.m[e.Session] = t
+	}
+	if t.current != nil && e.Time.Sub(t.current.started) > respawnTimeout {
+		t.finish(e.Session, "timed out")
+	}
+	switch {
+	case step == "death":
+		if t.current != nil {
+			if _, dead := t.current.steps["death"]; dead {
+				// Death is often reported by multiple packets, such as UpdateAttributes and DeathInfo.
+				return
+			}
+			t.finish(e.Session, "interrupted by another death")
+		}
+		t.current = &respawnTimeline{started: e.Time, steps: map[string]time.Time{}}
+	case t.current == nil:
+		if step == "position" || step == "health_restored" {
+			// Position and health updates are common outside of respawn sequences.
+			return
+		}
+		// A respawn sequence was started without a death being observed, which is worth reporting as well.
+		t.current = &respawnTimeline{started: e.Time, steps: map[string]time.Time{}}
+	case step == "position":
+		if _, ready := t.current.steps["server_ready_to_spawn"]; !ready {
+			return
+		}
+	}
+	t.current.record(step, e.Time)
+	if step == "health_restored" {
+		if _, ready := t.current.steps["server_ready_to_spawn"]; ready {
+			t.finish(e.Session, "completed")
+		}
+	}
+}
+
+// finish reports the current timeline of the tracker with the reason passed and stops tracking it. The respawn
+// trackers must be locked.
+func (t *respawnTracker) finish(session int64, reason string) {
+	t.current.reason = reason
+	report := t.current.report()
+	t.current = nil
+	t.reports = append(t.reports, report)
+	if len(t.reports) > maxRespawnReports {
+		t.reports = t.reports[1:]
+	}
+	logf(logFields{"session": strconv.FormatInt(session, 10)}, "Session %d %s\n", session, report)
+}
+
+// isLocalPlayer checks if the runtime ID passed belongs to the player of the session passed.
+func isLocalPlayer(session int64, runtimeID uint64) bool {
+	s, ok := sessionByID(session)
+	return ok && s.server.GameData().EntityRuntimeID == runtimeID
+}
+
+func init() {
+	addPacketListener(trackRespawn)
+	addSessionCloseListener(func(id int64) {
+		respawnTrackers.Lock()
+		if t, ok := respawnTrackers.m[id]; ok && t.current != nil {
+			t.finish(id, "session closed")
+		}
+		delete(respawnTrackers.m, id)
+		respawnTrackers.Unlock()
+	})
+	registerCommand("respawns", consoleCommand{
+		usage:       "<session>",
+		description: "Shows the death and respawn timelines of a session, flagging missing steps.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println("Usage: respawns <session>")
+				return
+			}
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				log.Printf("Invalid session %q.\n", args[0])
+				return
+			}
+			respawnTrackers.Lock()
+			defer respawnTrackers.Unlock()
+			t, ok := respawnTrackers.m[id]
+			if !ok {
+				log.Printf("No respawns were observed in session %d.\n", id)
+				return
+			}
+			for _, report := range t.reports {
+				log.Println(report)
+			}
+			if t.current != nil {
+				log.Printf("In progress: %s\n", t.current.report())
+			}
+		},
+	})
+}
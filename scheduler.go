@@ -0,0 +1,152 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tickDuration is the duration of a single Minecraft tick.
+const tickDuration = time.Second / 20
+
+// ticks returns the duration of n Minecraft ticks, so that tasks may be scheduled in ticks.
+func ticks(n int) time.Duration {
+	return tickDuration * time.Duration(n)
+}
+
+// scheduledTask is a function scheduled by a plugin to run after a delay or
+// repeatedly for a session. Tasks stop once they are cancelled or their session is closed.
+type scheduledTask struct {
+	id       int64
+	s        *session
+	name     string
+	interval time.Duration
+	repeat   bool
+	runs     atomic.Int64
+
+	once      sync.Once
+	cancelled chan struct{}
+}
+
+// scheduledTasks holds all tasks that have not yet finished, indexed by their ID.
+var scheduledTasks = struct {
+	sync.Mutex
+	id int64
+	m  map[int64]*scheduledTask
+}{m: map[int64]*scheduledTask{}}
+
+// after schedules f to run once for the session after the delay passed. The name is shown by the tasks command.
+func (s *session) after(name string, delay time.Duration, f func(s *session)) *scheduledTask {
+	return s.schedule(name, delay, false, f)
+}
+
+// every schedules f to run for the session every interval passed, starting one interval from now, until the task
+// is cancelled or the session is closed. A run is skipped if the previous run is still running. The name is shown
+// by the tasks command.
+func (s *session) every(name string, interval time.Duration, f func(s *session)) *scheduledTask {
+	return s.schedule(name, interval, true, f)
+}
+
+// schedule schedules f to run for the session after the interval passed, repeating it if repeat is true.
+func (s *session) schedule(name string, interval time.Duration, repeat bool, f func(s *session)) *scheduledTask {
+	if repeat && interval < tickDuration {
+		interval = tickDuration
+	} else if interval <= 0 {
+		interval = time.Nanosecond
+	}
+	scheduledTasks.Lock()
+	scheduledTasks.id++
+	t := &scheduledTask{id: scheduledTasks.id, s: s, name: name, interval: interval, repeat: repeat, cancelled: make(chan struct{})}
+	scheduledTasks.m[t.id] = t
+	scheduledTasks.Unlock()
+
+	s.spawn(func() {
+		defer t.Cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.closed:
+				return
+			case <-t.cancelled:
+				return
+			case <-ticker.C:
+			}
+			if !t.run(f) || !repeat {
+				return
+			}
+		}
+	})
+	return t
+}
+
+// run runs f for the session of the task, returning false if f panicked, in which case the task is stopped.
+func (t *scheduledTask) run(f func(s *session)) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("Task %d (%s) of session %d panicked and was stopped: %v\n", t.id, t.name, t.s.id, v)
+		}
+	}()
+	f(t.s)
+	t.runs.Add(1)
+	return true
+}
+
+// Cancel stops the task. It does not interrupt a run of the task that is in progress. Cancel implements
+// handler.Task, so that plugins may cancel their tasks.
+func (t *scheduledTask) Cancel() {
+	t.once.Do(func() {
+		close(t.cancelled)
+		scheduledTasks.Lock()
+		delete(scheduledTasks.m, t.id)
+		scheduledTasks.Unlock()
+	})
+}
+
+func init() {
+	registerCommand("tasks", consoleCommand{
+		usage:       "[cancel <id>]",
+		description: "Lists the tasks scheduled by plugins or cancels one.",
+		run: func(args []string) {
+			if len(args) == 2 && args[0] == "cancel" {
+				id, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil {
+					log.Println("Usage: tasks [cancel <id>]")
+					return
+				}
+				scheduledTasks.Lock()
+				t, ok := scheduledTasks.m[id]
+				scheduledTasks.Unlock()
+				if !ok {
+					log.Printf("No task with ID %d is scheduled.\n", id)
+					return
+				}
+				t.Cancel()
+				log.Printf("Cancelled task %d (%s).\n", t.id, t.name)
+				return
+			}
+			scheduledTasks.Lock()
+			tasks := make([]*scheduledTask, 0, len(scheduledTasks.m))
+			for _, t := range scheduledTasks.m {
+				tasks = append(tasks, t)
+			}
+			scheduledTasks.Unlock()
+			sort.Slice(tasks, func(i, j int) bool {
+				return tasks[i].id < tasks[j].id
+			})
+			if len(tasks) == 0 {
+				log.Println("No tasks are scheduled.")
+			}
+			for _, t := range tasks {
+				kind := "once after"
+				if t.repeat {
+					kind = "every"
+				}
+				log.Printf("#%d %s (session %d): %s %v, ran %d times\n", t.id, t.name, t.s.id, kind, t.interval, t.runs.Load())
+			}
+		},
+	})
+}
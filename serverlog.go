@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverLogSource is the source the log of the upstream server is followed from, or an empty string if it is
+// not followed. See tailServerLog for the sources supported.
+var serverLogSource string
+
+// serverLogOffset is added to the timestamps of server log lines, to correct for the clock of the machine running
+// the server differing from that of the proxy.
+var serverLogOffset time.Duration
+
+// serverLogLines is the amount of most recent server log lines kept for the timelines of sessions.
+const serverLogLines = 2000
+
+// serverLogLine is a single line of the log of the upstream server.
+type serverLogLine struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// serverLog holds the most recent lines of the log of the upstream server, ordered from oldest to newest.
+var serverLog struct {
+	sync.Mutex
+	lines []serverLogLine
+}
+
+// addServerLogLine records a line of the server log and logs it. The time of the line is taken from the
+// timestamp of the line if it has one, or the current time otherwise.
+func addServerLogLine(text string) {
+	text = strings.TrimRight(text, "\r\n")
+	if text == "" {
+		return
+	}
+	t, ok := parseServerLogTime(text)
+	if !ok {
+		t = time.Now()
+	}
+	line := serverLogLine{Time: t, Text: text}
+
+	serverLog.Lock()
+	if len(serverLog.lines) == serverLogLines {
+		serverLog.lines = append(serverLog.lines[:0], serverLog.lines[1:]...)
+	}
+	// Lines are inserted in order of time, as lines without timestamp may arrive later than lines that were
+	// logged after them.
+	i := len(serverLog.lines)
+	for i > 0 && serverLog.lines[i-1].Time.After(t) {
+		i--
+	}
+	serverLog.lines = append(serverLog.lines, serverLogLine{})
+	copy(serverLog.lines[i+1:], serverLog.lines[i:])
+	serverLog.lines[i] = line
+	serverLog.Unlock()
+
+	logf(logFields{"source": "server"}, "[server] %s\n", text)
+}
+
+// parseServerLogTime parses the timestamp at the start of a line of the log of a Bedrock Dedicated Server, such
+// as [2024-05-01 12:34:56:789 INFO], and corrects it by the server log offset.
+func parseServerLogTime(text string) (time.Time, bool) {
+	if !strings.HasPrefix(text, "[") {
+		return time.Time{}, false
+	}
+	fields := strings.Fields(strings.TrimPrefix(text, "["))
+	if len(fields) < 2 {
+		return time.Time{}, false
+	}
+	clock := fields[1]
+	if i := strings.LastIndex(clock, ":"); strings.Count(clock, ":") == 3 {
+		// BDS separates the milliseconds with a colon, which the time package does not support.
+		clock = clock[:i] + "." + clock[i+1:]
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05.000", fields[0]+" "+clock, time.Local)
+	if err != nil {
+		if t, err = time.ParseInLocation("2006-01-02 15:04:05", fields[0]+" "+clock, time.Local); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return t.Add(serverLogOffset), true
+}
+
+// serverLogBetween returns the server log lines recorded between the times passed.
+func serverLogBetween(from, to time.Time) []serverLogLine {
+	serverLog.Lock()
+	defer serverLog.Unlock()
+	var lines []serverLogLine
+	for _, line := range serverLog.lines {
+		if !line.Time.Before(from) && !line.Time.After(to) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// tailServerLog starts following the server log at the source passed in the background. The source is either
+// the path of a local file, an ssh://user@host[:port]/path URL of a file on a remote machine, which is followed
+// using the ssh command, or an http://addr/path URL on which a webhook receiving lines in the body of POST
+// requests is served.
+func tailServerLog(source string) error {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// Either not a URL or a Windows path with a drive letter.
+		go followFile(source)
+		return nil
+	}
+	switch u.Scheme {
+	case "file":
+		go followFile(u.Path)
+	case "ssh":
+		go followSSH(u)
+	case "http":
+		go serveServerLogWebhook(u)
+	default:
+		return fmt.Errorf("unknown server log source %q", source)
+	}
+	return nil
+}
+
+// followFile follows the local file at the path passed, recording every line appended to it. The file is
+// reopened when it is truncated or rotated.
+func followFile(path string) {
+	var (
+		f      *os.File
+		r      *bufio.Reader
+		offset int64
+		reopen bool
+	)
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(path); err != nil {
+				log.Printf("Unable to open server log, retrying in 5 seconds: %v\n", err)
+				time.Sleep(time.Second * 5)
+				continue
+			}
+			offset = 0
+			if !reopen {
+				// Only lines logged from now on are of interest, but all lines of a rotated log are new.
+				offset, _ = f.Seek(0, io.SeekEnd)
+			}
+			r = bufio.NewReader(f)
+		}
+		line, err := r.ReadString('\n')
+		if err == nil {
+			offset += int64(len(line))
+			addServerLogLine(line)
+			continue
+		}
+		// A partial line may have been read, which is completed once the rest of it is written.
+		_, _ = f.Seek(offset, io.SeekStart)
+		r.Reset(f)
+		time.Sleep(time.Millisecond * 250)
+		if info, err := os.Stat(path); err != nil || info.Size() < offset || !sameFile(f, info) {
+			_ = f.Close()
+			f, reopen = nil, true
+		}
+	}
+}
+
+// sameFile checks if the open file passed is the file described by the info passed.
+func sameFile(f *os.File, info os.FileInfo) bool {
+	current, err := f.Stat()
+	return err == nil && os.SameFile(current, info)
+}
+
+// followSSH follows a file on a remote machine by running tail over the ssh command, restarting it when the
+// connection is lost.
+func followSSH(u *url.URL) {
+	args := []string{"-o", "BatchMode=yes"}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	args = append(args, host, "tail", "-F", "-n", "0", u.Path)
+	for {
+		cmd := exec.Command("ssh", args...)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err == nil {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				addServerLogLine(scanner.Text())
+			}
+			err = cmd.Wait()
+		}
+		log.Printf("Lost server log of %s, reconnecting in 5 seconds: %v\n", u.Host, err)
+		time.Sleep(time.Second * 5)
+	}
+}
+
+// serveServerLogWebhook serves a webhook at the address and path of the URL passed. Each line in the body of a
+// POST request to it is recorded as a server log line.
+func serveServerLogWebhook(u *url.URL) {
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			addServerLogLine(scanner.Text())
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if err := http.ListenAndServe(u.Host, mux); err != nil {
+		log.Printf("An error occurred whilst serving the server log webhook: %v\n", err)
+	}
+}
+
+func init() {
+	registerCommand("serverlog", consoleCommand{
+		usage:       "[minutes]",
+		description: "Shows the lines of the server log recorded in the last minutes, 5 by default.",
+		run: func(args []string) {
+			minutes := 5
+			if len(args) > 0 {
+				if _, err := fmt.Sscan(args[0], &minutes); err != nil {
+					log.Printf("Invalid amount of minutes %q.\n", args[0])
+					return
+				}
+			}
+			now := time.Now()
+			lines := serverLogBetween(now.Add(-time.Duration(minutes)*time.Minute), now)
+			if len(lines) == 0 {
+				log.Println("No server log lines were recorded in this period.")
+				return
+			}
+			for _, line := range lines {
+				log.Printf("%s %s\n", line.Time.Format("15:04:05.000"), line.Text)
+			}
+		},
+	})
+}
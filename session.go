@@ -0,0 +1,557 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/login"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"golang.org/x/oauth2"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferLimit is the amount of bytes that may be queued for a single direction of a session before the
+// backpressure policy is applied.
+var bufferLimit int64 = 16 << 20
+
+// backpressurePolicy is the policy applied when the amount of bytes queued for one direction of a session
+// exceeds bufferLimit. It is one of the following:
+//   - "warn": The queue is unbounded and a warning is logged.
+//   - "block": Reading from the sending side is paused until the receiving side catches up.
+//   - "drop-oldest": The oldest droppable packets in the queue are dropped. If none are queued, reading blocks.
+//   - "disconnect": The session is closed.
+var backpressurePolicy = "warn"
+
+// droppablePackets holds the packets that may be dropped by the drop-oldest backpressure policy without
+// affecting the state of the game.
+var droppablePackets = map[string]bool{
+	getType(&packet.LevelSoundEvent{}, false):     true,
+	getType(&packet.PlaySound{}, false):           true,
+	getType(&packet.SpawnParticleEffect{}, false): true,
+}
+
+// session represents a client connected to the proxy together with its connection to the upstream server.
+type session struct {
+	id       int64
+	client   *minecraft.Conn
+	server   *minecraft.Conn
+	listener *minecraft.Listener
+	upstream string
+	started  time.Time
+
+	goroutines atomic.Int64
+	// serverbound holds the statistics of packets sent by the client to the server, clientbound those of
+	// packets sent by the server to the client.
+	serverbound, clientbound directionStats
+	// serverQueue holds packets waiting to be written to the server, clientQueue those waiting to be written to
+	// the client.
+	serverQueue, clientQueue *packetQueue
+
+	// hashes holds the hashes of the login-phase data sent by the server.
+	hashes sessionHashes
+	// serverboundRecent and clientboundRecent hold the most recent packets of each direction for forensic dumps.
+	serverboundRecent, clientboundRecent packetRing
+	// rateWindow is the start of the second that rateCount counts the packets sent by the client in, used to
+	// enforce the packet rate of gateway mode.
+	rateWindow time.Time
+	rateCount  int
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+// directionStats holds the resource usage of a single direction of a session.
+type directionStats struct {
+	packets, bytes             atomic.Int64
+	queuedPackets, queuedBytes atomic.Int64
+	dropped, suppressed        atomic.Int64
+	// chaosDropped, chaosDuplicated and chaosReordered are the amount of packets dropped, duplicated and sent
+	// ahead of earlier packets deliberately by chaos rules. chaosSkewed is the amount of packets of which the
+	// tick or timestamp fields were offset.
+	chaosDropped, chaosDuplicated, chaosReordered, chaosSkewed atomic.Int64
+}
+
+// memoryEstimate returns an estimate of the memory held by the session in bytes: the packets waiting in its
+// queues and held for forensic dumps, counted by their encoded size, and the buffers of its recording.
+func (s *session) memoryEstimate() int64 {
+	return s.serverbound.queuedBytes.Load() + s.clientbound.queuedBytes.Load() + s.serverboundRecent.bytes() +
+		s.clientboundRecent.bytes() + recordingMemory(s.id)
+}
+
+// sessions holds all sessions currently active, indexed by their ID.
+var sessions = struct {
+	sync.Mutex
+	m      map[int64]*session
+	nextID int64
+}{m: map[int64]*session{}}
+
+// activeSessions returns all sessions currently active, sorted by their ID.
+func activeSessions() []*session {
+	sessions.Lock()
+	list := make([]*session, 0, len(sessions.m))
+	for _, s := range sessions.m {
+		list = append(list, s)
+	}
+	sessions.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+	return list
+}
+
+// sessionByID returns the active session with the ID passed. False is returned if no such session exists.
+func sessionByID(id int64) (*session, bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	s, ok := sessions.m[id]
+	return s, ok
+}
+
+// acceptingConnections specifies if new clients are proxied to the upstream server. Sessions already active are
+// not affected when it is disabled.
+var acceptingConnections = func() *atomic.Bool {
+	b := new(atomic.Bool)
+	b.Store(true)
+	return b
+}()
+
+// handleConn accepts the connection from the client and tries to connect to the target server.
+func handleConn(conn *minecraft.Conn, listener *minecraft.Listener, hostString string, src oauth2.TokenSource) error {
+	serverConn, err := minecraft.Dialer{
+		TokenSource: src,
+		ClientData:  conn.ClientData(),
+		// Only used when logging in without authentication.
+		IdentityData: login.IdentityData{DisplayName: conn.IdentityData().DisplayName},
+	}.Dial(upstreamNetwork, hostString)
+	if err != nil {
+		return err
+	}
+	var g sync.WaitGroup
+	g.Add(2)
+	go func() {
+		if err := conn.StartGame(serverConn.GameData()); err != nil {
+			log.Printf("An error occurred whilst starting game: %v\n", err)
+		}
+		g.Done()
+	}()
+	go func() {
+		if err := serverConn.DoSpawn(); err != nil {
+			log.Printf("An error occurred whilst spawning: %v\n", err)
+		}
+		g.Done()
+	}()
+	g.Wait()
+
+	s := &session{client: conn, server: serverConn, listener: listener, upstream: hostString, started: time.Now(), closed: make(chan struct{})}
+	sessions.Lock()
+	sessions.nextID++
+	s.id = sessions.nextID
+	sessions.m[s.id] = s
+	sessions.Unlock()
+	s.hashGameData(serverConn.GameData())
+	s.learnGameData(serverConn.GameData())
+	cacheGameData(hostString, serverConn.GameData())
+	s.recordClient()
+
+	s.serverQueue, s.clientQueue = newPacketQueue(&s.serverbound), newPacketQueue(&s.clientbound)
+	read := s.read
+	if rawForwarding {
+		read = s.readRaw
+	}
+	s.spawn(func() { read(false) })
+	s.spawn(func() { s.write(serverConn, s.serverQueue) })
+	s.spawn(func() { read(true) })
+	s.spawn(func() { s.write(conn, s.clientQueue) })
+	if sessionLimit > 0 {
+		s.spawn(s.enforceTimeLimit)
+	}
+	if clientProbeInterval > 0 {
+		s.startClientProbe()
+	}
+	if migrationDelay > 0 {
+		s.spawn(func() {
+			select {
+			case <-s.closed:
+			case <-time.After(migrationDelay):
+				if err := s.migrate(); err != nil {
+					log.Printf("An error occurred whilst migrating session %d: %v\n", s.id, err)
+				}
+			}
+		})
+	}
+	s.spawn(func() {
+		// Close both queues once the session is closed, so that the writing goroutines stop.
+		<-s.closed
+		s.serverQueue.close()
+		s.clientQueue.close()
+	})
+	return nil
+}
+
+// logFields returns the structured log fields describing a packet with the name passed sent by the side passed,
+// either "client" or "server".
+func (s *session) logFields(source, packetName string) logFields {
+	return logFields{"session": strconv.FormatInt(s.id, 10), "direction": source, "packet": packetName}
+}
+
+// spawn runs f on a new goroutine that is accounted to the session.
+func (s *session) spawn(f func()) {
+	s.goroutines.Add(1)
+	go func() {
+		defer s.goroutines.Add(-1)
+		f()
+	}()
+}
+
+// read reads packets from the client, or from the server if fromServer is true, handles them and adds them to
+// the queue of the other side until the connection is closed.
+func (s *session) read(fromServer bool) {
+	src, q, stats, recent := s.client, s.serverQueue, &s.serverbound, &s.serverboundRecent
+	if fromServer {
+		src, q, stats, recent = s.server, s.clientQueue, &s.clientbound, &s.clientboundRecent
+	}
+	for {
+		pk, err := src.ReadPacket()
+		if err != nil {
+			if fromServer {
+				s.upstreamLost(err)
+			}
+			s.close(err)
+			return
+		}
+		received := time.Now()
+		if !fromServer && s.packetRateExceeded(received) {
+			log.Printf("Closing session %d: client exceeded %d packets per second\n", s.id, gatewayPacketRate)
+			s.close(fmt.Errorf("rate limit: %w", minecraft.DisconnectError("You are sending packets too fast.")))
+			return
+		}
+		onPacketReceived(s, pk, fromServer)
+
+		name, size := getType(pk, false), int64(packetSize(pk))
+		direction := "serverbound"
+		if fromServer {
+			direction = "clientbound"
+		}
+		var cancelled bool
+		if pluginInterceptors.Load() > 0 && !gatewayMode && !payloadRedacted(name) {
+			intercepted := interceptPluginPacket(packetEvent{Time: received, Session: s.id, Direction: direction, Name: name, ID: pk.ID(), Size: int(size), Packet: pk})
+			if intercepted == nil {
+				cancelled = true
+			} else {
+				pk = intercepted
+				name, size = getType(pk, false), int64(packetSize(pk))
+			}
+		}
+		e := packetEvent{Time: received, Session: s.id, Direction: direction, Name: name, ID: pk.ID(), Size: int(size), Packet: pk}
+		if payloadRedacted(name) {
+			e.Packet = nil
+		}
+		recent.add(e)
+		if len(packetListeners) > 0 {
+			notifyPacketListeners(e)
+		}
+		stats.packets.Add(1)
+		stats.bytes.Add(size)
+		if fromServer {
+			s.hashRegistryPacket(name, pk)
+		}
+		if cancelled || fromServer && packetSuppressed(name) {
+			stats.suppressed.Add(1)
+			continue
+		}
+		copies, delay := chaosOutcome(name, direction)
+		if copies == 0 {
+			stats.chaosDropped.Add(1)
+			continue
+		}
+		if !fromServer {
+			if responses, handled := respondLocally(s, name, pk); handled {
+				for _, response := range responses {
+					if err := s.sendToClient(response); err != nil {
+						s.close(err)
+						return
+					}
+				}
+				continue
+			}
+		}
+		if skewed, ok := skewPacket(name, pk); ok {
+			pk = skewed
+			stats.chaosSkewed.Add(1)
+		}
+		stats.chaosDuplicated.Add(int64(copies - 1))
+		for i := 0; i < copies; i++ {
+			if err := q.push(queuedPacket{pk: pk, size: size, droppable: droppablePackets[name], delay: delay, name: name, received: received}); err != nil {
+				log.Printf("Closing session %d: %v\n", s.id, err)
+				s.close(err)
+				return
+			}
+		}
+	}
+}
+
+// sendToClient queues a packet that did not originate from the server to be written to the client.
+func (s *session) sendToClient(pk packet.Packet) error {
+	return s.clientQueue.push(queuedPacket{pk: pk, size: int64(packetSize(pk))})
+}
+
+// sendToServer queues a packet that did not originate from the client to be written to the server.
+func (s *session) sendToServer(pk packet.Packet) error {
+	return s.serverQueue.push(queuedPacket{pk: pk, size: int64(packetSize(pk))})
+}
+
+// write writes packets from the queue to the connection passed until the queue is closed.
+func (s *session) write(dst *minecraft.Conn, q *packetQueue) {
+	for {
+		p, ok := q.pop()
+		if !ok {
+			return
+		}
+		var err error
+		if p.raw != nil {
+			_, err = dst.Write(p.raw)
+		} else {
+			err = dst.WritePacket(p.pk)
+		}
+		if err != nil {
+			s.close(err)
+			return
+		}
+		if !p.received.IsZero() {
+			observeLatency(p.name, time.Since(p.received))
+		}
+	}
+}
+
+// close closes the session, disconnecting the client with the reason held by the error passed if the upstream
+// server disconnected it.
+func (s *session) close(err error) {
+	s.once.Do(func() {
+		message := "connection lost"
+		if disconnect, ok := errors.Unwrap(err).(minecraft.DisconnectError); ok {
+			message = disconnect.Error()
+		}
+		_ = s.listener.Disconnect(s.client, message)
+		_ = s.server.Close()
+		close(s.closed)
+
+		sessions.Lock()
+		delete(sessions.m, s.id)
+		sessions.Unlock()
+		releaseClient(s.client.RemoteAddr())
+		s.storeSessionHashes()
+		reason := message
+		if err != nil {
+			reason = err.Error()
+		}
+		s.storeSessionAggregate(reason)
+
+		for _, f := range sessionCloseListeners {
+			f(s.id)
+		}
+	})
+}
+
+// queuedPacket is a packet waiting in a packetQueue to be written.
+type queuedPacket struct {
+	pk        packet.Packet
+	size      int64
+	droppable bool
+	// name is the name of the packet and received the time it was received by the proxy, used to measure the
+	// time it spends in the proxy. received is zero for packets that did not pass through the proxy.
+	name     string
+	received time.Time
+	// raw holds the packet including its header as it was received in raw mode, which is written instead of pk.
+	raw []byte
+	// delay is the amount of packets added to the queue later that may still be placed in front of this
+	// packet, which is used to deliberately reorder packets. held is the time the packet started waiting for
+	// them at the front of the queue.
+	delay int
+	held  time.Time
+}
+
+// packetQueue is a queue of packets waiting to be written to a connection. Its size is bounded by bufferLimit,
+// applying the backpressurePolicy when it is exceeded.
+type packetQueue struct {
+	stats *directionStats
+
+	mu             sync.Mutex
+	cond           *sync.Cond
+	queue          []queuedPacket
+	bytes          int64
+	closed, warned bool
+}
+
+// newPacketQueue returns a new, empty packetQueue that records its usage in the stats passed.
+func newPacketQueue(stats *directionStats) *packetQueue {
+	q := &packetQueue{stats: stats}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds a packet to the back of the queue. If the queue is full, push applies the backpressure policy,
+// which may block until space is available. An error is returned if the session should be closed.
+func (q *packetQueue) push(p queuedPacket) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.bytes+p.size > bufferLimit && len(q.queue) > 0 && !q.closed {
+		switch backpressurePolicy {
+		case "disconnect":
+			return fmt.Errorf("write buffer exceeded %d bytes", bufferLimit)
+		case "drop-oldest":
+			if q.dropOldest() {
+				continue
+			}
+		case "block":
+		default:
+			if !q.warned {
+				log.Printf("Buffering %d bytes because the receiving side can't keep up\n", q.bytes)
+				q.warned = true
+			}
+			q.add(p)
+			return nil
+		}
+		q.cond.Wait()
+	}
+	if q.bytes < bufferLimit/2 {
+		q.warned = false
+	}
+	q.add(p)
+	return nil
+}
+
+// add adds a packet to the back of the queue and wakes up the writing goroutine. The packet is placed in front
+// of any delayed packets at the back of the queue. The queue must be locked.
+func (q *packetQueue) add(p queuedPacket) {
+	i := len(q.queue)
+	for i > 0 && q.queue[i-1].delay > 0 {
+		q.queue[i-1].delay--
+		i--
+	}
+	if i != len(q.queue) {
+		q.stats.chaosReordered.Add(1)
+	}
+	q.queue = append(q.queue, queuedPacket{})
+	copy(q.queue[i+1:], q.queue[i:])
+	q.queue[i] = p
+	q.bytes += p.size
+	q.stats.queuedPackets.Add(1)
+	q.stats.queuedBytes.Add(p.size)
+	q.cond.Broadcast()
+}
+
+// dropOldest removes the oldest droppable packet from the queue. False is returned if no droppable packet was
+// queued. The queue must be locked.
+func (q *packetQueue) dropOldest() bool {
+	for i, p := range q.queue {
+		if p.droppable {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			q.bytes -= p.size
+			q.stats.queuedPackets.Add(-1)
+			q.stats.queuedBytes.Add(-p.size)
+			q.stats.dropped.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// pop removes the packet at the front of the queue, waiting until one is available. A delayed packet at the front
+// is held back until as many packets as its delay were placed in front of it, or until chaosReorderTimeout passed,
+// so that it is overtaken even if packets are written as fast as they arrive. False is returned if the queue was
+// closed.
+func (q *packetQueue) pop() (queuedPacket, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed {
+		if len(q.queue) == 0 {
+			q.cond.Wait()
+			continue
+		}
+		head := &q.queue[0]
+		if head.delay == 0 {
+			break
+		}
+		if head.held.IsZero() {
+			head.held = time.Now()
+			time.AfterFunc(chaosReorderTimeout, func() {
+				q.mu.Lock()
+				q.cond.Broadcast()
+				q.mu.Unlock()
+			})
+		}
+		if time.Since(head.held) >= chaosReorderTimeout {
+			// No packets arrived in time to overtake the packet, so it is written in its original order.
+			head.delay = 0
+			break
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return queuedPacket{}, false
+	}
+	p := q.queue[0]
+	q.queue[0] = queuedPacket{}
+	q.queue = q.queue[1:]
+	q.bytes -= p.size
+	q.stats.queuedPackets.Add(-1)
+	q.stats.queuedBytes.Add(-p.size)
+	// Wake up the reading goroutine if it is waiting for space in the queue.
+	q.cond.Broadcast()
+	return p, true
+}
+
+// close closes the queue, causing any pending calls to pop to return.
+func (q *packetQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.queue = nil
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// byteCounter is a writer that counts the bytes written to it and discards them.
+type byteCounter int
+
+// Write ...
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+// WriteByte ...
+func (c *byteCounter) WriteByte(byte) error {
+	*c++
+	return nil
+}
+
+// packetSize returns the size of the packet passed when encoded, excluding its header.
+func packetSize(pk packet.Packet) int {
+	var c byteCounter
+	pk.Marshal(protocol.NewWriter(&c, 0))
+	return int(c)
+}
+
+func init() {
+	registerCommand("sessions", consoleCommand{
+		description: "Lists active sessions with their resource usage.",
+		run: func([]string) {
+			list := activeSessions()
+			if len(list) == 0 {
+				log.Println("There are no active sessions.")
+				return
+			}
+			for _, s := range list {
+				log.Printf("#%d %s (%s) for %s: %d goroutines, ~%d KiB memory\n", s.id, s.client.IdentityData().DisplayName, s.client.RemoteAddr(), time.Since(s.started).Round(time.Second), s.goroutines.Load(), s.memoryEstimate()>>10)
+				log.Printf("    client->server: %d packets, %d bytes, %d bytes buffered, %d dropped, %d chaos dropped, %d chaos duplicated, %d chaos reordered\n", s.serverbound.packets.Load(), s.serverbound.bytes.Load(), s.serverbound.queuedBytes.Load(), s.serverbound.dropped.Load(), s.serverbound.chaosDropped.Load(), s.serverbound.chaosDuplicated.Load(), s.serverbound.chaosReordered.Load())
+				log.Printf("    server->client: %d packets, %d bytes, %d bytes buffered, %d dropped, %d suppressed, %d chaos dropped, %d chaos duplicated, %d chaos reordered\n", s.clientbound.packets.Load(), s.clientbound.bytes.Load(), s.clientbound.queuedBytes.Load(), s.clientbound.dropped.Load(), s.clientbound.suppressed.Load(), s.clientbound.chaosDropped.Load(), s.clientbound.chaosDuplicated.Load(), s.clientbound.chaosReordered.Load())
+			}
+		},
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setBackpressure sets the buffer limit and backpressure policy for the duration of the test.
+func setBackpressure(t *testing.T, limit int64, policy string) {
+	prevLimit, prevPolicy := bufferLimit, backpressurePolicy
+	bufferLimit, backpressurePolicy = limit, policy
+	t.Cleanup(func() {
+		bufferLimit, backpressurePolicy = prevLimit, prevPolicy
+	})
+}
+
+// popNames pops n packets from the queue and returns their names.
+func popNames(t *testing.T, q *packetQueue, n int) []string {
+	t.Helper()
+	names := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		p, ok := q.pop()
+		if !ok {
+			t.Fatalf("queue closed after %d packets", i)
+		}
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// equalNames checks if the names passed are equal.
+func equalNames(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPacketQueueOrder(t *testing.T) {
+	stats := &directionStats{}
+	q := newPacketQueue(stats)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := q.push(queuedPacket{name: name, size: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats.queuedPackets.Load() != 3 || stats.queuedBytes.Load() != 30 {
+		t.Errorf("queued %d packets of %d bytes, want 3 of 30", stats.queuedPackets.Load(), stats.queuedBytes.Load())
+	}
+	if names := popNames(t, q, 3); !equalNames(names, "a", "b", "c") {
+		t.Errorf("popped %v, want [a b c]", names)
+	}
+	if stats.queuedPackets.Load() != 0 || stats.queuedBytes.Load() != 0 {
+		t.Errorf("%d packets of %d bytes still queued", stats.queuedPackets.Load(), stats.queuedBytes.Load())
+	}
+
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Errorf("pop returned a packet after the queue was closed")
+	}
+}
+
+func TestPacketQueueBlock(t *testing.T) {
+	setBackpressure(t, 100, "block")
+	q := newPacketQueue(&directionStats{})
+	if err := q.push(queuedPacket{name: "a", size: 60}); err != nil {
+		t.Fatal(err)
+	}
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- q.push(queuedPacket{name: "b", size: 60})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push did not block while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if names := popNames(t, q, 1); !equalNames(names, "a") {
+		t.Errorf("popped %v, want [a]", names)
+	}
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after space became available")
+	}
+	if names := popNames(t, q, 1); !equalNames(names, "b") {
+		t.Errorf("popped %v, want [b]", names)
+	}
+}
+
+func TestPacketQueueDisconnect(t *testing.T) {
+	setBackpressure(t, 100, "disconnect")
+	q := newPacketQueue(&directionStats{})
+	if err := q.push(queuedPacket{name: "a", size: 60}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(queuedPacket{name: "b", size: 60}); err == nil {
+		t.Errorf("push exceeding the buffer limit did not return an error")
+	}
+}
+
+func TestPacketQueueDropOldest(t *testing.T) {
+	setBackpressure(t, 100, "drop-oldest")
+	stats := &directionStats{}
+	q := newPacketQueue(stats)
+	for _, p := range []queuedPacket{{name: "a", size: 30}, {name: "b", size: 30, droppable: true}, {name: "c", size: 30, droppable: true}} {
+		if err := q.push(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.push(queuedPacket{name: "d", size: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.dropped.Load() != 1 {
+		t.Errorf("dropped %d packets, want 1", stats.dropped.Load())
+	}
+	if names := popNames(t, q, 3); !equalNames(names, "a", "c", "d") {
+		t.Errorf("popped %v, want [a c d]", names)
+	}
+}
+
+func TestPacketQueueWarn(t *testing.T) {
+	setBackpressure(t, 100, "warn")
+	stats := &directionStats{}
+	q := newPacketQueue(stats)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := q.push(queuedPacket{name: name, size: 60}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats.queuedBytes.Load() != 180 || stats.dropped.Load() != 0 {
+		t.Errorf("queued %d bytes and dropped %d packets, want 180 bytes queued", stats.queuedBytes.Load(), stats.dropped.Load())
+	}
+}
+
+func TestPacketQueueReorder(t *testing.T) {
+	stats := &directionStats{}
+	q := newPacketQueue(stats)
+	for _, p := range []queuedPacket{{name: "a"}, {name: "b", delay: 2}, {name: "c"}, {name: "d"}, {name: "e"}} {
+		if err := q.push(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := popNames(t, q, 5); !equalNames(names, "a", "c", "d", "b", "e") {
+		t.Errorf("popped %v, want [a c d b e]", names)
+	}
+	if stats.chaosReordered.Load() != 2 {
+		t.Errorf("counted %d reordered packets, want 2", stats.chaosReordered.Load())
+	}
+}
+
+func TestPacketQueueReorderHeld(t *testing.T) {
+	stats := &directionStats{}
+	q := newPacketQueue(stats)
+	if err := q.push(queuedPacket{name: "a", delay: 1}); err != nil {
+		t.Fatal(err)
+	}
+	popped := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			p, _ := q.pop()
+			popped <- p.name
+		}
+	}()
+	// The delayed packet is at the front of the queue, but must be held back until the next packet overtakes it.
+	time.Sleep(chaosReorderTimeout / 5)
+	if err := q.push(queuedPacket{name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if first, second := <-popped, <-popped; first != "b" || second != "a" {
+		t.Errorf("popped [%s %s], want [b a]", first, second)
+	}
+	if stats.chaosReordered.Load() != 1 {
+		t.Errorf("counted %d reordered packets, want 1", stats.chaosReordered.Load())
+	}
+}
+
+func TestPacketQueueReorderTimeout(t *testing.T) {
+	stats := &directionStats{}
+	q := newPacketQueue(stats)
+	if err := q.push(queuedPacket{name: "a", delay: 1}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if names := popNames(t, q, 1); !equalNames(names, "a") {
+		t.Errorf("popped %v, want [a]", names)
+	}
+	if held := time.Since(start); held < chaosReorderTimeout {
+		t.Errorf("delayed packet was held for %v, want at least %v", held, chaosReorderTimeout)
+	}
+	if stats.chaosReordered.Load() != 0 {
+		t.Errorf("counted %d reordered packets without any packet overtaking", stats.chaosReordered.Load())
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/go-raknet"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenAddr is the address the proxy accepts clients on, and listenPort its port.
+var (
+	listenAddr = ":19132"
+	listenPort = 19132
+)
+
+// parseListenAddr sets the address the proxy accepts clients on to the host:port address passed. The host may be
+// empty to accept clients on all interfaces.
+func parseListenAddr(addr string) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid listen address %q: invalid port %q", addr, portStr)
+	}
+	listenAddr, listenPort = addr, port
+	return nil
+}
+
+// localListenAddr returns the address that the listener of the proxy can be reached on from this machine: the
+// host it is bound to, or the loopback address if it accepts clients on all interfaces.
+func localListenAddr() string {
+	host, _, _ := net.SplitHostPort(listenAddr)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(listenPort))
+}
+
+// listensOn checks if the upstream server at the host and port passed is the listener of the proxy itself, which
+// would make every client connect to the proxy again.
+func listensOn(host string, port int) bool {
+	if port != listenPort {
+		return false
+	}
+	listenHost, _, _ := net.SplitHostPort(listenAddr)
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		listenIP := net.ParseIP(listenHost)
+		return listenHost == "" || listenHost == "localhost" || listenIP != nil && (listenIP.IsUnspecified() || listenIP.IsLoopback())
+	}
+	return host == listenHost
+}
+
+func init() {
+	registerSubcommand("setup", "Interactively log in, configure the upstream server and write the config file", func(args []string) error {
+		path := "config.toml"
+		if len(args) > 0 {
+			path = args[0]
+		}
+		return runSetup(path)
+	})
+}
+
+// runSetup runs the interactive setup: it logs in with a device code, asks for the upstream server and tests
+// connectivity to it, writes the config file at the path passed and prints the address to connect to.
+func runSetup(path string) error {
+	in := bufio.NewReader(os.Stdin)
+	fmt.Println("Welcome to bds-mitm! This setup creates " + path + " so the proxy can be started without flags.")
+
+	fmt.Println("\nStep 1: Log in with the Microsoft account used to join the upstream server.")
+	tokenFile := prompt(in, "File to store the login token in", "token.tok")
+	if _, err := (deviceCodeProvider{path: tokenFile}).TokenSource(); err != nil {
+		return fmt.Errorf("log in: %w", err)
+	}
+	fmt.Println("Logged in successfully.")
+
+	fmt.Println("\nStep 2: Enter the address of the upstream server.")
+	var host string
+	var port int
+	for {
+		host = prompt(in, "Host", "127.0.0.1")
+		p, err := strconv.Atoi(prompt(in, "Port", "19134"))
+		if err != nil || p <= 0 || p > 65535 {
+			fmt.Println("The port must be a number between 1 and 65535.")
+			continue
+		}
+		port = p
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		fmt.Printf("Testing connectivity to %s...\n", addr)
+		data, err := raknet.PingTimeout(addr, time.Second*5)
+		if err == nil {
+			status := parseUpstreamStatus(data)
+			fmt.Printf("Found %q running %s (protocol %d) with %d/%d players.\n", status.MOTD, status.Version, status.Protocol, status.Players, status.Max)
+			break
+		}
+		fmt.Printf("The server did not respond: %v\n", err)
+		if strings.HasPrefix(strings.ToLower(prompt(in, "Use this address anyway? (y/n)", "n")), "y") {
+			break
+		}
+	}
+
+	if err := writeConfig(path, map[string]any{"host": host, "port": port, "token": tokenFile}); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+	fmt.Printf("\nStep 3: Wrote %s. Start the proxy by running it without arguments.\n", path)
+	fmt.Println("In Minecraft, add a server in the Servers tab with one of these addresses:")
+	for _, addr := range localAddresses() {
+		fmt.Printf("    Address: %-15s Port: %d\n", addr, listenPort)
+	}
+	return nil
+}
+
+// prompt asks the user for a value, returning the default value passed if nothing was entered.
+func prompt(in *bufio.Reader, question, def string) string {
+	fmt.Printf("%s [%s]: ", question, def)
+	line, _ := in.ReadString('\n')
+	if line = strings.TrimSpace(line); line == "" {
+		return def
+	}
+	return line
+}
+
+// localAddresses returns the IPv4 addresses that clients on this machine or the local network may use to reach
+// the proxy.
+func localAddresses() []string {
+	addrs := []string{"127.0.0.1"}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return addrs
+	}
+	for _, a := range ifaceAddrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			addrs = append(addrs, ipNet.IP.String())
+		}
+	}
+	return addrs
+}
+
+// firstRun checks if the proxy is started for the first time: no config file exists at the path passed, no
+// flags other than -config were passed and the proxy is run interactively.
+func firstRun(path string) bool {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	flagsPassed := false
+	flag.Visit(func(f *flag.Flag) {
+		flagsPassed = flagsPassed || f.Name != "config"
+	})
+	if flagsPassed {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
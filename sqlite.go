@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	_ "modernc.org/sqlite"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	registerSubcommand("query", "Runs an SQL query over the packets stored in a SQLite database with -sqlite", runQuery)
+}
+
+// sqliteSchema creates the tables of the packet store. Sessions are identified by the run of the proxy, the unix
+// time in milliseconds at which it was started, and the session ID, as session IDs start at 1 again every run.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	run INTEGER NOT NULL,
+	session INTEGER NOT NULL,
+	player TEXT NOT NULL,
+	xuid TEXT NOT NULL,
+	upstream TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	PRIMARY KEY (run, session)
+);
+CREATE TABLE IF NOT EXISTS packets (
+	run INTEGER NOT NULL,
+	session INTEGER NOT NULL,
+	direction TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	packet TEXT NOT NULL,
+	id INTEGER NOT NULL,
+	size INTEGER NOT NULL,
+	payload TEXT
+);
+CREATE INDEX IF NOT EXISTS packets_session ON packets (run, session, time);
+CREATE INDEX IF NOT EXISTS packets_packet ON packets (packet, time);
+`
+
+// sqliteBatchSize is the amount of packets buffered before they are written to the database in one transaction.
+const sqliteBatchSize = 512
+
+// sqliteStore writes the packets passing through the proxy to a SQLite database with their payload encoded as
+// JSON, so that past sessions may be queried with SQL using the query subcommand.
+type sqliteStore struct {
+	db  *sql.DB
+	run int64
+
+	queue  chan packetEvent
+	closed chan struct{}
+	done   chan struct{}
+	// sessions holds the sessions of which a row was already written to the sessions table.
+	sessions map[int64]bool
+}
+
+// newSQLiteStore opens or creates the SQLite database at the path passed and starts writing packets to it.
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// Only a single connection writes to the database, which avoids SQLITE_BUSY errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA journal_mode=WAL;" + sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create tables: %w", err)
+	}
+	store := &sqliteStore{
+		db:       db,
+		run:      time.Now().UnixMilli(),
+		queue:    make(chan packetEvent, 4096),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+		sessions: map[int64]bool{},
+	}
+	go store.process()
+	return store, nil
+}
+
+// handlePacket queues a packet event to be written. It may be passed to addPacketListener.
+func (store *sqliteStore) handlePacket(e packetEvent) {
+	select {
+	case store.queue <- e:
+	case <-store.closed:
+	}
+}
+
+// process writes queued packets in batches until the store is closed, writing a batch at least every second.
+func (store *sqliteStore) process() {
+	defer close(store.done)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	batch := make([]packetEvent, 0, sqliteBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := store.write(batch); err != nil {
+			log.Printf("Unable to store packets in SQLite: %v\n", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e := <-store.queue:
+			if batch = append(batch, e); len(batch) >= sqliteBatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-store.closed:
+			for {
+				select {
+				case e := <-store.queue:
+					batch = append(batch, e)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes the packets passed to the database in a single transaction.
+func (store *sqliteStore) write(batch []packetEvent) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare("INSERT INTO packets (run, session, direction, time, packet, id, size, payload) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	for _, e := range batch {
+		if !store.sessions[e.Session] {
+			store.sessions[e.Session] = true
+			if s, ok := sessionByID(e.Session); ok {
+				identity := s.client.IdentityData()
+				_, err := tx.Exec("INSERT OR IGNORE INTO sessions (run, session, player, xuid, upstream, started) VALUES (?, ?, ?, ?, ?, ?)",
+					store.run, e.Session, identity.DisplayName, identity.XUID, s.upstream, e.Time.UnixMilli())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		var payload any
+		if e.Packet != nil {
+			b, err := json.Marshal(e.Packet)
+			if err == nil {
+				payload = string(b)
+			}
+		}
+		if _, err := insert.Exec(store.run, e.Session, e.Direction, e.Time.UnixMilli(), e.Name, e.ID, e.Size, payload); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// close writes the packets still queued and closes the database.
+func (store *sqliteStore) close() {
+	close(store.closed)
+	<-store.done
+	if err := store.db.Close(); err != nil {
+		log.Printf("Unable to close the SQLite database: %v\n", err)
+	}
+}
+
+// runQuery runs the query subcommand, which runs an SQL query over a database written with -sqlite and prints the
+// rows returned as a table or as JSON lines.
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	path := fs.String("db", "packets.db", "SQLite database written with -sqlite")
+	jsonLines := fs.Bool("json", false, "Print every row as a JSON object on its own line instead of a table")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: query [-db packets.db] [-json] <sql>\n\nTables:" + sqliteSchema)
+	}
+	if _, err := os.Stat(*path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", "file:"+*path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.Query(strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values, pointers := make([]any, len(columns)), make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	enc := json.NewEncoder(os.Stdout)
+	if !*jsonLines {
+		_, _ = fmt.Fprintln(w, strings.Join(columns, "\t"))
+	}
+	var n int
+	for ; rows.Next(); n++ {
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		if *jsonLines {
+			row := make(map[string]any, len(columns))
+			for i, column := range columns {
+				row[column] = values[i]
+			}
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+			continue
+		}
+		cells := make([]string, len(values))
+		for i, v := range values {
+			if v == nil {
+				cells[i] = "NULL"
+			} else {
+				cells[i] = strings.ReplaceAll(fmt.Sprint(v), "\t", " ")
+			}
+		}
+		_, _ = fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if *jsonLines {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Printf("%d rows\n", n)
+	return nil
+}
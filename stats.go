@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// packetCounter holds the amount and total size of packets of a type received in one direction.
+type packetCounter struct {
+	count, bytes int64
+}
+
+// packetStats holds the packet counters of all packets that passed through the proxy and those of every active
+// session, indexed by direction and name of the packet, and the counters of all packets by direction.
+var packetStats = struct {
+	sync.Mutex
+	total      map[string]*packetCounter
+	sessions   map[int64]map[string]*packetCounter
+	directions map[string]*packetCounter
+}{total: map[string]*packetCounter{}, sessions: map[int64]map[string]*packetCounter{}, directions: map[string]*packetCounter{
+	"serverbound": {},
+	"clientbound": {},
+}}
+
+// statsTopN is the amount of packets listed in the summary printed when the proxy shuts down.
+const statsTopN = 20
+
+// countPacket adds a packet to the counters of its session and the total counters.
+func countPacket(e packetEvent) {
+	key := e.Direction + "/" + e.Name
+	packetStats.Lock()
+	defer packetStats.Unlock()
+	session, ok := packetStats.sessions[e.Session]
+	if !ok {
+		session = map[string]*packetCounter{}
+		packetStats.sessions[e.Session] = session
+	}
+	for _, m := range []map[string]*packetCounter{packetStats.total, session} {
+		c, ok := m[key]
+		if !ok {
+			c = &packetCounter{}
+			m[key] = c
+		}
+		c.count++
+		c.bytes += int64(e.Size)
+	}
+	if c, ok := packetStats.directions[e.Direction]; ok {
+		c.count++
+		c.bytes += int64(e.Size)
+	}
+}
+
+// reportStats logs a line with the packet and byte rates in both directions and the amount of active sessions
+// every interval.
+func reportStats(interval time.Duration) {
+	var last [2]packetCounter
+	for range time.Tick(interval) {
+		packetStats.Lock()
+		current := [2]packetCounter{*packetStats.directions["serverbound"], *packetStats.directions["clientbound"]}
+		packetStats.Unlock()
+		seconds, sessions := interval.Seconds(), len(activeSessions())
+		fields := logFields{"sessions": strconv.Itoa(sessions)}
+		rates := make([]string, 2)
+		for i, direction := range []string{"serverbound", "clientbound"} {
+			packets := float64(current[i].count-last[i].count) / seconds
+			bytes := float64(current[i].bytes-last[i].bytes) / seconds
+			fields[direction+"_packets_per_second"] = strconv.FormatFloat(packets, 'f', 1, 64)
+			fields[direction+"_bytes_per_second"] = strconv.FormatFloat(bytes, 'f', 0, 64)
+			rates[i] = fmt.Sprintf("%s %.0f pk/s %s/s", direction, packets, formatBytes(int64(bytes)))
+		}
+		logf(fields, "Stats: %d sessions | %s | %s\n", sessions, rates[0], rates[1])
+		last = current
+	}
+}
+
+// logPacketStats logs a table of the n packets with the most bytes in the counters passed. packetStats must be
+// locked.
+func logPacketStats(counters map[string]*packetCounter, n int) {
+	keys := make([]string, 0, len(counters))
+	var count, bytes int64
+	for key, c := range counters {
+		keys = append(keys, key)
+		count += c.count
+		bytes += c.bytes
+	}
+	if len(keys) == 0 {
+		log.Println("No packets were counted.")
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := counters[keys[i]], counters[keys[j]]
+		if a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		return keys[i] < keys[j]
+	})
+	log.Printf("%-44s %10s %12s %7s\n", "Packet", "Count", "Bytes", "Share")
+	for i, key := range keys {
+		if i == n {
+			log.Printf("... and %d more\n", len(keys)-n)
+			break
+		}
+		c := counters[key]
+		log.Printf("%-44s %10d %12s %6.1f%%\n", key, c.count, formatBytes(c.bytes), float64(c.bytes)*100/float64(max(bytes, 1)))
+	}
+	log.Printf("%-44s %10d %12s\n", "Total", count, formatBytes(bytes))
+}
+
+func init() {
+	addPacketListener(countPacket)
+	addSessionCloseListener(func(id int64) {
+		packetStats.Lock()
+		delete(packetStats.sessions, id)
+		packetStats.Unlock()
+	})
+	onShutdown(func() {
+		packetStats.Lock()
+		defer packetStats.Unlock()
+		if len(packetStats.total) == 0 {
+			return
+		}
+		log.Println("Packet statistics:")
+		logPacketStats(packetStats.total, statsTopN)
+		logCompressionStats()
+	})
+	const usage = "Usage: stats [session ID] [amount]"
+	registerCommand("stats", consoleCommand{
+		usage:       "[session ID] [amount]",
+		description: "Shows the packets with the most bytes, in total or of one session, with their counts.",
+		run: func(args []string) {
+			var id int64 = -1
+			n := statsTopN
+			if len(args) > 0 {
+				var err error
+				if id, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+					log.Println(usage)
+					return
+				}
+			}
+			if len(args) > 1 {
+				var err error
+				if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+					log.Println(usage)
+					return
+				}
+			}
+			packetStats.Lock()
+			defer packetStats.Unlock()
+			if id < 0 {
+				logPacketStats(packetStats.total, n)
+				logCompressionStats()
+				return
+			}
+			counters, ok := packetStats.sessions[id]
+			if !ok {
+				log.Printf("No active session with ID %d.\n", id)
+				return
+			}
+			logPacketStats(counters, n)
+		},
+	})
+}
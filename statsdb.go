@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsDBFile is the file that the aggregates of closed sessions are stored in, or an empty string to not store
+// them.
+var statsDBFile = "stats.db"
+
+// statsBucket is the bucket of the stats database holding session aggregates, keyed by the time the session
+// started and its ID so that they are sorted chronologically.
+var statsBucket = []byte("sessions")
+
+// statsDB is the stats database, opened the first time a session is stored or the history is read.
+var statsDB struct {
+	sync.Mutex
+	db  *bbolt.DB
+	err error
+}
+
+// sessionAggregate holds the aggregates of a closed session.
+type sessionAggregate struct {
+	Session  int64     `json:"session"`
+	Player   string    `json:"player"`
+	Upstream string    `json:"upstream"`
+	Started  time.Time `json:"started"`
+	// Duration is the duration of the session in seconds.
+	Duration float64 `json:"duration"`
+	// ServerboundBytes and ClientboundBytes are the amount of bytes sent by the client and server.
+	ServerboundBytes int64 `json:"serverbound_bytes"`
+	ClientboundBytes int64 `json:"clientbound_bytes"`
+	// Classes holds the amount of packets of every packet group, with packets in no group counted as other.
+	Classes map[string]int64 `json:"classes"`
+	Reason  string           `json:"reason"`
+}
+
+// openStatsDB returns the stats database, opening it if it is not yet open.
+func openStatsDB() (*bbolt.DB, error) {
+	statsDB.Lock()
+	defer statsDB.Unlock()
+	if statsDB.db == nil && statsDB.err == nil {
+		statsDB.db, statsDB.err = bbolt.Open(statsDBFile, 0644, &bbolt.Options{Timeout: time.Second})
+		if statsDB.err == nil {
+			onShutdown(func() {
+				_ = statsDB.db.Close()
+			})
+		}
+	}
+	return statsDB.db, statsDB.err
+}
+
+// packetClasses maps the names of packets to the first packet group, in alphabetical order, that they are in.
+var packetClasses = struct {
+	sync.Once
+	m map[string]string
+}{}
+
+// packetClass returns the packet group the packet with the name passed is counted under in session aggregates.
+func packetClass(name string) string {
+	packetClasses.Do(func() {
+		packetClasses.m = map[string]string{}
+		groups := make([]string, 0, len(packetGroups))
+		for group := range packetGroups {
+			groups = append(groups, group)
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(groups)))
+		for _, group := range groups {
+			names, _ := expandPacketNames([]string{"@" + group})
+			for _, n := range names {
+				packetClasses.m[n] = group
+			}
+		}
+	})
+	if class, ok := packetClasses.m[name]; ok {
+		return class
+	}
+	return "other"
+}
+
+// storeSessionAggregate stores the aggregates of the session in the stats database. It must be called when the
+// session is closed, before its packet counters are removed.
+func (s *session) storeSessionAggregate(reason string) {
+	if statsDBFile == "" {
+		return
+	}
+	agg := sessionAggregate{
+		Session:          s.id,
+		Player:           s.client.IdentityData().DisplayName,
+		Upstream:         s.upstream,
+		Started:          s.started,
+		Duration:         time.Since(s.started).Seconds(),
+		ServerboundBytes: s.serverbound.bytes.Load(),
+		ClientboundBytes: s.clientbound.bytes.Load(),
+		Classes:          map[string]int64{},
+		Reason:           reason,
+	}
+	packetStats.Lock()
+	for key, c := range packetStats.sessions[s.id] {
+		_, name, _ := strings.Cut(key, "/")
+		agg.Classes[packetClass(name)] += c.count
+	}
+	packetStats.Unlock()
+
+	db, err := openStatsDB()
+	if err != nil {
+		log.Printf("Unable to open stats database: %v\n", err)
+		return
+	}
+	b, _ := json.Marshal(agg)
+	key := binary.BigEndian.AppendUint64(nil, uint64(s.started.UnixNano()))
+	key = binary.BigEndian.AppendUint64(key, uint64(s.id))
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(statsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, b)
+	}); err != nil {
+		log.Printf("Unable to store session aggregate: %v\n", err)
+	}
+}
+
+// sessionAggregatesSince returns the aggregates of all sessions started after the time passed, or of all sessions
+// if it is zero, oldest first.
+func sessionAggregatesSince(since time.Time) ([]sessionAggregate, error) {
+	db, err := openStatsDB()
+	if err != nil {
+		return nil, err
+	}
+	var aggs []sessionAggregate
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.First()
+		if !since.IsZero() {
+			k, v = c.Seek(binary.BigEndian.AppendUint64(nil, uint64(since.UnixNano())))
+		}
+		for ; k != nil; k, v = c.Next() {
+			var agg sessionAggregate
+			if err := json.Unmarshal(v, &agg); err != nil {
+				return fmt.Errorf("decode session aggregate: %w", err)
+			}
+			aggs = append(aggs, agg)
+		}
+		return nil
+	})
+	return aggs, err
+}
+
+// dailyAggregate holds the totals of the sessions started on a single day.
+type dailyAggregate struct {
+	Day      string           `json:"day"`
+	Sessions int              `json:"sessions"`
+	Duration float64          `json:"duration"`
+	Bytes    int64            `json:"bytes"`
+	Classes  map[string]int64 `json:"classes"`
+	Reasons  map[string]int   `json:"reasons"`
+}
+
+// aggregateDays sums the session aggregates passed by the day they were started on, with an entry for every day
+// of the last days passed, oldest first.
+func aggregateDays(aggs []sessionAggregate, days int) []*dailyAggregate {
+	result := make([]*dailyAggregate, days)
+	index := map[string]*dailyAggregate{}
+	today := time.Now()
+	for i := range result {
+		day := today.AddDate(0, 0, i-days+1).Format(time.DateOnly)
+		result[i] = &dailyAggregate{Day: day, Classes: map[string]int64{}, Reasons: map[string]int{}}
+		index[day] = result[i]
+	}
+	for _, agg := range aggs {
+		d, ok := index[agg.Started.Format(time.DateOnly)]
+		if !ok {
+			continue
+		}
+		d.Sessions++
+		d.Duration += agg.Duration
+		d.Bytes += agg.ServerboundBytes + agg.ClientboundBytes
+		for class, n := range agg.Classes {
+			d.Classes[class] += n
+		}
+		d.Reasons[agg.Reason]++
+	}
+	return result
+}
+
+// statsChart is a bar chart of a value per day on the history page.
+type statsChart struct {
+	Title string
+	Bars  []statsBar
+}
+
+// statsBar is a bar of a statsChart.
+type statsBar struct {
+	X, Y, Height float64
+	Label        string
+}
+
+// newStatsChart creates a chart of the values passed, one per day.
+func newStatsChart(title string, days []*dailyAggregate, value func(d *dailyAggregate) float64, label func(v float64) string) statsChart {
+	most := 1.0
+	for _, d := range days {
+		most = max(most, value(d))
+	}
+	chart := statsChart{Title: title}
+	width := 600 / float64(len(days))
+	for i, d := range days {
+		v := value(d)
+		height := v * 100 / most
+		chart.Bars = append(chart.Bars, statsBar{X: float64(i) * width, Y: 100 - height, Height: height, Label: d.Day + ": " + label(v)})
+	}
+	return chart
+}
+
+// statsPage is the HTML page of the session history.
+var statsPage = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Session history</title>
+<style>body{font-family:sans-serif}rect{fill:#36c}rect:hover{fill:#f80}</style></head>
+<body><h1>Session history of the last {{.Days}} days</h1>
+{{range .Charts}}<h2>{{.Title}}</h2><svg width="600" height="100">
+{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{$.Width}}" height="{{.Height}}"><title>{{.Label}}</title></rect>{{end}}
+</svg>{{end}}
+<h2>Disconnect reasons</h2><table>{{range .Reasons}}<tr><td>{{.Count}}</td><td>{{.Reason}}</td></tr>{{end}}</table>
+<p><a href="sessions.json?days={{.Days}}">JSON</a></p></body></html>
+`))
+
+// historyDays returns the amount of days requested with the days query parameter, 30 by default.
+func historyDays(r *http.Request) int {
+	if days, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && days > 0 && days <= 3650 {
+		return days
+	}
+	return 30
+}
+
+// serveStatsHistory serves charts of the session aggregates of the last days at the address passed.
+func serveStatsHistory(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		days := historyDays(r)
+		aggs, err := sessionAggregatesSince(time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		daily := aggregateDays(aggs, days)
+		charts := []statsChart{
+			newStatsChart("Sessions", daily, func(d *dailyAggregate) float64 {
+				return float64(d.Sessions)
+			}, func(v float64) string {
+				return strconv.Itoa(int(v))
+			}),
+			newStatsChart("Average duration", daily, func(d *dailyAggregate) float64 {
+				return d.Duration / float64(max(d.Sessions, 1))
+			}, func(v float64) string {
+				return (time.Duration(v) * time.Second).String()
+			}),
+			newStatsChart("Bytes", daily, func(d *dailyAggregate) float64 {
+				return float64(d.Bytes)
+			}, func(v float64) string {
+				return formatBytes(int64(v))
+			}),
+		}
+		classes := map[string]bool{}
+		reasons := map[string]int{}
+		for _, d := range daily {
+			for class := range d.Classes {
+				classes[class] = true
+			}
+			for reason, n := range d.Reasons {
+				reasons[reason] += n
+			}
+		}
+		names := make([]string, 0, len(classes))
+		for class := range classes {
+			names = append(names, class)
+		}
+		sort.Strings(names)
+		for _, class := range names {
+			charts = append(charts, newStatsChart("Packets: "+class, daily, func(d *dailyAggregate) float64 {
+				return float64(d.Classes[class])
+			}, func(v float64) string {
+				return strconv.Itoa(int(v))
+			}))
+		}
+		type reasonCount struct {
+			Reason string
+			Count  int
+		}
+		var sortedReasons []reasonCount
+		for reason, n := range reasons {
+			sortedReasons = append(sortedReasons, reasonCount{Reason: reason, Count: n})
+		}
+		sort.Slice(sortedReasons, func(i, j int) bool {
+			if sortedReasons[i].Count != sortedReasons[j].Count {
+				return sortedReasons[i].Count > sortedReasons[j].Count
+			}
+			return sortedReasons[i].Reason < sortedReasons[j].Reason
+		})
+		_ = statsPage.Execute(w, struct {
+			Days    int
+			Width   float64
+			Charts  []statsChart
+			Reasons []reasonCount
+		}{Days: days, Width: 600/float64(days) - 1, Charts: charts, Reasons: sortedReasons})
+	})
+	mux.HandleFunc("/sessions.json", func(w http.ResponseWriter, r *http.Request) {
+		aggs, err := sessionAggregatesSince(time.Now().AddDate(0, 0, -historyDays(r)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(aggs)
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("An error occurred whilst serving the session history: %v\n", err)
+	}
+}
+
+func init() {
+	registerCommand("history", consoleCommand{
+		usage:       "[days]",
+		description: "Shows the amount of sessions, their average duration and bytes per day, 7 days by default.",
+		run: func(args []string) {
+			if statsDBFile == "" {
+				log.Println("The stats database is disabled, enable it using -stats-db.")
+				return
+			}
+			days := 7
+			if len(args) > 0 {
+				if n, err := strconv.Atoi(args[0]); err == nil && n > 0 {
+					days = n
+				}
+			}
+			aggs, err := sessionAggregatesSince(time.Now().AddDate(0, 0, -days))
+			if err != nil {
+				log.Printf("Unable to read the stats database: %v\n", err)
+				return
+			}
+			for _, d := range aggregateDays(aggs, days) {
+				avg := time.Duration(0)
+				if d.Sessions > 0 {
+					avg = time.Duration(d.Duration/float64(d.Sessions)) * time.Second
+				}
+				log.Printf("%s: %d sessions, average duration %v, %s\n", d.Day, d.Sessions, avg, formatBytes(d.Bytes))
+			}
+		},
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/go-raknet"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSubcommand("board", "Serves a status board of a list of servers, pinging them periodically without proxying", runStatusBoard)
+}
+
+// boardSample is the status of a server of the status board at a point in time.
+type boardSample struct {
+	upstreamStatus
+	// Ping is the time in milliseconds the server took to answer the ping, or 0 if it did not answer.
+	Ping float64 `json:"ping_ms,omitempty"`
+}
+
+// boardServer holds the samples of a server monitored by the status board.
+type boardServer struct {
+	Addr    string        `json:"addr"`
+	Samples []boardSample `json:"samples"`
+}
+
+// statusBoard periodically pings a list of servers and keeps their statuses for a limited time.
+type statusBoard struct {
+	interval, history time.Duration
+
+	mu      sync.Mutex
+	servers []*boardServer
+}
+
+// runStatusBoard runs the board subcommand, which pings the servers passed as arguments or listed in a file every
+// interval and serves their statuses over time as HTML page and as JSON at /status.json.
+func runStatusBoard(args []string) error {
+	fs := flag.NewFlagSet("board", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "Address to serve the status board on")
+	file := fs.String("servers", "", "File listing the addresses of servers to monitor, one per line")
+	interval := fs.Duration("interval", time.Second*30, "Interval at which servers are pinged")
+	history := fs.Duration("history", time.Hour*24, "Duration that statuses of servers are kept for")
+	_ = fs.Parse(args)
+
+	addrs := fs.Args()
+	if *file != "" {
+		listed, err := readBoardServers(*file)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, listed...)
+	}
+	if len(addrs) == 0 || *interval <= 0 {
+		return errors.New("usage: board [-listen addr] [-servers file] [-interval 30s] [-history 24h] [host:port...]")
+	}
+	b := &statusBoard{interval: *interval, history: *history}
+	for _, addr := range addrs {
+		if !strings.Contains(addr, ":") {
+			addr += ":19132"
+		}
+		b.servers = append(b.servers, &boardServer{Addr: addr})
+	}
+	go b.run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", b.serveHTML)
+	mux.HandleFunc("/status.json", b.serveJSON)
+	log.Printf("Serving the status board of %d servers on http://%s\n", len(b.servers), *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+// readBoardServers reads the addresses of servers from a file, ignoring empty lines and lines starting with #.
+func readBoardServers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, scanner.Err()
+}
+
+// run pings all servers every interval.
+func (b *statusBoard) run() {
+	b.pingAll()
+	for range time.Tick(b.interval) {
+		b.pingAll()
+	}
+}
+
+// pingAll pings all servers concurrently and records their statuses, dropping samples older than the history.
+func (b *statusBoard) pingAll() {
+	var wg sync.WaitGroup
+	for _, srv := range b.servers {
+		wg.Add(1)
+		go func(srv *boardServer) {
+			defer wg.Done()
+			sample := boardSample{upstreamStatus: upstreamStatus{Time: time.Now()}}
+			if data, err := raknet.PingTimeout(srv.Addr, time.Second*5); err == nil {
+				sample.Ping = float64(time.Since(sample.Time).Microseconds()) / 1000
+				sample.upstreamStatus = parseUpstreamStatus(data)
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if n := len(srv.Samples); n == 0 || !sample.sameRelease(srv.Samples[n-1].upstreamStatus) {
+				logf(logFields{"upstream": srv.Addr, "version": sample.Version}, "Server %s status: online=%v version=%s protocol=%d motd=%q\n", srv.Addr, sample.Online, sample.Version, sample.Protocol, sample.MOTD)
+			}
+			srv.Samples = append(srv.Samples, sample)
+			cutoff := time.Now().Add(-b.history)
+			for len(srv.Samples) > 1 && srv.Samples[0].Time.Before(cutoff) {
+				srv.Samples = srv.Samples[1:]
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// serveJSON serves the samples of all servers as JSON.
+func (b *statusBoard) serveJSON(w http.ResponseWriter, _ *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(b.servers)
+}
+
+// boardRow is a row of the HTML status board.
+type boardRow struct {
+	Addr   string
+	Last   boardSample
+	Uptime string
+	// Points holds the SVG polyline points of the player count over time.
+	Points string
+}
+
+// boardPage is the HTML page of the status board.
+var boardPage = template.Must(template.New("board").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="{{.Refresh}}"><title>Status board</title>
+<style>body{font-family:sans-serif}td,th{padding:4px 10px;text-align:left}.off{color:#b00}</style></head>
+<body><h1>Status board</h1><table>
+<tr><th>Server</th><th>Status</th><th>Version</th><th>Players</th><th>Ping</th><th>Uptime</th><th>Players over time</th><th>MOTD</th></tr>
+{{range .Rows}}<tr><td>{{.Addr}}</td>
+{{if .Last.Online}}<td>online</td><td>{{.Last.Version}} ({{.Last.Protocol}})</td><td>{{.Last.Players}}/{{.Last.Max}}</td><td>{{printf "%.0f" .Last.Ping}} ms</td>
+{{else}}<td class="off">offline</td><td></td><td></td><td></td>{{end}}
+<td>{{.Uptime}}</td><td><svg width="200" height="30"><polyline fill="none" stroke="#36c" points="{{.Points}}"/></svg></td><td>{{.Last.MOTD}}</td></tr>
+{{end}}</table><p><a href="status.json">JSON</a></p></body></html>
+`))
+
+// serveHTML serves the status board as HTML page that refreshes every interval.
+func (b *statusBoard) serveHTML(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	b.mu.Lock()
+	rows := make([]boardRow, 0, len(b.servers))
+	for _, srv := range b.servers {
+		row := boardRow{Addr: srv.Addr}
+		if n := len(srv.Samples); n > 0 {
+			row.Last = srv.Samples[n-1]
+			online, most := 0, 1
+			for _, sample := range srv.Samples {
+				if sample.Online {
+					online++
+				}
+				most = max(most, sample.Players)
+			}
+			row.Uptime = fmt.Sprintf("%.1f%%", float64(online)*100/float64(n))
+			points := make([]string, n)
+			for i, sample := range srv.Samples {
+				x := 200.0
+				if n > 1 {
+					x = float64(i) * 200 / float64(n-1)
+				}
+				points[i] = fmt.Sprintf("%.1f,%.1f", x, 29-float64(sample.Players)*28/float64(most))
+			}
+			row.Points = strings.Join(points, " ")
+		}
+		rows = append(rows, row)
+	}
+	b.mu.Unlock()
+	_ = boardPage.Execute(w, struct {
+		Refresh int
+		Rows    []boardRow
+	}{Refresh: max(int(b.interval.Seconds()), 1), Rows: rows})
+}
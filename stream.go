@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// streaming specifies if the proxy streams packets to stdout, in which case nothing else is written to the
+// console so that the output can be piped into other tools.
+var streaming bool
+
+// enableStream starts streaming packets to stdout in the format passed. Only ndjson is supported, which writes
+// every packet logged as a single line of JSON holding its session, direction, name, ID, size and payload. Packets
+// are still subject to filters, and log sinks such as the log file keep receiving all entries.
+func enableStream(format string) error {
+	if format != "ndjson" {
+		return fmt.Errorf("invalid stream format %q: expected ndjson", format)
+	}
+	logSinks.Lock()
+	defer logSinks.Unlock()
+	streaming, logFormat, consoleWriter, consoleColor = true, "json", os.Stdout, false
+	return nil
+}
+
+// streamVisible checks if the log entry passed is written to stdout while streaming: only entries describing a
+// packet are.
+func streamVisible(e logEntry) bool {
+	return !streaming || e.payload != nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+)
+
+// localResponder answers a packet sent by the client locally, emulating the server. If handled is true, the
+// packet is not forwarded to the server and the responses are sent to the client instead.
+type localResponder func(s *session, pk packet.Packet) (responses []packet.Packet, handled bool)
+
+// localResponders holds the responders registered, indexed by the name of the packet they respond to.
+var localResponders = struct {
+	sync.RWMutex
+	m map[string]localResponder
+}{m: map[string]localResponder{}}
+
+// registerLocalResponder registers a responder for packets with the name passed, replacing any responder
+// previously registered for it.
+func registerLocalResponder(name string, r localResponder) {
+	localResponders.Lock()
+	localResponders.m[name] = r
+	localResponders.Unlock()
+}
+
+// respondLocally calls the responder registered for the packet passed, if any.
+func respondLocally(s *session, name string, pk packet.Packet) ([]packet.Packet, bool) {
+	localResponders.RLock()
+	r, ok := localResponders.m[name]
+	localResponders.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return r(s, pk)
+}
+
+// stubResponse is a packet described in a stub file that is sent to the client in response to a packet.
+type stubResponse struct {
+	// Packet is the name of the packet to send, such as ServerSettingsResponse.
+	Packet string `json:"packet,omitempty"`
+	// Fields holds the fields of the packet, encoded the same way encoding/json encodes the packet struct.
+	Fields json.RawMessage `json:"fields,omitempty"`
+}
+
+// loadStubs loads a stub file and registers a local responder for each packet in it. The file holds a JSON
+// object mapping the names of client packets to the responses that should be sent instead of forwarding them,
+// for example:
+//
+//	{"ServerSettingsRequest": [{"packet": "ServerSettingsResponse", "fields": {"FormID": 1, "FormData": "e30="}}]}
+func loadStubs(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var stubs map[string][]stubResponse
+	if err := json.Unmarshal(b, &stubs); err != nil {
+		return fmt.Errorf("decode stubs: %w", err)
+	}
+	for name, responses := range stubs {
+		if !packetKnown(name) {
+			return fmt.Errorf("stub for unknown packet %q", name)
+		}
+		for _, response := range responses {
+			// Decode each response once up front so that errors are reported on startup.
+			if _, err := response.decode(); err != nil {
+				return fmt.Errorf("stub for %s: %w", name, err)
+			}
+		}
+		responses := responses
+		registerLocalResponder(name, func(*session, packet.Packet) ([]packet.Packet, bool) {
+			pks := make([]packet.Packet, 0, len(responses))
+			for _, response := range responses {
+				pk, _ := response.decode()
+				pks = append(pks, pk)
+			}
+			return pks, true
+		})
+	}
+	return nil
+}
+
+// decode creates the packet described by the response.
+func (r stubResponse) decode() (packet.Packet, error) {
+	pk, ok := newPacket(r.Packet)
+	if !ok {
+		return nil, fmt.Errorf("unknown packet %q", r.Packet)
+	}
+	if len(r.Fields) != 0 {
+		if err := json.Unmarshal(r.Fields, pk); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", r.Packet, err)
+		}
+	}
+	return pk, nil
+}
+
+func init() {
+	registerCommand("stubs", consoleCommand{
+		description: "Lists client packets that are answered locally instead of being forwarded to the server.",
+		run: func([]string) {
+			localResponders.RLock()
+			names := make([]string, 0, len(localResponders.m))
+			for name := range localResponders.m {
+				names = append(names, name)
+			}
+			localResponders.RUnlock()
+			sort.Strings(names)
+			if len(names) == 0 {
+				log.Println("No packets are answered locally.")
+				return
+			}
+			for _, name := range names {
+				log.Println(name)
+			}
+		},
+	})
+}
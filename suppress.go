@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// suppressedPackets holds the packets that are consumed by the proxy and never forwarded to the client. This
+// may be used to create minimal reproduction environments or measure the impact of packets on the client.
+var suppressedPackets = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// suppressPackets marks the packets with the names passed as suppressed, or no longer suppressed.
+func suppressPackets(names []string, suppress bool) {
+	suppressedPackets.Lock()
+	defer suppressedPackets.Unlock()
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if suppress {
+			suppressedPackets.m[name] = true
+		} else {
+			delete(suppressedPackets.m, name)
+		}
+	}
+}
+
+// packetSuppressed checks if the packet with the name passed should not be forwarded to the client.
+func packetSuppressed(name string) bool {
+	suppressedPackets.RLock()
+	defer suppressedPackets.RUnlock()
+	return suppressedPackets.m[name]
+}
+
+func init() {
+	registerCommand("suppress", consoleCommand{
+		usage:       "<add|remove|list> [packets or @groups...]",
+		description: "Manages packets that are never forwarded to the client.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println("Usage: suppress <add|remove|list> [packets...]")
+				return
+			}
+			switch args[0] {
+			case "add", "remove":
+				names, err := expandPacketNames(args[1:])
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				suppressPackets(names, args[0] == "add")
+				log.Printf("Updated %d suppressed packet(s).\n", len(names))
+			case "list":
+				suppressedPackets.RLock()
+				names := make([]string, 0, len(suppressedPackets.m))
+				for name := range suppressedPackets.m {
+					names = append(names, name)
+				}
+				suppressedPackets.RUnlock()
+				sort.Strings(names)
+				log.Printf("Suppressed packets: %s\n", strings.Join(names, ", "))
+			default:
+				log.Println("Usage: suppress <add|remove|list> [packets...]")
+			}
+		},
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// activeTail holds the session that is currently tailed. While a session is tailed, packets of other sessions
+// are not logged to the console. Log sinks are not affected.
+var activeTail struct {
+	sync.Mutex
+	active  bool
+	session string
+	filter  string
+}
+
+// tailMatches checks if the packet with the name passed matches the filter of the tail, which matches packets
+// in the group referred to if it starts with @, or otherwise packets of which the name contains the filter,
+// case-insensitively.
+func tailMatches(filter, name string) bool {
+	if strings.HasPrefix(filter, "@") {
+		packets, _ := groupPackets(filter[1:])
+		for _, p := range packets {
+			if p == name {
+				return true
+			}
+		}
+		return false
+	}
+	return filter == "" || strings.Contains(strings.ToLower(name), strings.ToLower(filter))
+}
+
+// tailWants checks if a packet with the name passed that is normally filtered from logging should be logged
+// because it is explicitly requested by the filter of the current tail.
+func tailWants(session int64, name string) bool {
+	activeTail.Lock()
+	defer activeTail.Unlock()
+	return activeTail.active && activeTail.filter != "" && activeTail.session == strconv.FormatInt(session, 10) && tailMatches(activeTail.filter, name)
+}
+
+// consoleVisible checks if a log entry should be written to the console. Entries describing packets are only
+// visible if they belong to the session currently tailed, if any.
+func consoleVisible(e logEntry) bool {
+	name, ok := e.fields["packet"]
+	if !ok {
+		return true
+	}
+	activeTail.Lock()
+	defer activeTail.Unlock()
+	return !activeTail.active || (e.fields["session"] == activeTail.session && tailMatches(activeTail.filter, name))
+}
+
+func init() {
+	registerCommand("tail", consoleCommand{
+		usage:       "<session|off> [filter]",
+		description: "Only logs packets of a session to the console, optionally only those matching a filter.",
+		run: func(args []string) {
+			if len(args) == 0 {
+				log.Println("Usage: tail <session|off> [filter]")
+				return
+			}
+			if args[0] == "off" {
+				activeTail.Lock()
+				activeTail.active = false
+				activeTail.Unlock()
+				log.Println("Stopped tailing, packets of all sessions are logged again.")
+				return
+			}
+			id, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				log.Printf("Invalid session %q.\n", args[0])
+				return
+			}
+			if _, ok := sessionByID(id); !ok {
+				log.Printf("Session %d does not exist.\n", id)
+				return
+			}
+			filter := strings.Join(args[1:], " ")
+			activeTail.Lock()
+			activeTail.active, activeTail.session, activeTail.filter = true, args[0], filter
+			activeTail.Unlock()
+			log.Printf("Tailing session %d. Type 'tail off' to stop.\n", id)
+		},
+	})
+}
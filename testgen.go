@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerSubcommand("gentest", "Generates a Go test asserting the output of the packet handlers for a capture segment", runGenTest)
+}
+
+// goldenTimes matches times formatted using time.Time.String, which the packet handlers log and which are
+// replaced so that the output is the same every time it is replayed.
+var goldenTimes = regexp.MustCompile(`\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? [+-]\d{4} \S+( m=[+-][\d.]+)?`)
+
+// goldenSink is a logSink collecting the messages of all entries logged.
+type goldenSink struct {
+	lines []string
+}
+
+// write ...
+func (sink *goldenSink) write(e logEntry) error {
+	sink.lines = append(sink.lines, goldenTimes.ReplaceAllString(e.message, "<time>"))
+	return nil
+}
+
+// replayHandlerPipeline passes the records of a capture through the packet handlers and packet listeners as if
+// they were received by the proxy, and returns the lines logged whilst doing so. Times in the lines are replaced
+// with <time>. It is used by tests generated with the gentest subcommand.
+func replayHandlerPipeline(records []capture.Record, shieldID int32) ([]string, error) {
+	sink := &goldenSink{}
+	logSinks.Lock()
+	sinks, writer, previousFormat := logSinks.sinks, consoleWriter, logFormat
+	logSinks.sinks, consoleWriter, logFormat = []logSink{sink}, io.Discard, "text"
+	logSinks.Unlock()
+	defer func() {
+		logSinks.Lock()
+		logSinks.sinks, consoleWriter, logFormat = sinks, writer, previousFormat
+		logSinks.Unlock()
+	}()
+
+	replaySessions := map[uint64]*session{}
+	for i, r := range records {
+		if r.IsAnnotation() {
+			continue
+		}
+		pk, err := decodePacket(r.PacketID, r.Payload, shieldID)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		s, ok := replaySessions[r.Session]
+		if !ok {
+			s = &session{id: int64(r.Session), started: time.Unix(0, r.TimeUnixNano), closed: make(chan struct{})}
+			replaySessions[r.Session] = s
+		}
+		direction := "serverbound"
+		if r.Direction == capture.DirectionClientbound {
+			direction = "clientbound"
+		}
+		onPacketReceived(s, pk, r.Direction == capture.DirectionClientbound)
+		notifyPacketListeners(packetEvent{
+			Time: time.Unix(0, r.TimeUnixNano), Session: s.id, Direction: direction, Name: getType(pk, false),
+			ID: r.PacketID, Size: len(r.Payload), Packet: pk,
+		})
+	}
+	return sink.lines, nil
+}
+
+// goldenDiff describes the first line in which the output of a replay differs from the output expected, or
+// returns an empty string if they are equal.
+func goldenDiff(got, want []string) string {
+	for i := 0; i < len(got) || i < len(want); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Sprintf("line %d: missing, want %q", i, want[i])
+		case i >= len(want):
+			return fmt.Sprintf("line %d: got unexpected %q", i, got[i])
+		case got[i] != want[i]:
+			return fmt.Sprintf("line %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	return ""
+}
+
+// runGenTest runs the gentest subcommand, which replays a segment of a capture through the packet handlers and
+// writes a Go test asserting that replaying it again produces the same output, so that changes to handlers can
+// be validated against real traffic.
+func runGenTest(args []string) error {
+	fs := flag.NewFlagSet("gentest", flag.ExitOnError)
+	out := fs.String("o", "", "Output file (defaults to <capture>_golden_test.go)")
+	from := fs.Int("from", 0, "Index of the first record of the segment")
+	to := fs.Int("to", -1, "Index of the record after the last record of the segment, or -1 for the end of the capture")
+	name := fs.String("name", "", "Name of the test function, prefixed with TestGolden (defaults to the capture name)")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: gentest [-o output] [-from index] [-to index] [-name name] [-shield-id id] <capture>")
+	}
+	in := fs.Arg(0)
+	base := strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+	if *out == "" {
+		*out = base + "_golden_test.go"
+	}
+	if *name == "" {
+		*name = base
+	}
+
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec, err := capture.NewDecoder(f)
+	if err != nil {
+		return err
+	}
+	h := dec.Header()
+	var records []capture.Record
+	for i := 0; *to < 0 || i < *to; i++ {
+		r, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("read record %d: %w", i, err)
+		}
+		capture.Migrate(h, &r)
+		if i >= *from {
+			records = append(records, r)
+		}
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no records in %s between %d and %d", in, *from, *to)
+	}
+	lines, err := replayHandlerPipeline(records, int32(*shieldID))
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	_, _ = fmt.Fprintf(buf, "// Code generated by bds-mitm gentest from %s, records %d-%d. DO NOT EDIT.\n\n", filepath.Base(in), *from, *from+len(records))
+	buf.WriteString("package main\n\nimport (\n\t\"bds-mitm/capture\"\n\t\"testing\"\n)\n\n")
+	_, _ = fmt.Fprintf(buf, "func TestGolden%s(t *testing.T) {\n", goIdentifier(*name))
+	buf.WriteString("\trecords := []capture.Record{\n")
+	for _, r := range records {
+		_, _ = fmt.Fprintf(buf, "\t\t{TimeUnixNano: %d, Session: %d, Direction: %d, PacketID: %d, PacketName: %q, Payload: []byte(%s)},\n",
+			r.TimeUnixNano, r.Session, r.Direction, r.PacketID, r.PacketName, strconv.Quote(string(r.Payload)))
+	}
+	buf.WriteString("\t}\n\twant := []string{\n")
+	for _, line := range lines {
+		_, _ = fmt.Fprintf(buf, "\t\t%q,\n", line)
+	}
+	_, _ = fmt.Fprintf(buf, "\t}\n\tgot, err := replayHandlerPipeline(records, %d)\n", *shieldID)
+	buf.WriteString(`	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := goldenDiff(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+}
+`)
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("format test: %w", err)
+	}
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote test of %d records and %d output lines to %s\n", len(records), len(lines), *out)
+	return nil
+}
+
+// goIdentifier turns the name passed into an exported Go identifier by removing all characters that are not
+// letters or digits and capitalising the words in between.
+func goIdentifier(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9':
+			if upper {
+				r = []rune(strings.ToUpper(string(r)))[0]
+			}
+			b.WriteRune(r)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	return b.String()
+}
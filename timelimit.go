@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sessionLimit is the maximum duration of a session, after which the client is disconnected, or 0 for no limit.
+var sessionLimit time.Duration
+
+// sessionWarnings holds the times before the session limit at which the player is warned that it will be
+// disconnected, sorted from longest to shortest.
+var sessionWarnings = []time.Duration{time.Minute * 5, time.Minute, time.Second * 10}
+
+// parseSessionWarnings parses a comma separated list of durations before the session limit at which players are
+// warned, such as 5m,1m,10s.
+func parseSessionWarnings(list string) ([]time.Duration, error) {
+	var warnings []time.Duration
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("session warning %q: %w", s, err)
+		}
+		warnings = append(warnings, d)
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		return warnings[i] > warnings[j]
+	})
+	return warnings, nil
+}
+
+// enforceTimeLimit warns the player of the session at each of the session warnings and disconnects it once the
+// session limit is reached, unless the session is closed before.
+func (s *session) enforceTimeLimit() {
+	end := s.started.Add(sessionLimit)
+	for _, warning := range sessionWarnings {
+		if warning >= sessionLimit {
+			continue
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(time.Until(end.Add(-warning))):
+		}
+		_ = s.sendToClient(&packet.Text{TextType: packet.TextTypeRaw, Message: fmt.Sprintf("§eThis session ends in %v.", warning)})
+	}
+	select {
+	case <-s.closed:
+		return
+	case <-time.After(time.Until(end)):
+	}
+	log.Printf("Session %d reached the session limit of %v, disconnecting\n", s.id, sessionLimit)
+	s.close(fmt.Errorf("session limit: %w", minecraft.DisconnectError(fmt.Sprintf("The session limit of %v was reached.", sessionLimit))))
+}
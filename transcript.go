@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerSubcommand("transcript", "Prints a readable transcript of the actions of the player of a capture, such as blocks broken and commands used", runTranscript)
+}
+
+// containerNames holds readable names of the container types of ContainerOpen packets.
+var containerNames = map[int32]string{
+	protocol.ContainerTypeContainer:     "chest",
+	protocol.ContainerTypeWorkbench:     "crafting table",
+	protocol.ContainerTypeFurnace:       "furnace",
+	protocol.ContainerTypeEnchantment:   "enchanting table",
+	protocol.ContainerTypeBrewingStand:  "brewing stand",
+	protocol.ContainerTypeAnvil:         "anvil",
+	protocol.ContainerTypeDispenser:     "dispenser",
+	protocol.ContainerTypeDropper:       "dropper",
+	protocol.ContainerTypeHopper:        "hopper",
+	protocol.ContainerTypeCartChest:     "minecart with chest",
+	protocol.ContainerTypeHorse:         "horse inventory",
+	protocol.ContainerTypeBeacon:        "beacon",
+	protocol.ContainerTypeTrade:         "trade screen",
+	protocol.ContainerTypeBlastFurnace:  "blast furnace",
+	protocol.ContainerTypeSmoker:        "smoker",
+	protocol.ContainerTypeSmithingTable: "smithing table",
+	protocol.ContainerTypeChestBoat:     "boat with chest",
+}
+
+// transcriber turns the packets of a session into a transcript of the actions of its player, such as "broke block
+// at (1, 64, 2)", so that sessions can be followed without knowledge of the protocol.
+type transcriber struct {
+	// player is the entity runtime ID of the player, or 0 if it is not yet known.
+	player uint64
+	health float32
+	// items holds the names of items indexed by their network ID.
+	items map[int32]string
+}
+
+// newTranscriber returns a transcriber for a session started with the game data passed.
+func newTranscriber(data minecraft.GameData) *transcriber {
+	t := &transcriber{items: map[int32]string{}}
+	t.learnGameData(data)
+	return t
+}
+
+// learnGameData learns the runtime ID of the player and the names of items from the game data passed.
+func (t *transcriber) learnGameData(data minecraft.GameData) {
+	t.player = data.EntityRuntimeID
+	for _, item := range data.Items {
+		t.items[int32(item.RuntimeID)] = item.Name
+	}
+}
+
+// itemName returns the name of the item of the instance passed.
+func (t *transcriber) itemName(item protocol.ItemInstance) string {
+	if item.Stack.NetworkID == 0 {
+		return "empty hand"
+	}
+	if name, ok := t.items[item.Stack.NetworkID]; ok {
+		return strings.TrimPrefix(name, "minecraft:")
+	}
+	return fmt.Sprintf("item %d", item.Stack.NetworkID)
+}
+
+// formatBlockPos formats a block position as (x, y, z).
+func formatBlockPos(pos protocol.BlockPos) string {
+	return fmt.Sprintf("(%d, %d, %d)", pos.X(), pos.Y(), pos.Z())
+}
+
+// describe returns the actions described by the packet passed, sent by the server if fromServer is true. Packets
+// that don't describe an action of the player return no actions.
+func (t *transcriber) describe(pk packet.Packet, fromServer bool) []string {
+	if fromServer {
+		return t.describeClientbound(pk)
+	}
+	switch pk := pk.(type) {
+	case *packet.Text:
+		if pk.TextType == packet.TextTypeChat {
+			return []string{fmt.Sprintf("said %q", pk.Message)}
+		}
+	case *packet.CommandRequest:
+		return []string{"used " + pk.CommandLine}
+	case *packet.PlayerAction:
+		if t.player == 0 {
+			t.player = pk.EntityRuntimeID
+		}
+		switch pk.ActionType {
+		case protocol.PlayerActionStartBreak:
+			return []string{"started breaking block at " + formatBlockPos(pk.BlockPosition)}
+		case protocol.PlayerActionCreativePlayerDestroyBlock:
+			return []string{"broke block at " + formatBlockPos(pk.BlockPosition)}
+		case protocol.PlayerActionRespawn:
+			return []string{"respawned"}
+		case protocol.PlayerActionStartSleeping:
+			return []string{"went to sleep"}
+		case protocol.PlayerActionStartGlide:
+			return []string{"started gliding"}
+		}
+	case *packet.PlayerAuthInput:
+		var actions []string
+		for _, action := range pk.BlockActions {
+			switch action.Action {
+			case protocol.PlayerActionStartBreak:
+				actions = append(actions, "started breaking block at "+formatBlockPos(action.BlockPos))
+			case protocol.PlayerActionPredictDestroyBlock:
+				actions = append(actions, "broke block at "+formatBlockPos(action.BlockPos))
+			}
+		}
+		return actions
+	case *packet.InventoryTransaction:
+		switch data := pk.TransactionData.(type) {
+		case *protocol.UseItemTransactionData:
+			switch data.ActionType {
+			case protocol.UseItemActionClickBlock:
+				return []string{fmt.Sprintf("used %s on block at %s", t.itemName(data.HeldItem), formatBlockPos(data.BlockPosition))}
+			case protocol.UseItemActionClickAir:
+				return []string{"used " + t.itemName(data.HeldItem)}
+			case protocol.UseItemActionBreakBlock:
+				return []string{"broke block at " + formatBlockPos(data.BlockPosition)}
+			}
+		case *protocol.UseItemOnEntityTransactionData:
+			if data.ActionType == protocol.UseItemOnEntityActionAttack {
+				return []string{fmt.Sprintf("attacked entity %d with %s", data.TargetEntityRuntimeID, t.itemName(data.HeldItem))}
+			}
+			return []string{fmt.Sprintf("interacted with entity %d", data.TargetEntityRuntimeID)}
+		case *protocol.ReleaseItemTransactionData:
+			return []string{"released " + t.itemName(data.HeldItem)}
+		}
+	case *packet.ItemStackRequest:
+		var actions []string
+		for _, request := range pk.Requests {
+			for _, action := range request.Actions {
+				switch action := action.(type) {
+				case *protocol.DropStackRequestAction:
+					actions = append(actions, fmt.Sprintf("dropped %d items", action.Count))
+				case *protocol.CraftRecipeStackRequestAction:
+					actions = append(actions, fmt.Sprintf("crafted recipe %d", action.RecipeNetworkID))
+				}
+			}
+		}
+		return actions
+	case *packet.Interact:
+		if pk.ActionType == packet.InteractActionOpenInventory {
+			return []string{"opened inventory"}
+		}
+	case *packet.ContainerClose:
+		return []string{"closed container"}
+	}
+	return nil
+}
+
+// describeClientbound returns the actions described by the packet passed sent by the server.
+func (t *transcriber) describeClientbound(pk packet.Packet) []string {
+	switch pk := pk.(type) {
+	case *packet.StartGame:
+		t.learnGameData(gameDataFromStartGame(pk))
+	case *packet.ContainerOpen:
+		// The container type is signed, as the inventory of the player has type -1.
+		containerType := int32(int8(pk.ContainerType))
+		if containerType == protocol.ContainerTypeInventory {
+			return []string{"opened inventory"}
+		}
+		name, ok := containerNames[containerType]
+		if !ok {
+			name = fmt.Sprintf("container of type %d", containerType)
+		}
+		return []string{fmt.Sprintf("opened %s at %s", name, formatBlockPos(pk.ContainerPosition))}
+	case *packet.ChangeDimension:
+		return []string{"moved to the " + dimensionName(pk.Dimension)}
+	case *packet.MovePlayer:
+		if pk.EntityRuntimeID == t.player && pk.Mode == packet.MoveModeTeleport {
+			return []string{fmt.Sprintf("was teleported to (%.1f, %.1f, %.1f)", pk.Position[0], pk.Position[1], pk.Position[2])}
+		}
+	case *packet.UpdateAttributes:
+		if pk.EntityRuntimeID != t.player {
+			break
+		}
+		for _, attribute := range pk.Attributes {
+			if attribute.Name != "minecraft:health" {
+				continue
+			}
+			previous := t.health
+			t.health = attribute.Value
+			if previous > 0 && attribute.Value < previous {
+				return []string{fmt.Sprintf("took %.1f damage, %.1f health left", previous-attribute.Value, attribute.Value)}
+			}
+		}
+	case *packet.DeathInfo:
+		return []string{"died: " + pk.Cause}
+	case *packet.Disconnect:
+		return []string{fmt.Sprintf("was disconnected: %q", pk.Message)}
+	}
+	return nil
+}
+
+// transcriptFile is the file that transcripts of the actions of players in all sessions are appended to, or an
+// empty string to not write transcripts.
+var transcriptFile string
+
+// transcripts holds the transcribers of active sessions and the file transcripts are written to.
+var transcripts = struct {
+	sync.Mutex
+	w *bufio.Writer
+	f *os.File
+	m map[int64]*transcriber
+}{m: map[int64]*transcriber{}}
+
+// startTranscripts opens the transcript file and starts transcribing the actions of players of all sessions.
+func startTranscripts(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	transcripts.f, transcripts.w = f, bufio.NewWriter(f)
+	addPacketListener(transcribePacket)
+	addSessionCloseListener(func(id int64) {
+		transcripts.Lock()
+		defer transcripts.Unlock()
+		delete(transcripts.m, id)
+		_ = transcripts.w.Flush()
+	})
+	onShutdown(func() {
+		transcripts.Lock()
+		defer transcripts.Unlock()
+		_ = transcripts.w.Flush()
+		_ = transcripts.f.Close()
+	})
+	return nil
+}
+
+// transcribePacket appends the actions described by the packet event passed to the transcript file.
+func transcribePacket(e packetEvent) {
+	if e.Packet == nil {
+		return
+	}
+	transcripts.Lock()
+	defer transcripts.Unlock()
+	s, ok := sessionByID(e.Session)
+	if !ok {
+		return
+	}
+	t, ok := transcripts.m[e.Session]
+	if !ok {
+		t = newTranscriber(s.server.GameData())
+		transcripts.m[e.Session] = t
+	}
+	for _, action := range t.describe(e.Packet, e.Direction == "clientbound") {
+		_, _ = fmt.Fprintf(transcripts.w, "%s #%d %s %s\n", e.Time.Format(time.RFC3339), e.Session, s.client.IdentityData().DisplayName, action)
+	}
+}
+
+// runTranscript runs the transcript subcommand, which prints the actions of the player of a session of a capture
+// derived from its packets.
+func runTranscript(args []string) error {
+	fs := flag.NewFlagSet("transcript", flag.ExitOnError)
+	out := fs.String("o", "-", "Output file, or - to write to stdout")
+	sessionID := fs.Uint64("session", 0, "Session to transcribe, or 0 for all sessions")
+	shieldID := fs.Int("shield-id", 0, "Runtime ID of the shield item, used to decode item stacks")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: transcript [-o output] [-session id] [-shield-id id] <capture|manifest>")
+	}
+	files, err := capture.Files(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		dst, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		w = dst
+	}
+	buf := bufio.NewWriter(w)
+	transcribers := map[uint64]*transcriber{}
+	var start int64
+	var n int
+	for _, file := range files {
+		err := forEachRecord(file, func(r capture.Record) error {
+			if *sessionID != 0 && r.Session != *sessionID {
+				return nil
+			}
+			if start == 0 {
+				start = r.TimeUnixNano
+			}
+			offset := time.Duration(r.TimeUnixNano - start).Round(time.Millisecond)
+			if r.IsAnnotation() {
+				n++
+				_, err := fmt.Fprintf(buf, "[+%v] #%d mark: %s\n", offset, r.Session, r.Annotation)
+				return err
+			}
+			pk, err := decodePacket(r.PacketID, r.Payload, int32(*shieldID))
+			if err != nil {
+				return nil
+			}
+			t, ok := transcribers[r.Session]
+			if !ok {
+				t = &transcriber{items: map[int32]string{}}
+				transcribers[r.Session] = t
+			}
+			for _, action := range t.describe(pk, r.Direction == capture.DirectionClientbound) {
+				n++
+				if _, err := fmt.Fprintf(buf, "[+%v] #%d %s\n", offset, r.Session, action); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if *out != "-" {
+		log.Printf("Wrote %d actions to %s\n", n, *out)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"fyne.io/systray"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// traySessionSlots is the maximum amount of sessions listed in the sessions menu of the tray.
+const traySessionSlots = 10
+
+// runTray shows the proxy in the system tray until it is quit from the tray. The tray allows starting and
+// stopping the proxy, lists the active sessions and opens the dashboard at the URL passed, if not empty.
+func runTray(hostString, dashboardURL string) {
+	systray.Run(func() {
+		systray.SetIcon(trayIcon())
+		systray.SetTitle("bds-mitm")
+		systray.SetTooltip("bds-mitm proxying to " + hostString)
+
+		status := systray.AddMenuItem("", "")
+		status.Disable()
+		toggle := systray.AddMenuItem("", "Start or stop accepting new connections")
+		sessionMenu := systray.AddMenuItem("", "Sessions currently proxied")
+		var slots [traySessionSlots]*systray.MenuItem
+		for i := range slots {
+			slots[i] = sessionMenu.AddSubMenuItem("", "")
+			slots[i].Disable()
+			slots[i].Hide()
+		}
+		dashboard := systray.AddMenuItem("Open dashboard", "Open the dashboard in the browser")
+		if dashboardURL == "" {
+			dashboard.SetTooltip("No dashboard URL was configured with -dashboard-url")
+			dashboard.Disable()
+		}
+		systray.AddSeparator()
+		quit := systray.AddMenuItem("Quit", "Stop the proxy and exit")
+
+		update := func() {
+			if acceptingConnections.Load() {
+				status.SetTitle("Accepting connections to " + hostString)
+				toggle.SetTitle("Stop proxy")
+			} else {
+				status.SetTitle("Stopped, existing sessions continue")
+				toggle.SetTitle("Start proxy")
+			}
+			list := activeSessions()
+			sessionMenu.SetTitle(fmt.Sprintf("Sessions (%d)", len(list)))
+			for i, slot := range slots {
+				if i >= len(list) {
+					slot.Hide()
+					continue
+				}
+				s := list[i]
+				slot.SetTitle(fmt.Sprintf("#%d %s (%s)", s.id, s.client.IdentityData().DisplayName, time.Since(s.started).Round(time.Second)))
+				slot.Show()
+			}
+		}
+		update()
+		go func() {
+			ticker := time.NewTicker(time.Second * 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-toggle.ClickedCh:
+					acceptingConnections.Store(!acceptingConnections.Load())
+				case <-dashboard.ClickedCh:
+					if err := openBrowser(dashboardURL); err != nil {
+						log.Printf("An error occurred whilst opening the dashboard: %v\n", err)
+					}
+				case <-quit.ClickedCh:
+					systray.Quit()
+					return
+				}
+				update()
+			}
+		}()
+	}, shutdown)
+}
+
+// openBrowser opens the URL passed in the default browser of the user.
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
+
+// trayIcon returns the icon shown in the system tray: a green square with a darker border. On Windows, the
+// icon is wrapped in an ICO container as required by the tray.
+func trayIcon() []byte {
+	const size = 32
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			c := color.RGBA{R: 0x4c, G: 0xaf, B: 0x50, A: 0xff}
+			if x < 3 || y < 3 || x >= size-3 || y >= size-3 {
+				c = color.RGBA{R: 0x2e, G: 0x7d, B: 0x32, A: 0xff}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	_ = png.Encode(buf, img)
+	if runtime.GOOS != "windows" {
+		return buf.Bytes()
+	}
+	// An ICO file holding a single PNG image: the ICONDIR header, one ICONDIRENTRY and the PNG data.
+	ico := new(bytes.Buffer)
+	_ = binary.Write(ico, binary.LittleEndian, []uint16{0, 1, 1})
+	ico.Write([]byte{size, size, 0, 0})
+	_ = binary.Write(ico, binary.LittleEndian, []uint16{1, 32})
+	_ = binary.Write(ico, binary.LittleEndian, []uint32{uint32(buf.Len()), 22})
+	ico.Write(buf.Bytes())
+	return ico.Bytes()
+}
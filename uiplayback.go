@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bds-mitm/capture"
+	"encoding/binary"
+	"errors"
+	"github.com/sandertv/gophertunnel/minecraft"
+	"github.com/sandertv/gophertunnel/minecraft/protocol/packet"
+	"log"
+	"time"
+)
+
+// uiFormTimeout is the time UI playback waits for a client to answer a form before it continues with the packets
+// after it.
+const uiFormTimeout = time.Minute
+
+// uiRecords returns the records of the form and UI packets among the records passed, and the first
+// ServerSettingsResponse, which is only sent when the client asks for it. The settings record is nil if the
+// records hold none.
+func uiRecords(records []capture.Record) (ui []capture.Record, settings *capture.Record) {
+	names, _ := groupPackets("ui")
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = true
+	}
+	for i, r := range records {
+		switch {
+		case r.PacketID == packet.IDServerSettingsResponse:
+			if settings == nil {
+				settings = &records[i]
+			}
+		case selected[r.PacketName]:
+			ui = append(ui, r)
+		}
+	}
+	return ui, settings
+}
+
+// writeRecord writes the payload of the record passed to the connection as a packet and flushes it.
+func writeRecord(conn *minecraft.Conn, r capture.Record) error {
+	if _, err := conn.Write(append(binary.AppendUvarint(nil, uint64(r.PacketID)), r.Payload...)); err != nil {
+		return err
+	}
+	return conn.Flush()
+}
+
+// playUIFlow plays the form and UI packets of the replayer back to every client that connects. Clients are spawned
+// in an empty world with the game data of the capture, and everything else the server sent is left out, so that
+// UI bugs can be reproduced without the server the capture was made on.
+func playUIFlow(replayer *crashReplayer, speed float64) error {
+	records, settings := uiRecords(replayer.records)
+	if len(records) == 0 {
+		return errors.New("the capture holds no form or UI packets to play back")
+	}
+	for {
+		log.Printf("Waiting for a client to connect to %s to play back %d form and UI packets\n", replayer.listener.Addr(), len(records))
+		c, err := replayer.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveUIFlow(c.(*minecraft.Conn), replayer.data, records, settings, speed)
+	}
+}
+
+// serveUIFlow spawns the client of the connection passed and plays the UI records passed back to it with their
+// original timing. After a form is shown, the next packet is only sent once the client answered the form, so
+// that the flow is followed at the pace of the player. Packets of the client are answered minimally so that it
+// stays connected.
+func serveUIFlow(conn *minecraft.Conn, data minecraft.GameData, records []capture.Record, settings *capture.Record, speed float64) {
+	defer conn.Close()
+	name := conn.IdentityData().DisplayName
+	if err := conn.StartGame(data); err != nil {
+		log.Printf("An error occurred whilst starting game: %v\n", err)
+		return
+	}
+	sendEmptyWorld(conn, data)
+
+	answered, closed := make(chan struct{}, 1), make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			pk, err := conn.ReadPacket()
+			if err != nil {
+				return
+			}
+			switch pk := pk.(type) {
+			case *packet.ModalFormResponse:
+				select {
+				case answered <- struct{}{}:
+				default:
+				}
+			case *packet.ServerSettingsRequest:
+				if settings != nil {
+					_ = writeRecord(conn, *settings)
+				}
+			case *packet.ContainerClose:
+				// The client keeps the container open until the server confirms it was closed.
+				_ = conn.WritePacket(&packet.ContainerClose{WindowID: pk.WindowID})
+			case *packet.NetworkStackLatency:
+				if pk.NeedsResponse {
+					_ = conn.WritePacket(&packet.NetworkStackLatency{Timestamp: pk.Timestamp})
+				}
+			case *packet.RequestChunkRadius:
+				_ = conn.WritePacket(&packet.ChunkRadiusUpdated{ChunkRadius: min(pk.ChunkRadius, clientOnlyRadius)})
+			case *packet.CommandRequest:
+				_ = conn.WritePacket(&packet.Text{TextType: packet.TextTypeRaw, Message: "§cCommands are not available during UI playback."})
+			}
+		}
+	}()
+
+	start, first := time.Now(), records[0].TimeUnixNano
+	for i, r := range records {
+		due := start.Add(time.Duration(float64(r.TimeUnixNano-first) / speed))
+		select {
+		case <-closed:
+			log.Printf("%s disconnected after %d of %d UI packets\n", name, i, len(records))
+			return
+		case <-time.After(time.Until(due)):
+		}
+		if err := writeRecord(conn, r); err != nil {
+			return
+		}
+		if r.PacketID != packet.IDModalFormRequest {
+			continue
+		}
+		select {
+		case <-closed:
+			log.Printf("%s disconnected without answering form %d of %d UI packets\n", name, i+1, len(records))
+			return
+		case <-answered:
+		case <-time.After(uiFormTimeout):
+			log.Printf("%s did not answer the form within %v, continuing\n", name, uiFormTimeout)
+		}
+		// The packets after the form are timed from the moment it was answered.
+		start, first = time.Now(), r.TimeUnixNano
+	}
+	log.Printf("Played back all %d UI packets to %s, who may stay connected to examine the last UI\n", len(records), name)
+	<-closed
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logVerbosity is the amount of detail with which packets are logged: quiet to only log connections and
+// disconnections, summary to periodically log the names and counts of the packets of each session, or full to log
+// every packet with its payload.
+var logVerbosity = "full"
+
+// summaryInterval is the interval at which packet counts are logged if the log verbosity is summary.
+const summaryInterval = time.Second * 10
+
+// packetSummaries holds the amount of packets of each type received since the last summary, indexed by session
+// ID and direction.
+var packetSummaries = struct {
+	sync.Mutex
+	m map[int64]*[2]map[string]int
+}{m: map[int64]*[2]map[string]int{}}
+
+// parseVerbosity checks if the verbosity passed is valid.
+func parseVerbosity(verbosity string) error {
+	switch verbosity {
+	case "quiet", "summary", "full":
+		return nil
+	}
+	return fmt.Errorf("invalid verbosity %q: expected quiet, summary or full", verbosity)
+}
+
+// packetLoggedInFull checks if packets are logged one by one. If they are not, the packet with the name passed is
+// counted for the next summary of the session.
+func (s *session) packetLoggedInFull(name string, fromServer bool) bool {
+	switch logVerbosity {
+	case "full":
+		return true
+	case "summary":
+		packetSummaries.Lock()
+		counts, ok := packetSummaries.m[s.id]
+		if !ok {
+			counts = &[2]map[string]int{{}, {}}
+			packetSummaries.m[s.id] = counts
+		}
+		if fromServer {
+			counts[1][name]++
+		} else {
+			counts[0][name]++
+		}
+		packetSummaries.Unlock()
+	}
+	return false
+}
+
+// packetSummariesStarted ensures the packet summaries are only logged by one goroutine.
+var packetSummariesStarted sync.Once
+
+// startPacketSummaries starts logging packet summaries if they are not logged yet.
+func startPacketSummaries() {
+	packetSummariesStarted.Do(func() {
+		go logPacketSummaries()
+	})
+}
+
+// logPacketSummaries logs the packet counts of every session every summary interval.
+func logPacketSummaries() {
+	for range time.Tick(summaryInterval) {
+		packetSummaries.Lock()
+		ids := make([]int64, 0, len(packetSummaries.m))
+		for id := range packetSummaries.m {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i] < ids[j]
+		})
+		for _, id := range ids {
+			logPacketSummary(id)
+		}
+		packetSummaries.Unlock()
+	}
+}
+
+// logPacketSummary logs the packet counts of the session with the ID passed and resets them. packetSummaries must
+// be locked.
+func logPacketSummary(id int64) {
+	counts, ok := packetSummaries.m[id]
+	if !ok {
+		return
+	}
+	delete(packetSummaries.m, id)
+	parts := make([]string, 0, 2)
+	for i, direction := range []string{"serverbound", "clientbound"} {
+		if len(counts[i]) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(counts[i]))
+		for name := range counts[i] {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(a, b int) bool {
+			if counts[i][names[a]] != counts[i][names[b]] {
+				return counts[i][names[a]] > counts[i][names[b]]
+			}
+			return names[a] < names[b]
+		})
+		for j, name := range names {
+			names[j] = fmt.Sprintf("%s %d", name, counts[i][name])
+		}
+		parts = append(parts, direction+": "+strings.Join(names, ", "))
+	}
+	logf(logFields{"session": fmt.Sprint(id)}, "Session %d packets: %s\n", id, strings.Join(parts, " | "))
+}
+
+func init() {
+	addSessionCloseListener(func(id int64) {
+		packetSummaries.Lock()
+		logPacketSummary(id)
+		packetSummaries.Unlock()
+	})
+}
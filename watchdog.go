@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/sandertv/go-raknet"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamStatus is the status of the upstream server as advertised in its response to a ping.
+type upstreamStatus struct {
+	Time     time.Time `json:"time"`
+	Online   bool      `json:"online"`
+	MOTD     string    `json:"motd,omitempty"`
+	SubMOTD  string    `json:"sub_motd,omitempty"`
+	Protocol int       `json:"protocol,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Players  int       `json:"players,omitempty"`
+	Max      int       `json:"max_players,omitempty"`
+}
+
+// parseUpstreamStatus parses the pong data sent by a Minecraft server, which has the format
+// MCPE;MOTD;protocol;version;players;max players;server ID;sub MOTD;game mode;...
+func parseUpstreamStatus(data []byte) upstreamStatus {
+	status := upstreamStatus{Time: time.Now(), Online: true}
+	frag := strings.Split(string(data), ";")
+	get := func(i int) string {
+		if i < len(frag) {
+			return frag[i]
+		}
+		return ""
+	}
+	status.MOTD, status.Version, status.SubMOTD = get(1), get(3), get(7)
+	status.Protocol, _ = strconv.Atoi(get(2))
+	status.Players, _ = strconv.Atoi(get(4))
+	status.Max, _ = strconv.Atoi(get(5))
+	return status
+}
+
+// sameRelease checks if two statuses advertise the same server release, ignoring the amount of players.
+func (status upstreamStatus) sameRelease(other upstreamStatus) bool {
+	return status.Online == other.Online && status.MOTD == other.MOTD && status.SubMOTD == other.SubMOTD &&
+		status.Protocol == other.Protocol && status.Version == other.Version
+}
+
+// upstreamWatchdog periodically pings the upstream server, even if no clients are connected, and appends a
+// line to its history file each time the server changes its version, protocol or MOTD, or goes on- or offline.
+type upstreamWatchdog struct {
+	addr, path string
+
+	mu         sync.Mutex
+	last       upstreamStatus
+	lastChange upstreamStatus
+}
+
+// activeWatchdog is the watchdog of the upstream server, if it is running.
+var activeWatchdog *upstreamWatchdog
+
+// runUpstreamWatchdog starts a watchdog pinging the server at the address passed every interval, appending
+// changes to the file at the path passed.
+func runUpstreamWatchdog(addr, path string, interval time.Duration) {
+	w := &upstreamWatchdog{addr: addr, path: path}
+	activeWatchdog = w
+	go func() {
+		w.check()
+		for range time.Tick(interval) {
+			w.check()
+		}
+	}()
+}
+
+// check pings the upstream server and records its status if it changed.
+func (w *upstreamWatchdog) check() {
+	status := upstreamStatus{Time: time.Now()}
+	if data, err := raknet.PingTimeout(w.addr, time.Second*5); err == nil {
+		status = parseUpstreamStatus(data)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed := w.last.Time.IsZero() || !status.sameRelease(w.last)
+	w.last = status
+	if !changed {
+		return
+	}
+	w.lastChange = status
+	logf(logFields{"upstream": w.addr, "version": status.Version, "protocol": strconv.Itoa(status.Protocol)}, "Upstream %s status changed: online=%v version=%s protocol=%d motd=%q\n", w.addr, status.Online, status.Version, status.Protocol, status.MOTD)
+
+	b, _ := json.Marshal(status)
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Unable to write upstream history: %v\n", err)
+		return
+	}
+	_, _ = f.Write(append(b, '\n'))
+	_ = f.Close()
+}
+
+func init() {
+	registerCommand("upstream", consoleCommand{
+		description: "Shows the status of the upstream server recorded by the watchdog.",
+		run: func([]string) {
+			if activeWatchdog == nil {
+				log.Println("The upstream watchdog is not running.")
+				return
+			}
+			activeWatchdog.mu.Lock()
+			last, change := activeWatchdog.last, activeWatchdog.lastChange
+			activeWatchdog.mu.Unlock()
+			log.Printf("Checked at %s: online=%v version=%s protocol=%d players=%d/%d motd=%q\n", last.Time.Format(time.RFC3339), last.Online, last.Version, last.Protocol, last.Players, last.Max, last.MOTD)
+			log.Printf("Last changed at %s\n", change.Time.Format(time.RFC3339))
+		},
+	})
+}